@@ -14,6 +14,12 @@ import AlertsList from './components/AlertsList';
 import AnalysisDetails from './components/AnalysisDetails';
 import StatsCards from './components/StatsCards';
 import CorrelationChart from './components/CorrelationChart';
+import EntityGraph from './components/EntityGraph';
+
+// The API needs a key with the read scope; see the README
+if (process.env.REACT_APP_API_KEY) {
+  axios.defaults.headers.common['X-API-Key'] = process.env.REACT_APP_API_KEY;
+}
 
 function App() {
   const [alerts, setAlerts] = useState([]);
@@ -27,48 +33,85 @@ function App() {
     avgProcessingTime: 0
   });
 
-  // Simulate real-time alerts (in production, this would be WebSocket or SSE)
+  // Load recent alerts, then keep them current from the server's event stream
   useEffect(() => {
-    const interval = setInterval(() => {
-      // Generate mock alerts for demo
-      const mockAlert = {
-        id: Date.now().toString(),
-        timestamp: new Date().toISOString(),
-        source: ['aws_waf', 'azure_waf', 'deep_security', 'akamai_waf'][Math.floor(Math.random() * 4)],
-        severity: ['high', 'medium', 'low'][Math.floor(Math.random() * 3)],
-        message: [
-          'Suspicious SQL injection attempt detected',
-          'Cross-site scripting attempt blocked',
-          'File modification detected in system directory',
-          'Multiple failed login attempts'
-        ][Math.floor(Math.random() * 4)],
-        project_id: 'demo-project-1',
-        status: 'analyzing'
-      };
+    const fetchAlerts = async () => {
+      try {
+        const response = await axios.get('/alerts', { params: { limit: 20 } });
+        const recent = response.data.alerts;
+        setAlerts(recent);
+        setStats(prev => ({
+          ...prev,
+          totalAlerts: recent.length,
+          highSeverity: recent.filter(alert => alert.severity === 'high').length
+        }));
+      } catch (error) {
+        console.error('Failed to fetch alerts:', error);
+      }
+    };
 
-      setAlerts(prev => [mockAlert, ...prev.slice(0, 19)]); // Keep last 20 alerts
-      
-      // Update stats
+    const addAlert = (message) => {
+      const event = JSON.parse(message.data);
+      const alert = { ...event.alert, status: event.status, duplicate_count: 0 };
+      setAlerts(prev => [alert, ...prev.filter(a => a.id !== alert.id).slice(0, 19)]); // Keep last 20 alerts
       setStats(prev => ({
         ...prev,
         totalAlerts: prev.totalAlerts + 1,
-        highSeverity: prev.highSeverity + (mockAlert.severity === 'high' ? 1 : 0)
+        highSeverity: prev.highSeverity + (alert.severity === 'high' ? 1 : 0)
       }));
+    };
 
-      // Simulate analysis completion after 2-5 seconds
-      setTimeout(() => {
-        setAlerts(prev => 
-          prev.map(alert => 
-            alert.id === mockAlert.id 
-              ? { ...alert, status: 'completed' }
-              : alert
-          )
-        );
-      }, Math.random() * 3000 + 2000);
+    const updateAlert = (message) => {
+      const event = JSON.parse(message.data);
+      setAlerts(prev =>
+        prev.map(alert =>
+          alert.id === event.alert_id
+            ? {
+                ...alert,
+                status: event.status,
+                error: event.error,
+                risk_score: event.risk_score ?? alert.risk_score,
+                risk_priority: event.risk_priority || alert.risk_priority,
+                incident_id: event.incident_id || alert.incident_id
+              }
+            : alert
+        )
+      );
+    };
+    let events = null;
+    let reconnectTimer = null;
+    let closed = false;
 
-    }, 10000); // New alert every 10 seconds
+    // EventSource can't send the API key, so each connection uses a fresh
+    // single-use ticket and reconnects are ours rather than EventSource's
+    const connect = async () => {
+      try {
+        const response = await axios.post('/events/ticket');
+        if (closed) return;
+        events = new EventSource(`/events?ticket=${encodeURIComponent(response.data.ticket)}`);
+      } catch (error) {
+        console.error('Failed to open event stream:', error);
+        reconnectTimer = setTimeout(connect, 5000);
+        return;
+      }
 
-    return () => clearInterval(interval);
+      // Catch up on anything missed while (re)connecting
+      events.onopen = fetchAlerts;
+      events.onerror = () => {
+        events.close();
+        if (!closed) reconnectTimer = setTimeout(connect, 5000);
+      };
+      events.addEventListener('alert-received', addAlert);
+      events.addEventListener('analysis-progress', updateAlert);
+      events.addEventListener('analysis-completed', updateAlert);
+    };
+    connect();
+
+    return () => {
+      closed = true;
+      clearTimeout(reconnectTimer);
+      if (events) events.close();
+    };
   }, []);
 
   const handleViewAnalysis = async (alertId) => {
@@ -76,69 +119,27 @@ function App() {
     setSelectedAlert(alertId);
     
     try {
-      // In a real implementation, this would fetch from /analysis/{alert_id}
-      // For demo, we'll generate mock analysis data
-      const mockAnalysis = {
-        alert_id: alertId,
-        project_id: 'demo-project-1',
-        correlated_logs: [
-          {
-            source: 'aws_waf',
-            timestamp: new Date().toISOString(),
-            ip_addresses: ['192.168.1.100', '10.0.0.50'],
-            user_emails: ['user@example.com', 'admin@company.com'],
-            action: 'BLOCK',
-            severity: 'high'
-          },
-          {
-            source: 'deep_security',
-            timestamp: new Date().toISOString(),
-            ip_addresses: ['192.168.1.100'],
-            user_emails: [],
-            action: 'ALERT',
-            severity: 'medium'
-          }
-        ],
-        user_correlations: [
-          {
-            user_identifier: 'user@example.com',
-            ip_address: '192.168.1.100',
-            confidence_score: 0.85,
-            correlation_type: 'time_proximity',
-            source_systems: ['aws_waf', 'deep_security']
-          },
-          {
-            user_identifier: 'admin@company.com',
-            ip_address: '10.0.0.50',
-            confidence_score: 0.72,
-            correlation_type: 'direct',
-            source_systems: ['aws_waf']
-          }
-        ],
-        enrichment_data: {
-          correlation_stats: {
-            total_logs_analyzed: 15,
-            user_correlations_found: 2,
-            correlation_score: 0.78
-          },
-          involved_users: ['user@example.com', 'admin@company.com'],
-          involved_ips: ['192.168.1.100', '10.0.0.50'],
-          source_breakdown: {
-            'aws_waf': 8,
-            'deep_security': 4,
-            'azure_waf': 3
-          }
-        },
-        processing_time_ms: Math.floor(Math.random() * 200) + 50
-      };
+      const response = await axios.get(`/analysis/${alertId}`);
+      // 202 while the analysis is still running, or a failed status
+      if (response.status !== 200 || response.data.status === 'failed') {
+        setAnalysisResult(null);
+        return;
+      }
+      const analysis = response.data;
+      // Go encodes empty slices as null
+      analysis.user_correlations = analysis.user_correlations || [];
+      analysis.enrichment_data.involved_users = analysis.enrichment_data.involved_users || [];
+      analysis.enrichment_data.involved_ips = analysis.enrichment_data.involved_ips || [];
 
-      setAnalysisResult(mockAnalysis);
+      setAnalysisResult(analysis);
       
       // Update stats
       setStats(prev => ({
         ...prev,
-        correlationsFound: prev.correlationsFound + mockAnalysis.user_correlations.length,
-        avgProcessingTime: Math.round((prev.avgProcessingTime + mockAnalysis.processing_time_ms) / 2)
+        correlationsFound: prev.correlationsFound + analysis.user_correlations.length,
+        avgProcessingTime: prev.avgProcessingTime
+          ? Math.round((prev.avgProcessingTime + analysis.processing_time_ms) / 2)
+          : analysis.processing_time_ms
       }));
 
     } catch (error) {
@@ -203,6 +204,15 @@ function App() {
                   correlations={analysisResult.user_correlations}
                   sourceBreakdown={analysisResult.enrichment_data.source_breakdown}
                 />
+                <EntityGraph
+                  rootEntity={
+                    analysisResult.enrichment_data.involved_users.length > 0
+                      ? `user_email:${analysisResult.enrichment_data.involved_users[0]}`
+                      : analysisResult.enrichment_data.involved_ips.length > 0
+                        ? `ip:${analysisResult.enrichment_data.involved_ips[0]}`
+                        : null
+                  }
+                />
               </>
             ) : (
               <div className="card text-center py-12">
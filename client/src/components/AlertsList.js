@@ -1,5 +1,5 @@
 import React from 'react';
-import { Eye, Clock, AlertTriangle, CheckCircle, Loader } from 'lucide-react';
+import { Eye, Clock, AlertTriangle, CheckCircle, XCircle, Loader } from 'lucide-react';
 
 const AlertsList = ({ alerts, onViewAnalysis, selectedAlert }) => {
   const getSeverityBadge = (severity) => {
@@ -23,15 +23,25 @@ const AlertsList = ({ alerts, onViewAnalysis, selectedAlert }) => {
 
   const getStatusIcon = (status) => {
     switch (status) {
-      case 'analyzing':
+      case 'fetching_logs':
+      case 'normalizing':
+      case 'correlating':
+      case 'enriching':
         return <Loader className="h-4 w-4 text-warning-500 animate-spin" />;
       case 'completed':
         return <CheckCircle className="h-4 w-4 text-success-500" />;
+      case 'partial':
+        return <CheckCircle className="h-4 w-4 text-warning-500" />;
+      case 'failed':
+        return <XCircle className="h-4 w-4 text-red-500" />;
       default:
         return <Clock className="h-4 w-4 text-gray-400" />;
     }
   };
 
+  // Partial analyses are still worth looking at
+  const isViewable = (status) => status === 'completed' || status === 'partial';
+
   const formatTime = (timestamp) => {
     return new Date(timestamp).toLocaleTimeString();
   };
@@ -75,22 +85,37 @@ const AlertsList = ({ alerts, onViewAnalysis, selectedAlert }) => {
                   </div>
                   
                   <p className="text-sm text-gray-600 mb-2">{alert.message}</p>
+                  {alert.error && (
+                    <p className="text-xs text-red-600 mb-2">{alert.error}</p>
+                  )}
                   
                   <div className="flex items-center text-xs text-gray-500">
                     <Clock className="h-3 w-3 mr-1" />
                     {formatTime(alert.timestamp)}
                     <span className="mx-2">•</span>
                     {getStatusIcon(alert.status)}
-                    <span className="ml-1 capitalize">{alert.status}</span>
+                    <span className="ml-1 capitalize">{alert.status.replace('_', ' ')}</span>
+                    {alert.risk_priority && (
+                      <>
+                        <span className="mx-2">•</span>
+                        <span className="font-medium">{alert.risk_priority} · {alert.risk_score}</span>
+                      </>
+                    )}
+                    {alert.duplicate_count > 0 && (
+                      <>
+                        <span className="mx-2">•</span>
+                        ×{alert.duplicate_count + 1}
+                      </>
+                    )}
                   </div>
                 </div>
 
                 <button
                   type="button"
                   onClick={() => onViewAnalysis(alert.id)}
-                  disabled={alert.status === 'analyzing'}
+                  disabled={!isViewable(alert.status)}
                                      className={`ml-4 btn btn-primary flex items-center text-sm ${
-                     alert.status === 'analyzing' 
+                     !isViewable(alert.status)
                        ? 'opacity-50 cursor-not-allowed' 
                        : 'hover:bg-blue-600'
                    }`}
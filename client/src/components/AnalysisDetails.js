@@ -1,7 +1,37 @@
-import React from 'react';
+import React, { useState, useEffect } from 'react';
+import axios from 'axios';
 import { Users, Network, Clock, TrendingUp, Shield } from 'lucide-react';
 
+// EvidenceLogs shows the logs behind a correlation, fetched on demand
+const EvidenceLogs = ({ state }) => (
+  <div className="mt-3 pt-3 border-t border-gray-100 space-y-2 text-xs">
+    {state.loading && <p className="text-gray-500">Loading evidence...</p>}
+    {state.error && <p className="text-red-600">{state.error}</p>}
+    {(state.logs || []).map((log) => (
+      <div key={log.id} className="p-2 bg-gray-50 rounded">
+        <div className="flex items-center space-x-2 text-gray-500 mb-1">
+          <Clock className="h-3 w-3" />
+          <span>{new Date(log.timestamp).toLocaleString()}</span>
+          <span>{log.source}</span>
+        </div>
+        <pre className="font-mono text-gray-700 whitespace-pre-wrap break-all">{log.original_log}</pre>
+      </div>
+    ))}
+    {(state.missing || []).length > 0 && (
+      <p className="text-gray-500">
+        {state.missing.length} older log(s) fall outside this alert's window
+      </p>
+    )}
+  </div>
+);
+
 const AnalysisDetails = ({ analysis, loading }) => {
+  // Evidence per correlation key: undefined until requested, then
+  // { loading }, { error } or { logs, missing }
+  const [evidence, setEvidence] = useState({});
+  const alertId = analysis && analysis.alert_id;
+  useEffect(() => setEvidence({}), [alertId]);
+
   if (loading) {
     return (
       <div className="card">
@@ -23,6 +53,13 @@ const AnalysisDetails = ({ analysis, loading }) => {
     return 'text-red-600 bg-red-50';
   };
 
+  const getRiskColor = (score) => {
+    if (score >= 80) return 'text-red-600 bg-red-50';
+    if (score >= 60) return 'text-orange-600 bg-orange-50';
+    if (score >= 35) return 'text-yellow-600 bg-yellow-50';
+    return 'text-green-600 bg-green-50';
+  };
+
   const getCorrelationTypeIcon = (type) => {
     switch (type) {
       case 'direct':
@@ -36,6 +73,29 @@ const AnalysisDetails = ({ analysis, loading }) => {
     }
   };
 
+  const correlationKey = (correlation) => `${correlation.user_identifier}-${correlation.ip_address}`;
+
+  const toggleEvidence = async (correlation) => {
+    const key = correlationKey(correlation);
+    if (evidence[key]) {
+      setEvidence(({ [key]: _, ...rest }) => rest);
+      return;
+    }
+
+    setEvidence(prev => ({ ...prev, [key]: { loading: true } }));
+    try {
+      const response = await axios.get(`/analysis/${analysis.alert_id}/evidence`, {
+        params: { user: correlation.user_identifier, ip: correlation.ip_address }
+      });
+      const logs = response.data.flatMap(item => item.logs || []);
+      const missing = response.data.flatMap(item => item.missing_log_ids || []);
+      setEvidence(prev => ({ ...prev, [key]: { logs, missing } }));
+    } catch (error) {
+      console.error('Failed to fetch evidence:', error);
+      setEvidence(prev => ({ ...prev, [key]: { error: 'Failed to load evidence' } }));
+    }
+  };
+
   return (
     <div className="space-y-6">
       {/* Analysis Summary */}
@@ -44,6 +104,15 @@ const AnalysisDetails = ({ analysis, loading }) => {
           <TrendingUp className="h-5 w-5 text-blue-500 mr-2" />
           <h3 className="text-lg font-semibold text-gray-900">Analysis Summary</h3>
         </div>
+
+        {analysis.warnings && analysis.warnings.length > 0 && (
+          <div className="mb-4 p-3 rounded-lg bg-yellow-50 text-sm text-yellow-800">
+            <p className="font-medium mb-1">Partial analysis</p>
+            {analysis.warnings.map((warning) => (
+              <p key={warning}>{warning}</p>
+            ))}
+          </div>
+        )}
         
         <div className="grid grid-cols-2 gap-4">
           <div>
@@ -71,6 +140,30 @@ const AnalysisDetails = ({ analysis, loading }) => {
             </p>
           </div>
         </div>
+
+        {analysis.risk && (
+          <div className="mt-4 pt-4 border-t border-gray-200">
+            <div className="flex items-center justify-between mb-2">
+              <p className="text-sm text-gray-500">Risk Score</p>
+              <span className={`px-2 py-1 rounded-full text-xs font-medium ${getRiskColor(analysis.risk.score)}`}>
+                {analysis.risk.priority} · {analysis.risk.score}/100
+              </span>
+            </div>
+            <div className="space-y-1">
+              {analysis.risk.breakdown.map((factor) => (
+                <div key={factor.name} className="flex justify-between text-xs text-gray-600">
+                  <span>
+                    {factor.name.replace('_', ' ')}
+                    {factor.detail && <span className="text-gray-400"> ({factor.detail})</span>}
+                  </span>
+                  <span className="font-mono">
+                    {factor.points > 0 ? '+' : ''}{factor.points}
+                  </span>
+                </div>
+              ))}
+            </div>
+          </div>
+        )}
       </div>
 
       {/* User Correlations */}
@@ -82,7 +175,7 @@ const AnalysisDetails = ({ analysis, loading }) => {
         
         <div className="space-y-3">
           {analysis.user_correlations.map((correlation, index) => (
-            <div key={`${correlation.user_identifier}-${correlation.ip_address}`} className="border border-gray-200 rounded-lg p-4">
+            <div key={correlationKey(correlation)} className="border border-gray-200 rounded-lg p-4">
               <div className="flex items-start justify-between">
                 <div className="flex-1">
                   <div className="flex items-center mb-2">
@@ -101,6 +194,15 @@ const AnalysisDetails = ({ analysis, loading }) => {
                   <div className="flex items-center space-x-4 text-sm text-gray-500">
                     <span>Type: {correlation.correlation_type.replace('_', ' ')}</span>
                     <span>Sources: {correlation.source_systems.join(', ')}</span>
+                    {correlation.evidence && correlation.evidence.length > 0 && (
+                      <button
+                        type="button"
+                        onClick={() => toggleEvidence(correlation)}
+                        className="text-blue-600 hover:underline"
+                      >
+                        Evidence: {correlation.evidence.length}
+                      </button>
+                    )}
                   </div>
                 </div>
                 
@@ -108,6 +210,12 @@ const AnalysisDetails = ({ analysis, loading }) => {
                   {(correlation.confidence_score * 100).toFixed(0)}% confidence
                 </div>
               </div>
+
+              {evidence[correlationKey(correlation)] && (
+                <EvidenceLogs state={evidence[correlationKey(correlation)]} />
+              )}
+                </div>
+              )}
             </div>
           ))}
         </div>
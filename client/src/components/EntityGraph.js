@@ -0,0 +1,111 @@
+import React, { useState, useEffect } from 'react';
+import axios from 'axios';
+import { Network } from 'lucide-react';
+
+const TYPE_COLORS = {
+  user_email: '#3b82f6',
+  user_name: '#6366f1',
+  ip: '#ef4444',
+  hostname: '#22c55e',
+  session_id: '#f59e0b',
+  user_agent: '#a855f7',
+  ja3: '#14b8a6',
+  device_id: '#84cc16',
+  aws_access_key: '#f97316'
+};
+
+const WIDTH = 560;
+const HEIGHT = 360;
+const RING_SPACING = 70;
+
+// Place nodes on concentric rings by hop distance from the root entity
+const layoutNodes = (nodes) => {
+  const rings = nodes.reduce((acc, node) => {
+    (acc[node.depth] = acc[node.depth] || []).push(node);
+    return acc;
+  }, {});
+
+  const positions = {};
+  Object.entries(rings).forEach(([depth, ringNodes]) => {
+    ringNodes.forEach((node, index) => {
+      const angle = (2 * Math.PI * index) / ringNodes.length;
+      const radius = Number(depth) * RING_SPACING;
+      positions[node.id] = {
+        x: WIDTH / 2 + radius * Math.cos(angle),
+        y: HEIGHT / 2 + radius * Math.sin(angle)
+      };
+    });
+  });
+  return positions;
+};
+
+const EntityGraph = ({ rootEntity, depth = 2 }) => {
+  const [graph, setGraph] = useState(null);
+  const [error, setError] = useState(null);
+
+  useEffect(() => {
+    if (!rootEntity) return;
+    setError(null);
+    axios
+      .get('/graph', { params: { entity: rootEntity, depth } })
+      .then((response) => setGraph(response.data))
+      .catch(() => {
+        setGraph(null);
+        setError('No graph data for this entity yet');
+      });
+  }, [rootEntity, depth]);
+
+  if (!rootEntity) return null;
+
+  const positions = graph ? layoutNodes(graph.nodes) : {};
+
+  return (
+    <div className="card">
+      <div className="flex items-center mb-4">
+        <Network className="h-5 w-5 text-blue-500 mr-2" />
+        <h3 className="text-lg font-semibold text-gray-900">Entity Pivot Graph</h3>
+        <span className="ml-2 text-sm text-gray-500 font-mono">{rootEntity}</span>
+      </div>
+
+      {error || !graph ? (
+        <p className="text-sm text-gray-500">{error || 'Loading graph...'}</p>
+      ) : (
+        <svg width="100%" viewBox={`0 0 ${WIDTH} ${HEIGHT}`}>
+          {graph.edges.map((edge) => {
+            const from = positions[edge.source];
+            const to = positions[edge.target];
+            if (!from || !to) return null;
+            return (
+              <line
+                key={`${edge.source}-${edge.target}`}
+                x1={from.x}
+                y1={from.y}
+                x2={to.x}
+                y2={to.y}
+                stroke="#9ca3af"
+                strokeWidth={1 + edge.confidence_score * 3}
+                strokeOpacity={0.3 + edge.confidence_score * 0.7}
+              >
+                <title>{`${(edge.confidence_score * 100).toFixed(0)}% confidence`}</title>
+              </line>
+            );
+          })}
+          {graph.nodes.map((node) => {
+            const position = positions[node.id];
+            return (
+              <g key={node.id} transform={`translate(${position.x}, ${position.y})`}>
+                <circle r={node.depth === 0 ? 10 : 7} fill={TYPE_COLORS[node.type] || '#6b7280'} />
+                <text y={-12} textAnchor="middle" fontSize="10" fill="#374151">
+                  {node.value.length > 24 ? `${node.value.slice(0, 24)}…` : node.value}
+                </text>
+                <title>{`${node.type}: ${node.value}`}</title>
+              </g>
+            );
+          })}
+        </svg>
+      )}
+    </div>
+  );
+};
+
+export default EntityGraph;
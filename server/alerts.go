@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hibiken/asynq"
+	"github.com/lib/pq"
+)
+
+// Analysis lifecycle of an alert. An alert moves through the in-progress
+// states in order and ends completed, partial (finished, but some enrichment
+// or the log query failed) or failed (retries exhausted).
+const (
+	alertStatusQueued       = "queued"
+	alertStatusFetchingLogs = "fetching_logs"
+	alertStatusNormalizing  = "normalizing"
+	alertStatusCorrelating  = "correlating"
+	alertStatusEnriching    = "enriching"
+	alertStatusCompleted    = "completed"
+	alertStatusPartial      = "partial"
+	alertStatusFailed       = "failed"
+)
+
+// analysisMaxRetry bounds how often a failing analysis is retried before the
+// alert is marked failed.
+const analysisMaxRetry = 3
+
+func isAnalysisFinished(status string) bool {
+	return status == alertStatusCompleted || status == alertStatusPartial || status == alertStatusFailed
+}
+
+// AlertRecord is a stored alert together with where its triage stands.
+type AlertRecord struct {
+	Alert
+	ReceivedAt      time.Time  `json:"received_at"`
+	Status          string     `json:"status"`
+	Error           string     `json:"error,omitempty"`
+	StatusUpdatedAt time.Time  `json:"status_updated_at"`
+	RiskScore       *int       `json:"risk_score"`
+	RiskPriority    string     `json:"risk_priority,omitempty"`
+	IncidentID      string     `json:"incident_id,omitempty"`
+	DuplicateCount  int64      `json:"duplicate_count"`
+	LastDuplicateAt *time.Time `json:"last_duplicate_at,omitempty"`
+	AnalyzedAt      *time.Time `json:"analyzed_at,omitempty"`
+}
+
+// IngestResult is what happened to one submitted alert.
+type IngestResult struct {
+	AlertID        string `json:"alert_id,omitempty"`
+	Status         string `json:"status"` // queued_for_analysis, already_received, duplicate or suppressed
+	DuplicateCount int64  `json:"duplicate_count,omitempty"`
+	SuppressionID  string `json:"suppression_id,omitempty"`
+}
+
+// acceptAlert runs an alert through suppression and deduplication and queues
+// it if it survives both. It assigns the alert's ID. Every alert source,
+// external or our own detections, goes through here or acceptAlerts so
+// analysts can suppress any of them and the alerts list sees each one as it
+// arrives.
+func (app *App) acceptAlert(ctx context.Context, alert Alert) (IngestResult, error) {
+	results, errs := app.acceptAlerts(ctx, []Alert{alert})
+	return results[0], errs[0]
+}
+
+// acceptAlerts is acceptAlert for many alerts at once. The survivors are
+// stored in a single insert and then queued. Results and errors line up with
+// alerts, and an error for one alert doesn't stop the others.
+func (app *App) acceptAlerts(ctx context.Context, alerts []Alert) ([]IngestResult, []error) {
+	results := make([]IngestResult, len(alerts))
+	errs := make([]error, len(alerts))
+
+	// Duplicates of a survivor in this batch wait until it is queued, since
+	// until then there is no alert to count them against
+	var survivors, waiting []int
+	pending := make(map[string]bool)
+	for i := range alerts {
+		alerts[i].ID = generateID()
+		result, err := app.screenAlert(ctx, alerts[i], pending)
+		switch {
+		case err != nil:
+			errs[i] = err
+		case result == nil:
+			pending[alerts[i].ID] = true
+			survivors = append(survivors, i)
+		case result.Status == "duplicate" && pending[result.AlertID]:
+			results[i] = *result
+			waiting = append(waiting, i)
+		default:
+			results[i] = *result
+		}
+	}
+	if len(survivors) == 0 {
+		return results, errs
+	}
+
+	batch := make([]Alert, len(survivors))
+	for j, i := range survivors {
+		batch[j] = alerts[i]
+	}
+	inserted, err := app.storeAlerts(batch)
+	if err != nil {
+		for _, i := range survivors {
+			app.releaseFingerprint(ctx, alerts[i])
+			errs[i] = err
+		}
+		// Their duplicates were part of the same failed delivery
+		for _, i := range waiting {
+			results[i] = IngestResult{}
+			errs[i] = err
+		}
+		return results, errs
+	}
+
+	queued := make(map[string]bool, len(survivors))
+	for _, i := range survivors {
+		alert := alerts[i]
+		// A concurrent retry, or an earlier item in the same batch, took the
+		// external ID first; its alert is the one to report
+		if !inserted[alert.ID] {
+			app.releaseFingerprint(ctx, alert)
+			existingID, err := app.findAlertByExternalID(alert)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			results[i] = IngestResult{AlertID: existingID, Status: "already_received"}
+			continue
+		}
+		if err := app.queueAlert(alert); err != nil {
+			app.releaseFingerprint(ctx, alert)
+			errs[i] = err
+			continue
+		}
+		queued[alert.ID] = true
+		results[i] = IngestResult{AlertID: alert.ID, Status: "queued_for_analysis"}
+	}
+
+	// Duplicates whose original was not queued are screened again, and the
+	// first of them takes over its fingerprint
+	var rescreen []int
+	for _, i := range waiting {
+		if queued[results[i].AlertID] {
+			results[i] = *app.resolveDuplicate(ctx, alerts[i], results[i])
+		} else {
+			rescreen = append(rescreen, i)
+		}
+	}
+	if len(rescreen) > 0 {
+		retry := make([]Alert, len(rescreen))
+		for j, i := range rescreen {
+			retry[j] = alerts[i]
+		}
+		retryResults, retryErrs := app.acceptAlerts(ctx, retry)
+		for j, i := range rescreen {
+			results[i], errs[i] = retryResults[j], retryErrs[j]
+		}
+	}
+	return results, errs
+}
+
+// releaseFingerprint undoes screenAlert's dedup claim for an alert that was
+// not stored or queued, so the sender's retry is analysed rather than
+// collapsed into it.
+func (app *App) releaseFingerprint(ctx context.Context, alert Alert) {
+	if err := app.Dedup.Release(ctx, alert); err != nil {
+		log.Printf("Failed to release dedup fingerprint of alert %s: %v", alert.ID, err)
+	}
+}
+
+// screenAlert returns what became of an alert that needs no analysis, or
+// nil if it should be stored and queued. A duplicate of an alert in pending,
+// which is yet to be stored, is returned unresolved; the caller resolves it
+// once the original is queued.
+func (app *App) screenAlert(ctx context.Context, alert Alert, pending map[string]bool) (*IngestResult, error) {
+	// A retried submission gets back the alert its first attempt created, or
+	// the same answer if that attempt was collapsed or suppressed
+	if alert.ExternalID != "" {
+		existingID, err := app.findAlertByExternalID(alert)
+		if err != nil {
+			return nil, err
+		}
+		if existingID != "" {
+			return &IngestResult{AlertID: existingID, Status: "already_received"}, nil
+		}
+		outcome, err := app.Dedup.Outcome(ctx, alert)
+		if err != nil {
+			log.Printf("Ingest outcome lookup failed, screening alert again: %v", err)
+		} else if outcome != nil {
+			return outcome, nil
+		}
+	}
+
+	// Analyst suppressions drop the alert outright
+	rule, err := app.Suppressions.Match(alert)
+	if err != nil {
+		log.Printf("Suppression check failed, accepting alert: %v", err)
+	} else if rule != nil {
+		return app.rememberOutcome(ctx, alert, IngestResult{Status: "suppressed", SuppressionID: rule.ID}), nil
+	}
+
+	// Repeats only bump the original alert's counter. If Redis is down we'd
+	// rather analyse twice than drop alerts.
+	originalID, count, duplicate, err := app.Dedup.Check(ctx, alert)
+	if err != nil {
+		log.Printf("Dedup check failed, accepting alert: %v", err)
+	} else if duplicate {
+		result := IngestResult{AlertID: originalID, Status: "duplicate", DuplicateCount: count}
+		if pending[originalID] {
+			return &result, nil
+		}
+		return app.resolveDuplicate(ctx, alert, result), nil
+	}
+	return nil, nil
+}
+
+// resolveDuplicate counts a collapsed alert against its stored original and
+// remembers the outcome for retries.
+func (app *App) resolveDuplicate(ctx context.Context, alert Alert, result IngestResult) *IngestResult {
+	app.recordDuplicate(result.AlertID, result.DuplicateCount)
+	return app.rememberOutcome(ctx, alert, result)
+}
+
+// rememberOutcome records the result for retries of the same external ID and
+// returns it.
+func (app *App) rememberOutcome(ctx context.Context, alert Alert, result IngestResult) *IngestResult {
+	if err := app.Dedup.RememberOutcome(ctx, alert, result); err != nil {
+		log.Printf("Failed to remember outcome of alert %s: %v", alert.ID, err)
+	}
+	return &result
+}
+
+// findAlertByExternalID returns the ID of the alert stored for the same
+// project, source and external ID, or "" if there is none.
+func (app *App) findAlertByExternalID(alert Alert) (string, error) {
+	var id string
+	err := app.DB.QueryRow(`
+		SELECT id FROM alerts WHERE project_id = $1 AND source = $2 AND external_id = $3
+	`, alert.ProjectID, alert.Source, alert.ExternalID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up external ID: %v", err)
+	}
+	return id, nil
+}
+
+// storeAlerts inserts alerts in one statement and returns the IDs of those
+// that were new. Alerts whose external ID is already taken are skipped.
+func (app *App) storeAlerts(alerts []Alert) (map[string]bool, error) {
+	const columns = 9
+	placeholders := make([]string, len(alerts))
+	args := make([]interface{}, 0, len(alerts)*columns)
+	for i, alert := range alerts {
+		marks := make([]string, columns)
+		for c := range marks {
+			marks[c] = "$" + strconv.Itoa(i*columns+c+1)
+		}
+		placeholders[i] = "(" + strings.Join(marks, ", ") + ")"
+		args = append(args, alert.ID, alert.ProjectID, alert.Source, alert.Severity, alert.Message,
+			alert.Timestamp, mustMarshal(alert.RawData), alertStatusQueued, alert.ExternalID)
+	}
+
+	rows, err := app.DB.Query(`
+		INSERT INTO alerts (id, project_id, source, severity, message, timestamp, raw_data, status, external_id)
+		VALUES `+strings.Join(placeholders, ", ")+`
+		ON CONFLICT DO NOTHING
+		RETURNING id
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store alerts: %v", err)
+	}
+	defer rows.Close()
+
+	inserted := make(map[string]bool, len(alerts))
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to store alerts: %v", err)
+		}
+		inserted[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to store alerts: %v", err)
+	}
+	return inserted, nil
+}
+
+// queueAlert queues a stored alert's analysis. If that fails the row is
+// removed again, so the sender's retry isn't answered with an alert that
+// will never be analysed.
+func (app *App) queueAlert(alert Alert) error {
+	task := asynq.NewTask("alert:analyze", mustMarshal(alert))
+	if _, err := app.TaskClient.Enqueue(task, asynq.MaxRetry(analysisMaxRetry)); err != nil {
+		if _, dbErr := app.DB.Exec(`DELETE FROM alerts WHERE id = $1`, alert.ID); dbErr != nil {
+			log.Printf("Failed to remove unqueued alert %s: %v", alert.ID, dbErr)
+		}
+		return fmt.Errorf("failed to queue analysis: %v", err)
+	}
+
+	app.publishAlertEvent(AlertEvent{
+		Type:      eventAlertReceived,
+		AlertID:   alert.ID,
+		ProjectID: alert.ProjectID,
+		Status:    alertStatusQueued,
+		Alert:     &alert,
+	})
+	return nil
+}
+
+// setAlertStatus records the analysis stage an alert has reached and
+// announces it on the live feed. detail is kept as the alert's error, so pass
+// "" once a stage succeeds.
+func (app *App) setAlertStatus(alert Alert, status, detail string) {
+	_, err := app.DB.Exec(`UPDATE alerts SET status = $2, error = $3, status_updated_at = NOW() WHERE id = $1`,
+		alert.ID, status, detail)
+	if err != nil {
+		log.Printf("Failed to set alert %s status to %s: %v", alert.ID, status, err)
+	}
+
+	eventType := eventAnalysisProgress
+	if isAnalysisFinished(status) {
+		eventType = eventAnalysisCompleted
+	}
+	app.publishAlertEvent(AlertEvent{
+		Type:      eventType,
+		AlertID:   alert.ID,
+		ProjectID: alert.ProjectID,
+		Status:    status,
+		Error:     detail,
+	})
+}
+
+// markAlertAnalyzed copies the headline results of an analysis onto the
+// alert's row.
+func (app *App) markAlertAnalyzed(result AnalysisResult) error {
+	var riskScore sql.NullInt64
+	var riskPriority string
+	if result.Risk != nil {
+		riskScore = sql.NullInt64{Int64: int64(result.Risk.Score), Valid: true}
+		riskPriority = result.Risk.Priority
+	}
+
+	warnings := strings.Join(result.Warnings, "; ")
+	_, err := app.DB.Exec(`
+		UPDATE alerts SET status = $2, error = $3, status_updated_at = NOW(),
+			risk_score = $4, risk_priority = $5, incident_id = $6, analyzed_at = $7
+		WHERE id = $1
+	`, result.AlertID, result.Status, warnings, riskScore, riskPriority,
+		result.IncidentID, result.AnalysisTimestamp)
+	if err != nil {
+		return fmt.Errorf("failed to update alert status: %v", err)
+	}
+
+	event := AlertEvent{
+		Type:         eventAnalysisCompleted,
+		AlertID:      result.AlertID,
+		ProjectID:    result.ProjectID,
+		Status:       result.Status,
+		Error:        warnings,
+		RiskPriority: riskPriority,
+		IncidentID:   result.IncidentID,
+	}
+	if result.Risk != nil {
+		event.RiskScore = &result.Risk.Score
+	}
+	app.publishAlertEvent(event)
+	return nil
+}
+
+// AnalysisStatus is returned by GET /analysis/{alert_id} while an analysis
+// is in progress or after it failed.
+type AnalysisStatus struct {
+	AlertID   string    `json:"alert_id"`
+	ProjectID string    `json:"project_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (app *App) getAnalysisStatus(alertID string) (*AnalysisStatus, error) {
+	status := AnalysisStatus{AlertID: alertID}
+	err := app.DB.QueryRow(`SELECT project_id, status, error, status_updated_at FROM alerts WHERE id = $1`, alertID).
+		Scan(&status.ProjectID, &status.Status, &status.Error, &status.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// recordDuplicate mirrors the deduplicator's counter onto the original alert.
+func (app *App) recordDuplicate(alertID string, count int64) {
+	_, err := app.DB.Exec(`UPDATE alerts SET duplicate_count = $2, last_duplicate_at = NOW() WHERE id = $1`, alertID, count)
+	if err != nil {
+		log.Printf("Failed to record duplicate of alert %s: %v", alertID, err)
+	}
+}
+
+// alertSortColumns maps the sort parameter to the expression alerts are
+// ordered by. Unscored alerts sort below every scored one.
+var alertSortColumns = map[string]string{
+	"timestamp":   "timestamp",
+	"received_at": "received_at",
+	"risk":        "COALESCE(risk_score, -1)",
+}
+
+// alertCursor marks the last alert of a page by its sort value and ID, so the
+// next page starts after it even while new alerts arrive.
+type alertCursor struct {
+	Sort string     `json:"s"`
+	Time *time.Time `json:"t,omitempty"`
+	Risk *int       `json:"r,omitempty"`
+	ID   string     `json:"id"`
+}
+
+func (c alertCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString(mustMarshal(c))
+}
+
+func decodeAlertCursor(value string) (alertCursor, error) {
+	var cursor alertCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, err
+	}
+	return cursor, nil
+}
+
+// listAlerts pages through stored alerts. Filters: project_id, source,
+// severity and status (comma-separated), since and until (RFC 3339, on the
+// alert timestamp). sort is timestamp, received_at or risk, prefixed with "-"
+// for descending; the default is -timestamp. Pass the returned next_cursor as
+// cursor to fetch the following page.
+func (app *App) listAlerts(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 50
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 500 {
+		limit = l
+	}
+
+	sortParam := query.Get("sort")
+	if sortParam == "" {
+		sortParam = "-timestamp"
+	}
+	sortKey := strings.TrimPrefix(sortParam, "-")
+	descending := sortKey != sortParam
+	sortColumn, ok := alertSortColumns[sortKey]
+	if !ok {
+		http.Error(w, "sort must be timestamp, received_at or risk, optionally prefixed with -", http.StatusBadRequest)
+		return
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+	if projects != nil {
+		addCondition("project_id = ANY($%d)", pq.Array(projects))
+	}
+	if source := query.Get("source"); source != "" {
+		addCondition("source = $%d", source)
+	}
+	if severities := splitQueryList(query.Get("severity")); len(severities) > 0 {
+		addCondition("severity = ANY($%d)", pq.Array(severities))
+	}
+	if statuses := splitQueryList(query.Get("status")); len(statuses) > 0 {
+		addCondition("status = ANY($%d)", pq.Array(statuses))
+	}
+	for _, bound := range []struct{ param, condition string }{
+		{"since", "timestamp >= $%d"},
+		{"until", "timestamp < $%d"},
+	} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, bound.param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		addCondition(bound.condition, t)
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := decodeAlertCursor(value)
+		if err != nil || cursor.Sort != sortParam {
+			http.Error(w, "Invalid cursor for this sort", http.StatusBadRequest)
+			return
+		}
+		var sortValue interface{}
+		switch {
+		case sortKey == "risk" && cursor.Risk != nil:
+			sortValue = *cursor.Risk
+		case sortKey != "risk" && cursor.Time != nil:
+			sortValue = *cursor.Time
+		default:
+			http.Error(w, "Invalid cursor for this sort", http.StatusBadRequest)
+			return
+		}
+		comparison := ">"
+		if descending {
+			comparison = "<"
+		}
+		args = append(args, sortValue, cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sortColumn, comparison, len(args)-1, len(args)))
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit+1)
+
+	rows, err := app.DB.Query(`
+		SELECT id, project_id, source, severity, message, timestamp, external_id, raw_data, received_at, status, error,
+			status_updated_at, risk_score, risk_priority, incident_id, duplicate_count, last_duplicate_at, analyzed_at
+		FROM alerts
+		`+where+`
+		ORDER BY `+sortColumn+` `+direction+`, id `+direction+`
+		LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		http.Error(w, "Failed to list alerts", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	alerts := []AlertRecord{}
+	for rows.Next() {
+		var record AlertRecord
+		var rawData []byte
+		var riskScore sql.NullInt64
+		var lastDuplicateAt, analyzedAt sql.NullTime
+		if err := rows.Scan(&record.ID, &record.ProjectID, &record.Source, &record.Severity, &record.Message,
+			&record.Timestamp, &record.ExternalID, &rawData, &record.ReceivedAt, &record.Status, &record.Error,
+			&record.StatusUpdatedAt, &riskScore, &record.RiskPriority,
+			&record.IncidentID, &record.DuplicateCount, &lastDuplicateAt, &analyzedAt); err != nil {
+			http.Error(w, "Failed to list alerts", http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(rawData, &record.RawData)
+		if riskScore.Valid {
+			score := int(riskScore.Int64)
+			record.RiskScore = &score
+		}
+		if lastDuplicateAt.Valid {
+			record.LastDuplicateAt = &lastDuplicateAt.Time
+		}
+		if analyzedAt.Valid {
+			record.AnalyzedAt = &analyzedAt.Time
+		}
+		alerts = append(alerts, record)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to list alerts", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Alerts     []AlertRecord `json:"alerts"`
+		NextCursor string        `json:"next_cursor,omitempty"`
+	}{Alerts: alerts}
+
+	if len(alerts) > limit {
+		response.Alerts = alerts[:limit]
+		last := response.Alerts[limit-1]
+		cursor := alertCursor{Sort: sortParam, ID: last.ID}
+		switch sortKey {
+		case "risk":
+			risk := -1
+			if last.RiskScore != nil {
+				risk = *last.RiskScore
+			}
+			cursor.Risk = &risk
+		case "received_at":
+			cursor.Time = &last.ReceivedAt
+		default:
+			cursor.Time = &last.Timestamp
+		}
+		response.NextCursor = cursor.encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func splitQueryList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertCursorRoundTrip(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	risk := 73
+	for _, cursor := range []alertCursor{
+		{Sort: "-timestamp", Time: &at, ID: "0190a1b2-0000-7000-8000-000000000001"},
+		{Sort: "risk", Risk: &risk, ID: "0190a1b2-0000-7000-8000-000000000002"},
+	} {
+		decoded, err := decodeAlertCursor(cursor.encode())
+		if err != nil {
+			t.Fatalf("decodeAlertCursor: %v", err)
+		}
+		if decoded.Sort != cursor.Sort || decoded.ID != cursor.ID ||
+			(cursor.Time != nil && !decoded.Time.Equal(*cursor.Time)) ||
+			(cursor.Risk != nil && *decoded.Risk != *cursor.Risk) {
+			t.Errorf("decoded %+v, want %+v", decoded, cursor)
+		}
+	}
+}
+
+func TestListAlertsRejectsBadParameters(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	timeCursor := alertCursor{Sort: "-timestamp", Time: &at, ID: "a"}.encode()
+	riskWithoutValue := alertCursor{Sort: "risk", ID: "a"}.encode()
+
+	principal := &Principal{Name: "dashboard", Scopes: []string{scopeRead}, Projects: []string{"company-a"}}
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"unknown sort", "sort=severity", http.StatusBadRequest},
+		{"bad since", "since=yesterday", http.StatusBadRequest},
+		{"cursor from another sort", "sort=risk&cursor=" + timeCursor, http.StatusBadRequest},
+		{"cursor without a sort value", "sort=risk&cursor=" + riskWithoutValue, http.StatusBadRequest},
+		{"garbled cursor", "cursor=not-a-cursor!", http.StatusBadRequest},
+		{"other project", "project_id=company-b", http.StatusForbidden},
+	}
+	app := &App{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/alerts?"+tt.query, nil)
+			r = r.WithContext(context.WithValue(r.Context(), principalKey{}, principal))
+			w := httptest.NewRecorder()
+			app.listAlerts(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"time"
 
@@ -18,54 +20,188 @@ func (app *App) handleAlertAnalysis(ctx context.Context, t *asynq.Task) error {
 		return fmt.Errorf("failed to unmarshal alert: %v", err)
 	}
 
+	if err := app.analyzeAlert(alert); err != nil {
+		// Only the last attempt marks the alert failed; earlier ones go back
+		// to queued with the error kept for the retry
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, ok := asynq.GetMaxRetry(ctx)
+		if !ok || retried >= maxRetry {
+			app.setAlertStatus(alert, alertStatusFailed, err.Error())
+		} else {
+			app.setAlertStatus(alert, alertStatusQueued, fmt.Sprintf("attempt %d failed: %v", retried+1, err))
+		}
+		return err
+	}
+	return nil
+}
+
+// analyzeAlert runs the full analysis of one alert, recording each stage on
+// the alert. Problems that only degrade the result are collected as warnings
+// and leave the analysis partial; an error means nothing was stored.
+func (app *App) analyzeAlert(alert Alert) error {
 	log.Printf("Processing alert analysis for alert ID: %s", alert.ID)
 	startTime := time.Now()
+	var warnings []string
 
 	// Query logs around the alert time (±15 minutes)
+	app.setAlertStatus(alert, alertStatusFetchingLogs, "")
 	lokiLogs, err := app.LokiClient.QueryLogsAroundTime(alert.ProjectID, alert.Timestamp, 15)
 	if err != nil {
 		log.Printf("Failed to query Loki logs: %v", err)
-		// Continue with empty logs for demo purposes
+		// Still correlate with history and enrich the alert itself
+		warnings = append(warnings, fmt.Sprintf("log query failed: %v", err))
 		lokiLogs = []LokiLog{}
 	}
 
 	// Normalize logs
+	app.setAlertStatus(alert, alertStatusNormalizing, "")
 	var normalizedLogs []NormalizedLog
+	normalizeFailures := 0
 	for _, lokiLog := range lokiLogs {
 		normalized, err := app.Normalizer.NormalizeLog(lokiLog)
 		if err != nil {
 			log.Printf("Failed to normalize log: %v", err)
+			normalizeFailures++
 			continue
 		}
 		normalizedLogs = append(normalizedLogs, *normalized)
 	}
+	if normalizeFailures > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d of %d logs could not be normalized", normalizeFailures, len(lokiLogs)))
+	}
+
+	// Geolocate every IP before correlating so sources without a country
+	// field still contribute one
+	geo := app.geoEnrichLogs(normalizedLogs)
 
 	// Perform correlation analysis
+	app.setAlertStatus(alert, alertStatusCorrelating, "")
 	correlationResult, err := app.Correlator.CorrelateLogsForAlert(alert, normalizedLogs)
 	if err != nil {
 		return fmt.Errorf("failed to correlate logs: %v", err)
 	}
+	warnings = append(warnings, correlationResult.Warnings...)
 
 	// Build enrichment data
+	app.setAlertStatus(alert, alertStatusEnriching, "")
 	enrichmentData := app.buildEnrichmentData(alert, correlationResult)
 
+	// Score each involved user's activity against their learned baseline
+	behaviour, behaviourWarnings := app.scoreUserBehaviour(alert.ProjectID, correlationResult)
+	warnings = append(warnings, behaviourWarnings...)
+	enrichmentData["behavioral_anomalies"] = behaviour
+	maxAnomaly := 0.0
+	for _, score := range behaviour {
+		maxAnomaly = math.Max(maxAnomaly, score.AnomalyScore)
+	}
+	enrichmentData["max_user_anomaly_score"] = maxAnomaly
+
+	// Score each log against the offline-trained model
+	logAnomalies, logAnomalySignal := app.scoreLogAnomalies(normalizedLogs)
+	if logAnomalies != nil {
+		enrichmentData["log_anomalies"] = logAnomalies
+	}
+
+	// The alert's own addresses are enriched too, even if no log in the
+	// window carries them
+	entities := app.alertEntities(alert, correlationResult)
+	geo = app.geoEnrichEntities(geo, entities)
+
+	// Group the alert with related alerts into an incident
+	var incidentID string
+	incident, err := app.Incidents.AssignAlert(alert, entities)
+	if err != nil {
+		log.Printf("Failed to assign alert %s to an incident: %v", alert.ID, err)
+		warnings = append(warnings, fmt.Sprintf("incident assignment failed: %v", err))
+	} else {
+		incidentID = incident.ID
+		enrichmentData["incident"] = map[string]interface{}{
+			"id":          incident.ID,
+			"alert_count": incident.AlertCount,
+			"first_seen":  incident.FirstSeen,
+		}
+	}
+
+	// Check each user's locations in this window against their history
+	var travelFindings []TravelFinding
+	if len(geo) > 0 {
+		travelFindings, err = app.Travel.Detect(alert.ProjectID, normalizedLogs, geo)
+		if err != nil {
+			log.Printf("Impossible travel check failed for alert %s: %v", alert.ID, err)
+			warnings = append(warnings, fmt.Sprintf("impossible travel check failed: %v", err))
+		}
+		enrichmentData["impossible_travel"] = travelFindings
+		if app.Travel.EmitAlerts {
+			app.emitTravelAlerts(travelFindings, alert)
+		}
+	}
+
+	// Match the alert's and every extracted entity against local threat intel
+	var threatIntelHits []ThreatIntelHit
+	if app.ThreatIntel != nil {
+		threatIntelHits = app.ThreatIntel.Match(entities, normalizedLogs)
+		enrichmentData["threat_intel_hits"] = threatIntelHits
+	}
+
+	// Resolve hosts and internal IPs to inventory assets
+	assets, err := app.Assets.Resolve(normalizedLogs)
+	if err != nil {
+		log.Printf("Asset lookup failed for alert %s: %v", alert.ID, err)
+		warnings = append(warnings, fmt.Sprintf("asset lookup failed: %v", err))
+	}
+	if len(assets) > 0 {
+		enrichmentData["assets"] = assets
+	}
+
+	// Combine everything into a triage priority
+	highConfidenceUsers := make(map[string]bool)
+	for _, correlation := range correlationResult.UserCorrelations {
+		if correlation.ConfidenceScore > 0.7 {
+			highConfidenceUsers[correlation.UserIdentifier] = true
+		}
+	}
+	risk := app.Risk.Score(RiskInputs{
+		Alert:               alert,
+		Correlation:         correlationResult,
+		UserAnomaly:         maxAnomaly,
+		LogAnomaly:          logAnomalySignal,
+		ThreatIntelHits:     distinctIndicators(threatIntelHits),
+		ImpossibleTravel:    len(travelFindings) > 0,
+		AssetCriticality:    highestCriticality(assets),
+		HighConfidenceUsers: len(highConfidenceUsers),
+	})
+
 	// Create analysis result
 	analysisResult := AnalysisResult{
-		AlertID:           alert.ID,
-		ProjectID:         alert.ProjectID,
-		CorrelatedLogs:    normalizedLogs,
-		UserCorrelations:  correlationResult.UserCorrelations,
-		EnrichmentData:    enrichmentData,
-		AnalysisTimestamp: time.Now(),
-		ProcessingTimeMs:  time.Since(startTime).Milliseconds(),
+		AlertID:            alert.ID,
+		ProjectID:          alert.ProjectID,
+		CorrelatedLogs:     normalizedLogs,
+		UserCorrelations:   correlationResult.UserCorrelations,
+		EntityCorrelations: correlationResult.EntityCorrelations,
+		IncidentID:         incidentID,
+		GeoIP:              geo,
+		Risk:               risk,
+		EnrichmentData:     enrichmentData,
+		Status:             alertStatusCompleted,
+		Warnings:           warnings,
+		AnalysisTimestamp:  time.Now(),
+		ProcessingTimeMs:   time.Since(startTime).Milliseconds(),
+	}
+
+	if len(warnings) > 0 {
+		analysisResult.Status = alertStatusPartial
 	}
 
 	// Store analysis result
 	if err := app.storeAnalysisResult(analysisResult); err != nil {
 		return fmt.Errorf("failed to store analysis result: %v", err)
 	}
+	if err := app.markAlertAnalyzed(analysisResult); err != nil {
+		log.Printf("Analysis of alert %s stored but not reflected in the alerts list: %v", alert.ID, err)
+	}
+	app.dispatchNotifications(alert, analysisResult)
 
-	log.Printf("Completed analysis for alert %s in %dms", alert.ID, analysisResult.ProcessingTimeMs)
+	log.Printf("Completed analysis for alert %s in %dms (%s)", alert.ID, analysisResult.ProcessingTimeMs, analysisResult.Status)
 	return nil
 }
 
@@ -128,6 +264,21 @@ func (app *App) buildEnrichmentData(alert Alert, correlationResult *CorrelationR
 	enrichment["involved_users"] = userList
 	enrichment["involved_ips"] = ipList
 
+	// Every extracted entity grouped by type
+	involvedEntities := make(map[string][]string)
+	seenEntities := make(map[string]bool)
+	for _, log := range correlationResult.RelatedLogs {
+		for _, entity := range log.Entities {
+			if seenEntities[entity.Key()] {
+				continue
+			}
+			seenEntities[entity.Key()] = true
+			involvedEntities[entity.Type] = append(involvedEntities[entity.Type], entity.Value)
+		}
+	}
+	enrichment["involved_entities"] = involvedEntities
+	enrichment["correlation_stats"].(map[string]interface{})["entity_correlations_found"] = len(correlationResult.EntityCorrelations)
+
 	return enrichment
 }
 
@@ -137,14 +288,21 @@ func (app *App) storeAnalysisResult(result AnalysisResult) error {
 		return fmt.Errorf("failed to marshal analysis result: %v", err)
 	}
 
+	// The risk score is duplicated into its own column so alerts can be
+	// sorted by it
+	var riskScore sql.NullInt64
+	if result.Risk != nil {
+		riskScore = sql.NullInt64{Int64: int64(result.Risk.Score), Valid: true}
+	}
+
 	query := `
-		INSERT INTO analysis_results (alert_id, project_id, result_data)
-		VALUES ($1, $2, $3)
+		INSERT INTO analysis_results (alert_id, project_id, result_data, risk_score)
+		VALUES ($1, $2, $3, $4)
 		ON CONFLICT (alert_id) 
-		DO UPDATE SET result_data = $3, created_at = NOW()
+		DO UPDATE SET result_data = $3, risk_score = $4, created_at = NOW()
 	`
 
-	_, err = app.DB.Exec(query, result.AlertID, result.ProjectID, resultJSON)
+	_, err = app.DB.Exec(query, result.AlertID, result.ProjectID, resultJSON, riskScore)
 	return err
 }
 
@@ -219,15 +377,14 @@ func (app *App) generateMockAlert() {
 
 	// Randomly select an alert
 	alert := alerts[rand.Intn(len(alerts))]
-	alert.ID = generateID()
 	alert.Timestamp = time.Now()
 
 	// Queue the alert for analysis
-	task := asynq.NewTask("alert:analyze", mustMarshal(alert))
-	if _, err := app.TaskClient.Enqueue(task); err != nil {
+	result, err := app.acceptAlert(context.Background(), alert)
+	if err != nil {
 		log.Printf("Failed to queue mock alert: %v", err)
 	} else {
-		log.Printf("Generated mock alert: %s (Source: %s, Severity: %s)", alert.ID, alert.Source, alert.Severity)
+		log.Printf("Generated mock alert: %s (Source: %s, Severity: %s, %s)", result.AlertID, alert.Source, alert.Severity, result.Status)
 	}
 }
 
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// anomalyFeatureNames lists the numeric features extracted from a
+// NormalizedLog, in vector order.
+var anomalyFeatureNames = []string{
+	"method_get", "method_post", "method_put", "method_delete", "method_other",
+	"status_2xx", "status_3xx", "status_4xx", "status_5xx", "status_missing",
+	"uri_length", "uri_depth", "uri_query_params", "uri_digit_ratio", "uri_special_ratio", "uri_entropy",
+	"country_rarity",
+	"source_aws_waf", "source_azure_waf", "source_akamai_waf", "source_deep_security", "source_aws_guardduty", "source_other",
+}
+
+var anomalySources = []string{"aws_waf", "azure_waf", "akamai_waf", "deep_security", "aws_guardduty"}
+
+// AnomalyModel is an isolation forest over normalized log features, backed
+// by per-feature robust z-scores. The forest catches unusual combinations;
+// the z-scores catch values never seen in training, which a forest cannot
+// isolate when a feature was constant. It is trained offline with
+// `soc-ml train-anomaly` and loaded by the worker.
+type AnomalyModel struct {
+	Version       int              `json:"version"`
+	TrainedAt     time.Time        `json:"trained_at"`
+	TrainingSize  int              `json:"training_size"`
+	SampleSize    int              `json:"sample_size"`
+	FeatureNames  []string         `json:"feature_names"`
+	CountryCounts map[string]int   `json:"country_counts"`
+	CountryTotal  int              `json:"country_total"`
+	Threshold     float64          `json:"threshold"` // score at the training 99th percentile
+	Trees         []*IsolationTree `json:"trees"`
+	FeatureStats  []RobustStat     `json:"feature_stats"`
+}
+
+// RobustStat is the median and median absolute deviation of one feature.
+// One-hot features have a MAD of 0 whenever one category dominates, so they
+// carry their smoothed training frequency instead.
+type RobustStat struct {
+	Median float64 `json:"median"`
+	MAD    float64 `json:"mad"`
+	Binary bool    `json:"binary,omitempty"`
+	Rate   float64 `json:"rate,omitempty"` // share of training logs with the feature set
+}
+
+// isOneHotFeature reports whether the named feature is a 0/1 category flag.
+func isOneHotFeature(name string) bool {
+	for _, prefix := range []string{"method_", "status_", "source_"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// robustZScale maps z-scores into (0, 1): z of 3 gives ~0.26, z of 20 ~0.86.
+const robustZScale = 10.0
+
+// AnomalyExplanation is a model score with the features furthest from the
+// training distribution.
+type AnomalyExplanation struct {
+	Score       float64            `json:"score"`
+	TopFeatures map[string]float64 `json:"top_features,omitempty"` // feature -> robust z
+}
+
+// IsolationTree is stored as a flat node list; node 0 is the root.
+type IsolationTree struct {
+	Nodes []IsolationNode `json:"nodes"`
+}
+
+type IsolationNode struct {
+	Feature int     `json:"f"` // -1 for leaves
+	Split   float64 `json:"s,omitempty"`
+	Left    int     `json:"l,omitempty"`
+	Right   int     `json:"r,omitempty"`
+	Size    int     `json:"n,omitempty"` // training points that reached the leaf
+}
+
+func uriEntropy(uri string) float64 {
+	if uri == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, r := range uri {
+		counts[r]++
+	}
+	entropy := 0.0
+	total := float64(len([]rune(uri)))
+	for _, c := range counts {
+		p := float64(c) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// ExtractFeatures turns a normalized log into the model's feature vector.
+// Country is encoded as its rarity in the training data.
+func (m *AnomalyModel) ExtractFeatures(normalized NormalizedLog) []float64 {
+	features := make([]float64, 0, len(anomalyFeatureNames))
+
+	method := strings.ToUpper(normalized.Method)
+	for _, known := range []string{"GET", "POST", "PUT", "DELETE"} {
+		features = append(features, boolFeature(method == known))
+	}
+	features = append(features, boolFeature(method != "" && method != "GET" && method != "POST" && method != "PUT" && method != "DELETE"))
+
+	statusClass := ""
+	if len(normalized.StatusCode) == 3 {
+		statusClass = normalized.StatusCode[:1]
+	}
+	for _, class := range []string{"2", "3", "4", "5"} {
+		features = append(features, boolFeature(statusClass == class))
+	}
+	features = append(features, boolFeature(statusClass == ""))
+
+	uri := normalized.URI
+	path, query, _ := strings.Cut(uri, "?")
+	queryParams := 0
+	if query != "" {
+		queryParams = strings.Count(query, "&") + 1
+	}
+	digits, specials := 0, 0
+	for _, r := range uri {
+		if unicode.IsDigit(r) {
+			digits++
+		} else if strings.ContainsRune(`%'"<>;()\`+"`"+`{}|$`, r) {
+			specials++
+		}
+	}
+	length := float64(len(uri))
+	features = append(features,
+		length,
+		float64(strings.Count(path, "/")),
+		float64(queryParams),
+		ratio(digits, len(uri)),
+		ratio(specials, len(uri)),
+		uriEntropy(uri),
+	)
+
+	rarity := 0.0
+	if normalized.Country != "" && m.CountryTotal > 0 {
+		// Laplace-smoothed negative log frequency
+		rarity = -math.Log((float64(m.CountryCounts[strings.ToUpper(normalized.Country)]) + 1) / (float64(m.CountryTotal) + 1))
+	}
+	features = append(features, rarity)
+
+	knownSource := false
+	for _, source := range anomalySources {
+		features = append(features, boolFeature(normalized.Source == source))
+		knownSource = knownSource || normalized.Source == source
+	}
+	features = append(features, boolFeature(!knownSource))
+
+	return features
+}
+
+func boolFeature(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func ratio(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// averagePathLength is c(n), the expected path length of an unsuccessful
+// search in a binary search tree of n points.
+func averagePathLength(n int) float64 {
+	if n <= 1 {
+		return 0
+	}
+	if n == 2 {
+		return 1
+	}
+	return 2*(math.Log(float64(n-1))+0.5772156649) - 2*float64(n-1)/float64(n)
+}
+
+func buildIsolationTree(rng *rand.Rand, points [][]float64, maxDepth int) *IsolationTree {
+	tree := &IsolationTree{}
+	var build func(points [][]float64, depth int) int
+	build = func(points [][]float64, depth int) int {
+		index := len(tree.Nodes)
+		tree.Nodes = append(tree.Nodes, IsolationNode{Feature: -1, Size: len(points)})
+		if depth >= maxDepth || len(points) <= 1 {
+			return index
+		}
+
+		// Pick a random feature that actually varies among these points
+		dims := len(points[0])
+		for _, feature := range rng.Perm(dims) {
+			lo, hi := points[0][feature], points[0][feature]
+			for _, p := range points {
+				lo = math.Min(lo, p[feature])
+				hi = math.Max(hi, p[feature])
+			}
+			if lo == hi {
+				continue
+			}
+
+			split := lo + rng.Float64()*(hi-lo)
+			var left, right [][]float64
+			for _, p := range points {
+				if p[feature] < split {
+					left = append(left, p)
+				} else {
+					right = append(right, p)
+				}
+			}
+
+			tree.Nodes[index] = IsolationNode{Feature: feature, Split: split}
+			l := build(left, depth+1)
+			r := build(right, depth+1)
+			tree.Nodes[index].Left = l
+			tree.Nodes[index].Right = r
+			return index
+		}
+		return index
+	}
+	build(points, 0)
+	return tree
+}
+
+func (t *IsolationTree) pathLength(x []float64) float64 {
+	index, depth := 0, 0.0
+	for {
+		node := t.Nodes[index]
+		if node.Feature < 0 {
+			return depth + averagePathLength(node.Size)
+		}
+		if x[node.Feature] < node.Split {
+			index = node.Left
+		} else {
+			index = node.Right
+		}
+		depth++
+	}
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func (stat RobustStat) z(value float64) float64 {
+	if stat.Binary {
+		// The z-score whose two-sided normal tail is as rare as this value
+		// was in training: a category seen in 1% of logs scores ~2.6
+		p := stat.Rate
+		if value < 0.5 {
+			p = 1 - p
+		}
+		return math.Sqrt2 * math.Erfinv(1-p)
+	}
+	// 1.4826 makes MAD consistent with a standard deviation; the floor keeps
+	// constant features from producing infinite scores
+	scale := math.Max(1.4826*stat.MAD, 0.05*math.Max(1, math.Abs(stat.Median)))
+	return math.Abs(value-stat.Median) / scale
+}
+
+// Score returns the anomaly score in (0, 1]: the larger of the isolation
+// forest score (values well above 0.5 are easy to isolate) and the squashed
+// maximum robust z-score.
+func (m *AnomalyModel) Score(normalized NormalizedLog) float64 {
+	return m.Explain(normalized).Score
+}
+
+func (m *AnomalyModel) Explain(normalized NormalizedLog) AnomalyExplanation {
+	x := m.ExtractFeatures(normalized)
+	total := 0.0
+	for _, tree := range m.Trees {
+		total += tree.pathLength(x)
+	}
+	forest := math.Pow(2, -(total/float64(len(m.Trees)))/averagePathLength(m.SampleSize))
+
+	zs := make([]float64, len(m.FeatureStats))
+	order := make([]int, len(m.FeatureStats))
+	for i, stat := range m.FeatureStats {
+		order[i] = i
+		// Models trained before one-hot features carried frequencies only
+		// have a MAD for them, which scores every minority category ~20
+		if !stat.Binary && isOneHotFeature(m.FeatureNames[i]) {
+			continue
+		}
+		zs[i] = stat.z(x[i])
+	}
+	sort.SliceStable(order, func(a, b int) bool { return zs[order[a]] > zs[order[b]] })
+
+	explanation := AnomalyExplanation{TopFeatures: make(map[string]float64)}
+	maxZ := 0.0
+	if len(order) > 0 {
+		maxZ = zs[order[0]]
+	}
+	for _, i := range order {
+		if zs[i] < 3 || len(explanation.TopFeatures) == 3 {
+			break
+		}
+		explanation.TopFeatures[m.FeatureNames[i]] = math.Round(zs[i]*10) / 10
+	}
+
+	explanation.Score = math.Max(forest, 1-math.Exp(-maxZ/robustZScale))
+	return explanation
+}
+
+// TrainAnomalyModel fits an isolation forest on the given logs.
+func TrainAnomalyModel(logs []NormalizedLog, trees, sampleSize int, seed int64) (*AnomalyModel, error) {
+	if trees < 1 {
+		return nil, fmt.Errorf("need at least 1 tree, got %d", trees)
+	}
+	// A tree over a single point has an expected path length of 0, which
+	// makes every score undefined
+	if sampleSize < 2 {
+		return nil, fmt.Errorf("sample size must be at least 2, got %d", sampleSize)
+	}
+	if len(logs) < 2 {
+		return nil, fmt.Errorf("need at least 2 logs to train, got %d", len(logs))
+	}
+	if sampleSize > len(logs) {
+		sampleSize = len(logs)
+	}
+
+	model := &AnomalyModel{
+		Version:       2,
+		TrainedAt:     time.Now().UTC(),
+		TrainingSize:  len(logs),
+		SampleSize:    sampleSize,
+		FeatureNames:  anomalyFeatureNames,
+		CountryCounts: make(map[string]int),
+	}
+	for _, log := range logs {
+		if log.Country != "" {
+			model.CountryCounts[strings.ToUpper(log.Country)]++
+			model.CountryTotal++
+		}
+	}
+
+	points := make([][]float64, len(logs))
+	for i, log := range logs {
+		points[i] = model.ExtractFeatures(log)
+	}
+
+	for feature, name := range anomalyFeatureNames {
+		column := make([]float64, len(points))
+		for i, p := range points {
+			column[i] = p[feature]
+		}
+		if isOneHotFeature(name) {
+			set := 0.0
+			for _, value := range column {
+				set += value
+			}
+			// Laplace-smoothed so categories never seen still get a finite score
+			model.FeatureStats = append(model.FeatureStats, RobustStat{Binary: true, Rate: (set + 1) / (float64(len(column)) + 2)})
+			continue
+		}
+		stat := RobustStat{Median: median(column)}
+		for i := range column {
+			column[i] = math.Abs(column[i] - stat.Median)
+		}
+		stat.MAD = median(column)
+		model.FeatureStats = append(model.FeatureStats, stat)
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	maxDepth := int(math.Ceil(math.Log2(float64(sampleSize))))
+	for i := 0; i < trees; i++ {
+		sample := make([][]float64, sampleSize)
+		for j, k := range rng.Perm(len(points))[:sampleSize] {
+			sample[j] = points[k]
+		}
+		model.Trees = append(model.Trees, buildIsolationTree(rng, sample, maxDepth))
+	}
+
+	scores := make([]float64, len(logs))
+	for i, log := range logs {
+		scores[i] = model.Score(log)
+	}
+	sort.Float64s(scores)
+	model.Threshold = scores[int(float64(len(scores)-1)*0.99)]
+
+	return model, nil
+}
+
+func LoadAnomalyModel(path string) (*AnomalyModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var model AnomalyModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("failed to parse anomaly model %s: %v", path, err)
+	}
+	if len(model.FeatureNames) != len(anomalyFeatureNames) || len(model.FeatureStats) != len(anomalyFeatureNames) || len(model.Trees) == 0 || model.SampleSize < 2 {
+		return nil, fmt.Errorf("anomaly model %s does not match this build's features", path)
+	}
+	// Trees split on feature indices, so a model trained with the same
+	// number of features in a different order would score the wrong columns
+	for i, name := range model.FeatureNames {
+		if name != anomalyFeatureNames[i] {
+			return nil, fmt.Errorf("anomaly model %s has feature %q at position %d, this build expects %q", path, name, i, anomalyFeatureNames[i])
+		}
+	}
+	return &model, nil
+}
+
+func (m *AnomalyModel) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a watching worker never reads a partial model
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readReplayFile loads logs for training. Each line is either a LokiLog
+// ({"timestamp": ..., "line": ..., "labels": ...}) or a raw log line.
+func readReplayFile(path string, normalizer *LogNormalizer) ([]NormalizedLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var logs []NormalizedLog
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 10*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		lokiLog := LokiLog{Timestamp: time.Now(), Line: line}
+		var wrapped LokiLog
+		if err := json.Unmarshal([]byte(line), &wrapped); err == nil && wrapped.Line != "" {
+			lokiLog = wrapped
+		}
+
+		normalized, err := normalizer.NormalizeLog(lokiLog)
+		if err != nil {
+			continue
+		}
+		logs = append(logs, *normalized)
+	}
+	return logs, scanner.Err()
+}
+
+// runTrainAnomaly implements the `train-anomaly` subcommand.
+func runTrainAnomaly(args []string) error {
+	flags := flag.NewFlagSet("train-anomaly", flag.ExitOnError)
+	input := flags.String("input", "", "replay file with one log per line (required)")
+	output := flags.String("output", "models/anomaly.json", "where to write the trained model")
+	trees := flags.Int("trees", 100, "number of isolation trees")
+	sampleSize := flags.Int("sample-size", 256, "points sampled per tree")
+	seed := flags.Int64("seed", 1, "random seed for reproducible models")
+	flags.Parse(args)
+
+	if *input == "" {
+		flags.Usage()
+		return fmt.Errorf("-input is required")
+	}
+
+	logs, err := readReplayFile(*input, NewLogNormalizer())
+	if err != nil {
+		return fmt.Errorf("failed to read replay file: %v", err)
+	}
+
+	model, err := TrainAnomalyModel(logs, *trees, *sampleSize, *seed)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(*output), 0o755); err != nil {
+		return err
+	}
+	if err := model.Save(*output); err != nil {
+		return fmt.Errorf("failed to save model: %v", err)
+	}
+
+	log.Printf("Trained anomaly model on %d logs (%d trees, threshold %.3f) -> %s",
+		len(logs), len(model.Trees), model.Threshold, *output)
+	return nil
+}
+
+// AnomalyScorer holds the model loaded from Path so it can be swapped when
+// a retrained artifact is dropped in place.
+type AnomalyScorer struct {
+	mu    sync.RWMutex
+	model *AnomalyModel
+
+	Path string
+}
+
+func NewAnomalyScorer(path string) *AnomalyScorer {
+	return &AnomalyScorer{Path: path}
+}
+
+// Load replaces the active model; on error the previous one stays active.
+func (s *AnomalyScorer) Load() error {
+	model, err := LoadAnomalyModel(s.Path)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.model = model
+	s.mu.Unlock()
+
+	log.Printf("Loaded anomaly model from %s (trained %s on %d logs)", s.Path, model.TrainedAt.Format(time.RFC3339), model.TrainingSize)
+	return nil
+}
+
+func (s *AnomalyScorer) Model() *AnomalyModel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.model
+}
+
+// scoreLogAnomalies attaches the model's score to each correlated log and
+// summarises the outliers for enrichment. It also returns how far the worst
+// log lies beyond the model's threshold, from 0 to 1, for risk scoring.
+func (app *App) scoreLogAnomalies(logs []NormalizedLog) (map[string]interface{}, float64) {
+	if app.Anomaly == nil || app.Anomaly.Model() == nil {
+		return nil, 0
+	}
+	model := app.Anomaly.Model()
+
+	maxScore := 0.0
+	outliers := make(map[string]map[string]float64)
+	for i := range logs {
+		explanation := model.Explain(logs[i])
+		score := math.Round(explanation.Score*1000) / 1000
+		logs[i].AnomalyScore = &score
+		maxScore = math.Max(maxScore, score)
+		if score > model.Threshold {
+			outliers[logs[i].ID] = explanation.TopFeatures
+		}
+	}
+
+	signal := 0.0
+	if maxScore > model.Threshold && model.Threshold < 1 {
+		signal = (maxScore - model.Threshold) / (1 - model.Threshold)
+	}
+
+	return map[string]interface{}{
+		"model_trained_at": model.TrainedAt,
+		"threshold":        model.Threshold,
+		"max_score":        maxScore,
+		"outlier_count":    len(outliers),
+		"outliers":         outliers,
+	}, signal
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func anomalyTrainingLogs(n int) []NormalizedLog {
+	logs := make([]NormalizedLog, n)
+	for i := range logs {
+		logs[i] = NormalizedLog{
+			ID:         fmt.Sprintf("log-%d", i),
+			Source:     "aws_waf",
+			Method:     "GET",
+			URI:        fmt.Sprintf("/products/%d", i),
+			StatusCode: "200",
+		}
+	}
+	return logs
+}
+
+func TestTrainAnomalyModelRejectsInvalidParameters(t *testing.T) {
+	logs := anomalyTrainingLogs(10)
+	tests := []struct {
+		name              string
+		trees, sampleSize int
+	}{
+		{"no trees", 0, 8},
+		{"negative trees", -1, 8},
+		{"single-point samples", 10, 1},
+		{"empty samples", 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := TrainAnomalyModel(logs, tt.trees, tt.sampleSize, 1); err == nil {
+				t.Errorf("TrainAnomalyModel(trees=%d, sample=%d) succeeded", tt.trees, tt.sampleSize)
+			}
+		})
+	}
+}
+
+func TestLoadAnomalyModelChecksFeatureOrder(t *testing.T) {
+	model, err := TrainAnomalyModel(anomalyTrainingLogs(10), 5, 8, 1)
+	if err != nil {
+		t.Fatalf("TrainAnomalyModel: %v", err)
+	}
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "anomaly.json")
+	if err := model.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAnomalyModel(path); err != nil {
+		t.Fatalf("LoadAnomalyModel: %v", err)
+	}
+
+	// Same features, two of them swapped
+	names := append([]string(nil), anomalyFeatureNames...)
+	names[0], names[1] = names[1], names[0]
+	model.FeatureNames = names
+	swapped := filepath.Join(dir, "swapped.json")
+	if err := model.Save(swapped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadAnomalyModel(swapped); err == nil {
+		t.Error("LoadAnomalyModel accepted a model with reordered features")
+	}
+}
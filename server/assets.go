@@ -0,0 +1,404 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// Asset is an inventory record for one host.
+type Asset struct {
+	Hostname    string    `json:"hostname"`
+	Owner       string    `json:"owner,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Criticality string    `json:"criticality"`
+	IPs         []string  `json:"ips,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Source      string    `json:"source"` // "file" or "api"
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+var assetCriticalities = []string{"low", "medium", "high", "critical"}
+
+func criticalityRank(criticality string) int {
+	for i, c := range assetCriticalities {
+		if c == criticality {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// validate normalizes the record and rejects ones we couldn't match on.
+func (a *Asset) validate() error {
+	a.Hostname = strings.ToLower(strings.TrimSpace(a.Hostname))
+	if a.Hostname == "" {
+		return fmt.Errorf("hostname is required")
+	}
+
+	a.Criticality = strings.ToLower(strings.TrimSpace(a.Criticality))
+	if a.Criticality == "" {
+		a.Criticality = "medium"
+	}
+	if criticalityRank(a.Criticality) == 0 {
+		return fmt.Errorf("asset %s: criticality must be one of %s", a.Hostname, strings.Join(assetCriticalities, ", "))
+	}
+
+	ips := a.IPs[:0]
+	for _, ip := range a.IPs {
+		parsed := net.ParseIP(strings.TrimSpace(ip))
+		if parsed == nil {
+			return fmt.Errorf("asset %s: invalid IP %q", a.Hostname, ip)
+		}
+		ips = append(ips, parsed.String())
+	}
+	a.IPs = ips
+	return nil
+}
+
+// AssetInventory stores assets in Postgres. File imports and API pushes
+// write to the same table; a file import only replaces the records it
+// created, so API-managed assets survive a reload.
+type AssetInventory struct {
+	db *sql.DB
+
+	Path string
+}
+
+func NewAssetInventory(db *sql.DB, path string) *AssetInventory {
+	return &AssetInventory{db: db, Path: path}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ';' || r == '|' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseAssetCSV reads a CSV with a header row of hostname, owner,
+// environment, criticality, ips and tags. Lists are separated by ';'.
+func parseAssetCSV(r io.Reader) ([]Asset, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["hostname"]; !ok {
+		return nil, fmt.Errorf("CSV header needs a hostname column")
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var assets []Asset
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %v", err)
+		}
+		assets = append(assets, Asset{
+			Hostname:    column(record, "hostname"),
+			Owner:       column(record, "owner"),
+			Environment: column(record, "environment"),
+			Criticality: column(record, "criticality"),
+			IPs:         splitList(column(record, "ips")),
+			Tags:        splitList(column(record, "tags")),
+		})
+	}
+	return assets, nil
+}
+
+// parseAssetJSON accepts a list of assets or {"assets": [...]}.
+func parseAssetJSON(data []byte) ([]Asset, error) {
+	var assets []Asset
+	if err := json.Unmarshal(data, &assets); err == nil {
+		return assets, nil
+	}
+	var wrapped struct {
+		Assets []Asset `json:"assets"`
+	}
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return nil, fmt.Errorf("expected a list of assets or {\"assets\": [...]}: %v", err)
+	}
+	return wrapped.Assets, nil
+}
+
+// LoadFile imports the inventory file, replacing earlier file-sourced
+// records. Hosts pushed through the API keep their record. The whole file is
+// rejected if any record is invalid.
+func (ai *AssetInventory) LoadFile() error {
+	data, err := os.ReadFile(ai.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read asset inventory %s: %v", ai.Path, err)
+	}
+
+	var assets []Asset
+	switch strings.ToLower(filepath.Ext(ai.Path)) {
+	case ".csv":
+		assets, err = parseAssetCSV(strings.NewReader(string(data)))
+	case ".json":
+		assets, err = parseAssetJSON(data)
+	default:
+		return fmt.Errorf("asset inventory %s must be .csv or .json", ai.Path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse asset inventory %s: %v", ai.Path, err)
+	}
+
+	tx, err := ai.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM assets WHERE source = 'file'`); err != nil {
+		return fmt.Errorf("failed to clear file assets: %v", err)
+	}
+	stored := 0
+	for i := range assets {
+		assets[i].Source = "file"
+		ok, err := ai.upsert(tx, &assets[i])
+		if err != nil {
+			return err
+		}
+		if ok {
+			stored++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Loaded %d assets from %s (%d kept their API record)", stored, ai.Path, len(assets)-stored)
+	return nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// upsert stores asset and reports whether it was written. API pushes replace
+// any record, but a file record never replaces one pushed through the API.
+func (ai *AssetInventory) upsert(db execer, asset *Asset) (bool, error) {
+	if err := asset.validate(); err != nil {
+		return false, err
+	}
+	result, err := db.Exec(`
+		INSERT INTO assets (hostname, owner, environment, criticality, ips, tags, source, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+		ON CONFLICT (hostname) DO UPDATE SET
+			owner = $2, environment = $3, criticality = $4, ips = $5, tags = $6, source = $7, updated_at = NOW()
+		WHERE EXCLUDED.source = 'api' OR assets.source <> 'api'
+	`, asset.Hostname, asset.Owner, asset.Environment, asset.Criticality,
+		pq.Array(asset.IPs), pq.Array(asset.Tags), asset.Source)
+	if err != nil {
+		return false, fmt.Errorf("failed to store asset %s: %v", asset.Hostname, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to store asset %s: %v", asset.Hostname, err)
+	}
+	return affected > 0, nil
+}
+
+const assetColumns = `hostname, owner, environment, criticality, ips, tags, source, updated_at`
+
+func scanAssets(rows *sql.Rows) ([]Asset, error) {
+	defer rows.Close()
+	assets := []Asset{}
+	for rows.Next() {
+		var asset Asset
+		if err := rows.Scan(&asset.Hostname, &asset.Owner, &asset.Environment, &asset.Criticality,
+			pq.Array(&asset.IPs), pq.Array(&asset.Tags), &asset.Source, &asset.UpdatedAt); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+// Resolve finds the assets behind the hostnames and internal IPs seen in
+// logs. Hostnames match on the full name or on the first label, so
+// "web-01.corp.example" finds an asset recorded as "web-01".
+func (ai *AssetInventory) Resolve(logs []NormalizedLog) ([]Asset, error) {
+	hostSet := make(map[string]bool)
+	ipSet := make(map[string]bool)
+	for _, log := range logs {
+		var hosts []string
+		hosts = append(hosts, log.Host)
+		for _, entity := range log.Entities {
+			if entity.Type == EntityHostname {
+				hosts = append(hosts, entity.Value)
+			}
+		}
+		for _, host := range hosts {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" {
+				continue
+			}
+			hostSet[host] = true
+			if short, _, found := strings.Cut(host, "."); found && net.ParseIP(host) == nil {
+				hostSet[short] = true
+			}
+		}
+		for _, ip := range log.IPAddresses {
+			// Public addresses belong to clients, not to our inventory
+			if parsed := net.ParseIP(ip); parsed != nil && (parsed.IsPrivate() || parsed.IsLoopback()) {
+				ipSet[parsed.String()] = true
+			}
+		}
+	}
+	if len(hostSet) == 0 && len(ipSet) == 0 {
+		return nil, nil
+	}
+
+	hosts := make([]string, 0, len(hostSet))
+	for host := range hostSet {
+		hosts = append(hosts, host)
+	}
+	ips := make([]string, 0, len(ipSet))
+	for ip := range ipSet {
+		ips = append(ips, ip)
+	}
+
+	rows, err := ai.db.Query(`
+		SELECT `+assetColumns+` FROM assets
+		WHERE hostname = ANY($1) OR ips && $2
+		ORDER BY hostname
+	`, pq.Array(hosts), pq.Array(ips))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve assets: %v", err)
+	}
+	return scanAssets(rows)
+}
+
+// highestCriticality is what the risk score uses when several assets are
+// involved.
+func highestCriticality(assets []Asset) string {
+	highest := ""
+	for _, asset := range assets {
+		if criticalityRank(asset.Criticality) > criticalityRank(highest) {
+			highest = asset.Criticality
+		}
+	}
+	return highest
+}
+
+// pushAssets upserts one asset or a list of assets sent by an external CMDB.
+func (app *App) pushAssets(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	assets, err := parseAssetJSON(body)
+	if err != nil || len(assets) == 0 {
+		var single Asset
+		if json.Unmarshal(body, &single) != nil || single.Hostname == "" {
+			http.Error(w, "Expected an asset, a list of assets or {\"assets\": [...]}", http.StatusBadRequest)
+			return
+		}
+		assets = []Asset{single}
+	}
+
+	hostnames := make([]string, len(assets))
+	for i := range assets {
+		hostnames[i] = assets[i].Hostname
+	}
+	auditDetail(r.Context(), "hostnames", hostnames)
+
+	for i := range assets {
+		assets[i].Source = "api"
+		if err := assets[i].validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to store assets", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for i := range assets {
+		if _, err := app.Assets.upsert(tx, &assets[i]); err != nil {
+			http.Error(w, "Failed to store assets", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to store assets", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"stored": len(assets)})
+}
+
+func (app *App) listAssets(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + assetColumns + ` FROM assets
+		WHERE ($1 = '' OR environment = $1) AND ($2 = '' OR criticality = $2)
+		ORDER BY hostname`
+	rows, err := app.DB.Query(query, r.URL.Query().Get("environment"), r.URL.Query().Get("criticality"))
+	if err != nil {
+		http.Error(w, "Failed to list assets", http.StatusInternalServerError)
+		return
+	}
+	assets, err := scanAssets(rows)
+	if err != nil {
+		http.Error(w, "Failed to list assets", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assets)
+}
+
+func (app *App) getAsset(w http.ResponseWriter, r *http.Request) {
+	rows, err := app.DB.Query(`SELECT `+assetColumns+` FROM assets WHERE hostname = $1`,
+		strings.ToLower(chi.URLParam(r, "hostname")))
+	if err != nil {
+		http.Error(w, "Failed to get asset", http.StatusInternalServerError)
+		return
+	}
+	assets, err := scanAssets(rows)
+	if err != nil || len(assets) == 0 {
+		http.Error(w, "Asset not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(assets[0])
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/lib/pq"
+)
+
+// Audit outcomes, from the response status of audited requests.
+const (
+	auditSuccess  = "success"
+	auditDenied   = "denied" // 401 or 403
+	auditNotFound = "not_found"
+	auditRejected = "rejected" // any other 4xx
+	auditError    = "error"
+)
+
+// auditActions names the audited routes worth searching for by name. Other
+// routes are recorded under their method and pattern.
+var auditActions = map[string]string{
+	"POST /alerts":                          "alert.submit",
+	"POST /alerts/batch":                    "alert.submit_batch",
+	"POST /alerts/ingest/{format}":          "alert.ingest",
+	"GET /alerts":                           "alert.list",
+	"GET /analysis/{alert_id}":              "analysis.read",
+	"GET /analysis/{alert_id}/evidence":     "analysis.read_evidence",
+	"GET /graph":                            "graph.read",
+	"GET /incidents":                        "incident.list",
+	"GET /incidents/{incident_id}":          "incident.read",
+	"POST /suppressions":                    "suppression.create",
+	"DELETE /suppressions/{suppression_id}": "suppression.delete",
+	"POST /assets":                          "asset.push",
+	"POST /notifications/dead-letters/{dead_letter_id}/requeue": "notification.requeue",
+	"POST /events/ticket": "events.ticket",
+	"GET /events":         "events.stream",
+	"GET /audit":          "audit.list",
+	"GET /audit/verify":   "audit.verify",
+}
+
+// AuditEntry is one record of the audit trail. Each entry's Hash covers its
+// own fields and the previous entry's hash, so editing, removing or
+// reordering entries breaks the chain from that point on.
+type AuditEntry struct {
+	Seq        int64           `json:"seq"`
+	Time       time.Time       `json:"time"`
+	Principal  string          `json:"principal"` // "system" for the server's own actions
+	AuthMethod string          `json:"auth_method,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	Action     string          `json:"action"`
+	Target     string          `json:"target,omitempty"`
+	ProjectIDs []string        `json:"project_ids,omitempty"`
+	Outcome    string          `json:"outcome"`
+	StatusCode int             `json:"status_code,omitempty"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Detail     json.RawMessage `json:"detail,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+
+	details map[string]interface{}
+}
+
+// chainHash is the hash of entry chained onto prevHash. It covers every
+// field except Seq, which the database assigns.
+func (entry *AuditEntry) chainHash(prevHash string) string {
+	projects := entry.ProjectIDs
+	if len(projects) == 0 {
+		projects = nil
+	}
+	fields := mustMarshal([]interface{}{
+		entry.Time.UTC().Format(time.RFC3339Nano),
+		entry.Principal,
+		entry.AuthMethod,
+		entry.RequestID,
+		entry.Action,
+		entry.Target,
+		projects,
+		entry.Outcome,
+		entry.StatusCode,
+		entry.RemoteAddr,
+		string(entry.Detail),
+	})
+	sum := sha256.Sum256(append([]byte(prevHash+"\n"), fields...))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditBuffer is how many entries may wait to be written before requests
+// start waiting on the writer, and auditBatchSize how many are written per
+// transaction.
+const (
+	auditBuffer    = 1024
+	auditBatchSize = 100
+)
+
+// Auditor appends entries to the audit_log table. Entries are written by a
+// single goroutine in batches, each batch under a lock shared by every
+// replica so the chain stays linear.
+type Auditor struct {
+	db      *sql.DB
+	entries chan *AuditEntry
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewAuditor(db *sql.DB) *Auditor {
+	return &Auditor{db: db, entries: make(chan *AuditEntry, auditBuffer), done: make(chan struct{})}
+}
+
+// Run writes recorded entries until Close is called.
+func (a *Auditor) Run() {
+	defer close(a.done)
+	for entry := range a.entries {
+		batch := []*AuditEntry{entry}
+	drain:
+		for len(batch) < auditBatchSize {
+			select {
+			case more, ok := <-a.entries:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, more)
+			default:
+				break drain
+			}
+		}
+		if err := a.append(batch); err != nil {
+			// Keep the trail recoverable from the server log
+			log.Printf("Failed to write %d audit entries: %v", len(batch), err)
+			for _, entry := range batch {
+				log.Printf("Unwritten audit entry: %s", mustMarshal(entry))
+			}
+		}
+	}
+}
+
+// Close writes the entries still queued and stops the writer. Entries
+// recorded afterwards only go to the server log.
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	a.closed = true
+	close(a.entries)
+	a.mu.Unlock()
+	<-a.done
+}
+
+// Record queues entry for writing, waiting if the writer is far behind
+// rather than dropping it.
+func (a *Auditor) Record(entry AuditEntry) {
+	entry.Time = entry.Time.UTC().Truncate(time.Microsecond) // what Postgres keeps
+	if entry.details != nil {
+		entry.Detail = mustMarshal(entry.details)
+		entry.details = nil
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		log.Printf("Unwritten audit entry: %s", mustMarshal(entry))
+		return
+	}
+	a.entries <- &entry
+}
+
+// RecordSystem records something the server did on its own, such as
+// reloading a config file. err is nil on success.
+func (a *Auditor) RecordSystem(action, target string, err error) {
+	entry := AuditEntry{Time: time.Now(), Principal: "system", Action: action, Target: target, Outcome: auditSuccess}
+	if err != nil {
+		entry.Outcome = auditError
+		entry.details = map[string]interface{}{"error": err.Error()}
+	}
+	a.Record(entry)
+}
+
+func (a *Auditor) append(batch []*AuditEntry) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('audit_log'))`); err != nil {
+		return fmt.Errorf("failed to lock audit log: %v", err)
+	}
+	var prevHash string
+	err = tx.QueryRow(`SELECT hash FROM audit_log ORDER BY seq DESC LIMIT 1`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to read audit chain head: %v", err)
+	}
+
+	for _, entry := range batch {
+		entry.PrevHash = prevHash
+		entry.Hash = entry.chainHash(prevHash)
+		var detail interface{}
+		if len(entry.Detail) > 0 {
+			detail = string(entry.Detail)
+		}
+		_, err := tx.Exec(`
+			INSERT INTO audit_log (time, principal, auth_method, request_id, action, target, project_ids,
+				outcome, status_code, remote_addr, detail, prev_hash, hash)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		`, entry.Time, entry.Principal, entry.AuthMethod, entry.RequestID, entry.Action, entry.Target,
+			pq.Array(entry.ProjectIDs), entry.Outcome, entry.StatusCode, entry.RemoteAddr, detail,
+			entry.PrevHash, entry.Hash)
+		if err != nil {
+			return fmt.Errorf("failed to insert audit entry: %v", err)
+		}
+		prevHash = entry.Hash
+	}
+	return tx.Commit()
+}
+
+type auditKey struct{}
+
+// Middleware records one audit entry per request once it has been served.
+// It must run before authentication so refused requests are recorded too.
+// Handlers add what they learn through the audit* helpers.
+func (a *Auditor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &AuditEntry{
+			Time:       time.Now(),
+			Principal:  "anonymous",
+			RequestID:  middleware.GetReqID(r.Context()),
+			RemoteAddr: r.RemoteAddr,
+		}
+		if projectID := r.URL.Query().Get("project_id"); projectID != "" {
+			entry.ProjectIDs = []string{projectID}
+		}
+
+		recorder := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditKey{}, entry)))
+
+		route := chi.RouteContext(r.Context())
+		pattern := r.Method + " " + route.RoutePattern()
+		entry.Action = auditActions[pattern]
+		if entry.Action == "" {
+			entry.Action = pattern
+		}
+		if entry.Target == "" {
+			entry.Target = strings.Join(route.URLParams.Values, "/")
+		}
+		entry.StatusCode = recorder.Status()
+		if entry.StatusCode == 0 {
+			entry.StatusCode = http.StatusOK
+		}
+		entry.Outcome = auditOutcome(entry.StatusCode)
+		a.Record(*entry)
+	})
+}
+
+func auditOutcome(status int) string {
+	switch {
+	case status < 400:
+		return auditSuccess
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return auditDenied
+	case status == http.StatusNotFound:
+		return auditNotFound
+	case status < 500:
+		return auditRejected
+	}
+	return auditError
+}
+
+func auditEntryFrom(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(auditKey{}).(*AuditEntry)
+	return entry
+}
+
+// auditPrincipal records who the request was authenticated as.
+func auditPrincipal(ctx context.Context, principal *Principal) {
+	if entry := auditEntryFrom(ctx); entry != nil {
+		entry.Principal = principal.Name
+		entry.AuthMethod = principal.Method
+	}
+}
+
+// auditProjects records projects the request touched, replacing the
+// project_id filter recorded by default.
+func auditProjects(ctx context.Context, projects ...string) {
+	entry := auditEntryFrom(ctx)
+	if entry == nil {
+		return
+	}
+	entry.ProjectIDs = nil
+	seen := make(map[string]bool)
+	for _, project := range projects {
+		if project != "" && !seen[project] {
+			seen[project] = true
+			entry.ProjectIDs = append(entry.ProjectIDs, project)
+		}
+	}
+}
+
+// auditTarget records what the request acted on when the route's URL
+// parameters don't say, such as the ID of a created alert.
+func auditTarget(ctx context.Context, target string) {
+	if entry := auditEntryFrom(ctx); entry != nil {
+		entry.Target = target
+	}
+}
+
+// auditDetail adds a detail to the request's audit entry.
+func auditDetail(ctx context.Context, key string, value interface{}) {
+	entry := auditEntryFrom(ctx)
+	if entry == nil {
+		return
+	}
+	if entry.details == nil {
+		entry.details = make(map[string]interface{})
+	}
+	entry.details[key] = value
+}
+
+const auditColumns = `seq, time, principal, auth_method, request_id, action, target, project_ids,
+	outcome, status_code, remote_addr, detail, prev_hash, hash`
+
+func scanAuditEntry(rows *sql.Rows) (AuditEntry, error) {
+	var entry AuditEntry
+	var projects pq.StringArray
+	var detail sql.NullString
+	err := rows.Scan(&entry.Seq, &entry.Time, &entry.Principal, &entry.AuthMethod, &entry.RequestID,
+		&entry.Action, &entry.Target, &projects, &entry.Outcome, &entry.StatusCode, &entry.RemoteAddr,
+		&detail, &entry.PrevHash, &entry.Hash)
+	entry.ProjectIDs = projects
+	if detail.Valid {
+		entry.Detail = json.RawMessage(detail.String)
+	}
+	return entry, err
+}
+
+// listAuditLog pages backwards through the audit trail. Filters: principal,
+// action, outcome, request_id, target, project_id, and since and until (RFC
+// 3339). Callers limited to some projects only see entries about those
+// projects. Pass the returned next_cursor as cursor for older entries.
+func (app *App) listAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := 100
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	var conditions []string
+	var args []interface{}
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	for _, column := range []string{"principal", "action", "outcome", "request_id", "target"} {
+		if value := query.Get(column); value != "" {
+			addCondition(column+" = $%d", value)
+		}
+	}
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+	if projects != nil {
+		addCondition("project_ids && $%d", pq.Array(projects))
+	}
+	for _, bound := range []struct{ param, condition string }{
+		{"since", "time >= $%d"},
+		{"until", "time < $%d"},
+	} {
+		value := query.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, bound.param+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		addCondition(bound.condition, t)
+	}
+	if value := query.Get("cursor"); value != "" {
+		seq, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		addCondition("seq < $%d", seq)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit+1)
+	rows, err := app.DB.Query(fmt.Sprintf(`
+		SELECT %s FROM audit_log %s ORDER BY seq DESC LIMIT $%d
+	`, auditColumns, where, len(args)), args...)
+	if err != nil {
+		http.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			http.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to list audit entries", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{"entries": entries}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		response["entries"] = entries
+		response["next_cursor"] = strconv.FormatInt(entries[limit-1].Seq, 10)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AuditVerification is the outcome of checking the hash chain.
+type AuditVerification struct {
+	Valid   bool   `json:"valid"`
+	Checked int64  `json:"checked"`
+	FromSeq int64  `json:"from_seq,omitempty"`
+	ToSeq   int64  `json:"to_seq,omitempty"`
+	Head    string `json:"head,omitempty"` // hash of the last entry checked
+	// The first entry that doesn't chain onto the one before it, or whose
+	// contents don't match its hash
+	BrokenAtSeq int64  `json:"broken_at_seq,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// verifyAuditLog recomputes the hash chain, from from_seq (default the
+// start) to to_seq (default the end). The first entry checked is trusted to
+// chain onto its predecessor; compare head against a copy kept elsewhere to
+// detect the log being rewritten wholesale.
+func (app *App) verifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	var bounds [2]int64
+	for i, param := range []string{"from_seq", "to_seq"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			seq, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || seq < 0 {
+				http.Error(w, param+" must be a non-negative integer", http.StatusBadRequest)
+				return
+			}
+			bounds[i] = seq
+		}
+	}
+
+	rows, err := app.DB.Query(`
+		SELECT `+auditColumns+` FROM audit_log
+		WHERE seq >= $1 AND ($2 = 0 OR seq <= $2)
+		ORDER BY seq
+	`, bounds[0], bounds[1])
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	result := AuditVerification{Valid: true}
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+			return
+		}
+		if !result.check(entry) {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// check adds the next entry in seq order to the verification and reports
+// whether the chain still holds. The first entry's prev_hash is trusted.
+func (result *AuditVerification) check(entry AuditEntry) bool {
+	prevHash := result.Head
+	if result.Checked == 0 {
+		result.FromSeq = entry.Seq
+		prevHash = entry.PrevHash
+	}
+	result.Checked++
+	result.ToSeq = entry.Seq
+
+	switch {
+	case entry.PrevHash != prevHash:
+		result.Reason = "prev_hash does not match the previous entry's hash"
+	case entry.chainHash(entry.PrevHash) != entry.Hash:
+		result.Reason = "contents do not match hash"
+	}
+	if result.Reason != "" {
+		result.Valid = false
+		result.BrokenAtSeq = entry.Seq
+		return false
+	}
+	result.Head = entry.Hash
+	return true
+}
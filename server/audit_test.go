@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testAuditEntry() AuditEntry {
+	return AuditEntry{
+		Time:       time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC),
+		Principal:  "soc-reader",
+		AuthMethod: "api_key",
+		RequestID:  "req-1",
+		Action:     "analysis.read",
+		Target:     "alert-1",
+		ProjectIDs: []string{"company-a"},
+		Outcome:    auditSuccess,
+		StatusCode: http.StatusOK,
+		RemoteAddr: "192.0.2.10:51234",
+		Detail:     json.RawMessage(`{"accepted":1}`),
+	}
+}
+
+// auditChain links n entries the way Auditor.append does, with seq
+// starting at 1.
+func auditChain(n int) []AuditEntry {
+	entries := make([]AuditEntry, n)
+	prevHash := ""
+	for i := range entries {
+		entry := testAuditEntry()
+		entry.Seq = int64(i + 1)
+		entry.Time = entry.Time.Add(time.Duration(i) * time.Second)
+		entry.Target = "alert-" + string(rune('a'+i))
+		entry.PrevHash = prevHash
+		entry.Hash = entry.chainHash(prevHash)
+		prevHash = entry.Hash
+		entries[i] = entry
+	}
+	return entries
+}
+
+func verifyEntries(entries []AuditEntry) AuditVerification {
+	result := AuditVerification{Valid: true}
+	for _, entry := range entries {
+		if !result.check(entry) {
+			break
+		}
+	}
+	return result
+}
+
+func TestChainHashCoversEveryField(t *testing.T) {
+	base := testAuditEntry()
+	hash := base.chainHash("prev")
+	if len(hash) != 64 || hash != base.chainHash("prev") {
+		t.Fatalf("chainHash = %q, want a stable hex SHA-256", hash)
+	}
+	if base.chainHash("other") == hash {
+		t.Error("chainHash ignores the previous hash")
+	}
+
+	changes := map[string]func(*AuditEntry){
+		"time":        func(e *AuditEntry) { e.Time = e.Time.Add(time.Microsecond) },
+		"principal":   func(e *AuditEntry) { e.Principal = "soc-admin" },
+		"auth_method": func(e *AuditEntry) { e.AuthMethod = "jwt" },
+		"request_id":  func(e *AuditEntry) { e.RequestID = "req-2" },
+		"action":      func(e *AuditEntry) { e.Action = "analysis.read_evidence" },
+		"target":      func(e *AuditEntry) { e.Target = "alert-2" },
+		"project_ids": func(e *AuditEntry) { e.ProjectIDs = []string{"company-b"} },
+		"outcome":     func(e *AuditEntry) { e.Outcome = auditDenied },
+		"status_code": func(e *AuditEntry) { e.StatusCode = http.StatusForbidden },
+		"remote_addr": func(e *AuditEntry) { e.RemoteAddr = "198.51.100.1:443" },
+		"detail":      func(e *AuditEntry) { e.Detail = json.RawMessage(`{"accepted":2}`) },
+	}
+	for field, change := range changes {
+		entry := testAuditEntry()
+		change(&entry)
+		if entry.chainHash("prev") == hash {
+			t.Errorf("changing %s leaves the hash unchanged", field)
+		}
+	}
+}
+
+func TestChainHashIgnoresStorageDetails(t *testing.T) {
+	base := testAuditEntry()
+	hash := base.chainHash("prev")
+
+	// The database assigns seq and may return times in its own zone
+	stored := testAuditEntry()
+	stored.Seq = 42
+	stored.Time = stored.Time.In(time.FixedZone("CEST", 2*60*60))
+	if stored.chainHash("prev") != hash {
+		t.Error("seq or time zone changes the hash")
+	}
+
+	// An empty project list reads back from Postgres as an empty array
+	empty, none := testAuditEntry(), testAuditEntry()
+	empty.ProjectIDs, none.ProjectIDs = []string{}, nil
+	if empty.chainHash("prev") != none.chainHash("prev") {
+		t.Error("empty and missing project lists hash differently")
+	}
+}
+
+func TestRecordKeepsHashStableThroughStorage(t *testing.T) {
+	auditor := NewAuditor(nil)
+	entry := testAuditEntry()
+	entry.Time = time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.FixedZone("CEST", 2*60*60))
+	entry.details = map[string]interface{}{"rejected": 3}
+	auditor.Record(entry)
+
+	recorded := <-auditor.entries
+	if recorded.Time.Nanosecond() != 123456000 || recorded.Time.Location() != time.UTC {
+		t.Errorf("recorded time = %v, want UTC truncated to microseconds", recorded.Time)
+	}
+	if string(recorded.Detail) != `{"rejected":3}` {
+		t.Errorf("recorded detail = %s", recorded.Detail)
+	}
+
+	// What Postgres returns must hash the same as what was written
+	stored := *recorded
+	stored.Time = time.Date(2024, 5, 1, 10, 0, 0, 123456000, time.UTC).In(time.Local)
+	if stored.chainHash("prev") != recorded.chainHash("prev") {
+		t.Error("hash changes once the entry is stored and read back")
+	}
+}
+
+func TestVerifyAuditChain(t *testing.T) {
+	entries := auditChain(5)
+
+	result := verifyEntries(entries)
+	want := AuditVerification{Valid: true, Checked: 5, FromSeq: 1, ToSeq: 5, Head: entries[4].Hash}
+	if result != want {
+		t.Errorf("verification = %+v, want %+v", result, want)
+	}
+
+	// Verifying a range trusts where its first entry says it chains from
+	result = verifyEntries(entries[2:])
+	if !result.Valid || result.FromSeq != 3 || result.Checked != 3 || result.Head != entries[4].Hash {
+		t.Errorf("range verification = %+v", result)
+	}
+
+	if result := verifyEntries(nil); !result.Valid || result.Checked != 0 {
+		t.Errorf("empty verification = %+v", result)
+	}
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]AuditEntry) []AuditEntry
+		seq    int64
+		reason string
+	}{
+		{"edited contents", func(entries []AuditEntry) []AuditEntry {
+			entries[2].Outcome = auditError
+			return entries
+		}, 3, "contents do not match hash"},
+		{"edited and rehashed", func(entries []AuditEntry) []AuditEntry {
+			entries[2].Principal = "someone-else"
+			entries[2].Hash = entries[2].chainHash(entries[2].PrevHash)
+			return entries
+		}, 4, "prev_hash does not match the previous entry's hash"},
+		{"deleted entry", func(entries []AuditEntry) []AuditEntry {
+			return append(entries[:1], entries[2:]...)
+		}, 3, "prev_hash does not match the previous entry's hash"},
+		{"reordered entries", func(entries []AuditEntry) []AuditEntry {
+			entries[1], entries[2] = entries[2], entries[1]
+			return entries
+		}, 3, "prev_hash does not match the previous entry's hash"},
+		{"edited last entry", func(entries []AuditEntry) []AuditEntry {
+			entries[4].Detail = nil
+			return entries
+		}, 5, "contents do not match hash"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := auditChain(5)
+			result := verifyEntries(tt.tamper(entries))
+			if result.Valid || result.BrokenAtSeq != tt.seq || result.Reason != tt.reason {
+				t.Errorf("verification = %+v, want broken at %d: %s", result, tt.seq, tt.reason)
+			}
+			// Head is the last entry that still verified
+			if tt.seq > 1 && result.Head == "" {
+				t.Error("head is empty after verified entries")
+			}
+		})
+	}
+}
+
+func TestVerifyAuditLogRejectsBadBounds(t *testing.T) {
+	app := &App{}
+	for _, query := range []string{"from_seq=abc", "to_seq=-1", "from_seq=1.5"} {
+		recorder := httptest.NewRecorder()
+		app.verifyAuditLog(recorder, httptest.NewRequest(http.MethodGet, "/audit/verify?"+query, nil))
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, recorder.Code)
+		}
+	}
+}
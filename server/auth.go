@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+// API scopes. admin implies the other two.
+const (
+	scopeIngest = "ingest"
+	scopeRead   = "read"
+	scopeAdmin  = "admin"
+)
+
+// allProjects in a key's or token's project list grants every project.
+const allProjects = "*"
+
+// Principal is the caller a request was authenticated as.
+type Principal struct {
+	Name     string   `json:"name"`   // API key name or JWT subject
+	Method   string   `json:"method"` // api_key, jwt or disabled
+	Scopes   []string `json:"scopes"`
+	Projects []string `json:"projects"`
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) AllProjects() bool {
+	for _, project := range p.Projects {
+		if project == allProjects {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) CanAccess(projectID string) bool {
+	if p.AllProjects() {
+		return true
+	}
+	for _, project := range p.Projects {
+		if project == projectID {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectFilter returns the projects to restrict queries to, or nil if the
+// principal may see every project. A principal with no projects gets an
+// empty, non-nil filter that matches nothing.
+func (p *Principal) ProjectFilter() []string {
+	if p.AllProjects() {
+		return nil
+	}
+	return append([]string{}, p.Projects...)
+}
+
+// requestProjects resolves an optional project_id filter against what the
+// principal may see: the one project if given and allowed, otherwise the
+// principal's filter. ok is false if the requested project isn't allowed.
+func requestProjects(r *http.Request) (projects []string, ok bool) {
+	principal := principalFrom(r.Context())
+	if projectID := r.URL.Query().Get("project_id"); projectID != "" {
+		return []string{projectID}, principal.CanAccess(projectID)
+	}
+	return principal.ProjectFilter(), true
+}
+
+type principalKey struct{}
+
+// principalFrom returns the request's principal. Routes outside the
+// authenticated groups have none, so handlers there must not call it.
+func principalFrom(ctx context.Context) *Principal {
+	return ctx.Value(principalKey{}).(*Principal)
+}
+
+// APIKey is one entry of the API keys file. Either key (usually a ${VAR}
+// reference) or key_sha256 identifies it; storing only the hash keeps the
+// file free of secrets.
+type APIKey struct {
+	Name      string   `yaml:"name"`
+	Key       string   `yaml:"key"`
+	KeySHA256 string   `yaml:"key_sha256"`
+	Scopes    []string `yaml:"scopes"`
+	Projects  []string `yaml:"projects"`
+}
+
+type apiKeysFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// Authenticator checks API keys from KeysPath and JWT bearer tokens signed
+// by a key in the JWKS at JWKSPath. Both files are optional and reloaded by
+// the caller; with neither loaded every request is refused. Disabled lets
+// every request through with full access, for local development only.
+type Authenticator struct {
+	mu   sync.RWMutex
+	keys map[string]*Principal // by hex SHA-256 of the key
+	jwks map[string]crypto.PublicKey
+
+	redis *redis.Client
+
+	KeysPath string
+	JWKSPath string
+	// Checked when set
+	Issuer   string
+	Audience string
+	// Claim listing the token's projects; scopes come from scope or scp
+	ProjectsClaim string
+	Disabled      bool
+}
+
+func NewAuthenticator(client *redis.Client, keysPath, jwksPath string) *Authenticator {
+	return &Authenticator{
+		redis:         client,
+		keys:          make(map[string]*Principal),
+		jwks:          make(map[string]crypto.PublicKey),
+		KeysPath:      keysPath,
+		JWKSPath:      jwksPath,
+		ProjectsClaim: "projects",
+	}
+}
+
+// LoadKeys replaces the API keys with the contents of KeysPath, keeping the
+// previous keys on any error.
+func (a *Authenticator) LoadKeys() error {
+	data, err := os.ReadFile(a.KeysPath)
+	if err != nil {
+		return fmt.Errorf("failed to read API keys %s: %v", a.KeysPath, err)
+	}
+
+	var file apiKeysFile
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &file); err != nil {
+		return fmt.Errorf("failed to parse API keys %s: %v", a.KeysPath, err)
+	}
+
+	keys := make(map[string]*Principal)
+	for i, key := range file.Keys {
+		if key.Name == "" {
+			return fmt.Errorf("API key %d has no name", i+1)
+		}
+		hash := strings.ToLower(key.KeySHA256)
+		if key.Key != "" {
+			hash = hashAPIKey(key.Key)
+		}
+		if len(hash) != sha256.Size*2 {
+			return fmt.Errorf("API key %s needs a key or a hex key_sha256", key.Name)
+		}
+		if _, exists := keys[hash]; exists {
+			return fmt.Errorf("API key %s duplicates another key", key.Name)
+		}
+		if err := validateGrants(key.Scopes, key.Projects); err != nil {
+			return fmt.Errorf("API key %s: %v", key.Name, err)
+		}
+		keys[hash] = &Principal{Name: key.Name, Method: "api_key", Scopes: key.Scopes, Projects: key.Projects}
+	}
+
+	a.mu.Lock()
+	a.keys = keys
+	a.mu.Unlock()
+
+	log.Printf("Loaded %d API keys from %s", len(keys), a.KeysPath)
+	return nil
+}
+
+func validateGrants(scopes, projects []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("no scopes")
+	}
+	for _, scope := range scopes {
+		if scope != scopeIngest && scope != scopeRead && scope != scopeAdmin {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	if len(projects) == 0 {
+		return fmt.Errorf("no projects; use %q for all", allProjects)
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// LoadJWKS replaces the token signing keys with the contents of JWKSPath,
+// keeping the previous keys on any error. Encryption keys are skipped.
+func (a *Authenticator) LoadJWKS() error {
+	data, err := os.ReadFile(a.JWKSPath)
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS %s: %v", a.JWKSPath, err)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to parse JWKS %s: %v", a.JWKSPath, err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return fmt.Errorf("JWKS key %d (%s): %v", i+1, jwk.Kid, err)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	a.mu.Lock()
+	a.jwks = keys
+	a.mu.Unlock()
+
+	log.Printf("Loaded %d token signing keys from %s", len(keys), a.JWKSPath)
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %v", err)
+		}
+		e, err := decode(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, errX := decode(jwk.X)
+		y, errY := decode(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid x or y")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := decode(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("only Ed25519 OKP keys are supported")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// Authenticate resolves the credentials on r: an X-API-Key header, or an
+// Authorization bearer value that is either a JWT or an API key.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if a.Disabled {
+		return &Principal{Name: "anonymous", Method: "disabled", Scopes: []string{scopeAdmin}, Projects: []string{allProjects}}, nil
+	}
+
+	credential := r.Header.Get("X-API-Key")
+	if credential == "" {
+		scheme, value, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, errUnauthenticated
+		}
+		credential = strings.TrimSpace(value)
+		// JWTs are three base64url segments; API keys contain no dots
+		if strings.Count(credential, ".") == 2 {
+			return a.verifyToken(credential)
+		}
+	}
+	if credential == "" {
+		return nil, errUnauthenticated
+	}
+
+	a.mu.RLock()
+	principal, ok := a.keys[hashAPIKey(credential)]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	return principal, nil
+}
+
+func (a *Authenticator) verifyToken(raw string) (*Principal, error) {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if a.Issuer != "" {
+		options = append(options, jwt.WithIssuer(a.Issuer))
+	}
+	if a.Audience != "" {
+		options = append(options, jwt.WithAudience(a.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := a.jwks[kid]; ok {
+			return key, nil
+		}
+		// A set with a single key needn't name it
+		if kid == "" && len(a.jwks) == 1 {
+			for _, key := range a.jwks {
+				return key, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}, options...)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+
+	subject, _ := claims.GetSubject()
+	principal := &Principal{
+		Name:     subject,
+		Method:   "jwt",
+		Projects: claimList(claims[a.ProjectsClaim]),
+	}
+	// Scopes we don't know belong to other services sharing the issuer
+	for _, scope := range append(claimList(claims["scope"]), claimList(claims["scp"])...) {
+		if scope == scopeIngest || scope == scopeRead || scope == scopeAdmin {
+			principal.Scopes = append(principal.Scopes, scope)
+		}
+	}
+	return principal, nil
+}
+
+// claimList reads a claim that is either a space-separated string or an
+// array of strings.
+func claimList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// Require authenticates every request and refuses those whose principal
+// lacks scope.
+func (a *Authenticator) Require(scope string) func(http.Handler) http.Handler {
+	return a.require(scope, false)
+}
+
+// RequireStream is Require for the event stream, which also accepts a
+// one-time ticket from POST /events/ticket since EventSource can't set
+// headers.
+func (a *Authenticator) RequireStream(scope string) func(http.Handler) http.Handler {
+	return a.require(scope, true)
+}
+
+func (a *Authenticator) require(scope string, allowTicket bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var principal *Principal
+			var err error
+			if ticket := r.URL.Query().Get("ticket"); allowTicket && ticket != "" {
+				principal, err = a.redeemTicket(r.Context(), ticket)
+			} else {
+				principal, err = a.Authenticate(r)
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="soc-ml"`)
+				writeValidationError(w, http.StatusUnauthorized, "unauthorized", "Missing or invalid credentials", nil)
+				return
+			}
+			auditPrincipal(r.Context(), principal)
+			if !principal.HasScope(scope) {
+				writeValidationError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("The %s scope is required", scope), nil)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+		})
+	}
+}
+
+// requireAllProjects refuses principals limited to some projects, for
+// endpoints whose data isn't divided by project.
+func requireAllProjects(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !principalFrom(r.Context()).AllProjects() {
+			writeValidationError(w, http.StatusForbidden, "forbidden", "This endpoint needs access to all projects", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streamTicketTTL is how long an event stream ticket may wait to be used.
+const streamTicketTTL = 30 * time.Second
+
+const streamTicketPrefix = "events-ticket:"
+
+// issueStreamTicket hands the caller a single-use ticket for GET /events.
+// Tickets rather than credentials go in the URL because URLs end up in logs.
+func (app *App) issueStreamTicket(w http.ResponseWriter, r *http.Request) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(secret)
+
+	principal := principalFrom(r.Context())
+	if err := app.Redis.Set(r.Context(), streamTicketPrefix+ticket, mustMarshal(principal), streamTicketTTL).Err(); err != nil {
+		http.Error(w, "Failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ticket":     ticket,
+		"expires_in": int(streamTicketTTL.Seconds()),
+	})
+}
+
+func (a *Authenticator) redeemTicket(ctx context.Context, ticket string) (*Principal, error) {
+	data, err := a.redis.GetDel(ctx, streamTicketPrefix+ticket).Bytes()
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	var principal Principal
+	if err := json.Unmarshal(data, &principal); err != nil {
+		return nil, errUnauthenticated
+	}
+	return &principal, nil
+}
+
+// runGenerateAPIKey implements the `gen-api-key` subcommand: it prints a new
+// random key and the hash to put in the API keys file.
+func runGenerateAPIKey() error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	key := "soc_" + base64.RawURLEncoding.EncodeToString(secret)
+	fmt.Printf("key:        %s\nkey_sha256: %s\n", key, hashAPIKey(key))
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testSigner is a private key together with its public JWK.
+type testSigner struct {
+	method jwt.SigningMethod
+	key    crypto.PrivateKey
+	jwk    map[string]string
+}
+
+func b64(data []byte) string { return base64.RawURLEncoding.EncodeToString(data) }
+
+func newRSASigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{jwt.SigningMethodRS256, key, map[string]string{
+		"kty": "RSA", "kid": kid, "use": "sig",
+		"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes()),
+	}}
+}
+
+func newECSigner(t *testing.T, kid string) testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{jwt.SigningMethodES256, key, map[string]string{
+		"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.Bytes()), "y": b64(key.Y.Bytes()),
+	}}
+}
+
+func newEd25519Signer(t *testing.T, kid string) testSigner {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testSigner{jwt.SigningMethodEdDSA, private, map[string]string{
+		"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(public),
+	}}
+}
+
+// sign issues a token with claims, naming the signer's kid unless it is
+// empty. Claims default to a valid subject and expiry.
+func (s testSigner) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	full := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}
+	for name, value := range claims {
+		if value == nil {
+			delete(full, name)
+		} else {
+			full[name] = value
+		}
+	}
+	token := jwt.NewWithClaims(s.method, full)
+	if kid := s.jwk["kid"]; kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// newJWKSAuthenticator loads the public keys of signers, plus any extra
+// JWKs, from a JWKS file.
+func newJWKSAuthenticator(t *testing.T, signers []testSigner, extra ...map[string]string) *Authenticator {
+	t.Helper()
+	var keys []map[string]string
+	for _, signer := range signers {
+		keys = append(keys, signer.jwk)
+	}
+	keys = append(keys, extra...)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, mustMarshal(map[string]interface{}{"keys": keys}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a := NewAuthenticator(nil, "", path)
+	if err := a.LoadJWKS(); err != nil {
+		t.Fatalf("LoadJWKS: %v", err)
+	}
+	return a
+}
+
+func TestVerifyTokenKeyTypes(t *testing.T) {
+	signers := []testSigner{newRSASigner(t, "rsa"), newECSigner(t, "ec"), newEd25519Signer(t, "ed")}
+	a := newJWKSAuthenticator(t, signers)
+	for _, signer := range signers {
+		t.Run(signer.method.Alg(), func(t *testing.T) {
+			principal, err := a.verifyToken(signer.sign(t, nil))
+			if err != nil {
+				t.Fatalf("verifyToken: %v", err)
+			}
+			if principal.Name != "alice" || principal.Method != "jwt" {
+				t.Errorf("principal = %+v", principal)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenClaims(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	a := newJWKSAuthenticator(t, []testSigner{signer})
+
+	principal, err := a.verifyToken(signer.sign(t, jwt.MapClaims{
+		"scope":    "read openid ingest",
+		"scp":      []interface{}{"admin", "profile"},
+		"projects": []interface{}{"company-a", "company-b"},
+	}))
+	if err != nil {
+		t.Fatalf("verifyToken: %v", err)
+	}
+	if want := []string{scopeRead, scopeIngest, scopeAdmin}; !reflect.DeepEqual(principal.Scopes, want) {
+		t.Errorf("scopes = %v, want %v", principal.Scopes, want)
+	}
+	if want := []string{"company-a", "company-b"}; !reflect.DeepEqual(principal.Projects, want) {
+		t.Errorf("projects = %v, want %v", principal.Projects, want)
+	}
+
+	a.ProjectsClaim = "tenants"
+	principal, err = a.verifyToken(signer.sign(t, jwt.MapClaims{"tenants": "company-c *"}))
+	if err != nil {
+		t.Fatalf("verifyToken: %v", err)
+	}
+	if want := []string{"company-c", allProjects}; !reflect.DeepEqual(principal.Projects, want) {
+		t.Errorf("projects from %s = %v, want %v", a.ProjectsClaim, principal.Projects, want)
+	}
+}
+
+func TestVerifyTokenRejections(t *testing.T) {
+	signer := newRSASigner(t, "rsa")
+	other := newRSASigner(t, "rsa")
+	a := newJWKSAuthenticator(t, []testSigner{signer})
+	a.Issuer = "https://idp.example.com"
+	a.Audience = "soc-ml"
+	valid := jwt.MapClaims{"iss": a.Issuer, "aud": a.Audience}
+	with := func(changes jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		for name, value := range changes {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	if _, err := a.verifyToken(signer.sign(t, valid)); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+
+	unknownKid := signer
+	unknownKid.jwk = map[string]string{"kid": "other"}
+	hmacToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, with(nil)).SignedString([]byte("secret"))
+	noneToken, _ := jwt.NewWithClaims(jwt.SigningMethodNone, with(nil)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"expired", signer.sign(t, with(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))},
+		{"without expiry", signer.sign(t, with(jwt.MapClaims{"exp": nil}))},
+		{"not yet valid", signer.sign(t, with(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()}))},
+		{"wrong issuer", signer.sign(t, with(jwt.MapClaims{"iss": "https://evil.example.com"}))},
+		{"wrong audience", signer.sign(t, with(jwt.MapClaims{"aud": "other-service"}))},
+		{"unknown kid", unknownKid.sign(t, with(nil))},
+		{"signed by another key", other.sign(t, with(nil))},
+		{"HMAC", hmacToken},
+		{"unsigned", noneToken},
+		{"garbage", "not.a.token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.verifyToken(tt.token)
+			if err == nil {
+				t.Fatalf("verifyToken accepted the token as %+v", principal)
+			}
+			if !strings.Contains(err.Error(), errUnauthenticated.Error()) {
+				t.Errorf("error %v does not wrap errUnauthenticated", err)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenWithoutKid(t *testing.T) {
+	first, second := newRSASigner(t, "first"), newECSigner(t, "second")
+	anonymous := first
+	anonymous.jwk = map[string]string{}
+
+	single := newJWKSAuthenticator(t, []testSigner{first})
+	if _, err := single.verifyToken(anonymous.sign(t, nil)); err != nil {
+		t.Errorf("token without kid rejected by a single-key set: %v", err)
+	}
+
+	multiple := newJWKSAuthenticator(t, []testSigner{first, second})
+	if _, err := multiple.verifyToken(anonymous.sign(t, nil)); err == nil {
+		t.Error("token without kid accepted by a set with several keys")
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	signer := newRSASigner(t, "sig")
+	encryption := newRSASigner(t, "enc").jwk
+	encryption["use"] = "enc"
+	a := newJWKSAuthenticator(t, []testSigner{signer}, encryption)
+	if len(a.jwks) != 1 || a.jwks["sig"] == nil {
+		t.Errorf("loaded keys %v, want only the signing key", a.jwks)
+	}
+
+	for _, content := range []string{
+		`{"keys": [`,
+		`{"keys": [{"kty": "oct", "kid": "k", "k": "c2VjcmV0"}]}`,
+		`{"keys": [{"kty": "EC", "kid": "k", "crv": "P-192", "x": "AA", "y": "AA"}]}`,
+		`{"keys": [{"kty": "OKP", "kid": "k", "crv": "X25519", "x": "AA"}]}`,
+		`{"keys": [{"kty": "RSA", "kid": "k", "n": "!!", "e": "AQAB"}]}`,
+		`{"keys": [{"kty": "RSA", "kid": "k", "n": "AQAB", "e": ""}]}`,
+	} {
+		if err := os.WriteFile(a.JWKSPath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.LoadJWKS(); err == nil {
+			t.Errorf("LoadJWKS accepted %s", content)
+		}
+	}
+	// A bad file keeps the keys loaded before it
+	if _, err := a.verifyToken(signer.sign(t, nil)); err != nil {
+		t.Errorf("previous keys lost after failed reloads: %v", err)
+	}
+}
+
+func TestAuthenticateBearerToken(t *testing.T) {
+	signer := newEd25519Signer(t, "ed")
+	a := newJWKSAuthenticator(t, []testSigner{signer})
+
+	request := httptest.NewRequest("GET", "/alerts", nil)
+	request.Header.Set("Authorization", "Bearer "+signer.sign(t, jwt.MapClaims{"scope": "read", "projects": "company-a"}))
+	principal, err := a.Authenticate(request)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if !principal.HasScope(scopeRead) || !principal.CanAccess("company-a") || principal.CanAccess("company-b") {
+		t.Errorf("principal = %+v", principal)
+	}
+
+	request.Header.Set("Authorization", "Bearer "+signer.sign(t, jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}))
+	if _, err := a.Authenticate(request); err == nil {
+		t.Error("expired bearer token accepted")
+	}
+}
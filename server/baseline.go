@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// defaultBaselineMinEvents is how many events a user needs before their
+	// baseline is trusted for scoring.
+	defaultBaselineMinEvents = 20
+
+	// baselineRateBuckets is how many hourly buckets feed the request rate.
+	baselineRateBuckets = 7 * 24
+
+	// baselineLogTTL is how long learned log IDs are remembered so that
+	// overlapping analysis windows don't count the same log twice.
+	baselineLogTTL = 48 * time.Hour
+)
+
+// UserBaseline is the learned behavioural profile of one user within a
+// project.
+type UserBaseline struct {
+	UserIdentifier string         `json:"user_identifier"`
+	EventCount     int            `json:"event_count"`
+	FirstSeen      time.Time      `json:"first_seen"`
+	LastSeen       time.Time      `json:"last_seen"`
+	Countries      map[string]int `json:"countries"`
+	IPPrefixes     map[string]int `json:"ip_prefixes"`
+	Hours          [24]int        `json:"hours"`
+	UserAgents     map[string]int `json:"user_agents"`
+	HourlyCounts   map[string]int `json:"hourly_counts"` // "2006-01-02T15" -> events
+}
+
+// BaselineDeviation describes one way the current activity differs from the
+// user's baseline. Score is 0 (normal) to 1 (never seen before).
+type BaselineDeviation struct {
+	Feature string  `json:"feature"`
+	Value   string  `json:"value"`
+	Score   float64 `json:"score"`
+	Detail  string  `json:"detail"`
+}
+
+type BaselineScore struct {
+	UserIdentifier string              `json:"user_identifier"`
+	Status         string              `json:"status"` // "scored" or "learning"
+	AnomalyScore   float64             `json:"anomaly_score"`
+	EventsScored   int                 `json:"events_scored"`
+	BaselineEvents int                 `json:"baseline_events"`
+	Deviations     []BaselineDeviation `json:"deviations"`
+}
+
+// baselineFeatureWeights combine per-feature deviations into AnomalyScore.
+var baselineFeatureWeights = map[string]float64{
+	"country":      0.3,
+	"ip_prefix":    0.2,
+	"hour_of_day":  0.15,
+	"user_agent":   0.15,
+	"request_rate": 0.2,
+}
+
+type BaselineEngine struct {
+	db    *sql.DB
+	redis *redis.Client
+
+	MinEvents int
+}
+
+func NewBaselineEngine(db *sql.DB, redisClient *redis.Client) *BaselineEngine {
+	return &BaselineEngine{db: db, redis: redisClient, MinEvents: defaultBaselineMinEvents}
+}
+
+func newUserBaseline(user string) *UserBaseline {
+	return &UserBaseline{
+		UserIdentifier: user,
+		Countries:      make(map[string]int),
+		IPPrefixes:     make(map[string]int),
+		UserAgents:     make(map[string]int),
+		HourlyCounts:   make(map[string]int),
+	}
+}
+
+// ipPrefix groups addresses into the /24 (IPv4) or /48 (IPv6) they belong to.
+func ipPrefix(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// userActivity selects the logs attributable to each user: logs naming the
+// user directly, plus logs whose client IP is correlated to the user with
+// high confidence.
+func userActivity(logs []NormalizedLog, correlations []UserCorrelation) map[string][]NormalizedLog {
+	userIPs := make(map[string]map[string]bool)
+	for _, correlation := range correlations {
+		if correlation.ConfidenceScore <= 0.7 {
+			continue
+		}
+		if userIPs[correlation.UserIdentifier] == nil {
+			userIPs[correlation.UserIdentifier] = make(map[string]bool)
+		}
+		userIPs[correlation.UserIdentifier][correlation.IPAddress] = true
+	}
+
+	activity := make(map[string][]NormalizedLog)
+	for _, log := range logs {
+		users := make(map[string]bool)
+		for _, email := range log.UserEmails {
+			users[email] = true
+		}
+		if ip := log.ClientIP(); ip != "" {
+			for user, ips := range userIPs {
+				if ips[ip] {
+					users[user] = true
+				}
+			}
+		}
+		for user := range users {
+			activity[user] = append(activity[user], log)
+		}
+	}
+	return activity
+}
+
+func (be *BaselineEngine) load(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, projectID, user string, forUpdate bool) (*UserBaseline, error) {
+	query := `SELECT profile FROM user_baselines WHERE project_id = $1 AND user_identifier = $2`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	var profileJSON []byte
+	err := q.QueryRow(query, projectID, user).Scan(&profileJSON)
+	if err == sql.ErrNoRows {
+		return newUserBaseline(user), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	baseline := newUserBaseline(user)
+	if err := json.Unmarshal(profileJSON, baseline); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal baseline for %s: %v", user, err)
+	}
+	return baseline, nil
+}
+
+// Score compares a user's activity in the analysis window with their stored
+// baseline in the project.
+func (be *BaselineEngine) Score(projectID, user string, logs []NormalizedLog) (*BaselineScore, error) {
+	baseline, err := be.load(be.db, projectID, user, false)
+	if err != nil {
+		return nil, err
+	}
+
+	score := &BaselineScore{
+		UserIdentifier: user,
+		EventsScored:   len(logs),
+		BaselineEvents: baseline.EventCount,
+		Deviations:     []BaselineDeviation{},
+	}
+	if baseline.EventCount < be.MinEvents {
+		score.Status = "learning"
+		return score, nil
+	}
+	score.Status = "scored"
+
+	worst := make(map[string]BaselineDeviation)
+	consider := func(deviation BaselineDeviation) {
+		if deviation.Score > worst[deviation.Feature].Score {
+			worst[deviation.Feature] = deviation
+		}
+	}
+
+	frequencyDeviation := func(feature, value string, counts map[string]int) {
+		if value == "" {
+			return
+		}
+		total := 0
+		for _, c := range counts {
+			total += c
+		}
+		if total == 0 {
+			return
+		}
+		share := float64(counts[value]) / float64(total)
+		consider(BaselineDeviation{
+			Feature: feature,
+			Value:   value,
+			Score:   1 - math.Min(1, share*5), // anything above 20% of history is normal
+			Detail:  fmt.Sprintf("%d of %d baseline events", counts[value], total),
+		})
+	}
+
+	expectedPerHour := float64(baseline.EventCount) / 24
+	for _, log := range logs {
+		frequencyDeviation("country", log.Country, baseline.Countries)
+		frequencyDeviation("ip_prefix", ipPrefix(log.ClientIP()), baseline.IPPrefixes)
+		for _, agent := range entityValues(log, EntityUserAgent) {
+			frequencyDeviation("user_agent", agent, baseline.UserAgents)
+		}
+
+		hour := log.Timestamp.UTC().Hour()
+		consider(BaselineDeviation{
+			Feature: "hour_of_day",
+			Value:   fmt.Sprintf("%02d:00 UTC", hour),
+			Score:   math.Max(0, 1-float64(baseline.Hours[hour])/expectedPerHour),
+			Detail:  fmt.Sprintf("%d baseline events in this hour, %.1f expected", baseline.Hours[hour], expectedPerHour),
+		})
+	}
+
+	if rateDeviation, ok := be.rateDeviation(baseline, logs); ok {
+		consider(rateDeviation)
+	}
+
+	features := make([]string, 0, len(worst))
+	for feature := range worst {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	for _, feature := range features {
+		deviation := worst[feature]
+		score.AnomalyScore += baselineFeatureWeights[feature] * deviation.Score
+		if deviation.Score > 0 {
+			score.Deviations = append(score.Deviations, deviation)
+		}
+	}
+	score.AnomalyScore = math.Round(score.AnomalyScore*1000) / 1000
+
+	return score, nil
+}
+
+// rateDeviation z-scores the user's events per hour in the window against
+// the hourly buckets of the last week.
+func (be *BaselineEngine) rateDeviation(baseline *UserBaseline, logs []NormalizedLog) (BaselineDeviation, bool) {
+	if len(logs) == 0 || len(baseline.HourlyCounts) < 2 {
+		return BaselineDeviation{}, false
+	}
+
+	first, last := logs[0].Timestamp, logs[0].Timestamp
+	for _, log := range logs {
+		first = minTime(first, log.Timestamp)
+		last = maxTime(last, log.Timestamp)
+	}
+	hours := math.Max(last.Sub(first).Hours(), 0.5)
+	rate := float64(len(logs)) / hours
+
+	// Hours without activity count as zero-rate samples
+	span := math.Min(baselineRateBuckets, math.Max(1, baseline.LastSeen.Sub(baseline.FirstSeen).Hours()+1))
+	sum, sumSquares := 0.0, 0.0
+	for _, count := range baseline.HourlyCounts {
+		sum += float64(count)
+		sumSquares += float64(count) * float64(count)
+	}
+	mean := sum / span
+	variance := math.Max(sumSquares/span-mean*mean, 1)
+	z := (rate - mean) / math.Sqrt(variance)
+
+	return BaselineDeviation{
+		Feature: "request_rate",
+		Value:   fmt.Sprintf("%.1f/h", rate),
+		Score:   math.Min(1, math.Max(0, z/4)),
+		Detail:  fmt.Sprintf("baseline %.1f/h (z=%.1f)", mean, z),
+	}, true
+}
+
+func baselineLogKey(projectID, user, logID string) string {
+	return "baseline:" + projectID + ":" + user + ":" + logID
+}
+
+// Learn folds the user's logs into their baseline in the project. Logs
+// already learned from an earlier, overlapping analysis window are skipped.
+// A log only counts as learned once the baseline holding it is committed;
+// until then it is claimed, and the claims are given up if the update fails
+// so the next analysis learns it instead.
+func (be *BaselineEngine) Learn(projectID, user string, logs []NormalizedLog) (err error) {
+	ctx := context.Background()
+
+	var fresh []NormalizedLog
+	var claimed []string
+	defer func() {
+		if err != nil && len(claimed) > 0 {
+			if releaseErr := be.redis.Del(ctx, claimed...).Err(); releaseErr != nil {
+				log.Printf("Failed to release learned logs of %s: %v", user, releaseErr)
+			}
+		}
+	}()
+	for _, log := range logs {
+		key := baselineLogKey(projectID, user, log.ID)
+		isNew, err := be.redis.SetNX(ctx, key, 1, baselineLogTTL).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check learned logs: %v", err)
+		}
+		if isNew {
+			fresh = append(fresh, log)
+			claimed = append(claimed, key)
+		}
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	tx, err := be.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to start baseline update: %v", err)
+	}
+	defer tx.Rollback()
+
+	baseline, err := be.load(tx, projectID, user, true)
+	if err != nil {
+		return err
+	}
+
+	for _, log := range fresh {
+		if baseline.EventCount == 0 || log.Timestamp.Before(baseline.FirstSeen) {
+			baseline.FirstSeen = log.Timestamp
+		}
+		if log.Timestamp.After(baseline.LastSeen) {
+			baseline.LastSeen = log.Timestamp
+		}
+		baseline.EventCount++
+		if log.Country != "" {
+			baseline.Countries[log.Country]++
+		}
+		if prefix := ipPrefix(log.ClientIP()); prefix != "" {
+			baseline.IPPrefixes[prefix]++
+		}
+		for _, agent := range entityValues(log, EntityUserAgent) {
+			baseline.UserAgents[agent]++
+		}
+		baseline.Hours[log.Timestamp.UTC().Hour()]++
+		baseline.HourlyCounts[log.Timestamp.UTC().Format("2006-01-02T15")]++
+	}
+
+	// Keep only the most recent hourly buckets
+	if len(baseline.HourlyCounts) > baselineRateBuckets {
+		buckets := make([]string, 0, len(baseline.HourlyCounts))
+		for bucket := range baseline.HourlyCounts {
+			buckets = append(buckets, bucket)
+		}
+		sort.Strings(buckets)
+		for _, bucket := range buckets[:len(buckets)-baselineRateBuckets] {
+			delete(baseline.HourlyCounts, bucket)
+		}
+	}
+
+	profileJSON, err := json.Marshal(baseline)
+	if err != nil {
+		return fmt.Errorf("failed to marshal baseline: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO user_baselines (project_id, user_identifier, profile, event_count, updated_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (project_id, user_identifier)
+		DO UPDATE SET profile = $3, event_count = $4, updated_at = NOW()
+	`, projectID, user, profileJSON, baseline.EventCount)
+	if err != nil {
+		return fmt.Errorf("failed to store baseline: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to store baseline: %v", err)
+	}
+	return nil
+}
+
+// scoreUserBehaviour scores every user involved in the analysis against their
+// baseline in the alert's project before learning from the window, so the
+// alert's own activity doesn't mask itself. Failures come back as warnings.
+func (app *App) scoreUserBehaviour(projectID string, correlationResult *CorrelationResult) (map[string]*BaselineScore, []string) {
+	scores := make(map[string]*BaselineScore)
+	var warnings []string
+	for user, logs := range userActivity(correlationResult.RelatedLogs, correlationResult.UserCorrelations) {
+		score, err := app.Baselines.Score(projectID, user, logs)
+		if err != nil {
+			log.Printf("Failed to score baseline for %s: %v", user, err)
+			warnings = append(warnings, fmt.Sprintf("baseline scoring failed for %s: %v", user, err))
+			continue
+		}
+		scores[user] = score
+
+		if err := app.Baselines.Learn(projectID, user, logs); err != nil {
+			log.Printf("Failed to update baseline for %s: %v", user, err)
+			warnings = append(warnings, fmt.Sprintf("baseline update failed for %s: %v", user, err))
+		}
+	}
+	return scores, warnings
+}
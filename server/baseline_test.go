@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestIPPrefix(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.7":          "203.0.113.0/24",
+		"::ffff:203.0.113.7":   "203.0.113.0/24",
+		"2001:db8:1:2::abcd":   "2001:db8:1::/48",
+		"not an address":       "",
+		"":                     "",
+		"2001:db8:ffff:1234::": "2001:db8:ffff::/48",
+	}
+	for ip, want := range tests {
+		if got := ipPrefix(ip); got != want {
+			t.Errorf("ipPrefix(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestUserActivityFollowsClientIP(t *testing.T) {
+	correlations := []UserCorrelation{
+		{UserIdentifier: "alice@example.com", IPAddress: "203.0.113.7", ConfidenceScore: 0.9},
+		{UserIdentifier: "bob@example.com", IPAddress: "198.51.100.80", ConfidenceScore: 0.9},
+		{UserIdentifier: "carol@example.com", IPAddress: "192.0.2.5", ConfidenceScore: 0.5},
+	}
+	logs := []NormalizedLog{
+		// The edge address 198.51.100.80 is in every line but is bob's
+		// client address only in log-3
+		{ID: "log-1", IPAddresses: []string{"203.0.113.7", "198.51.100.80"}, RawData: map[string]interface{}{"clientIP": "203.0.113.7"}},
+		{ID: "log-2", UserEmails: []string{"dave@example.com"}, IPAddresses: []string{"192.0.2.5", "198.51.100.80"}, RawData: map[string]interface{}{"clientIP": "192.0.2.5"}},
+		{ID: "log-3", IPAddresses: []string{"198.51.100.80"}, RawData: map[string]interface{}{"clientIP": "198.51.100.80"}},
+	}
+
+	activity := userActivity(logs, correlations)
+	want := map[string][]string{
+		"alice@example.com": {"log-1"},
+		"bob@example.com":   {"log-3"},
+		"dave@example.com":  {"log-2"},
+	}
+	if len(activity) != len(want) {
+		t.Fatalf("activity for %d users, want %d: %v", len(activity), len(want), activity)
+	}
+	for user, ids := range want {
+		got := activity[user]
+		if len(got) != len(ids) {
+			t.Errorf("%s: %d logs, want %v", user, len(got), ids)
+			continue
+		}
+		for i, id := range ids {
+			if got[i].ID != id {
+				t.Errorf("%s log %d = %s, want %s", user, i, got[i].ID, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Limits on POST /alerts/batch. Each item is also held to maxAlertBody.
+const (
+	maxBatchBody  = 10 << 20
+	maxBatchItems = 1000
+)
+
+// BatchItemResult is what happened to one alert in a batch. Index is the
+// item's position in the array, or among the non-blank NDJSON lines.
+type BatchItemResult struct {
+	Index          int          `json:"index"`
+	Status         string       `json:"status"` // accepted, duplicate, suppressed or rejected
+	AlertID        string       `json:"alert_id,omitempty"`
+	DuplicateCount int64        `json:"duplicate_count,omitempty"`
+	SuppressionID  string       `json:"suppression_id,omitempty"`
+	Error          string       `json:"error,omitempty"` // rejected only, with the same codes as ValidationError
+	Message        string       `json:"message,omitempty"`
+	Fields         []FieldError `json:"fields,omitempty"`
+}
+
+// BatchResult is the body of a POST /alerts/batch response.
+type BatchResult struct {
+	Accepted   int               `json:"accepted"`
+	Duplicate  int               `json:"duplicate"`
+	Suppressed int               `json:"suppressed"`
+	Rejected   int               `json:"rejected"`
+	Results    []BatchItemResult `json:"results"`
+}
+
+// batchStatuses folds acceptAlert's outcomes into the batch vocabulary.
+// Resubmissions and repeats both point at an earlier alert.
+var batchStatuses = map[string]string{
+	"queued_for_analysis": "accepted",
+	"already_received":    "duplicate",
+	"duplicate":           "duplicate",
+	"suppressed":          "suppressed",
+}
+
+// handleAlertBatch accepts a JSON array of POST /alerts bodies, or the same
+// objects as NDJSON. Every item is validated on its own and the valid ones
+// are accepted together; a bad item is reported as rejected without failing
+// the rest. Only a body that can't be split into items fails as a whole.
+func (app *App) handleAlertBatch(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBatchBody+1))
+	if err != nil {
+		writeValidationError(w, http.StatusBadRequest, "invalid_body", "Failed to read request body", nil)
+		return
+	}
+	if len(body) > maxBatchBody {
+		writeValidationError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("Request body exceeds %d bytes", maxBatchBody), nil)
+		return
+	}
+
+	items, err := splitBatch(body)
+	if err != nil {
+		writeValidationError(w, http.StatusBadRequest, "invalid_json", err.Error(), nil)
+		return
+	}
+	if len(items) > maxBatchItems {
+		writeValidationError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("Batch has %d alerts, the limit is %d", len(items), maxBatchItems), nil)
+		return
+	}
+
+	principal := principalFrom(r.Context())
+	receivedAt := time.Now()
+	response := BatchResult{Results: make([]BatchItemResult, len(items))}
+	var alerts []Alert
+	var positions []int
+	var projects []string
+	for i, item := range items {
+		response.Results[i] = BatchItemResult{Index: i}
+		if len(item) > maxAlertBody {
+			response.Results[i].reject("body_too_large", fmt.Sprintf("Alert exceeds %d bytes", maxAlertBody), nil)
+			continue
+		}
+		request, fields, err := parseAlertRequest(item, "", receivedAt)
+		if request != nil {
+			projects = append(projects, request.ProjectID)
+		}
+		switch {
+		case err != nil:
+			response.Results[i].reject("invalid_json", err.Error(), nil)
+		case len(fields) > 0:
+			response.Results[i].reject("validation_failed", "Alert failed validation", fields)
+		case !principal.CanAccess(request.ProjectID):
+			response.Results[i].reject("forbidden", "Not allowed to submit alerts for this project", nil)
+		default:
+			alerts = append(alerts, request.Alert(receivedAt))
+			positions = append(positions, i)
+		}
+	}
+
+	auditProjects(r.Context(), projects...)
+
+	if len(alerts) > 0 {
+		results, errs := app.acceptAlerts(r.Context(), alerts)
+		for j, i := range positions {
+			if errs[j] != nil {
+				log.Printf("Failed to accept batch alert %d: %v", i, errs[j])
+				response.Results[i].reject("internal_error", "Failed to queue analysis", nil)
+				continue
+			}
+			item := &response.Results[i]
+			item.Status = batchStatuses[results[j].Status]
+			item.AlertID = results[j].AlertID
+			item.DuplicateCount = results[j].DuplicateCount
+			item.SuppressionID = results[j].SuppressionID
+		}
+	}
+
+	for _, item := range response.Results {
+		switch item.Status {
+		case "accepted":
+			response.Accepted++
+		case "duplicate":
+			response.Duplicate++
+		case "suppressed":
+			response.Suppressed++
+		case "rejected":
+			response.Rejected++
+		}
+	}
+
+	auditDetail(r.Context(), "accepted", response.Accepted)
+	auditDetail(r.Context(), "duplicate", response.Duplicate)
+	auditDetail(r.Context(), "suppressed", response.Suppressed)
+	auditDetail(r.Context(), "rejected", response.Rejected)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (item *BatchItemResult) reject(code, message string, fields []FieldError) {
+	item.Status = "rejected"
+	item.Error = code
+	item.Message = message
+	item.Fields = fields
+}
+
+// splitBatch returns the items of a JSON array, or the non-blank lines of an
+// NDJSON body. NDJSON lines are left for parseAlertRequest to judge, so one
+// malformed line only rejects that item.
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, fmt.Errorf("Batch is empty")
+	}
+
+	if trimmed[0] == '[' {
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, fmt.Errorf("Invalid JSON array: %v", err)
+		}
+		return items, nil
+	}
+
+	var items []json.RawMessage
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			items = append(items, json.RawMessage(line))
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		items []string
+	}{
+		{"array", `[{"source":"a"}, {"source":"b"}]`, []string{`{"source":"a"}`, `{"source":"b"}`}},
+		{"array with surrounding space", "\n  [ {\"source\":\"a\"} ]\n", []string{`{"source":"a"}`}},
+		{"empty array", `[]`, []string{}},
+		{"array keeps non-objects for the parser to reject", `[{"source":"a"}, 42, "x"]`, []string{`{"source":"a"}`, `42`, `"x"`}},
+		{"ndjson", "{\"source\":\"a\"}\n{\"source\":\"b\"}\n", []string{`{"source":"a"}`, `{"source":"b"}`}},
+		{"ndjson skips blank lines and CRLF", "{\"source\":\"a\"}\r\n\r\n  \n{\"source\":\"b\"}\r\n", []string{`{"source":"a"}`, `{"source":"b"}`}},
+		{"ndjson keeps a malformed line", "{\"source\":\"a\"}\n{\"source\":\n{\"source\":\"c\"}", []string{`{"source":"a"}`, `{"source":`, `{"source":"c"}`}},
+		{"single object", `{"source":"a"}`, []string{`{"source":"a"}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			items, err := splitBatch([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("splitBatch: %v", err)
+			}
+			if len(items) != len(tt.items) {
+				t.Fatalf("got %d items %q, want %d", len(items), items, len(tt.items))
+			}
+			for i, item := range items {
+				if !jsonEqual(t, item, tt.items[i]) {
+					t.Errorf("item %d = %s, want %s", i, item, tt.items[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSplitBatchRejectsUnsplittableBodies(t *testing.T) {
+	for _, body := range []string{"", " \n\t ", `[{"source":"a"}`, `[{"source":"a"},]`} {
+		if items, err := splitBatch([]byte(body)); err == nil {
+			t.Errorf("splitBatch(%q) = %q, want an error", body, items)
+		}
+	}
+}
+
+// jsonEqual compares JSON texts, or raw text when want is not valid JSON.
+func jsonEqual(t *testing.T, got json.RawMessage, want string) bool {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if json.Unmarshal([]byte(want), &wantValue) != nil {
+		return string(got) == want
+	}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		return false
+	}
+	return string(mustMarshal(gotValue)) == string(mustMarshal(wantValue))
+}
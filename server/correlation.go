@@ -2,12 +2,38 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxEvidencePerCorrelation bounds how many evidence entries are kept for a
+// single user/IP pair, both in memory and in user_correlations.evidence.
+const maxEvidencePerCorrelation = 20
+
+// maxHistoricalUserCorrelations caps how many stored user-IP links are loaded
+// per analysis, newest first.
+const maxHistoricalUserCorrelations = 500
+
+const (
+	// defaultConfidenceHalfLife is how long it takes a historical correlation
+	// to lose half of its confidence when it is not observed again.
+	defaultConfidenceHalfLife = 30 * 24 * time.Hour
+
+	// minHistoricalConfidence drops historical correlations that have decayed
+	// below this score instead of reporting them.
+	minHistoricalConfidence = 0.1
 )
 
 type CorrelationEngine struct {
 	db *sql.DB
+
+	// HalfLife controls the decay of historical correlations by last_seen age.
+	HalfLife time.Duration
 }
 
 type UserCorrelation struct {
@@ -18,14 +44,35 @@ type UserCorrelation struct {
 	ConfidenceScore float64   `json:"confidence_score"`
 	SourceSystems   []string  `json:"source_systems"`
 	CorrelationType string    `json:"correlation_type"`
+
+	// Historical correlations are re-scored at query time; these carry the
+	// stored peak score and how often the pair has been seen.
+	ObservationCount   int     `json:"observation_count,omitempty"`
+	RawConfidenceScore float64 `json:"raw_confidence_score,omitempty"`
+
+	Evidence []CorrelationEvidence `json:"evidence"`
+}
+
+// CorrelationEvidence records which normalized logs produced a correlation and
+// which attributes matched between them.
+type CorrelationEvidence struct {
+	LogIDs            []string          `json:"log_ids"`
+	Timestamps        []time.Time       `json:"timestamps"`
+	Sources           []string          `json:"sources"`
+	TimeDeltaMs       int64             `json:"time_delta_ms"`
+	MatchedAttributes map[string]string `json:"matched_attributes"`
 }
 
 type CorrelationResult struct {
-	PrimaryLog       *NormalizedLog    `json:"primary_log"`
-	RelatedLogs      []NormalizedLog   `json:"related_logs"`
-	UserCorrelations []UserCorrelation `json:"user_correlations"`
-	TimeWindow       TimeWindow        `json:"time_window"`
-	CorrelationScore float64           `json:"correlation_score"`
+	PrimaryLog         *NormalizedLog      `json:"primary_log"`
+	RelatedLogs        []NormalizedLog     `json:"related_logs"`
+	UserCorrelations   []UserCorrelation   `json:"user_correlations"`
+	EntityCorrelations []EntityCorrelation `json:"entity_correlations"`
+	TimeWindow         TimeWindow          `json:"time_window"`
+	CorrelationScore   float64             `json:"correlation_score"`
+
+	// Warnings lists steps that failed without invalidating the result
+	Warnings []string `json:"-"`
 }
 
 type TimeWindow struct {
@@ -34,7 +81,7 @@ type TimeWindow struct {
 }
 
 func NewCorrelationEngine(db *sql.DB) *CorrelationEngine {
-	return &CorrelationEngine{db: db}
+	return &CorrelationEngine{db: db, HalfLife: defaultConfidenceHalfLife}
 }
 
 func (ce *CorrelationEngine) CorrelateLogsForAlert(alert Alert, logs []NormalizedLog) (*CorrelationResult, error) {
@@ -49,13 +96,25 @@ func (ce *CorrelationEngine) CorrelateLogsForAlert(alert Alert, logs []Normalize
 	// Build user-to-IP correlations from the logs
 	userCorrelations := ce.buildUserIPCorrelations(logs)
 
-	// Store correlations in database for future use
+	// Store correlations in database for future use. History is kept per
+	// project so one project's analyses never surface another's links.
+	// Failing to store only degrades later analyses.
+	var storeErr error
+	storeFailures := 0
 	for _, correlation := range userCorrelations {
-		ce.storeUserCorrelation(correlation)
+		if err := ce.storeUserCorrelation(alert.ProjectID, correlation); err != nil {
+			storeErr = err
+			storeFailures++
+		}
+	}
+	if storeFailures > 0 {
+		log.Printf("Failed to store %d user correlations: %v", storeFailures, storeErr)
+		result.Warnings = append(result.Warnings,
+			fmt.Sprintf("failed to store %d of %d user correlations: %v", storeFailures, len(userCorrelations), storeErr))
 	}
 
 	// Find existing correlations from database
-	existingCorrelations, err := ce.getExistingCorrelations(logs)
+	existingCorrelations, err := ce.getExistingCorrelations(alert.ProjectID, logs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get existing correlations: %v", err)
 	}
@@ -67,6 +126,14 @@ func (ce *CorrelationEngine) CorrelateLogsForAlert(alert Alert, logs []Normalize
 	// Calculate correlation score
 	result.CorrelationScore = ce.calculateCorrelationScore(logs, allCorrelations)
 
+	// Link every other entity type (hosts, sessions, access keys, ...) pairwise
+	entityCorrelations, warnings, err := ce.correlateEntities(alert.ProjectID, logs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to correlate entities: %v", err)
+	}
+	result.EntityCorrelations = entityCorrelations
+	result.Warnings = append(result.Warnings, warnings...)
+
 	return result, nil
 }
 
@@ -94,6 +161,7 @@ func (ce *CorrelationEngine) buildUserIPCorrelations(logs []NormalizedLog) []Use
 							ConfidenceScore: ce.calculateConfidenceScore(emailLog, ipLog),
 							SourceSystems:   []string{emailLog.Source, ipLog.Source},
 							CorrelationType: "time_proximity",
+							Evidence:        []CorrelationEvidence{ce.buildProximityEvidence(emailLog, ipLog, email, ip)},
 						}
 						correlations = append(correlations, correlation)
 					}
@@ -115,6 +183,16 @@ func (ce *CorrelationEngine) buildUserIPCorrelations(logs []NormalizedLog) []Use
 						ConfidenceScore: 0.9, // High confidence for direct correlation
 						SourceSystems:   []string{log.Source},
 						CorrelationType: "direct",
+						Evidence: []CorrelationEvidence{{
+							LogIDs:     []string{log.ID},
+							Timestamps: []time.Time{log.Timestamp},
+							Sources:    []string{log.Source},
+							MatchedAttributes: map[string]string{
+								"user_email": email,
+								"ip_address": ip,
+								"same_log":   "true",
+							},
+						}},
 					}
 					correlations = append(correlations, correlation)
 				}
@@ -220,29 +298,84 @@ func (ce *CorrelationEngine) calculateConfidenceScore(emailLog, ipLog Normalized
 	return score
 }
 
-func (ce *CorrelationEngine) storeUserCorrelation(correlation UserCorrelation) error {
+func (ce *CorrelationEngine) buildProximityEvidence(emailLog, ipLog NormalizedLog, email, ip string) CorrelationEvidence {
+	timeDiff := emailLog.Timestamp.Sub(ipLog.Timestamp)
+	if timeDiff < 0 {
+		timeDiff = -timeDiff
+	}
+
+	// Mirror the attributes that calculateConfidenceScore rewards
+	matched := map[string]string{
+		"user_email": email,
+		"ip_address": ip,
+	}
+	if emailLog.CompanyCode != "" && emailLog.CompanyCode == ipLog.CompanyCode {
+		matched["company_code"] = emailLog.CompanyCode
+	}
+	if emailLog.Host != "" && emailLog.Host == ipLog.Host {
+		matched["host"] = emailLog.Host
+	}
+
+	return CorrelationEvidence{
+		LogIDs:            []string{emailLog.ID, ipLog.ID},
+		Timestamps:        []time.Time{emailLog.Timestamp, ipLog.Timestamp},
+		Sources:           []string{emailLog.Source, ipLog.Source},
+		TimeDeltaMs:       timeDiff.Milliseconds(),
+		MatchedAttributes: matched,
+	}
+}
+
+func (ce *CorrelationEngine) storeUserCorrelation(projectID string, correlation UserCorrelation) error {
 	query := `
-		INSERT INTO user_correlations (user_identifier, ip_address, first_seen, last_seen, confidence_score, source_systems)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (user_identifier, ip_address) 
+		INSERT INTO user_correlations (user_identifier, ip_address, first_seen, last_seen, confidence_score, source_systems, evidence, observation_count, project_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $9, $10)
+		ON CONFLICT (project_id, user_identifier, ip_address)
 		DO UPDATE SET 
 			last_seen = GREATEST(user_correlations.last_seen, $4),
 			confidence_score = GREATEST(user_correlations.confidence_score, $5),
-			source_systems = array(SELECT DISTINCT unnest(user_correlations.source_systems || $6))
+			observation_count = user_correlations.observation_count + jsonb_array_length(unseen_evidence(user_correlations.evidence, $7::jsonb)),
+			source_systems = array(SELECT DISTINCT unnest(user_correlations.source_systems || $6)),
+			evidence = (
+				SELECT COALESCE(jsonb_agg(entry ORDER BY position), '[]'::jsonb) FROM (
+					SELECT entry, position
+					FROM jsonb_array_elements(user_correlations.evidence || unseen_evidence(user_correlations.evidence, $7::jsonb)) WITH ORDINALITY AS e(entry, position)
+					ORDER BY position DESC
+					LIMIT $8
+				) newest
+			)
 	`
 
-	_, err := ce.db.Exec(query,
+	evidence := newestEvidence(correlation.Evidence)
+	evidenceJSON, err := json.Marshal(evidence)
+	if err != nil {
+		return fmt.Errorf("failed to marshal correlation evidence: %v", err)
+	}
+
+	_, err = ce.db.Exec(query,
 		correlation.UserIdentifier,
 		correlation.IPAddress,
 		correlation.FirstSeen,
 		correlation.LastSeen,
 		correlation.ConfidenceScore,
-		correlation.SourceSystems)
+		pq.Array(correlation.SourceSystems),
+		evidenceJSON,
+		maxEvidencePerCorrelation,
+		max(len(evidence), 1),
+		projectID)
 
 	return err
 }
 
-func (ce *CorrelationEngine) getExistingCorrelations(logs []NormalizedLog) ([]UserCorrelation, error) {
+// newestEvidence keeps the last maxEvidencePerCorrelation entries, which are
+// the most recently appended ones.
+func newestEvidence(evidence []CorrelationEvidence) []CorrelationEvidence {
+	if len(evidence) > maxEvidencePerCorrelation {
+		return evidence[len(evidence)-maxEvidencePerCorrelation:]
+	}
+	return evidence
+}
+
+func (ce *CorrelationEngine) getExistingCorrelations(projectID string, logs []NormalizedLog) ([]UserCorrelation, error) {
 	var correlations []UserCorrelation
 
 	// Collect all unique IPs and emails from logs
@@ -261,9 +394,12 @@ func (ce *CorrelationEngine) getExistingCorrelations(logs []NormalizedLog) ([]Us
 	// Query for existing correlations
 	if len(ips) > 0 || len(emails) > 0 {
 		query := `
-			SELECT user_identifier, ip_address, first_seen, last_seen, confidence_score, source_systems
-			FROM user_correlations 
-			WHERE user_identifier = ANY($1) OR ip_address = ANY($2)
+			SELECT user_identifier, ip_address, first_seen, last_seen, confidence_score, observation_count, source_systems, evidence
+			FROM user_correlations
+			WHERE project_id = $3 AND (user_identifier = ANY($1) OR ip_address = ANY($2))
+			  AND last_seen >= $4
+			ORDER BY last_seen DESC
+			LIMIT $5
 		`
 
 		emailList := make([]string, 0, len(emails))
@@ -276,7 +412,8 @@ func (ce *CorrelationEngine) getExistingCorrelations(logs []NormalizedLog) ([]Us
 			ipList = append(ipList, ip)
 		}
 
-		rows, err := ce.db.Query(query, emailList, ipList)
+		rows, err := ce.db.Query(query, pq.Array(emailList), pq.Array(ipList), projectID,
+			ce.historyCutoff(time.Now()), maxHistoricalUserCorrelations)
 		if err != nil {
 			return nil, err
 		}
@@ -285,21 +422,31 @@ func (ce *CorrelationEngine) getExistingCorrelations(logs []NormalizedLog) ([]Us
 		for rows.Next() {
 			var correlation UserCorrelation
 			var sourceSystems []string
+			var evidenceJSON []byte
 
 			err := rows.Scan(
 				&correlation.UserIdentifier,
 				&correlation.IPAddress,
 				&correlation.FirstSeen,
 				&correlation.LastSeen,
-				&correlation.ConfidenceScore,
-				&sourceSystems,
+				&correlation.RawConfidenceScore,
+				&correlation.ObservationCount,
+				pq.Array(&sourceSystems),
+				&evidenceJSON,
 			)
 			if err != nil {
 				continue
 			}
 
+			if err := json.Unmarshal(evidenceJSON, &correlation.Evidence); err != nil {
+				correlation.Evidence = nil
+			}
 			correlation.SourceSystems = sourceSystems
 			correlation.CorrelationType = "historical"
+			correlation.ConfidenceScore = ce.decayedConfidence(correlation.RawConfidenceScore, correlation.LastSeen, correlation.ObservationCount, time.Now())
+			if correlation.ConfidenceScore < minHistoricalConfidence {
+				continue
+			}
 			correlations = append(correlations, correlation)
 		}
 	}
@@ -307,6 +454,38 @@ func (ce *CorrelationEngine) getExistingCorrelations(logs []NormalizedLog) ([]Us
 	return correlations, nil
 }
 
+// historyCutoff is the oldest last_seen whose decayed confidence can still
+// reach minHistoricalConfidence, so older rows need not be loaded at all.
+func (ce *CorrelationEngine) historyCutoff(now time.Time) time.Time {
+	if ce.HalfLife <= 0 {
+		return time.Time{}
+	}
+	halfLives := math.Log2(1 / minHistoricalConfidence)
+	return now.Add(-time.Duration(halfLives * float64(ce.HalfLife)))
+}
+
+// decayedConfidence re-scores a stored correlation: the peak confidence halves
+// every HalfLife since last_seen, and pairs seen only a few times are
+// discounted relative to ones that keep recurring.
+func (ce *CorrelationEngine) decayedConfidence(rawScore float64, lastSeen time.Time, observationCount int, now time.Time) float64 {
+	score := rawScore
+
+	age := now.Sub(lastSeen)
+	if age > 0 && ce.HalfLife > 0 {
+		score *= math.Pow(0.5, float64(age)/float64(ce.HalfLife))
+	}
+
+	// 1 observation -> 0.75, 3 -> 0.875, 9 -> 0.95
+	observations := float64(observationCount)
+	if observations < 1 {
+		observations = 1
+	}
+	support := 1 - 1/(1+observations)
+	score *= 0.5 + 0.5*support
+
+	return score
+}
+
 func (ce *CorrelationEngine) mergeCorrelations(new, existing []UserCorrelation) []UserCorrelation {
 	correlationMap := make(map[string]UserCorrelation)
 
@@ -325,6 +504,7 @@ func (ce *CorrelationEngine) mergeCorrelations(new, existing []UserCorrelation)
 				existing.ConfidenceScore = correlation.ConfidenceScore
 			}
 			existing.SourceSystems = ce.mergeSources(existing.SourceSystems, correlation.SourceSystems)
+			existing.Evidence = ce.mergeEvidence(existing.Evidence, correlation.Evidence)
 			correlationMap[key] = existing
 		} else {
 			correlationMap[key] = correlation
@@ -356,16 +536,40 @@ func (ce *CorrelationEngine) mergeSources(sources1, sources2 []string) []string
 	return result
 }
 
+// mergeEvidence appends the newer evidence list to the older one, dropping
+// entries that reference the same set of logs, and keeps the newest
+// maxEvidencePerCorrelation entries.
+func (ce *CorrelationEngine) mergeEvidence(older, newer []CorrelationEvidence) []CorrelationEvidence {
+	seen := make(map[string]bool)
+	var result []CorrelationEvidence
+
+	for _, list := range [][]CorrelationEvidence{older, newer} {
+		for _, evidence := range list {
+			key := fmt.Sprint(evidence.LogIDs, evidence.MatchedAttributes)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, evidence)
+		}
+	}
+
+	return newestEvidence(result)
+}
+
 func (ce *CorrelationEngine) deduplicateCorrelations(correlations []UserCorrelation) []UserCorrelation {
 	correlationMap := make(map[string]UserCorrelation)
 
 	for _, correlation := range correlations {
 		key := correlation.UserIdentifier + "|" + correlation.IPAddress
 		if existing, exists := correlationMap[key]; exists {
-			// Keep the one with higher confidence
+			// Keep the one with higher confidence, but retain evidence from both
+			evidence := ce.mergeEvidence(existing.Evidence, correlation.Evidence)
 			if correlation.ConfidenceScore > existing.ConfidenceScore {
-				correlationMap[key] = correlation
+				existing = correlation
 			}
+			existing.Evidence = evidence
+			correlationMap[key] = existing
 		} else {
 			correlationMap[key] = correlation
 		}
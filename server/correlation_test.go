@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func evidenceRange(from, to int) []CorrelationEvidence {
+	var evidence []CorrelationEvidence
+	for i := from; i < to; i++ {
+		evidence = append(evidence, CorrelationEvidence{LogIDs: []string{fmt.Sprintf("log-%d", i)}})
+	}
+	return evidence
+}
+
+func TestMergeEvidenceKeepsNewest(t *testing.T) {
+	ce := NewCorrelationEngine(nil)
+
+	// 15 stored entries followed by 15 new ones, 5 of which repeat stored logs
+	merged := ce.mergeEvidence(evidenceRange(0, 15), evidenceRange(10, 25))
+	if len(merged) != maxEvidencePerCorrelation {
+		t.Fatalf("kept %d entries, want %d", len(merged), maxEvidencePerCorrelation)
+	}
+	if first, last := merged[0].LogIDs[0], merged[len(merged)-1].LogIDs[0]; first != "log-5" || last != "log-24" {
+		t.Errorf("kept %s..%s, want log-5..log-24", first, last)
+	}
+}
+
+func TestDecayedConfidence(t *testing.T) {
+	ce := NewCorrelationEngine(nil)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		age          time.Duration
+		observations int
+		want         float64
+	}{
+		{"fresh single sighting", 0, 1, 0.75},
+		{"fresh recurring pair", 0, 9, 0.95},
+		{"one half-life old", ce.HalfLife, 1, 0.375},
+		{"two half-lives old", 2 * ce.HalfLife, 9, 0.2375},
+		{"no observations recorded", 0, 0, 0.75},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ce.decayedConfidence(1, now.Add(-tt.age), tt.observations, now)
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("decayedConfidence = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryCutoff(t *testing.T) {
+	ce := NewCorrelationEngine(nil)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// A perfect, often-seen pair at the cutoff decays to just below the floor
+	cutoff := ce.historyCutoff(now)
+	if got := ce.decayedConfidence(1, cutoff, 1000, now); got >= minHistoricalConfidence {
+		t.Errorf("confidence at cutoff = %v, want below %v", got, minHistoricalConfidence)
+	}
+	if got := ce.decayedConfidence(1, cutoff.Add(24*time.Hour), 1000, now); got < minHistoricalConfidence {
+		t.Errorf("confidence a day inside the cutoff = %v, want at least %v", got, minHistoricalConfidence)
+	}
+
+	ce.HalfLife = 0
+	if cutoff := ce.historyCutoff(now); !cutoff.IsZero() {
+		t.Errorf("cutoff without decay = %v, want zero", cutoff)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Alert fields that fingerprints and suppression rules can be built from.
+// Any raw data key can be used as "raw.<key>".
+var alertMatchFields = []string{"source", "rule", "ip", "project", "severity", "message"}
+
+var defaultDedupFields = []string{"source", "rule", "ip", "project"}
+
+// alertClientIPKeys are the raw data fields holding the client address, in
+// order of preference.
+var alertClientIPKeys = []string{"clientIP", "clientIp", "client_ip", "sourceIPAddress", "srcIP", "src_ip", "Source_IP", "cliIP", "ip"}
+
+func isAlertMatchField(field string) bool {
+	if strings.HasPrefix(field, "raw.") && len(field) > len("raw.") {
+		return true
+	}
+	for _, f := range alertMatchFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// alertField returns the value of one of alertMatchFields for an alert.
+func alertField(alert Alert, field string) string {
+	switch field {
+	case "source":
+		return alert.Source
+	case "rule":
+		return alertRuleID(alert)
+	case "project":
+		return alert.ProjectID
+	case "severity":
+		return alert.Severity
+	case "message":
+		return alert.Message
+	case "ip":
+		for _, key := range alertClientIPKeys {
+			if value := toString(alert.RawData[key]); value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+	if key, ok := strings.CutPrefix(field, "raw."); ok {
+		return toString(alert.RawData[key])
+	}
+	return ""
+}
+
+// AlertDeduplicator collapses repeats of the same alert at ingest. Alerts
+// whose fingerprint over Fields matches one accepted within Window are not
+// analysed again; the original's duplicate counter is incremented instead.
+type AlertDeduplicator struct {
+	redis *redis.Client
+
+	Fields []string
+	Window time.Duration
+}
+
+func NewAlertDeduplicator(client *redis.Client) *AlertDeduplicator {
+	return &AlertDeduplicator{redis: client, Fields: defaultDedupFields, Window: 5 * time.Minute}
+}
+
+// Fingerprint hashes the alert's Fields. Alerts without a rule ID, such as
+// most POST /alerts bodies, use their message signature as the rule, so
+// different detections from one IP are not collapsed together.
+func (d *AlertDeduplicator) Fingerprint(alert Alert) string {
+	var b strings.Builder
+	for _, field := range d.Fields {
+		value := alertField(alert, field)
+		if field == "rule" && value == "" {
+			value = alertSignature(alert)
+		}
+		b.WriteString(field)
+		b.WriteByte('=')
+		b.WriteString(strings.ToLower(value))
+		b.WriteByte('\n')
+	}
+	sum := sha1.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func dedupStatsKey(alertID string) string {
+	return "dedup:alert:" + alertID
+}
+
+// Check claims the alert's fingerprint for its window. If another alert
+// already holds it, Check records the duplicate against that alert and
+// returns its ID and updated count.
+func (d *AlertDeduplicator) Check(ctx context.Context, alert Alert) (string, int64, bool, error) {
+	key := "dedup:fp:" + d.Fingerprint(alert)
+
+	// Retry once in case the original's window expires between the calls
+	for attempt := 0; attempt < 2; attempt++ {
+		claimed, err := d.redis.SetNX(ctx, key, alert.ID, d.Window).Result()
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to claim fingerprint: %v", err)
+		}
+		if claimed {
+			return "", 0, false, nil
+		}
+
+		originalID, err := d.redis.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to read fingerprint: %v", err)
+		}
+
+		statsKey := dedupStatsKey(originalID)
+		var countCmd *redis.IntCmd
+		_, err = d.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			countCmd = pipe.HIncrBy(ctx, statsKey, "count", 1)
+			pipe.HSet(ctx, statsKey, "last_seen", time.Now().UTC().Format(time.RFC3339Nano))
+			pipe.Expire(ctx, statsKey, 30*24*time.Hour)
+			return nil
+		})
+		if err != nil {
+			return "", 0, false, fmt.Errorf("failed to count duplicate: %v", err)
+		}
+		return originalID, countCmd.Val(), true, nil
+	}
+	return "", 0, false, nil
+}
+
+// releaseScript deletes a fingerprint only while it still names the alert,
+// so a newer claim by another alert survives.
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Release gives up the fingerprint that Check claimed for alert, for when the
+// alert ends up not being stored or queued. Otherwise retries within the
+// window would be collapsed into an alert that doesn't exist.
+func (d *AlertDeduplicator) Release(ctx context.Context, alert Alert) error {
+	if err := releaseScript.Run(ctx, d.redis, []string{"dedup:fp:" + d.Fingerprint(alert)}, alert.ID).Err(); err != nil {
+		return fmt.Errorf("failed to release fingerprint: %v", err)
+	}
+	return nil
+}
+
+// idempotencyWindow is how long the outcome of a collapsed or suppressed
+// alert is remembered by external ID, so the sender's retries get the same
+// answer without counting again.
+const idempotencyWindow = 24 * time.Hour
+
+func ingestOutcomeKey(alert Alert) string {
+	sum := sha1.Sum([]byte(alert.ProjectID + "\n" + alert.Source + "\n" + alert.ExternalID))
+	return "dedup:outcome:" + hex.EncodeToString(sum[:])
+}
+
+// RememberOutcome records what became of an alert with an external ID that
+// was not stored, since the alerts table can't answer its retries.
+func (d *AlertDeduplicator) RememberOutcome(ctx context.Context, alert Alert, result IngestResult) error {
+	if alert.ExternalID == "" {
+		return nil
+	}
+	if err := d.redis.Set(ctx, ingestOutcomeKey(alert), mustMarshal(result), idempotencyWindow).Err(); err != nil {
+		return fmt.Errorf("failed to remember ingest outcome: %v", err)
+	}
+	return nil
+}
+
+// Outcome returns the outcome RememberOutcome recorded for the alert's
+// external ID, or nil.
+func (d *AlertDeduplicator) Outcome(ctx context.Context, alert Alert) (*IngestResult, error) {
+	if alert.ExternalID == "" {
+		return nil, nil
+	}
+	data, err := d.redis.Get(ctx, ingestOutcomeKey(alert)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ingest outcome: %v", err)
+	}
+	var result IngestResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to read ingest outcome: %v", err)
+	}
+	return &result, nil
+}
+
+// DuplicateStats returns how many duplicates of alertID were collapsed and
+// when the last one arrived.
+func (d *AlertDeduplicator) DuplicateStats(ctx context.Context, alertID string) (int64, *time.Time, error) {
+	values, err := d.redis.HGetAll(ctx, dedupStatsKey(alertID)).Result()
+	if err != nil || len(values) == 0 {
+		return 0, nil, err
+	}
+	var count int64
+	fmt.Sscan(values["count"], &count)
+	var lastSeen *time.Time
+	if t, err := time.Parse(time.RFC3339Nano, values["last_seen"]); err == nil {
+		lastSeen = &t
+	}
+	return count, lastSeen, nil
+}
+
+// SuppressionRule drops matching alerts at ingest until it expires. Match
+// values are case-insensitive glob patterns, e.g. {"rule": "AWS-AWSManaged*"}.
+type SuppressionRule struct {
+	ID        string            `json:"id"`
+	ProjectID string            `json:"project_id,omitempty"` // empty applies to every project
+	Match     map[string]string `json:"match"`
+	Reason    string            `json:"reason"`
+	CreatedBy string            `json:"created_by"`
+	CreatedAt time.Time         `json:"created_at"`
+	ExpiresAt time.Time         `json:"expires_at"`
+	HitCount  int               `json:"hit_count"`
+}
+
+func (rule SuppressionRule) Matches(alert Alert) bool {
+	if rule.ProjectID != "" && rule.ProjectID != alert.ProjectID {
+		return false
+	}
+	for field, pattern := range rule.Match {
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(alertField(alert, field)))
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// maxSuppressionDuration keeps forgotten suppressions from hiding alerts
+// forever.
+const maxSuppressionDuration = 90 * 24 * time.Hour
+
+type SuppressionStore struct {
+	db *sql.DB
+}
+
+func NewSuppressionStore(db *sql.DB) *SuppressionStore {
+	return &SuppressionStore{db: db}
+}
+
+const suppressionColumns = `id, project_id, match, reason, created_by, created_at, expires_at, hit_count`
+
+func scanSuppressions(rows *sql.Rows) ([]SuppressionRule, error) {
+	defer rows.Close()
+	rules := []SuppressionRule{}
+	for rows.Next() {
+		var rule SuppressionRule
+		var matchJSON []byte
+		if err := rows.Scan(&rule.ID, &rule.ProjectID, &matchJSON, &rule.Reason, &rule.CreatedBy,
+			&rule.CreatedAt, &rule.ExpiresAt, &rule.HitCount); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(matchJSON, &rule.Match); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Match returns the first active rule that suppresses the alert and counts
+// the hit, or nil.
+func (s *SuppressionStore) Match(alert Alert) (*SuppressionRule, error) {
+	rows, err := s.db.Query(`
+		SELECT `+suppressionColumns+` FROM suppression_rules
+		WHERE expires_at > NOW() AND (project_id = '' OR project_id = $1)
+		ORDER BY created_at
+	`, alert.ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load suppression rules: %v", err)
+	}
+	rules, err := scanSuppressions(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load suppression rules: %v", err)
+	}
+
+	for _, rule := range rules {
+		if rule.Matches(alert) {
+			if _, err := s.db.Exec(`UPDATE suppression_rules SET hit_count = hit_count + 1 WHERE id = $1`, rule.ID); err != nil {
+				return nil, fmt.Errorf("failed to count suppression hit: %v", err)
+			}
+			rule.HitCount++
+			return &rule, nil
+		}
+	}
+	return nil, nil
+}
+
+func (app *App) createSuppression(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		SuppressionRule
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	rule := request.SuppressionRule
+
+	if len(rule.Match) == 0 {
+		http.Error(w, "match needs at least one field", http.StatusBadRequest)
+		return
+	}
+	for field := range rule.Match {
+		if !isAlertMatchField(field) {
+			http.Error(w, fmt.Sprintf("unknown match field %q; use one of %s or raw.<key>", field, strings.Join(alertMatchFields, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	if strings.TrimSpace(rule.Reason) == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	// A rule without a project applies to every project
+	auditProjects(r.Context(), rule.ProjectID)
+	auditDetail(r.Context(), "match", rule.Match)
+	auditDetail(r.Context(), "reason", rule.Reason)
+	principal := principalFrom(r.Context())
+	if (rule.ProjectID == "" && !principal.AllProjects()) || !principal.CanAccess(rule.ProjectID) {
+		http.Error(w, "Not allowed to suppress alerts for this project", http.StatusForbidden)
+		return
+	}
+	if rule.CreatedBy == "" {
+		rule.CreatedBy = principal.Name
+	}
+
+	now := time.Now()
+	if request.TTL != "" {
+		ttl, err := time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			http.Error(w, "ttl must be a positive duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		rule.ExpiresAt = now.Add(ttl)
+	}
+	if !rule.ExpiresAt.After(now) {
+		http.Error(w, "expires_at or ttl is required and must be in the future", http.StatusBadRequest)
+		return
+	}
+	if rule.ExpiresAt.Sub(now) > maxSuppressionDuration {
+		http.Error(w, fmt.Sprintf("suppressions may last at most %s", maxSuppressionDuration), http.StatusBadRequest)
+		return
+	}
+
+	rule.ID = generateID()
+	rule.CreatedAt = now
+	rule.HitCount = 0
+	_, err := app.DB.Exec(`
+		INSERT INTO suppression_rules (id, project_id, match, reason, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, rule.ID, rule.ProjectID, mustMarshal(rule.Match), rule.Reason, rule.CreatedBy, rule.CreatedAt, rule.ExpiresAt)
+	if err != nil {
+		http.Error(w, "Failed to store suppression rule", http.StatusInternalServerError)
+		return
+	}
+
+	auditTarget(r.Context(), rule.ID)
+	auditDetail(r.Context(), "expires_at", rule.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// listSuppressions lists the rules of the caller's projects, or of
+// project_id, along with the rules that apply to every project.
+func (app *App) listSuppressions(w http.ResponseWriter, r *http.Request) {
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+	rows, err := app.DB.Query(`
+		SELECT `+suppressionColumns+` FROM suppression_rules
+		WHERE ($1 OR expires_at > NOW()) AND ($2::text[] IS NULL OR project_id = '' OR project_id = ANY($2))
+		ORDER BY created_at DESC
+	`, r.URL.Query().Get("include_expired") == "true", pq.Array(projects))
+	if err != nil {
+		http.Error(w, "Failed to list suppression rules", http.StatusInternalServerError)
+		return
+	}
+	rules, err := scanSuppressions(rows)
+	if err != nil {
+		http.Error(w, "Failed to list suppression rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// deleteSuppression lifts a suppression early by expiring it, keeping the
+// record of what was suppressed. Only callers with every project may lift
+// rules that apply to every project.
+func (app *App) deleteSuppression(w http.ResponseWriter, r *http.Request) {
+	result, err := app.DB.Exec(`
+		UPDATE suppression_rules SET expires_at = NOW()
+		WHERE id = $1 AND expires_at > NOW() AND ($2::text[] IS NULL OR project_id = ANY($2))
+	`, chi.URLParam(r, "suppression_id"), pq.Array(principalFrom(r.Context()).ProjectFilter()))
+	if err != nil {
+		http.Error(w, "Failed to lift suppression rule", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Active suppression rule not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAlertField(t *testing.T) {
+	alert := Alert{
+		Source:    "aws_waf",
+		ProjectID: "company-a",
+		RawData: map[string]interface{}{
+			"ruleId":          "AWS-AWSManagedRulesSQLiRuleSet",
+			"sourceIPAddress": "198.51.100.80",
+			"clientIP":        "203.0.113.7",
+			"uri":             "/login",
+		},
+	}
+	tests := map[string]string{
+		"source":  "aws_waf",
+		"project": "company-a",
+		"rule":    "AWS-AWSManagedRulesSQLiRuleSet",
+		"ip":      "203.0.113.7", // clientIP is preferred over sourceIPAddress
+		"raw.uri": "/login",
+		"raw.any": "",
+		"unknown": "",
+	}
+	for field, want := range tests {
+		if got := alertField(alert, field); got != want {
+			t.Errorf("alertField(%q) = %q, want %q", field, got, want)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	d := NewAlertDeduplicator(nil)
+	base := Alert{
+		Source:    "aws_guardduty",
+		ProjectID: "company-a",
+		Message:   "Port scan from 203.0.113.7",
+		RawData:   map[string]interface{}{"clientIP": "203.0.113.7"},
+	}
+	with := func(change func(*Alert)) Alert {
+		alert := base
+		alert.RawData = map[string]interface{}{"clientIP": "203.0.113.7"}
+		change(&alert)
+		return alert
+	}
+	tests := []struct {
+		name  string
+		alert Alert
+		same  bool
+	}{
+		{"identical", with(func(a *Alert) {}), true},
+		{"different case", with(func(a *Alert) { a.ProjectID = "Company-A" }), true},
+		{"message differs only in numbers", with(func(a *Alert) { a.Message = "Port scan from 203.0.113.8" }), true},
+		{"different severity", with(func(a *Alert) { a.Severity = "high" }), true},
+		{"different detection", with(func(a *Alert) { a.Message = "SSH brute force from 203.0.113.7" }), false},
+		{"different client", with(func(a *Alert) { a.RawData["clientIP"] = "203.0.113.9" }), false},
+		{"different project", with(func(a *Alert) { a.ProjectID = "company-b" }), false},
+	}
+	want := d.Fingerprint(base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.Fingerprint(tt.alert) == want; got != tt.same {
+				t.Errorf("same fingerprint = %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+func TestSuppressionRuleMatches(t *testing.T) {
+	alert := Alert{
+		Source:    "aws_waf",
+		ProjectID: "company-a",
+		RawData:   map[string]interface{}{"ruleId": "AWS-AWSManagedRulesSQLiRuleSet", "uri": "/health"},
+	}
+	tests := []struct {
+		name string
+		rule SuppressionRule
+		want bool
+	}{
+		{"glob on rule", SuppressionRule{Match: map[string]string{"rule": "AWS-AWSManaged*"}}, true},
+		{"case-insensitive", SuppressionRule{Match: map[string]string{"rule": "aws-awsmanaged*"}}, true},
+		{"raw field", SuppressionRule{Match: map[string]string{"raw.uri": "/health"}}, true},
+		{"every field must match", SuppressionRule{Match: map[string]string{"rule": "AWS-*", "source": "azure_waf"}}, false},
+		{"own project", SuppressionRule{ProjectID: "company-a", Match: map[string]string{"source": "aws_waf"}}, true},
+		{"other project", SuppressionRule{ProjectID: "company-b", Match: map[string]string{"source": "aws_waf"}}, false},
+		{"missing field", SuppressionRule{Match: map[string]string{"ip": "203.0.113.*"}}, false},
+		{"malformed pattern", SuppressionRule{Match: map[string]string{"rule": "AWS-[*"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(alert); got != tt.want {
+				t.Errorf("Matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngestOutcomeKey(t *testing.T) {
+	base := Alert{Source: "aws_guardduty", ProjectID: "company-a", ExternalID: "finding-1"}
+	key := ingestOutcomeKey(base)
+
+	// Retries differ in everything but the sender's ID
+	retry := base
+	retry.Message, retry.Severity = "changed", "critical"
+	if ingestOutcomeKey(retry) != key {
+		t.Error("retry with the same external ID got a different key")
+	}
+	for _, other := range []Alert{
+		{Source: "aws_guardduty", ProjectID: "company-b", ExternalID: "finding-1"},
+		{Source: "azure_waf", ProjectID: "company-a", ExternalID: "finding-1"},
+		{Source: "aws_guardduty", ProjectID: "company-a", ExternalID: "finding-2"},
+	} {
+		if ingestOutcomeKey(other) == key {
+			t.Errorf("%+v shares the key of %+v", other, base)
+		}
+	}
+}
+
+func TestOutcomeWithoutExternalID(t *testing.T) {
+	// Alerts without an external ID never touch Redis
+	d := NewAlertDeduplicator(nil)
+	alert := Alert{Source: "aws_waf", ProjectID: "company-a"}
+	if err := d.RememberOutcome(context.Background(), alert, IngestResult{}); err != nil {
+		t.Errorf("RememberOutcome: %v", err)
+	}
+	if result, err := d.Outcome(context.Background(), alert); result != nil || err != nil {
+		t.Errorf("Outcome = %+v, %v; want nothing", result, err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Detection is a match produced by one of our own detection engines.
+type Detection struct {
+	Engine       string        `json:"engine"`
+	RuleID       string        `json:"rule_id"`
+	RuleTitle    string        `json:"rule_title"`
+	Level        string        `json:"level"`
+	Tags         []string      `json:"tags,omitempty"`
+	GroupKey     string        `json:"group_key,omitempty"`
+	Log          NormalizedLog `json:"-"`
+	Contributing []LogRef      `json:"contributing_logs"`
+}
+
+// LogRef is the compact form of a normalized log kept in detection state and
+// attached to the alerts it contributes to.
+type LogRef struct {
+	ID          string    `json:"id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	IPAddresses []string  `json:"ip_addresses,omitempty"`
+	UserEmails  []string  `json:"user_emails,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	URI         string    `json:"uri,omitempty"`
+	StatusCode  string    `json:"status_code,omitempty"`
+	Country     string    `json:"country,omitempty"`
+}
+
+func newLogRef(log NormalizedLog) LogRef {
+	return LogRef{
+		ID:          log.ID,
+		Timestamp:   log.Timestamp,
+		Source:      log.Source,
+		IPAddresses: log.IPAddresses,
+		UserEmails:  log.UserEmails,
+		Action:      log.Action,
+		URI:         log.URI,
+		StatusCode:  log.StatusCode,
+		Country:     log.Country,
+	}
+}
+
+// Detector is implemented by every engine that runs over the normalized log
+// stream.
+type Detector interface {
+	Detect(projectID string, log NormalizedLog) []Detection
+}
+
+var detectionSeverities = map[string]string{
+	"informational": "low",
+	"low":           "low",
+	"medium":        "medium",
+	"high":          "high",
+	"critical":      "critical",
+}
+
+// detectionAlert builds the internal alert for a detection. The triggering
+// log's raw fields are kept so the analysis and incident grouping see its
+// entities, and the contributing logs are attached for the analyst.
+func detectionAlert(detection Detection, projectID string) Alert {
+	rawData := make(map[string]interface{}, len(detection.Log.RawData)+8)
+	for key, value := range detection.Log.RawData {
+		rawData[key] = value
+	}
+	rawData["ruleId"] = detection.RuleID
+	rawData["rule_title"] = detection.RuleTitle
+	rawData["rule_tags"] = detection.Tags
+	rawData["detection_engine"] = detection.Engine
+	rawData["log_id"] = detection.Log.ID
+	rawData["log_source"] = detection.Log.Source
+	rawData["contributing_logs"] = detection.Contributing
+	if detection.GroupKey != "" {
+		rawData["group_key"] = detection.GroupKey
+	}
+	if len(detection.Log.IPAddresses) > 0 {
+		if _, exists := rawData["clientIP"]; !exists {
+			rawData["clientIP"] = detection.Log.IPAddresses[0]
+		}
+	}
+
+	severity := detectionSeverities[strings.ToLower(detection.Level)]
+	if severity == "" {
+		severity = "medium"
+	}
+
+	source := "sigma"
+	if detection.Engine != "sigma" {
+		source = "rule_engine"
+	}
+
+	return Alert{
+		ID:        generateID(),
+		Timestamp: detection.Log.Timestamp,
+		Source:    source,
+		Severity:  severity,
+		Message:   detection.RuleTitle,
+		ProjectID: projectID,
+		RawData:   rawData,
+	}
+}
+
+// DetectionPipeline polls each configured project for new logs in Loki,
+// normalizes them once and hands them to every detector.
+type DetectionPipeline struct {
+	Projects     []string
+	PollInterval time.Duration
+	Detectors    []Detector
+}
+
+func (app *App) startDetection(pipeline *DetectionPipeline) {
+	log.Printf("Starting detection for projects %v every %s", pipeline.Projects, pipeline.PollInterval)
+
+	ticker := time.NewTicker(pipeline.PollInterval)
+	defer ticker.Stop()
+
+	last := time.Now().Add(-pipeline.PollInterval)
+	for now := range ticker.C {
+		for _, projectID := range pipeline.Projects {
+			app.runDetection(pipeline, projectID, last, now)
+		}
+		last = now
+	}
+}
+
+func (app *App) runDetection(pipeline *DetectionPipeline, projectID string, start, end time.Time) {
+	lokiLogs, err := app.LokiClient.QueryRange("", start, end, projectID)
+	if err != nil {
+		log.Printf("Detection: failed to query Loki for %s: %v", projectID, err)
+		return
+	}
+
+	// Stateful rules depend on seeing events in time order
+	normalizedLogs := make([]NormalizedLog, 0, len(lokiLogs))
+	for _, lokiLog := range lokiLogs {
+		normalized, err := app.Normalizer.NormalizeLog(lokiLog)
+		if err != nil {
+			continue
+		}
+		normalizedLogs = append(normalizedLogs, *normalized)
+	}
+	app.geoEnrichLogs(normalizedLogs)
+	sortLogsByTime(normalizedLogs)
+
+	for _, normalized := range normalizedLogs {
+		for _, detector := range pipeline.Detectors {
+			for _, detection := range detector.Detect(projectID, normalized) {
+				app.emitDetection(detection, projectID)
+			}
+		}
+	}
+}
+
+func (app *App) emitDetection(detection Detection, projectID string) {
+	result, err := app.acceptAlert(context.Background(), detectionAlert(detection, projectID))
+	if err != nil {
+		log.Printf("Failed to queue %s detection for rule %s: %v", detection.Engine, detection.RuleID, err)
+		return
+	}
+	log.Printf("%s rule %q matched log %s in %s: alert %s (%s)", detection.Engine, detection.RuleTitle, detection.Log.ID, projectID, result.AlertID, result.Status)
+}
+
+func sortLogsByTime(logs []NormalizedLog) {
+	sort.SliceStable(logs, func(i, j int) bool {
+		return logs[i].Timestamp.Before(logs[j].Timestamp)
+	})
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Entity types that can be extracted from normalized logs and correlated.
+const (
+	EntityUserEmail    = "user_email"
+	EntityUserName     = "user_name"
+	EntityIP           = "ip"
+	EntityHostname     = "hostname"
+	EntitySessionID    = "session_id"
+	EntityUserAgent    = "user_agent"
+	EntityJA3          = "ja3"
+	EntityDeviceID     = "device_id"
+	EntityAWSAccessKey = "aws_access_key"
+	EntityFileHash     = "file_hash"
+)
+
+var entityTypes = []string{
+	EntityUserEmail, EntityUserName, EntityIP, EntityHostname, EntitySessionID,
+	EntityUserAgent, EntityJA3, EntityDeviceID, EntityAWSAccessKey, EntityFileHash,
+}
+
+func isEntityType(entityType string) bool {
+	for _, t := range entityTypes {
+		if t == entityType {
+			return true
+		}
+	}
+	return false
+}
+
+type Entity struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Key identifies an entity independently of the system it was seen in.
+func (e Entity) Key() string {
+	return e.Type + ":" + e.Value
+}
+
+// EntityCorrelation links two entities of different types, e.g. a GuardDuty
+// access key to a WAF session. EntityA always sorts before EntityB by key.
+type EntityCorrelation struct {
+	EntityA         Entity    `json:"entity_a"`
+	EntityB         Entity    `json:"entity_b"`
+	FirstSeen       time.Time `json:"first_seen"`
+	LastSeen        time.Time `json:"last_seen"`
+	ConfidenceScore float64   `json:"confidence_score"`
+	SourceSystems   []string  `json:"source_systems"`
+	CorrelationType string    `json:"correlation_type"`
+
+	ObservationCount   int     `json:"observation_count,omitempty"`
+	RawConfidenceScore float64 `json:"raw_confidence_score,omitempty"`
+
+	Evidence []CorrelationEvidence `json:"evidence"`
+}
+
+func (ec EntityCorrelation) Key() string {
+	return ec.EntityA.Key() + "|" + ec.EntityB.Key()
+}
+
+// newEntityCorrelation orders the pair canonically so the same link is always
+// stored and merged under one key.
+func newEntityCorrelation(a, b Entity) EntityCorrelation {
+	if b.Key() < a.Key() {
+		a, b = b, a
+	}
+	return EntityCorrelation{EntityA: a, EntityB: b}
+}
+
+var awsAccessKeyRegex = regexp.MustCompile(`\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`)
+
+// entityFieldMappings lists the raw JSON fields each entity type is read from.
+var entityFieldMappings = map[string][]string{
+	EntityUserName:     {"userName", "username", "user_name", "User_name"},
+	EntityHostname:     {"hostname", "hostName", "Host_name"},
+	EntitySessionID:    {"sessionId", "session_id", "sid", "JSESSIONID"},
+	EntityUserAgent:    {"userAgent", "user_agent", "User-Agent", "ua"},
+	EntityJA3:          {"ja3", "ja3Fingerprint", "ja3_fingerprint"},
+	EntityDeviceID:     {"deviceId", "device_id", "DeviceId", "hostID"},
+	EntityAWSAccessKey: {"accessKeyId", "access_key_id", "AccessKeyId"},
+	EntityFileHash:     {"sha256", "sha1", "md5", "SHA256", "SHA1", "MD5", "fileHash", "file_hash"},
+}
+
+// extractEntities builds the entity list for a normalized log from the fields
+// already extracted plus any source-specific identifiers in the raw data.
+func (ln *LogNormalizer) extractEntities(normalized *NormalizedLog) []Entity {
+	seen := make(map[string]bool)
+	var entities []Entity
+
+	add := func(entityType, value string) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return
+		}
+		switch entityType {
+		case EntityUserEmail:
+			value = normalizeEmail(value)
+		case EntityFileHash:
+			value = strings.ToLower(value)
+		}
+		entity := Entity{Type: entityType, Value: value, Source: normalized.Source}
+		if seen[entity.Key()] {
+			return
+		}
+		seen[entity.Key()] = true
+		entities = append(entities, entity)
+	}
+
+	for _, email := range normalized.UserEmails {
+		add(EntityUserEmail, email)
+	}
+	for _, name := range normalized.UserNames {
+		add(EntityUserName, name)
+	}
+	for _, ip := range normalized.IPAddresses {
+		add(EntityIP, ip)
+	}
+	add(EntityHostname, normalized.Host)
+
+	// Iterate types in a fixed order so entity lists are stable across runs
+	mappedTypes := make([]string, 0, len(entityFieldMappings))
+	for entityType := range entityFieldMappings {
+		mappedTypes = append(mappedTypes, entityType)
+	}
+	sort.Strings(mappedTypes)
+
+	for _, entityType := range mappedTypes {
+		if entityType == EntityUserName {
+			continue // already covered by UserNames
+		}
+		for _, key := range entityFieldMappings[entityType] {
+			if value, exists := normalized.RawData[key]; exists {
+				add(entityType, toString(value))
+			}
+		}
+	}
+
+	for _, key := range awsAccessKeyRegex.FindAllString(normalized.OriginalLog, -1) {
+		add(EntityAWSAccessKey, key)
+	}
+
+	return entities
+}
+
+// maxEntityCorrelations caps how many entity pairs a single alert can produce,
+// since pairing every entity in a busy window grows quadratically.
+const maxEntityCorrelations = 2000
+
+// maxHistoricalEntityCorrelations caps how many stored links are loaded per
+// analysis; common entities such as a shared NAT address have thousands.
+const maxHistoricalEntityCorrelations = 500
+
+// correlateEntities links entities seen in the same log or in logs from
+// different systems within the same time group, persists the links and merges
+// them with historical ones. Failing to persist only degrades later analyses,
+// so it is reported as a warning.
+func (ce *CorrelationEngine) correlateEntities(projectID string, logs []NormalizedLog) ([]EntityCorrelation, []string, error) {
+	correlations := ce.buildEntityCorrelations(logs)
+
+	var warnings []string
+	if err := ce.storeEntities(projectID, logs); err != nil {
+		log.Printf("Failed to store entities: %v", err)
+		warnings = append(warnings, err.Error())
+	}
+	if err := ce.storeEntityCorrelations(projectID, correlations); err != nil {
+		log.Printf("Failed to store entity correlations: %v", err)
+		warnings = append(warnings, err.Error())
+	}
+
+	existing, err := ce.getExistingEntityCorrelations(projectID, logs)
+	if err != nil {
+		return nil, warnings, fmt.Errorf("failed to get existing entity correlations: %v", err)
+	}
+
+	return ce.mergeEntityCorrelations(correlations, existing), warnings, nil
+}
+
+func (ce *CorrelationEngine) buildEntityCorrelations(logs []NormalizedLog) []EntityCorrelation {
+	correlationMap := make(map[string]EntityCorrelation)
+
+	add := func(correlation EntityCorrelation) bool {
+		key := correlation.Key()
+		if existing, exists := correlationMap[key]; exists {
+			evidence := ce.mergeEvidence(existing.Evidence, correlation.Evidence)
+			if correlation.ConfidenceScore > existing.ConfidenceScore {
+				existing.ConfidenceScore = correlation.ConfidenceScore
+				existing.CorrelationType = correlation.CorrelationType
+			}
+			if correlation.FirstSeen.Before(existing.FirstSeen) {
+				existing.FirstSeen = correlation.FirstSeen
+			}
+			if correlation.LastSeen.After(existing.LastSeen) {
+				existing.LastSeen = correlation.LastSeen
+			}
+			existing.SourceSystems = ce.mergeSources(existing.SourceSystems, correlation.SourceSystems)
+			existing.Evidence = evidence
+			correlationMap[key] = existing
+			return true
+		}
+		if len(correlationMap) >= maxEntityCorrelations {
+			return false
+		}
+		correlationMap[key] = correlation
+		return true
+	}
+
+	// Direct correlations: both entities appear in the same log
+	for _, log := range logs {
+		for i, a := range log.Entities {
+			for _, b := range log.Entities[i+1:] {
+				if a.Type == b.Type {
+					continue
+				}
+				correlation := newEntityCorrelation(a, b)
+				correlation.FirstSeen = log.Timestamp
+				correlation.LastSeen = log.Timestamp
+				correlation.ConfidenceScore = 0.9
+				correlation.SourceSystems = []string{log.Source}
+				correlation.CorrelationType = "direct"
+				correlation.Evidence = []CorrelationEvidence{{
+					LogIDs:     []string{log.ID},
+					Timestamps: []time.Time{log.Timestamp},
+					Sources:    []string{log.Source},
+					MatchedAttributes: map[string]string{
+						a.Type:     a.Value,
+						b.Type:     b.Value,
+						"same_log": "true",
+					},
+				}}
+				if !add(correlation) {
+					return ce.entityCorrelationList(correlationMap)
+				}
+			}
+		}
+	}
+
+	// Time proximity: entities from different systems within the same window
+	for _, group := range ce.groupLogsByTime(logs, 5*time.Minute) {
+		for i, logA := range group {
+			for _, logB := range group[i+1:] {
+				if logA.Source == logB.Source {
+					continue
+				}
+				confidence := ce.calculateConfidenceScore(logA, logB)
+				for _, a := range logA.Entities {
+					for _, b := range logB.Entities {
+						if a.Type == b.Type {
+							continue
+						}
+						correlation := newEntityCorrelation(a, b)
+						correlation.FirstSeen = minTime(logA.Timestamp, logB.Timestamp)
+						correlation.LastSeen = maxTime(logA.Timestamp, logB.Timestamp)
+						correlation.ConfidenceScore = confidence
+						correlation.SourceSystems = []string{logA.Source, logB.Source}
+						correlation.CorrelationType = "time_proximity"
+						correlation.Evidence = []CorrelationEvidence{ce.buildEntityProximityEvidence(logA, logB, a, b)}
+						if !add(correlation) {
+							return ce.entityCorrelationList(correlationMap)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return ce.entityCorrelationList(correlationMap)
+}
+
+func (ce *CorrelationEngine) buildEntityProximityEvidence(logA, logB NormalizedLog, a, b Entity) CorrelationEvidence {
+	timeDiff := logA.Timestamp.Sub(logB.Timestamp)
+	if timeDiff < 0 {
+		timeDiff = -timeDiff
+	}
+
+	matched := map[string]string{
+		a.Type: a.Value,
+		b.Type: b.Value,
+	}
+	if logA.CompanyCode != "" && logA.CompanyCode == logB.CompanyCode {
+		matched["company_code"] = logA.CompanyCode
+	}
+	if logA.Host != "" && logA.Host == logB.Host {
+		matched["host"] = logA.Host
+	}
+
+	return CorrelationEvidence{
+		LogIDs:            []string{logA.ID, logB.ID},
+		Timestamps:        []time.Time{logA.Timestamp, logB.Timestamp},
+		Sources:           []string{logA.Source, logB.Source},
+		TimeDeltaMs:       timeDiff.Milliseconds(),
+		MatchedAttributes: matched,
+	}
+}
+
+func (ce *CorrelationEngine) entityCorrelationList(correlationMap map[string]EntityCorrelation) []EntityCorrelation {
+	result := make([]EntityCorrelation, 0, len(correlationMap))
+	for _, correlation := range correlationMap {
+		result = append(result, correlation)
+	}
+	return result
+}
+
+// entityUpsertBatch bounds the rows per multi-row upsert, keeping the
+// statement well under Postgres' parameter limit.
+const entityUpsertBatch = 500
+
+// valuesPlaceholders renders "($1, $2), ($3, $4)" for a multi-row VALUES list.
+func valuesPlaceholders(rows, columns int) string {
+	placeholders := make([]string, rows)
+	for i := range placeholders {
+		marks := make([]string, columns)
+		for c := range marks {
+			marks[c] = "$" + strconv.Itoa(i*columns+c+1)
+		}
+		placeholders[i] = "(" + strings.Join(marks, ", ") + ")"
+	}
+	return strings.Join(placeholders, ", ")
+}
+
+// storeEntityCorrelations upserts the pairs in batches. The pairs must be
+// unique, as buildEntityCorrelations returns them, since one statement cannot
+// update the same row twice.
+func (ce *CorrelationEngine) storeEntityCorrelations(projectID string, correlations []EntityCorrelation) error {
+	const columns = 11
+	for start := 0; start < len(correlations); start += entityUpsertBatch {
+		batch := correlations[start:min(start+entityUpsertBatch, len(correlations))]
+
+		args := make([]interface{}, 0, len(batch)*columns)
+		for _, correlation := range batch {
+			evidence := newestEvidence(correlation.Evidence)
+			evidenceJSON, err := json.Marshal(evidence)
+			if err != nil {
+				return fmt.Errorf("failed to marshal correlation evidence: %v", err)
+			}
+			args = append(args,
+				correlation.EntityA.Type,
+				correlation.EntityA.Value,
+				correlation.EntityB.Type,
+				correlation.EntityB.Value,
+				correlation.FirstSeen,
+				correlation.LastSeen,
+				correlation.ConfidenceScore,
+				pq.Array(correlation.SourceSystems),
+				evidenceJSON,
+				max(len(evidence), 1),
+				projectID)
+		}
+
+		_, err := ce.db.Exec(`
+			INSERT INTO entity_correlations (entity_a_type, entity_a_value, entity_b_type, entity_b_value,
+				first_seen, last_seen, confidence_score, source_systems, evidence, observation_count, project_id)
+			VALUES `+valuesPlaceholders(len(batch), columns)+`
+			ON CONFLICT (project_id, entity_a_type, entity_a_value, entity_b_type, entity_b_value)
+			DO UPDATE SET
+				first_seen = LEAST(entity_correlations.first_seen, EXCLUDED.first_seen),
+				last_seen = GREATEST(entity_correlations.last_seen, EXCLUDED.last_seen),
+				confidence_score = GREATEST(entity_correlations.confidence_score, EXCLUDED.confidence_score),
+				observation_count = entity_correlations.observation_count + jsonb_array_length(unseen_evidence(entity_correlations.evidence, EXCLUDED.evidence)),
+				source_systems = array(SELECT DISTINCT unnest(entity_correlations.source_systems || EXCLUDED.source_systems)),
+				evidence = (
+					SELECT COALESCE(jsonb_agg(entry ORDER BY position), '[]'::jsonb) FROM (
+						SELECT entry, position
+						FROM jsonb_array_elements(entity_correlations.evidence || unseen_evidence(entity_correlations.evidence, EXCLUDED.evidence)) WITH ORDINALITY AS e(entry, position)
+						ORDER BY position DESC
+						LIMIT `+strconv.Itoa(maxEvidencePerCorrelation)+`
+					) newest
+				)
+		`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to store entity correlations: %v", err)
+		}
+	}
+	return nil
+}
+
+func (ce *CorrelationEngine) getExistingEntityCorrelations(projectID string, logs []NormalizedLog) ([]EntityCorrelation, error) {
+	var correlations []EntityCorrelation
+
+	seen := make(map[string]bool)
+	var types, values []string
+	for _, log := range logs {
+		for _, entity := range log.Entities {
+			if seen[entity.Key()] {
+				continue
+			}
+			seen[entity.Key()] = true
+			types = append(types, entity.Type)
+			values = append(values, entity.Value)
+		}
+	}
+
+	if len(types) == 0 {
+		return correlations, nil
+	}
+
+	query := `
+		WITH wanted AS (SELECT * FROM unnest($1::text[], $2::text[]) AS w(entity_type, entity_value))
+		SELECT entity_a_type, entity_a_value, entity_b_type, entity_b_value,
+			first_seen, last_seen, confidence_score, observation_count, source_systems, evidence
+		FROM entity_correlations
+		WHERE ((entity_a_type, entity_a_value) IN (SELECT entity_type, entity_value FROM wanted)
+		    OR (entity_b_type, entity_b_value) IN (SELECT entity_type, entity_value FROM wanted))
+		  AND project_id = $5
+		  AND last_seen >= $3
+		ORDER BY last_seen DESC
+		LIMIT $4
+	`
+
+	now := time.Now()
+	rows, err := ce.db.Query(query, pq.Array(types), pq.Array(values), ce.historyCutoff(now), maxHistoricalEntityCorrelations, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var correlation EntityCorrelation
+		var evidenceJSON []byte
+
+		err := rows.Scan(
+			&correlation.EntityA.Type,
+			&correlation.EntityA.Value,
+			&correlation.EntityB.Type,
+			&correlation.EntityB.Value,
+			&correlation.FirstSeen,
+			&correlation.LastSeen,
+			&correlation.RawConfidenceScore,
+			&correlation.ObservationCount,
+			pq.Array(&correlation.SourceSystems),
+			&evidenceJSON,
+		)
+		if err != nil {
+			continue
+		}
+
+		if err := json.Unmarshal(evidenceJSON, &correlation.Evidence); err != nil {
+			correlation.Evidence = nil
+		}
+		correlation.CorrelationType = "historical"
+		correlation.ConfidenceScore = ce.decayedConfidence(correlation.RawConfidenceScore, correlation.LastSeen, correlation.ObservationCount, now)
+		if correlation.ConfidenceScore < minHistoricalConfidence {
+			continue
+		}
+		correlations = append(correlations, correlation)
+	}
+
+	return correlations, nil
+}
+
+func (ce *CorrelationEngine) mergeEntityCorrelations(new, existing []EntityCorrelation) []EntityCorrelation {
+	correlationMap := make(map[string]EntityCorrelation)
+
+	for _, correlation := range existing {
+		correlationMap[correlation.Key()] = correlation
+	}
+
+	for _, correlation := range new {
+		key := correlation.Key()
+		if existing, exists := correlationMap[key]; exists {
+			if correlation.ConfidenceScore > existing.ConfidenceScore {
+				existing.ConfidenceScore = correlation.ConfidenceScore
+			}
+			existing.EntityA.Source = correlation.EntityA.Source
+			existing.EntityB.Source = correlation.EntityB.Source
+			existing.SourceSystems = ce.mergeSources(existing.SourceSystems, correlation.SourceSystems)
+			existing.Evidence = ce.mergeEvidence(existing.Evidence, correlation.Evidence)
+			correlationMap[key] = existing
+		} else {
+			correlationMap[key] = correlation
+		}
+	}
+
+	return ce.entityCorrelationList(correlationMap)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
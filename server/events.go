@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// alertEventsChannel is the Redis pub/sub channel workers publish alert
+// events on. Every API replica subscribes and fans events out to its own
+// stream clients.
+const alertEventsChannel = "alert-events"
+
+const (
+	eventAlertReceived     = "alert-received"
+	eventAnalysisProgress  = "analysis-progress"
+	eventAnalysisCompleted = "analysis-completed" // also sent when an analysis fails for good
+)
+
+// AlertEvent is one update on the live feed.
+type AlertEvent struct {
+	Type         string    `json:"type"`
+	AlertID      string    `json:"alert_id"`
+	ProjectID    string    `json:"project_id"`
+	Status       string    `json:"status"`
+	Error        string    `json:"error,omitempty"`
+	Alert        *Alert    `json:"alert,omitempty"` // alert-received only
+	RiskScore    *int      `json:"risk_score,omitempty"`
+	RiskPriority string    `json:"risk_priority,omitempty"`
+	IncidentID   string    `json:"incident_id,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+// publishAlertEvent is best effort: a missed event only delays the dashboard
+// until its next refresh.
+func (app *App) publishAlertEvent(event AlertEvent) {
+	if app.Redis == nil {
+		return
+	}
+	event.Time = time.Now()
+	if err := app.Redis.Publish(context.Background(), alertEventsChannel, mustMarshal(event)).Err(); err != nil {
+		log.Printf("Failed to publish %s event for alert %s: %v", event.Type, event.AlertID, err)
+	}
+}
+
+// subscriberBuffer is how many events a slow client may fall behind before
+// further events are dropped for it.
+const subscriberBuffer = 64
+
+type eventSubscriber struct {
+	projects []string // nil for all projects
+	events   chan AlertEvent
+}
+
+func (s *eventSubscriber) wants(event AlertEvent) bool {
+	if s.projects == nil {
+		return true
+	}
+	for _, project := range s.projects {
+		if project == event.ProjectID {
+			return true
+		}
+	}
+	return false
+}
+
+// EventHub holds this replica's single Redis subscription and hands each
+// event to the local subscribers whose project filter matches.
+type EventHub struct {
+	redis *redis.Client
+
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewEventHub(client *redis.Client) *EventHub {
+	return &EventHub{redis: client, subscribers: make(map[*eventSubscriber]bool), closed: make(chan struct{})}
+}
+
+// Close ends every stream, current and future, so the HTTP server can shut
+// down without waiting for clients to disconnect.
+func (h *EventHub) Close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// Done is closed once the hub is closed.
+func (h *EventHub) Done() <-chan struct{} {
+	return h.closed
+}
+
+// Run relays published events until ctx is cancelled. go-redis reconnects
+// the subscription by itself if the connection drops.
+func (h *EventHub) Run(ctx context.Context) {
+	pubsub := h.redis.Subscribe(ctx, alertEventsChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-messages:
+			if !ok {
+				return
+			}
+			var event AlertEvent
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				log.Printf("Ignoring malformed alert event: %v", err)
+				continue
+			}
+			h.broadcast(event)
+		}
+	}
+}
+
+func (h *EventHub) broadcast(event AlertEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscriber := range h.subscribers {
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events for projects (all projects when nil)
+// and a function that ends the subscription.
+func (h *EventHub) Subscribe(projects []string) (<-chan AlertEvent, func()) {
+	subscriber := &eventSubscriber{projects: projects, events: make(chan AlertEvent, subscriberBuffer)}
+	h.mu.Lock()
+	h.subscribers[subscriber] = true
+	h.mu.Unlock()
+
+	return subscriber.events, func() {
+		h.mu.Lock()
+		delete(h.subscribers, subscriber)
+		h.mu.Unlock()
+	}
+}
+
+// streamEvents serves the live feed as server-sent events, optionally for a
+// single project_id, and otherwise for every project the caller can read.
+// Each event's SSE name is its type.
+func (app *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+
+	events, unsubscribe := app.Events.Subscribe(projects)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	// no-transform stops compressing proxies, including the dashboard dev
+	// server, from buffering events
+	w.Header().Set("Cache-Control", "no-cache, no-transform")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop reverse proxies such as nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	// Comments keep idle connections from being closed by proxies
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-app.Events.Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, mustMarshal(event))
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubBroadcastFiltersByProject(t *testing.T) {
+	hub := NewEventHub(nil)
+	all, unsubscribeAll := hub.Subscribe(nil)
+	defer unsubscribeAll()
+	companyA, unsubscribeA := hub.Subscribe([]string{"company-a"})
+	defer unsubscribeA()
+
+	hub.broadcast(AlertEvent{Type: eventAlertReceived, AlertID: "b-1", ProjectID: "company-b"})
+	hub.broadcast(AlertEvent{Type: eventAlertReceived, AlertID: "a-1", ProjectID: "company-a"})
+
+	if got := (<-all).AlertID; got != "b-1" {
+		t.Errorf("all-projects subscriber got %s first, want b-1", got)
+	}
+	if got := (<-all).AlertID; got != "a-1" {
+		t.Errorf("all-projects subscriber got %s second, want a-1", got)
+	}
+	if got := (<-companyA).AlertID; got != "a-1" {
+		t.Errorf("company-a subscriber got %s, want a-1", got)
+	}
+	select {
+	case event := <-companyA:
+		t.Errorf("company-a subscriber also got %+v", event)
+	default:
+	}
+}
+
+func TestShutdownEndsOpenStreams(t *testing.T) {
+	app := &App{Events: NewEventHub(nil)}
+	principal := &Principal{Name: "dashboard", Scopes: []string{scopeRead}, Projects: []string{allProjects}}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.streamEvents(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	}))
+	server.Config.RegisterOnShutdown(app.Events.Close)
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+	if line, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("stream started with %q, %v", line, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := server.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Shutdown waited %v for an open stream", elapsed)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchFile polls path every interval and calls onChange whenever its
+// modification time or size changes. It never returns; run it in a goroutine.
+func watchFile(path string, interval time.Duration, onChange func()) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		log.Printf("Detected change in %s, reloading", path)
+		onChange()
+	}
+}
+
+// watchDir is watchFile for a directory of config files: it fires when any
+// file is added, removed, modified or resized.
+func watchDir(dir string, interval time.Duration, onChange func()) {
+	fingerprint := func() string {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return ""
+		}
+		var b strings.Builder
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s:%d:%d;", entry.Name(), info.ModTime().UnixNano(), info.Size())
+		}
+		return b.String()
+	}
+
+	last := fingerprint()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		current := fingerprint()
+		if current == last {
+			continue
+		}
+		last = current
+		log.Printf("Detected change in %s, reloading", dir)
+		onChange()
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoInfo is the location and network owner of an IP address.
+type GeoInfo struct {
+	IP             string  `json:"ip"`
+	Country        string  `json:"country,omitempty"` // ISO 3166-1 alpha-2
+	CountryName    string  `json:"country_name,omitempty"`
+	City           string  `json:"city,omitempty"`
+	Latitude       float64 `json:"latitude,omitempty"`
+	Longitude      float64 `json:"longitude,omitempty"`
+	AccuracyRadius uint16  `json:"accuracy_radius_km,omitempty"`
+	ASN            uint    `json:"asn,omitempty"`
+	Org            string  `json:"org,omitempty"`
+}
+
+// HasLocation reports whether the lookup returned coordinates.
+func (g GeoInfo) HasLocation() bool {
+	return g.Latitude != 0 || g.Longitude != 0
+}
+
+type mmdbCityRecord struct {
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude       float64 `maxminddb:"latitude"`
+		Longitude      float64 `maxminddb:"longitude"`
+		AccuracyRadius uint16  `maxminddb:"accuracy_radius"`
+	} `maxminddb:"location"`
+}
+
+type mmdbASNRecord struct {
+	Number uint   `maxminddb:"autonomous_system_number"`
+	Org    string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIPResolver looks up IPs in local MaxMind-format databases: a City (or
+// Country) database and an ASN database. Either may be absent.
+type GeoIPResolver struct {
+	mu   sync.RWMutex
+	city *maxminddb.Reader
+	asn  *maxminddb.Reader
+
+	CityPath string
+	ASNPath  string
+}
+
+func NewGeoIPResolver(cityPath, asnPath string) *GeoIPResolver {
+	return &GeoIPResolver{CityPath: cityPath, ASNPath: asnPath}
+}
+
+func openMMDB(path string) (*maxminddb.Reader, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	// FromBytes rather than Open: the file is replaced on update and we don't
+	// want a memory map of the old inode
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return reader, nil
+}
+
+// Load opens both databases and swaps them in. If either fails to open, the
+// previously loaded databases stay active; a database whose file is absent
+// keeps its previously loaded version, if any.
+func (g *GeoIPResolver) Load() error {
+	city, err := openMMDB(g.CityPath)
+	if err != nil {
+		return err
+	}
+	asn, err := openMMDB(g.ASNPath)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	if city == nil {
+		city = g.city
+	}
+	if asn == nil {
+		asn = g.asn
+	}
+	if city == nil && asn == nil {
+		g.mu.Unlock()
+		return fmt.Errorf("no GeoIP databases found at %s or %s", g.CityPath, g.ASNPath)
+	}
+	previousCity, previousASN := g.city, g.asn
+	g.city, g.asn = city, asn
+	g.mu.Unlock()
+
+	for _, loaded := range []struct{ reader, previous *maxminddb.Reader }{{city, previousCity}, {asn, previousASN}} {
+		if loaded.reader != nil && loaded.reader != loaded.previous {
+			log.Printf("Loaded GeoIP database %s built %s", loaded.reader.Metadata.DatabaseType,
+				time.Unix(int64(loaded.reader.Metadata.BuildEpoch), 0).UTC().Format("2006-01-02"))
+		}
+	}
+	return nil
+}
+
+// Lookup returns what the databases know about ip, or nil for private,
+// unparseable or unknown addresses.
+func (g *GeoIPResolver) Lookup(ip string) *GeoInfo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() || parsed.IsUnspecified() {
+		return nil
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	info := GeoInfo{IP: ip}
+	found := false
+
+	if g.city != nil {
+		var record mmdbCityRecord
+		if err := g.city.Lookup(parsed, &record); err == nil && record.Country.ISOCode != "" {
+			info.Country = record.Country.ISOCode
+			info.CountryName = record.Country.Names["en"]
+			info.City = record.City.Names["en"]
+			info.Latitude = record.Location.Latitude
+			info.Longitude = record.Location.Longitude
+			info.AccuracyRadius = record.Location.AccuracyRadius
+			found = true
+		}
+	}
+
+	if g.asn != nil {
+		var record mmdbASNRecord
+		if err := g.asn.Lookup(parsed, &record); err == nil && record.Number != 0 {
+			info.ASN = record.Number
+			info.Org = record.Org
+			found = true
+		}
+	}
+
+	if !found {
+		return nil
+	}
+	return &info
+}
+
+// geoEnrichLogs resolves every IP in logs, filling in Country on logs whose
+// source didn't provide one. It returns the lookups keyed by IP.
+func (app *App) geoEnrichLogs(logs []NormalizedLog) map[string]GeoInfo {
+	if app.GeoIP == nil {
+		return nil
+	}
+
+	results := make(map[string]GeoInfo)
+	misses := make(map[string]bool)
+	for i := range logs {
+		for _, ip := range logs[i].IPAddresses {
+			info, ok := results[ip]
+			if !ok && !misses[ip] {
+				if lookup := app.GeoIP.Lookup(ip); lookup != nil {
+					info, ok = *lookup, true
+					results[ip] = info
+				} else {
+					misses[ip] = true
+				}
+			}
+			if ok && logs[i].Country == "" && info.Country != "" {
+				logs[i].Country = info.Country
+			}
+		}
+	}
+	return results
+}
+
+// geoEnrichEntities adds lookups for IP entities that no log carried, such as
+// the alert's client IP hint, to results.
+func (app *App) geoEnrichEntities(results map[string]GeoInfo, entities []Entity) map[string]GeoInfo {
+	if app.GeoIP == nil {
+		return results
+	}
+	for _, entity := range entities {
+		if entity.Type != EntityIP {
+			continue
+		}
+		if _, ok := results[entity.Value]; ok {
+			continue
+		}
+		if lookup := app.GeoIP.Lookup(entity.Value); lookup != nil {
+			if results == nil {
+				results = make(map[string]GeoInfo)
+			}
+			results[entity.Value] = *lookup
+		}
+	}
+	return results
+}
+
+const earthRadiusKm = 6371.0
+
+// haversineKm is the great-circle distance between two points.
+func haversineKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
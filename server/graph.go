@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxGraphDepth = 4
+	maxGraphNodes = 500
+
+	// maxGraphFanout caps how many neighbours, strongest first, are followed
+	// from each node, so hubs like a shared NAT address don't flood the walk.
+	maxGraphFanout = 50
+)
+
+type GraphNode struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Value         string    `json:"value"`
+	Depth         int       `json:"depth"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	SourceSystems []string  `json:"source_systems"`
+}
+
+type GraphEdge struct {
+	Source           string    `json:"source"`
+	Target           string    `json:"target"`
+	ConfidenceScore  float64   `json:"confidence_score"`
+	ObservationCount int       `json:"observation_count"`
+	LastSeen         time.Time `json:"last_seen"`
+	SourceSystems    []string  `json:"source_systems"`
+}
+
+type EntityGraph struct {
+	Root  string      `json:"root"` // value of the entity the walk started from
+	Depth int         `json:"depth"`
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// storeEntities upserts the graph nodes of the logs within the project so
+// traversals can report when and where an entity was seen, independently of
+// the edges it takes part in.
+func (ce *CorrelationEngine) storeEntities(projectID string, logs []NormalizedLog) error {
+	type sighting struct {
+		entity              Entity
+		firstSeen, lastSeen time.Time
+		sources             []string
+	}
+	// One row per entity, since a statement cannot update a row twice
+	var sightings []*sighting
+	byKey := make(map[string]*sighting)
+	for _, log := range logs {
+		for _, entity := range log.Entities {
+			s, ok := byKey[entity.Key()]
+			if !ok {
+				s = &sighting{entity: entity, firstSeen: log.Timestamp, lastSeen: log.Timestamp}
+				byKey[entity.Key()] = s
+				sightings = append(sightings, s)
+			}
+			s.firstSeen = minTime(s.firstSeen, log.Timestamp)
+			s.lastSeen = maxTime(s.lastSeen, log.Timestamp)
+			s.sources = ce.mergeSources(s.sources, []string{entity.Source})
+		}
+	}
+
+	const columns = 6
+	for start := 0; start < len(sightings); start += entityUpsertBatch {
+		batch := sightings[start:min(start+entityUpsertBatch, len(sightings))]
+		args := make([]interface{}, 0, len(batch)*columns)
+		for _, s := range batch {
+			args = append(args, s.entity.Type, s.entity.Value, s.firstSeen, s.lastSeen, pq.Array(s.sources), projectID)
+		}
+
+		_, err := ce.db.Exec(`
+			INSERT INTO entities (entity_type, entity_value, first_seen, last_seen, source_systems, project_id)
+			VALUES `+valuesPlaceholders(len(batch), columns)+`
+			ON CONFLICT (project_id, entity_type, entity_value)
+			DO UPDATE SET
+				first_seen = LEAST(entities.first_seen, EXCLUDED.first_seen),
+				last_seen = GREATEST(entities.last_seen, EXCLUDED.last_seen),
+				source_systems = array(SELECT DISTINCT unnest(entities.source_systems || EXCLUDED.source_systems))
+		`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to store entities: %v", err)
+		}
+	}
+	return nil
+}
+
+// EntityGraph walks entity_correlations from root up to depth hops, treating
+// every stored pair as an undirected edge and following at most
+// maxGraphFanout of the strongest edges per node, and returns the reachable
+// subgraph. Only pairs stored by projects are followed; nil means every
+// project. Edge confidence is decayed the same way as historical correlations.
+func (ce *CorrelationEngine) EntityGraph(projects []string, root Entity, depth int, minConfidence float64) (*EntityGraph, error) {
+	graph := &EntityGraph{Root: root.Value, Depth: depth, Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+
+	// Walk breadth-first, one level per query, so every node is expanded
+	// once at its shortest depth. Raw confidence is an upper bound of the
+	// decayed one, so it is safe to prune on it in SQL and apply the exact
+	// threshold to the edges afterwards.
+	depths := make(map[string]int)
+	var types, values []string
+	visit := func(entity Entity, d int) bool {
+		if _, seen := depths[entity.Key()]; seen {
+			return false
+		}
+		if len(types) >= maxGraphNodes {
+			return false
+		}
+		depths[entity.Key()] = d
+		types = append(types, entity.Type)
+		values = append(values, entity.Value)
+		return true
+	}
+
+	rootRows, err := ce.db.Query(`
+		SELECT DISTINCT entity_type, entity_value FROM entities
+		WHERE entity_value = $2 AND ($1 = '' OR entity_type = $1) AND ($3::text[] IS NULL OR project_id = ANY($3))
+		ORDER BY entity_type
+	`, root.Type, root.Value, pq.Array(projects))
+	if err != nil {
+		return nil, fmt.Errorf("failed to traverse entity graph: %v", err)
+	}
+	frontier, err := scanGraphEntities(rootRows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to traverse entity graph: %v", err)
+	}
+	for _, entity := range frontier {
+		visit(entity, 0)
+	}
+
+	neighbourQuery := `
+		WITH frontier AS (SELECT * FROM unnest($1::text[], $2::text[]) AS f(entity_type, entity_value)),
+		edges AS (
+			SELECT entity_a_type AS src_type, entity_a_value AS src_value,
+				entity_b_type AS dst_type, entity_b_value AS dst_value, confidence_score, last_seen
+			FROM entity_correlations
+			WHERE (entity_a_type, entity_a_value) IN (SELECT entity_type, entity_value FROM frontier)
+			  AND confidence_score >= $3 AND ($5::text[] IS NULL OR project_id = ANY($5))
+			UNION ALL
+			SELECT entity_b_type, entity_b_value, entity_a_type, entity_a_value, confidence_score, last_seen
+			FROM entity_correlations
+			WHERE (entity_b_type, entity_b_value) IN (SELECT entity_type, entity_value FROM frontier)
+			  AND confidence_score >= $3 AND ($5::text[] IS NULL OR project_id = ANY($5))
+		),
+		ranked AS (
+			SELECT dst_type, dst_value, ROW_NUMBER() OVER (
+				PARTITION BY src_type, src_value ORDER BY confidence_score DESC, last_seen DESC
+			) AS rank
+			FROM edges
+		)
+		SELECT dst_type, dst_value FROM ranked
+		WHERE rank <= $4
+		GROUP BY dst_type, dst_value
+		ORDER BY MIN(rank), dst_type, dst_value
+	`
+	for d := 1; d <= depth && len(frontier) > 0 && len(types) < maxGraphNodes; d++ {
+		frontierTypes := make([]string, len(frontier))
+		frontierValues := make([]string, len(frontier))
+		for i, entity := range frontier {
+			frontierTypes[i], frontierValues[i] = entity.Type, entity.Value
+		}
+
+		rows, err := ce.db.Query(neighbourQuery, pq.Array(frontierTypes), pq.Array(frontierValues), minConfidence, maxGraphFanout,
+			pq.Array(projects))
+		if err != nil {
+			return nil, fmt.Errorf("failed to traverse entity graph: %v", err)
+		}
+		neighbours, err := scanGraphEntities(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to traverse entity graph: %v", err)
+		}
+
+		frontier = nil
+		for _, entity := range neighbours {
+			if visit(entity, d) {
+				frontier = append(frontier, entity)
+			}
+		}
+	}
+
+	if len(types) == 0 {
+		return graph, nil
+	}
+
+	rows, err := ce.db.Query(`
+		WITH nodes AS (SELECT * FROM unnest($1::text[], $2::text[]) AS n(entity_type, entity_value))
+		SELECT entity_type, entity_value, first_seen, last_seen, source_systems
+		FROM entities
+		WHERE (entity_type, entity_value) IN (SELECT entity_type, entity_value FROM nodes)
+		  AND ($3::text[] IS NULL OR project_id = ANY($3))
+	`, pq.Array(types), pq.Array(values), pq.Array(projects))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load graph nodes: %v", err)
+	}
+	defer rows.Close()
+
+	// An entity seen by several of the projects is folded into one node
+	nodeIndex := make(map[string]int)
+	for rows.Next() {
+		var node GraphNode
+		if err := rows.Scan(&node.Type, &node.Value, &node.FirstSeen, &node.LastSeen, pq.Array(&node.SourceSystems)); err != nil {
+			continue
+		}
+		node.ID = Entity{Type: node.Type, Value: node.Value}.Key()
+		node.Depth = depths[node.ID]
+		i, ok := nodeIndex[node.ID]
+		if !ok {
+			nodeIndex[node.ID] = len(graph.Nodes)
+			graph.Nodes = append(graph.Nodes, node)
+			continue
+		}
+		merged := &graph.Nodes[i]
+		merged.FirstSeen = minTime(merged.FirstSeen, node.FirstSeen)
+		merged.LastSeen = maxTime(merged.LastSeen, node.LastSeen)
+		merged.SourceSystems = ce.mergeSources(merged.SourceSystems, node.SourceSystems)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].Depth < graph.Nodes[j].Depth })
+
+	if len(graph.Nodes) == 0 {
+		return graph, nil
+	}
+
+	edgeQuery := `
+		WITH nodes AS (SELECT * FROM unnest($1::text[], $2::text[]) AS n(entity_type, entity_value))
+		SELECT entity_a_type, entity_a_value, entity_b_type, entity_b_value,
+			confidence_score, observation_count, last_seen, source_systems
+		FROM entity_correlations
+		WHERE (entity_a_type, entity_a_value) IN (SELECT entity_type, entity_value FROM nodes)
+		  AND (entity_b_type, entity_b_value) IN (SELECT entity_type, entity_value FROM nodes)
+		  AND confidence_score >= $3 AND ($4::text[] IS NULL OR project_id = ANY($4))
+	`
+
+	edgeRows, err := ce.db.Query(edgeQuery, pq.Array(types), pq.Array(values), minConfidence, pq.Array(projects))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load graph edges: %v", err)
+	}
+	defer edgeRows.Close()
+
+	// A pair stored by several of the projects is folded into one edge: its
+	// strongest confidence, all observations.
+	now := time.Now()
+	edgeIndex := make(map[string]int)
+	for edgeRows.Next() {
+		var a, b Entity
+		var edge GraphEdge
+		var rawConfidence float64
+		if err := edgeRows.Scan(&a.Type, &a.Value, &b.Type, &b.Value, &rawConfidence,
+			&edge.ObservationCount, &edge.LastSeen, pq.Array(&edge.SourceSystems)); err != nil {
+			continue
+		}
+		edge.ConfidenceScore = ce.decayedConfidence(rawConfidence, edge.LastSeen, edge.ObservationCount, now)
+		if edge.ConfidenceScore < minConfidence {
+			continue
+		}
+		edge.Source = a.Key()
+		edge.Target = b.Key()
+
+		key := edge.Source + "|" + edge.Target
+		i, ok := edgeIndex[key]
+		if !ok {
+			edgeIndex[key] = len(graph.Edges)
+			graph.Edges = append(graph.Edges, edge)
+			continue
+		}
+		merged := &graph.Edges[i]
+		merged.ConfidenceScore = max(merged.ConfidenceScore, edge.ConfidenceScore)
+		merged.ObservationCount += edge.ObservationCount
+		merged.LastSeen = maxTime(merged.LastSeen, edge.LastSeen)
+		merged.SourceSystems = ce.mergeSources(merged.SourceSystems, edge.SourceSystems)
+	}
+
+	return graph, edgeRows.Err()
+}
+
+func scanGraphEntities(rows *sql.Rows) ([]Entity, error) {
+	defer rows.Close()
+	var entities []Entity
+	for rows.Next() {
+		var entity Entity
+		if err := rows.Scan(&entity.Type, &entity.Value); err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, rows.Err()
+}
+
+// parseEntityParam accepts "type:value" or a bare value that matches any type.
+func parseEntityParam(param string) Entity {
+	if i := strings.Index(param, ":"); i > 0 {
+		if entityType := param[:i]; isEntityType(entityType) {
+			return Entity{Type: entityType, Value: param[i+1:]}
+		}
+	}
+	return Entity{Value: param}
+}
+
+func (app *App) getEntityGraph(w http.ResponseWriter, r *http.Request) {
+	entityParam := r.URL.Query().Get("entity")
+	if entityParam == "" {
+		http.Error(w, "entity parameter is required", http.StatusBadRequest)
+		return
+	}
+	root := parseEntityParam(entityParam)
+
+	depth := 2
+	if value := r.URL.Query().Get("depth"); value != "" {
+		d, err := strconv.Atoi(value)
+		if err != nil || d < 0 {
+			http.Error(w, "depth must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		depth = d
+	}
+	if depth > maxGraphDepth {
+		depth = maxGraphDepth
+	}
+
+	minConfidence := 0.0
+	if value := r.URL.Query().Get("min_confidence"); value != "" {
+		c, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, "min_confidence must be a number", http.StatusBadRequest)
+			return
+		}
+		minConfidence = c
+	}
+
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+
+	graph, err := app.Correlator.EntityGraph(projects, root, depth, minConfidence)
+	if err != nil {
+		http.Error(w, "Failed to build entity graph", http.StatusInternalServerError)
+		return
+	}
+	if len(graph.Nodes) == 0 {
+		http.Error(w, "Entity not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graph)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lib/pq"
+)
+
+// defaultIncidentWindow is how long after its last alert an incident keeps
+// absorbing new alerts that share entities or a rule signature with it.
+const defaultIncidentWindow = time.Hour
+
+// incidentEntityTypes are the entities specific enough to merge alerts into
+// one incident. User agents and JA3 fingerprints are shared by unrelated
+// clients and would chain everything together.
+var incidentEntityTypes = map[string]bool{
+	EntityIP:           true,
+	EntityUserEmail:    true,
+	EntityUserName:     true,
+	EntityHostname:     true,
+	EntitySessionID:    true,
+	EntityDeviceID:     true,
+	EntityAWSAccessKey: true,
+	EntityFileHash:     true,
+}
+
+// maxIncidentEntities caps the entities kept per incident; the earliest ones
+// are kept since they describe what the incident started from.
+const maxIncidentEntities = 100
+
+type Incident struct {
+	ID         string    `json:"id"`
+	ProjectID  string    `json:"project_id"`
+	Title      string    `json:"title"`
+	Status     string    `json:"status"`
+	Severity   string    `json:"severity"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	AlertCount int       `json:"alert_count"`
+	Entities   []string  `json:"entities"`
+	Signatures []string  `json:"signatures"`
+	AlertIDs   []string  `json:"alert_ids,omitempty"`
+}
+
+type IncidentManager struct {
+	db *sql.DB
+
+	// Window bounds the time proximity between an incident and a new alert.
+	Window time.Duration
+}
+
+func NewIncidentManager(db *sql.DB) *IncidentManager {
+	return &IncidentManager{db: db, Window: defaultIncidentWindow}
+}
+
+var signatureNoiseRegex = regexp.MustCompile(`[0-9]+`)
+
+// alertRuleID returns the rule identifier carried in the alert's raw data.
+func alertRuleID(alert Alert) string {
+	for _, key := range []string{"ruleId", "rule_id", "terminatingRuleId", "Rule_name", "rule"} {
+		if value := toString(alert.RawData[key]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// alertSignature identifies the detection that fired, preferring an explicit
+// rule identifier and falling back to the message with numbers stripped.
+func alertSignature(alert Alert) string {
+	rule := alertRuleID(alert)
+	if rule == "" {
+		rule = signatureNoiseRegex.ReplaceAllString(strings.ToLower(alert.Message), "#")
+	}
+
+	sum := sha1.Sum([]byte(alert.Source + "|" + rule))
+	return alert.Source + ":" + hex.EncodeToString(sum[:])[:12]
+}
+
+// alertEntities extracts the entities carried by the alert itself plus users
+// that are linked with high confidence to its IPs in the current analysis.
+func (app *App) alertEntities(alert Alert, correlationResult *CorrelationResult) []Entity {
+	var entities []Entity
+	if len(alert.RawData) > 0 {
+		line := string(mustMarshal(alert.RawData))
+		if normalized, err := app.Normalizer.NormalizeLog(LokiLog{Timestamp: alert.Timestamp, Line: line}); err == nil {
+			entities = normalized.Entities
+		}
+	}
+
+	alertIPs := make(map[string]bool)
+	for _, entity := range entities {
+		if entity.Type == EntityIP {
+			alertIPs[entity.Value] = true
+		}
+	}
+
+	if correlationResult != nil {
+		for _, correlation := range correlationResult.UserCorrelations {
+			if alertIPs[correlation.IPAddress] && correlation.ConfidenceScore > 0.7 {
+				entities = append(entities, Entity{Type: EntityUserEmail, Value: correlation.UserIdentifier, Source: alert.Source})
+			}
+		}
+	}
+
+	return entities
+}
+
+var severityRank = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+func maxSeverity(a, b string) string {
+	if severityRank[strings.ToLower(b)] > severityRank[strings.ToLower(a)] {
+		return b
+	}
+	return a
+}
+
+// AssignAlert attaches the alert to the best matching open incident in its
+// project or opens a new one. Candidates must have been active within Window
+// of the alert; they match on shared entities, or on the rule signature when
+// the alert carries no entities at all. Only incidentEntityTypes count as
+// shared entities.
+func (im *IncidentManager) AssignAlert(alert Alert, entities []Entity) (*Incident, error) {
+	entityKeys := make([]string, 0, len(entities))
+	seen := make(map[string]bool)
+	for _, entity := range entities {
+		if incidentEntityTypes[entity.Type] && !seen[entity.Key()] && len(entityKeys) < maxIncidentEntities {
+			seen[entity.Key()] = true
+			entityKeys = append(entityKeys, entity.Key())
+		}
+	}
+	signature := alertSignature(alert)
+
+	tx, err := im.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Serialize assignment per project so concurrent workers don't open
+	// duplicate incidents for the same burst of alerts.
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, "incident:"+alert.ProjectID); err != nil {
+		return nil, fmt.Errorf("failed to lock project incidents: %v", err)
+	}
+
+	// Retried analyses must not count the same alert twice
+	var existingID string
+	err = tx.QueryRow(`SELECT incident_id FROM incident_alerts WHERE alert_id = $1`, alert.ID).Scan(&existingID)
+	if err == nil {
+		tx.Commit()
+		return im.GetIncident(existingID)
+	} else if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to look up alert incident: %v", err)
+	}
+
+	query := `
+		SELECT id,
+			cardinality(ARRAY(SELECT unnest(entities) INTERSECT SELECT unnest($3::text[]))) AS shared,
+			$4 = ANY(signatures) AS same_signature
+		FROM incidents
+		WHERE project_id = $1 AND status = 'open' AND last_seen >= $2
+		  AND (entities && $3::text[] OR (cardinality($3::text[]) = 0 AND $4 = ANY(signatures)))
+		ORDER BY shared DESC, same_signature DESC, last_seen DESC
+		LIMIT 1
+	`
+
+	var incidentID string
+	var shared int
+	var sameSignature bool
+	err = tx.QueryRow(query, alert.ProjectID, alert.Timestamp.Add(-im.Window), pq.Array(entityKeys), signature).
+		Scan(&incidentID, &shared, &sameSignature)
+
+	switch {
+	case err == sql.ErrNoRows:
+		incidentID = "inc-" + generateID()
+		_, err = tx.Exec(`
+			INSERT INTO incidents (id, project_id, title, status, severity, first_seen, last_seen, alert_count, entities, signatures)
+			VALUES ($1, $2, $3, 'open', $4, $5, $5, 1, $6, $7)
+		`, incidentID, alert.ProjectID, alert.Message, alert.Severity, alert.Timestamp, pq.Array(entityKeys), pq.Array([]string{signature}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create incident: %v", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to find matching incident: %v", err)
+	default:
+		var severity string
+		if err := tx.QueryRow(`SELECT severity FROM incidents WHERE id = $1`, incidentID).Scan(&severity); err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			UPDATE incidents SET
+				last_seen = GREATEST(last_seen, $2),
+				first_seen = LEAST(first_seen, $2),
+				alert_count = alert_count + 1,
+				severity = $3,
+				entities = array(
+					SELECT entity FROM unnest(entities || $4::text[]) WITH ORDINALITY AS e(entity, position)
+					GROUP BY entity ORDER BY MIN(position) LIMIT $6
+				),
+				signatures = array(SELECT DISTINCT unnest(signatures || $5::text[])),
+				updated_at = NOW()
+			WHERE id = $1
+		`, incidentID, alert.Timestamp, maxSeverity(severity, alert.Severity), pq.Array(entityKeys), pq.Array([]string{signature}), maxIncidentEntities)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update incident: %v", err)
+		}
+	}
+
+	reason := "new_incident"
+	if shared > 0 {
+		reason = fmt.Sprintf("shared_entities:%d", shared)
+	} else if sameSignature {
+		reason = "same_signature"
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO incident_alerts (incident_id, alert_id, alert_timestamp, match_reason)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (alert_id) DO NOTHING
+	`, incidentID, alert.ID, alert.Timestamp, reason)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link alert to incident: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return im.GetIncident(incidentID)
+}
+
+func (im *IncidentManager) GetIncident(incidentID string) (*Incident, error) {
+	var incident Incident
+	query := `
+		SELECT id, project_id, title, status, severity, first_seen, last_seen, alert_count, entities, signatures
+		FROM incidents WHERE id = $1
+	`
+	err := im.db.QueryRow(query, incidentID).Scan(
+		&incident.ID,
+		&incident.ProjectID,
+		&incident.Title,
+		&incident.Status,
+		&incident.Severity,
+		&incident.FirstSeen,
+		&incident.LastSeen,
+		&incident.AlertCount,
+		pq.Array(&incident.Entities),
+		pq.Array(&incident.Signatures),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := im.db.Query(`SELECT alert_id FROM incident_alerts WHERE incident_id = $1 ORDER BY alert_timestamp`, incidentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var alertID string
+		if err := rows.Scan(&alertID); err != nil {
+			continue
+		}
+		incident.AlertIDs = append(incident.AlertIDs, alertID)
+	}
+
+	return &incident, rows.Err()
+}
+
+// ListIncidents lists the most recently active incidents of projects, or of
+// every project when projects is nil.
+func (im *IncidentManager) ListIncidents(projects []string, status string, limit int) ([]Incident, error) {
+	query := `
+		SELECT id, project_id, title, status, severity, first_seen, last_seen, alert_count, entities, signatures
+		FROM incidents
+		WHERE ($1::text[] IS NULL OR project_id = ANY($1)) AND ($2 = '' OR status = $2)
+		ORDER BY last_seen DESC
+		LIMIT $3
+	`
+
+	rows, err := im.db.Query(query, pq.Array(projects), status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	incidents := []Incident{}
+	for rows.Next() {
+		var incident Incident
+		err := rows.Scan(
+			&incident.ID,
+			&incident.ProjectID,
+			&incident.Title,
+			&incident.Status,
+			&incident.Severity,
+			&incident.FirstSeen,
+			&incident.LastSeen,
+			&incident.AlertCount,
+			pq.Array(&incident.Entities),
+			pq.Array(&incident.Signatures),
+		)
+		if err != nil {
+			continue
+		}
+		incidents = append(incidents, incident)
+	}
+
+	return incidents, rows.Err()
+}
+
+func (app *App) listIncidents(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if value := r.URL.Query().Get("limit"); value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil || l <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if l < 500 {
+			limit = l
+		} else {
+			limit = 500
+		}
+	}
+
+	projects, ok := requestProjects(r)
+	if !ok {
+		http.Error(w, "Not allowed to read this project", http.StatusForbidden)
+		return
+	}
+	incidents, err := app.Incidents.ListIncidents(projects, r.URL.Query().Get("status"), limit)
+	if err != nil {
+		http.Error(w, "Failed to list incidents", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incidents)
+}
+
+func (app *App) getIncident(w http.ResponseWriter, r *http.Request) {
+	incident, err := app.Incidents.GetIncident(chi.URLParam(r, "incident_id"))
+	if err == nil {
+		auditProjects(r.Context(), incident.ProjectID)
+	}
+	if err != nil || !principalFrom(r.Context()).CanAccess(incident.ProjectID) {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incident)
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxIngestBody bounds vendor payloads; Security Hub batches are the largest
+// at up to 100 findings.
+const maxIngestBody = 10 << 20
+
+// alertAdapter turns one native vendor payload into alerts. RawData keeps the
+// vendor's own record, plus the ruleId, clientIP, userName and hostname hints
+// that dedup, suppressions and incident grouping read, when the record has
+// them. ExternalID is the vendor's ID for this version of the record, so a
+// redelivered payload is recognised. Resolved or informational notifications
+// yield no alerts.
+type alertAdapter func(data []byte) ([]Alert, error)
+
+var alertAdapters = map[string]alertAdapter{
+	"guardduty":    parseGuardDutyEvent,
+	"asff":         parseASFFFindings,
+	"azure":        parseAzureMonitorAlert,
+	"alertmanager": parseAlertmanagerWebhook,
+	"deepsecurity": parseDeepSecurityEvents,
+}
+
+// handleAlertIngest accepts a native payload on /alerts/ingest/{format}. The
+// project_id query parameter sets the project for every alert in it;
+// Alertmanager alerts may carry a project label instead.
+func (app *App) handleAlertIngest(w http.ResponseWriter, r *http.Request) {
+	format := chi.URLParam(r, "format")
+	adapter, ok := alertAdapters[format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown ingest format %q", format), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxIngestBody+1))
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxIngestBody {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	alerts, err := adapter(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s payload: %v", format, err), http.StatusBadRequest)
+		return
+	}
+
+	principal := principalFrom(r.Context())
+	projectID := r.URL.Query().Get("project_id")
+	projects := make([]string, len(alerts))
+	for i := range alerts {
+		if projectID != "" {
+			alerts[i].ProjectID = projectID
+		}
+		projects[i] = alerts[i].ProjectID
+	}
+	auditProjects(r.Context(), projects...)
+	for i := range alerts {
+		if field := validateIdentifier("project_id", alerts[i].ProjectID, maxProjectIDLength); field != nil {
+			writeValidationError(w, http.StatusUnprocessableEntity, "validation_failed", "Alert failed validation", []FieldError{*field})
+			return
+		}
+		if !principal.CanAccess(alerts[i].ProjectID) {
+			writeValidationError(w, http.StatusForbidden, "forbidden",
+				fmt.Sprintf("Not allowed to submit alerts for project %s", alerts[i].ProjectID), nil)
+			return
+		}
+		// The vendor can't correct a bad event time, so analyse it around
+		// receipt instead of rejecting the payload
+		now := time.Now()
+		if alerts[i].Timestamp.IsZero() {
+			alerts[i].Timestamp = now
+		} else if message := alertTimeError(alerts[i].Timestamp, now); message != "" {
+			log.Printf("%s alert %s timestamp %s %s, using receipt time", format, alerts[i].ExternalID,
+				alerts[i].Timestamp.Format(time.RFC3339), message)
+			alerts[i].Timestamp = now
+		}
+	}
+
+	// Any failure fails the delivery so the vendor retries it; the alerts
+	// that did get through are recognised by their external IDs
+	results, errs := app.acceptAlerts(r.Context(), alerts)
+	for _, err := range errs {
+		if err != nil {
+			log.Printf("Failed to accept %s alert: %v", format, err)
+			http.Error(w, "Failed to queue analysis", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	auditDetail(r.Context(), "alerts", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// decodeRecord unmarshals one vendor record both into its typed view and
+// into the generic map kept as RawData.
+func decodeRecord(data []byte, typed interface{}) (map[string]interface{}, error) {
+	if err := json.Unmarshal(data, typed); err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// setHint adds a normalized field to RawData unless the vendor record
+// already uses that key.
+func setHint(raw map[string]interface{}, key, value string) {
+	if value == "" {
+		return
+	}
+	if _, exists := raw[key]; !exists {
+		raw[key] = value
+	}
+}
+
+// externalID joins a vendor record ID with whatever distinguishes versions
+// of the record, hashing the result if it is too long to store. Records
+// without an ID get none.
+func externalID(id string, version ...string) string {
+	if id == "" {
+		return ""
+	}
+	parts := []string{id}
+	for _, v := range version {
+		if v != "" {
+			parts = append(parts, v)
+		}
+	}
+	joined := strings.Join(parts, "@")
+	if len(joined) > maxExternalIDLen {
+		sum := sha256.Sum256([]byte(joined))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return joined
+}
+
+// parseTimestamp returns the first value that parses, in UTC; vendors send
+// their own offsets but the alert tables store times without one.
+func parseTimestamp(values ...string) time.Time {
+	for _, value := range values {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// hostFromInstance strips the port from a host:port target.
+func hostFromInstance(instance string) string {
+	if host, _, err := net.SplitHostPort(instance); err == nil {
+		return host
+	}
+	return instance
+}
+
+// GuardDuty findings as delivered by EventBridge.
+type guardDutyEvent struct {
+	DetailType string          `json:"detail-type"`
+	Source     string          `json:"source"`
+	Account    string          `json:"account"`
+	Time       string          `json:"time"`
+	Detail     guardDutyDetail `json:"detail"`
+}
+
+type guardDutyRemoteIP struct {
+	RemoteIPDetails struct {
+		IPAddressV4 string `json:"ipAddressV4"`
+	} `json:"remoteIpDetails"`
+}
+
+type guardDutyDetail struct {
+	ID        string  `json:"id"`
+	Type      string  `json:"type"`
+	Title     string  `json:"title"`
+	Severity  float64 `json:"severity"`
+	UpdatedAt string  `json:"updatedAt"`
+	Resource  struct {
+		AccessKeyDetails struct {
+			UserName string `json:"userName"`
+		} `json:"accessKeyDetails"`
+		InstanceDetails struct {
+			InstanceID string `json:"instanceId"`
+		} `json:"instanceDetails"`
+	} `json:"resource"`
+	Service struct {
+		Action struct {
+			AwsAPICallAction        guardDutyRemoteIP `json:"awsApiCallAction"`
+			NetworkConnectionAction guardDutyRemoteIP `json:"networkConnectionAction"`
+			KubernetesAPICall       guardDutyRemoteIP `json:"kubernetesApiCallAction"`
+			RDSLoginAttemptAction   guardDutyRemoteIP `json:"rdsLoginAttemptAction"`
+			PortProbeAction         struct {
+				PortProbeDetails []guardDutyRemoteIP `json:"portProbeDetails"`
+			} `json:"portProbeAction"`
+		} `json:"action"`
+	} `json:"service"`
+}
+
+func (d guardDutyDetail) remoteIP() string {
+	action := d.Service.Action
+	for _, candidate := range []guardDutyRemoteIP{action.AwsAPICallAction, action.NetworkConnectionAction, action.KubernetesAPICall, action.RDSLoginAttemptAction} {
+		if ip := candidate.RemoteIPDetails.IPAddressV4; ip != "" {
+			return ip
+		}
+	}
+	for _, probe := range action.PortProbeAction.PortProbeDetails {
+		if ip := probe.RemoteIPDetails.IPAddressV4; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// guardDutySeverity follows GuardDuty's documented bands.
+func guardDutySeverity(score float64) string {
+	switch {
+	case score >= 9:
+		return "critical"
+	case score >= 7:
+		return "high"
+	case score >= 4:
+		return "medium"
+	}
+	return "low"
+}
+
+func parseGuardDutyEvent(data []byte) ([]Alert, error) {
+	var event guardDutyEvent
+	raw, err := decodeRecord(data, &event)
+	if err != nil {
+		return nil, err
+	}
+	if event.Source != "aws.guardduty" && event.DetailType != "GuardDuty Finding" {
+		return nil, fmt.Errorf("not a GuardDuty finding event (source %q)", event.Source)
+	}
+	detail := event.Detail
+	if detail.Type == "" {
+		return nil, fmt.Errorf("finding has no type")
+	}
+
+	setHint(raw, "ruleId", detail.Type)
+	setHint(raw, "clientIP", detail.remoteIP())
+	setHint(raw, "userName", detail.Resource.AccessKeyDetails.UserName)
+	setHint(raw, "hostname", detail.Resource.InstanceDetails.InstanceID)
+
+	message := detail.Title
+	if message == "" {
+		message = detail.Type
+	}
+	// GuardDuty updates a finding in place as it recurs
+	return []Alert{{
+		Timestamp:  parseTimestamp(detail.UpdatedAt, event.Time),
+		Source:     "aws_guardduty",
+		Severity:   guardDutySeverity(detail.Severity),
+		Message:    message,
+		ExternalID: externalID(detail.ID, detail.UpdatedAt),
+		RawData:    raw,
+	}}, nil
+}
+
+// AWS Security Finding Format, as a BatchImportFindings body ({"Findings":
+// [...]}), a Security Hub EventBridge event ({"detail": {"findings": [...]}}),
+// a bare array or a single finding.
+type asffFinding struct {
+	ID          string   `json:"Id"`
+	ProductArn  string   `json:"ProductArn"`
+	ProductName string   `json:"ProductName"`
+	GeneratorID string   `json:"GeneratorId"`
+	Title       string   `json:"Title"`
+	Description string   `json:"Description"`
+	Types       []string `json:"Types"`
+	UpdatedAt   string   `json:"UpdatedAt"`
+	CreatedAt   string   `json:"CreatedAt"`
+	Severity    struct {
+		Label      string `json:"Label"`
+		Normalized int    `json:"Normalized"`
+	} `json:"Severity"`
+	Workflow struct {
+		Status string `json:"Status"`
+	} `json:"Workflow"`
+	Network struct {
+		SourceIPV4 string `json:"SourceIpV4"`
+		SourceIPV6 string `json:"SourceIpV6"`
+	} `json:"Network"`
+	Resources []struct {
+		Type string `json:"Type"`
+		ID   string `json:"Id"`
+	} `json:"Resources"`
+}
+
+func asffRecords(data []byte) ([]json.RawMessage, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var records []json.RawMessage
+		err := json.Unmarshal(data, &records)
+		return records, err
+	}
+
+	var envelope struct {
+		Findings      []json.RawMessage `json:"Findings"`
+		SchemaVersion string            `json:"SchemaVersion"`
+		Detail        struct {
+			Findings []json.RawMessage `json:"findings"`
+		} `json:"detail"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	switch {
+	case envelope.Findings != nil:
+		return envelope.Findings, nil
+	case envelope.Detail.Findings != nil:
+		return envelope.Detail.Findings, nil
+	case envelope.SchemaVersion != "":
+		return []json.RawMessage{data}, nil
+	}
+	return nil, fmt.Errorf("no findings found")
+}
+
+// asffSource maps the producing product to our source names so that source
+// reliability and detection routing treat them like their native feeds.
+func asffSource(finding asffFinding) string {
+	product := strings.ToLower(finding.ProductName + " " + finding.ProductArn)
+	switch {
+	case strings.Contains(product, "guardduty"):
+		return "aws_guardduty"
+	case strings.Contains(product, "waf"):
+		return "aws_waf"
+	}
+	return "aws_securityhub"
+}
+
+func asffSeverity(finding asffFinding) string {
+	switch strings.ToUpper(finding.Severity.Label) {
+	case "CRITICAL":
+		return "critical"
+	case "HIGH":
+		return "high"
+	case "MEDIUM":
+		return "medium"
+	case "LOW", "INFORMATIONAL":
+		return "low"
+	}
+	// Older findings only carry the 0-100 normalized score
+	switch n := finding.Severity.Normalized; {
+	case n >= 90:
+		return "critical"
+	case n >= 70:
+		return "high"
+	case n >= 40:
+		return "medium"
+	}
+	return "low"
+}
+
+func parseASFFFindings(data []byte) ([]Alert, error) {
+	records, err := asffRecords(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []Alert
+	for i, record := range records {
+		var finding asffFinding
+		raw, err := decodeRecord(record, &finding)
+		if err != nil {
+			return nil, fmt.Errorf("finding %d: %v", i, err)
+		}
+		if finding.ID == "" || finding.Title == "" {
+			return nil, fmt.Errorf("finding %d: Id and Title are required", i)
+		}
+		// Findings an analyst already resolved or suppressed in Security Hub
+		if status := strings.ToUpper(finding.Workflow.Status); status == "RESOLVED" || status == "SUPPRESSED" {
+			continue
+		}
+		if strings.EqualFold(finding.Severity.Label, "INFORMATIONAL") {
+			continue
+		}
+
+		setHint(raw, "ruleId", finding.GeneratorID)
+		clientIP := finding.Network.SourceIPV4
+		if clientIP == "" {
+			clientIP = finding.Network.SourceIPV6
+		}
+		setHint(raw, "clientIP", clientIP)
+		for _, resource := range finding.Resources {
+			if resource.Type == "AwsEc2Instance" {
+				setHint(raw, "hostname", resource.ID[strings.LastIndex(resource.ID, "/")+1:])
+				break
+			}
+		}
+
+		alerts = append(alerts, Alert{
+			Timestamp:  parseTimestamp(finding.UpdatedAt, finding.CreatedAt),
+			Source:     asffSource(finding),
+			Severity:   asffSeverity(finding),
+			Message:    finding.Title,
+			ExternalID: externalID(finding.ID, finding.UpdatedAt),
+			RawData:    raw,
+		})
+	}
+	return alerts, nil
+}
+
+// Azure Monitor common alert schema.
+type azureMonitorAlert struct {
+	SchemaID string `json:"schemaId"`
+	Data     struct {
+		Essentials struct {
+			AlertID            string   `json:"alertId"`
+			AlertRule          string   `json:"alertRule"`
+			Severity           string   `json:"severity"`
+			MonitorCondition   string   `json:"monitorCondition"`
+			MonitoringService  string   `json:"monitoringService"`
+			ConfigurationItems []string `json:"configurationItems"`
+			FiredDateTime      string   `json:"firedDateTime"`
+			Description        string   `json:"description"`
+		} `json:"essentials"`
+	} `json:"data"`
+}
+
+var azureSeverities = map[string]string{
+	"Sev0": "critical",
+	"Sev1": "high",
+	"Sev2": "medium",
+	"Sev3": "low",
+	"Sev4": "low",
+}
+
+func parseAzureMonitorAlert(data []byte) ([]Alert, error) {
+	var payload azureMonitorAlert
+	raw, err := decodeRecord(data, &payload)
+	if err != nil {
+		return nil, err
+	}
+	if payload.SchemaID != "azureMonitorCommonAlertSchema" {
+		return nil, fmt.Errorf("schemaId must be azureMonitorCommonAlertSchema, got %q", payload.SchemaID)
+	}
+	essentials := payload.Data.Essentials
+	if essentials.MonitorCondition == "Resolved" {
+		return nil, nil
+	}
+
+	severity, ok := azureSeverities[essentials.Severity]
+	if !ok {
+		severity = "medium"
+	}
+	message := essentials.AlertRule
+	if essentials.Description != "" {
+		message += ": " + essentials.Description
+	}
+
+	// WAF alerts come from Application Gateway or Front Door diagnostics
+	source := "azure_monitor"
+	if strings.Contains(strings.ToLower(essentials.AlertRule+" "+essentials.Description), "waf") {
+		source = "azure_waf"
+	}
+
+	setHint(raw, "ruleId", essentials.AlertRule)
+	if len(essentials.ConfigurationItems) > 0 {
+		setHint(raw, "hostname", essentials.ConfigurationItems[0])
+	}
+	return []Alert{{
+		Timestamp:  parseTimestamp(essentials.FiredDateTime),
+		Source:     source,
+		Severity:   severity,
+		Message:    message,
+		ExternalID: externalID(essentials.AlertID),
+		RawData:    raw,
+	}}, nil
+}
+
+// Prometheus Alertmanager webhook, one alert per firing entry.
+type alertmanagerWebhook struct {
+	Version  string            `json:"version"`
+	GroupKey string            `json:"groupKey"`
+	Receiver string            `json:"receiver"`
+	Alerts   []json.RawMessage `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	StartsAt    string            `json:"startsAt"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+var alertmanagerSeverities = map[string]string{
+	"critical": "critical",
+	"page":     "critical",
+	"error":    "high",
+	"high":     "high",
+	"warning":  "medium",
+	"medium":   "medium",
+	"info":     "low",
+	"low":      "low",
+}
+
+func parseAlertmanagerWebhook(data []byte) ([]Alert, error) {
+	var webhook alertmanagerWebhook
+	if err := json.Unmarshal(data, &webhook); err != nil {
+		return nil, err
+	}
+	if webhook.Alerts == nil {
+		return nil, fmt.Errorf("no alerts array")
+	}
+
+	var alerts []Alert
+	for i, record := range webhook.Alerts {
+		var entry alertmanagerAlert
+		raw, err := decodeRecord(record, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("alert %d: %v", i, err)
+		}
+		if entry.Status == "resolved" {
+			continue
+		}
+		alertname := entry.Labels["alertname"]
+		if alertname == "" {
+			return nil, fmt.Errorf("alert %d has no alertname label", i)
+		}
+
+		severity, ok := alertmanagerSeverities[strings.ToLower(entry.Labels["severity"])]
+		if !ok {
+			severity = "medium"
+		}
+		message := alertname
+		for _, key := range []string{"summary", "description", "message"} {
+			if text := entry.Annotations[key]; text != "" {
+				message = text
+				break
+			}
+		}
+
+		raw["receiver"] = webhook.Receiver
+		raw["groupKey"] = webhook.GroupKey
+		setHint(raw, "ruleId", alertname)
+		setHint(raw, "hostname", hostFromInstance(entry.Labels["instance"]))
+
+		// Alertmanager re-sends firing alerts every repeat_interval; the
+		// fingerprint and start time stay the same until it fires anew
+		alerts = append(alerts, Alert{
+			Timestamp:  parseTimestamp(entry.StartsAt),
+			Source:     "alertmanager",
+			Severity:   severity,
+			Message:    message,
+			ProjectID:  entry.Labels["project"],
+			ExternalID: externalID(entry.Fingerprint, entry.StartsAt),
+			RawData:    raw,
+		})
+	}
+	return alerts, nil
+}
+
+// Deep Security event forwarding (SNS): a JSON array of events, optionally
+// still wrapped in the SNS notification envelope.
+type deepSecurityEvent struct {
+	EventType        string          `json:"EventType"`
+	EventID          json.RawMessage `json:"EventID"`
+	HostName         string          `json:"HostName"`
+	LogDate          string          `json:"LogDate"`
+	Severity         json.RawMessage `json:"Severity"`
+	SourceIP         string          `json:"SourceIP"`
+	Reason           string          `json:"Reason"`
+	MalwareName      string          `json:"MalwareName"`
+	InfectedFilePath string          `json:"InfectedFilePath"`
+	Key              string          `json:"Key"`
+	Change           string          `json:"Change"`
+	OSSECDescription string          `json:"OSSEC_Description"`
+	OSSECLevel       int             `json:"OSSEC_Level"`
+	OSSECRuleID      json.RawMessage `json:"OSSEC_RuleID"`
+	URL              string          `json:"URL"`
+	Title            string          `json:"Title"`
+}
+
+func deepSecurityRecords(data []byte) ([]json.RawMessage, error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		var records []json.RawMessage
+		err := json.Unmarshal(data, &records)
+		return records, err
+	}
+
+	var envelope struct {
+		Type      string `json:"Type"`
+		Message   string `json:"Message"`
+		EventType string `json:"EventType"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	switch {
+	case envelope.Type == "Notification" && envelope.Message != "":
+		return deepSecurityRecords([]byte(envelope.Message))
+	case envelope.EventType != "":
+		return []json.RawMessage{data}, nil
+	}
+	return nil, fmt.Errorf("no events found")
+}
+
+// deepSecuritySeverity reads the per-module severity scales: 1-4 for
+// IPS, firewall and integrity events, 0-15 OSSEC levels for log inspection.
+func deepSecuritySeverity(event deepSecurityEvent) string {
+	switch event.EventType {
+	case "AntiMalwareEvent":
+		return "high"
+	case "LogInspectionEvent":
+		switch {
+		case event.OSSECLevel >= 12:
+			return "high"
+		case event.OSSECLevel >= 7:
+			return "medium"
+		}
+		return "low"
+	}
+	level, _ := strconv.Atoi(strings.Trim(string(event.Severity), `"`))
+	switch {
+	case level >= 4:
+		return "critical"
+	case level == 3:
+		return "high"
+	case level == 2:
+		return "medium"
+	case level == 1:
+		return "low"
+	}
+	return "medium"
+}
+
+func deepSecurityMessage(event deepSecurityEvent) string {
+	switch event.EventType {
+	case "AntiMalwareEvent":
+		return fmt.Sprintf("Malware %s detected in %s", event.MalwareName, event.InfectedFilePath)
+	case "IntegrityEvent":
+		return fmt.Sprintf("Integrity change (%s) to %s", event.Change, event.Key)
+	case "LogInspectionEvent":
+		return event.OSSECDescription
+	case "WebReputationEvent":
+		return "Blocked access to " + event.URL
+	case "SystemEvent":
+		return event.Title
+	}
+	if event.Reason != "" {
+		return event.Reason
+	}
+	return event.EventType + " on " + event.HostName
+}
+
+func parseDeepSecurityEvents(data []byte) ([]Alert, error) {
+	records, err := deepSecurityRecords(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var alerts []Alert
+	for i, record := range records {
+		var event deepSecurityEvent
+		raw, err := decodeRecord(record, &event)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", i, err)
+		}
+		if event.EventType == "" {
+			return nil, fmt.Errorf("event %d has no EventType", i)
+		}
+
+		ruleID := event.EventType
+		switch {
+		case len(event.OSSECRuleID) > 0:
+			ruleID += ":" + strings.Trim(string(event.OSSECRuleID), `"`)
+		case event.Reason != "":
+			ruleID += ":" + event.Reason
+		case event.MalwareName != "":
+			ruleID += ":" + event.MalwareName
+		}
+		setHint(raw, "ruleId", ruleID)
+		setHint(raw, "clientIP", event.SourceIP)
+		setHint(raw, "hostname", event.HostName)
+
+		// Event IDs are only unique within an event type
+		var eventID string
+		if id := strings.Trim(string(event.EventID), `"`); id != "" && id != "null" {
+			eventID = event.EventType + ":" + id
+		}
+
+		alerts = append(alerts, Alert{
+			Timestamp:  parseTimestamp(event.LogDate),
+			Source:     "deep_security",
+			Severity:   deepSecuritySeverity(event),
+			Message:    deepSecurityMessage(event),
+			ExternalID: externalID(eventID),
+			RawData:    raw,
+		})
+	}
+	return alerts, nil
+}
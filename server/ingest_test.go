@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	want := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		values []string
+		want   time.Time
+	}{
+		{"UTC", []string{"2024-05-01T11:30:00Z"}, want},
+		{"ahead of UTC", []string{"2024-05-01T13:30:00+02:00"}, want},
+		{"behind UTC", []string{"2024-05-01T06:30:00-05:00"}, want},
+		{"fractional seconds", []string{"2024-05-01T11:30:00.250Z"}, want.Add(250 * time.Millisecond)},
+		{"falls back to the next value", []string{"", "not a time", "2024-05-01T11:30:00Z"}, want},
+		{"nothing parses", []string{"yesterday"}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTimestamp(tt.values...)
+			if got != tt.want {
+				t.Errorf("parseTimestamp(%q) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertAdapters(t *testing.T) {
+	want := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		format   string
+		body     string
+		source   string
+		severity string
+		message  string
+		external string
+		hints    map[string]string
+	}{
+		{"guardduty", "guardduty", `{"source":"aws.guardduty","detail-type":"GuardDuty Finding","time":"2024-05-01T11:00:00Z",
+			"detail":{"id":"f-1","type":"UnauthorizedAccess:EC2/SSHBruteForce","title":"SSH brute force","severity":8.0,
+			"updatedAt":"2024-05-01T13:30:00+02:00",
+			"resource":{"instanceDetails":{"instanceId":"i-0abc"}},
+			"service":{"action":{"networkConnectionAction":{"remoteIpDetails":{"ipAddressV4":"203.0.113.7"}}}}}}`,
+			"aws_guardduty", "high", "SSH brute force", "f-1@2024-05-01T13:30:00+02:00",
+			map[string]string{"ruleId": "UnauthorizedAccess:EC2/SSHBruteForce", "clientIP": "203.0.113.7", "hostname": "i-0abc"}},
+		{"asff", "asff", `{"Findings":[{"SchemaVersion":"2018-10-08","Id":"arn:finding/1","ProductName":"WAF",
+			"GeneratorId":"waf-rule","Title":"SQL injection","Severity":{"Label":"CRITICAL"},
+			"UpdatedAt":"2024-05-01T20:30:00+09:00","Network":{"SourceIpV6":"2001:db8::1"},
+			"Resources":[{"Type":"AwsEc2Instance","Id":"arn:aws:ec2:eu-west-1:1:instance/i-0def"}]}]}`,
+			"aws_waf", "critical", "SQL injection", "arn:finding/1@2024-05-01T20:30:00+09:00",
+			map[string]string{"ruleId": "waf-rule", "clientIP": "2001:db8::1", "hostname": "i-0def"}},
+		{"azure", "azure", `{"schemaId":"azureMonitorCommonAlertSchema","data":{"essentials":{"alertId":"/alerts/1",
+			"alertRule":"WAF blocks","severity":"Sev1","monitorCondition":"Fired","description":"spike",
+			"configurationItems":["appgw-1"],"firedDateTime":"2024-05-01T07:30:00-04:00"}}}`,
+			"azure_waf", "high", "WAF blocks: spike", "/alerts/1",
+			map[string]string{"ruleId": "WAF blocks", "hostname": "appgw-1"}},
+		{"alertmanager", "alertmanager", `{"receiver":"soc","groupKey":"g","alerts":[{"status":"firing",
+			"labels":{"alertname":"HighErrorRate","severity":"warning","instance":"web-1:9100","project":"company-a"},
+			"annotations":{"summary":"Error rate above 5%"},"startsAt":"2024-05-01T12:30:00+01:00","fingerprint":"fp1"}]}`,
+			"alertmanager", "medium", "Error rate above 5%", "fp1@2024-05-01T12:30:00+01:00",
+			map[string]string{"ruleId": "HighErrorRate", "hostname": "web-1"}},
+		{"deep security", "deepsecurity", `[{"EventType":"PacketLog","EventID":42,"HostName":"db-1","Severity":3,
+			"SourceIP":"198.51.100.4","Reason":"Port scan","LogDate":"2024-05-01T11:30:00.000Z"}]`,
+			"deep_security", "high", "Port scan", "PacketLog:42",
+			map[string]string{"ruleId": "PacketLog:Port scan", "clientIP": "198.51.100.4", "hostname": "db-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts, err := alertAdapters[tt.format]([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("adapter: %v", err)
+			}
+			if len(alerts) != 1 {
+				t.Fatalf("got %d alerts, want 1", len(alerts))
+			}
+			alert := alerts[0]
+			if alert.Source != tt.source || alert.Severity != tt.severity || alert.Message != tt.message {
+				t.Errorf("alert = %s/%s %q, want %s/%s %q", alert.Source, alert.Severity, alert.Message, tt.source, tt.severity, tt.message)
+			}
+			if alert.ExternalID != tt.external {
+				t.Errorf("external ID = %q, want %q", alert.ExternalID, tt.external)
+			}
+			if alert.Timestamp != want {
+				t.Errorf("timestamp = %v, want %v", alert.Timestamp, want)
+			}
+			for key, value := range tt.hints {
+				if alert.RawData[key] != value {
+					t.Errorf("RawData[%s] = %v, want %s", key, alert.RawData[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestAlertAdaptersSkipClosedRecords(t *testing.T) {
+	tests := map[string]string{
+		"asff": `[{"Id":"1","Title":"t","Workflow":{"Status":"RESOLVED"}},
+			{"Id":"2","Title":"t","Severity":{"Label":"INFORMATIONAL"}}]`,
+		"azure":        `{"schemaId":"azureMonitorCommonAlertSchema","data":{"essentials":{"alertId":"1","monitorCondition":"Resolved"}}}`,
+		"alertmanager": `{"alerts":[{"status":"resolved","labels":{"alertname":"A"}}]}`,
+	}
+	for format, body := range tests {
+		alerts, err := alertAdapters[format]([]byte(body))
+		if err != nil || len(alerts) != 0 {
+			t.Errorf("%s: got %+v, %v; want no alerts", format, alerts, err)
+		}
+	}
+}
+
+func TestAlertAdaptersRejectForeignPayloads(t *testing.T) {
+	tests := map[string]string{
+		"guardduty":    `{"source":"aws.ec2","detail":{"type":"x"}}`,
+		"asff":         `{"something":"else"}`,
+		"azure":        `{"schemaId":"Microsoft.Insights/activityLogs"}`,
+		"alertmanager": `{"version":"4"}`,
+		"deepsecurity": `[{"HostName":"db-1"}]`,
+	}
+	for format, body := range tests {
+		if alerts, err := alertAdapters[format]([]byte(body)); err == nil {
+			t.Errorf("%s accepted %s as %+v", format, body, alerts)
+		}
+	}
+}
+
+func TestExternalIDHashesLongIDs(t *testing.T) {
+	if id := externalID(""); id != "" {
+		t.Errorf("externalID of an empty ID = %q", id)
+	}
+	long := externalID(strings.Repeat("x", maxExternalIDLen), "v1")
+	if !strings.HasPrefix(long, "sha256:") || len(long) > maxExternalIDLen {
+		t.Errorf("long external ID = %q", long)
+	}
+	if long == externalID(strings.Repeat("x", maxExternalIDLen), "v2") {
+		t.Error("versions of a long ID hash alike")
+	}
+}
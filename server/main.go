@@ -9,45 +9,90 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
 	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 )
 
 type App struct {
-	DB         *sql.DB
-	TaskClient *asynq.Client
-	TaskServer *asynq.Server
-	LokiClient *LokiClient
-	Normalizer *LogNormalizer
-	Correlator *CorrelationEngine
+	DB           *sql.DB
+	TaskClient   *asynq.Client
+	TaskServer   *asynq.Server
+	LokiClient   *LokiClient
+	Normalizer   *LogNormalizer
+	Correlator   *CorrelationEngine
+	Incidents    *IncidentManager
+	Sigma        *SigmaEngine
+	Rules        *RuleEngine
+	Redis        *redis.Client
+	Baselines    *BaselineEngine
+	Anomaly      *AnomalyScorer
+	Risk         *RiskScorer
+	ThreatIntel  *ThreatIntelStore
+	GeoIP        *GeoIPResolver
+	Travel       *ImpossibleTravelDetector
+	Assets       *AssetInventory
+	Dedup        *AlertDeduplicator
+	Suppressions *SuppressionStore
+	Events       *EventHub
+	Notifier     *Notifier
+	Auth         *Authenticator
+	Audit        *Auditor
 }
 
 type Alert struct {
-	ID        string                 `json:"id"`
-	Timestamp time.Time              `json:"timestamp"`
-	Source    string                 `json:"source"`
-	Severity  string                 `json:"severity"`
-	Message   string                 `json:"message"`
-	ProjectID string                 `json:"project_id"`
-	RawData   map[string]interface{} `json:"raw_data"`
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	Severity  string    `json:"severity"`
+	Message   string    `json:"message"`
+	ProjectID string    `json:"project_id"`
+	// The sender's own identifier, when it supplied one
+	ExternalID string                 `json:"external_id,omitempty"`
+	RawData    map[string]interface{} `json:"raw_data"`
 }
 
 type AnalysisResult struct {
-	AlertID           string                 `json:"alert_id"`
-	ProjectID         string                 `json:"project_id"`
-	CorrelatedLogs    []NormalizedLog        `json:"correlated_logs"`
-	UserCorrelations  []UserCorrelation      `json:"user_correlations"`
-	EnrichmentData    map[string]interface{} `json:"enrichment_data"`
-	AnalysisTimestamp time.Time              `json:"analysis_timestamp"`
-	ProcessingTimeMs  int64                  `json:"processing_time_ms"`
+	AlertID            string                 `json:"alert_id"`
+	ProjectID          string                 `json:"project_id"`
+	CorrelatedLogs     []NormalizedLog        `json:"correlated_logs"`
+	UserCorrelations   []UserCorrelation      `json:"user_correlations"`
+	EntityCorrelations []EntityCorrelation    `json:"entity_correlations"`
+	IncidentID         string                 `json:"incident_id,omitempty"`
+	GeoIP              map[string]GeoInfo     `json:"geoip,omitempty"`
+	Risk               *RiskScore             `json:"risk,omitempty"`
+	EnrichmentData     map[string]interface{} `json:"enrichment_data"`
+	Status             string                 `json:"status"`             // completed or partial
+	Warnings           []string               `json:"warnings,omitempty"` // why the analysis is partial
+	AnalysisTimestamp  time.Time              `json:"analysis_timestamp"`
+	ProcessingTimeMs   int64                  `json:"processing_time_ms"`
+	// Duplicates collapsed into this alert at ingest, filled in on read
+	DuplicateCount  int64      `json:"duplicate_count,omitempty"`
+	LastDuplicateAt *time.Time `json:"last_duplicate_at,omitempty"`
 }
 
 func main() {
+	// Offline tooling subcommands run without the server's dependencies
+	if len(os.Args) > 1 && os.Args[1] == "train-anomaly" {
+		if err := runTrainAnomaly(os.Args[2:]); err != nil {
+			log.Fatal("Training failed: ", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "gen-api-key" {
+		if err := runGenerateAPIKey(); err != nil {
+			log.Fatal("Failed to generate API key: ", err)
+		}
+		return
+	}
+
 	// Initialize database
 	db, err := initDB()
 	if err != nil {
@@ -56,6 +101,9 @@ func main() {
 	defer db.Close()
 
 	// Initialize task queue
+	redisClient := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer redisClient.Close()
+
 	taskClient := asynq.NewClient(asynq.RedisClientOpt{Addr: "localhost:6379"})
 	defer taskClient.Close()
 
@@ -68,24 +116,220 @@ func main() {
 	lokiClient := NewLokiClient("http://localhost:3100")
 	normalizer := NewLogNormalizer()
 	correlator := NewCorrelationEngine(db)
+	correlator.HalfLife = envDuration("CORRELATION_HALF_LIFE", defaultConfidenceHalfLife)
+	incidents := NewIncidentManager(db)
+	incidents.Window = envDuration("INCIDENT_WINDOW", defaultIncidentWindow)
 
 	app := &App{
-		DB:         db,
-		TaskClient: taskClient,
-		TaskServer: taskServer,
-		LokiClient: lokiClient,
-		Normalizer: normalizer,
-		Correlator: correlator,
+		DB:           db,
+		TaskClient:   taskClient,
+		TaskServer:   taskServer,
+		LokiClient:   lokiClient,
+		Normalizer:   normalizer,
+		Correlator:   correlator,
+		Incidents:    incidents,
+		Redis:        redisClient,
+		Baselines:    NewBaselineEngine(db, redisClient),
+		Risk:         NewRiskScorer(),
+		Assets:       NewAssetInventory(db, envString("ASSET_INVENTORY_FILE", "assets.csv")),
+		Dedup:        NewAlertDeduplicator(redisClient),
+		Suppressions: NewSuppressionStore(db),
+		Events:       NewEventHub(redisClient),
+		Audit:        NewAuditor(db),
+	}
+	go app.Audit.Run()
+
+	alertMaxAge = envDuration("ALERT_MAX_AGE", alertMaxAge)
+	alertMaxClockSkew = envDuration("ALERT_MAX_CLOCK_SKEW", alertMaxClockSkew)
+
+	// Repeats of the same alert within the window are counted, not analysed
+	app.Dedup.Window = envDuration("ALERT_DEDUP_WINDOW", app.Dedup.Window)
+	if fields := envList("ALERT_DEDUP_FIELDS"); len(fields) > 0 {
+		for _, field := range fields {
+			if !isAlertMatchField(field) {
+				log.Fatalf("Invalid ALERT_DEDUP_FIELDS entry %q", field)
+			}
+		}
+		app.Dedup.Fields = fields
+	}
+
+	// Our own detections: Sigma rules plus stateful threshold/sequence rules,
+	// both fed from the same Loki polling loop
+	pipeline := &DetectionPipeline{
+		Projects:     envList("DETECTION_PROJECTS"),
+		PollInterval: envDuration("DETECTION_POLL_INTERVAL", time.Minute),
+	}
+	// Deployments configured before threshold rules existed still use the
+	// Sigma-only names
+	if len(pipeline.Projects) == 0 && os.Getenv("SIGMA_PROJECTS") != "" {
+		log.Printf("SIGMA_PROJECTS is deprecated, use DETECTION_PROJECTS")
+		pipeline.Projects = envList("SIGMA_PROJECTS")
+	}
+	if os.Getenv("DETECTION_POLL_INTERVAL") == "" && os.Getenv("SIGMA_POLL_INTERVAL") != "" {
+		log.Printf("SIGMA_POLL_INTERVAL is deprecated, use DETECTION_POLL_INTERVAL")
+		pipeline.PollInterval = envDuration("SIGMA_POLL_INTERVAL", time.Minute)
+	}
+
+	sigma := NewSigmaEngine(envString("SIGMA_RULES_DIR", "rules/sigma"))
+	if err := sigma.LoadRules(); err != nil {
+		log.Printf("Sigma detection disabled: %v", err)
+	} else {
+		app.Sigma = sigma
+		pipeline.Detectors = append(pipeline.Detectors, sigma)
+	}
+
+	var ruleState RuleStateStore
+	if envString("RULE_STATE_BACKEND", "redis") == "memory" {
+		ruleState = NewMemoryRuleState()
+	} else {
+		ruleState = NewRedisRuleState(redisClient)
+	}
+	rules := NewRuleEngine(envString("RULES_FILE", "rules/detections.yml"), ruleState)
+	if err := rules.LoadRules(); err != nil {
+		log.Printf("Stateful rules disabled: %v", err)
+	} else {
+		app.Rules = rules
+		pipeline.Detectors = append(pipeline.Detectors, rules)
+		go watchFile(rules.Path, 10*time.Second, func() {
+			err := rules.LoadRules()
+			if err != nil {
+				log.Printf("Keeping previous stateful rules: %v", err)
+			}
+			app.Audit.RecordSystem("config.reload", rules.Path, err)
+		})
+	}
+
+	// Offline-trained log anomaly model, picked up again when retrained
+	anomaly := NewAnomalyScorer(envString("ANOMALY_MODEL_PATH", "models/anomaly.json"))
+	if err := anomaly.Load(); err != nil {
+		log.Printf("Log anomaly scoring disabled until a model is trained: %v", err)
+	}
+	app.Anomaly = anomaly
+	go watchFile(anomaly.Path, 30*time.Second, func() {
+		err := anomaly.Load()
+		if err != nil {
+			log.Printf("Keeping previous anomaly model: %v", err)
+		}
+		app.Audit.RecordSystem("config.reload", anomaly.Path, err)
+	})
+
+	// Local IOC feeds matched against every analysis
+	threatIntel := NewThreatIntelStore(envString("THREAT_INTEL_DIR", "intel"))
+	if err := threatIntel.Load(); err != nil {
+		log.Printf("Threat intel matching disabled until feeds are installed: %v", err)
+	}
+	app.ThreatIntel = threatIntel
+	go watchDir(threatIntel.Dir, 30*time.Second, func() {
+		err := threatIntel.Load()
+		if err != nil {
+			log.Printf("Keeping previous threat intel: %v", err)
+		}
+		app.Audit.RecordSystem("config.reload", threatIntel.Dir, err)
+	})
+
+	// Offline GeoIP/ASN lookups, reloaded when the databases are updated
+	geoIP := NewGeoIPResolver(
+		envString("GEOIP_CITY_DB", "geoip/GeoLite2-City.mmdb"),
+		envString("GEOIP_ASN_DB", "geoip/GeoLite2-ASN.mmdb"),
+	)
+	if err := geoIP.Load(); err != nil {
+		log.Printf("GeoIP enrichment disabled until a database is installed: %v", err)
+	}
+	app.GeoIP = geoIP
+	for _, path := range []string{geoIP.CityPath, geoIP.ASNPath} {
+		go watchFile(path, time.Minute, func() {
+			err := geoIP.Load()
+			if err != nil {
+				log.Printf("Keeping previous GeoIP databases: %v", err)
+			}
+			app.Audit.RecordSystem("config.reload", path, err)
+		})
+	}
+
+	// Impossible travel, allowing for VPN and corporate egress ranges
+	travel := NewImpossibleTravelDetector(db, geoIP)
+	travel.Lookback = envDuration("TRAVEL_LOOKBACK", travel.Lookback)
+	travel.EmitAlerts = envString("TRAVEL_EMIT_ALERTS", "true") == "true"
+	if err := travel.AllowNetworks(envList("TRAVEL_ALLOWED_CIDRS")); err != nil {
+		log.Fatal("Invalid TRAVEL_ALLOWED_CIDRS: ", err)
+	}
+	if err := travel.AllowASNs(envList("TRAVEL_ALLOWED_ASNS")); err != nil {
+		log.Fatal("Invalid TRAVEL_ALLOWED_ASNS: ", err)
+	}
+	app.Travel = travel
+
+	// Asset inventory from a CSV/JSON export; assets can also be pushed via
+	// the API
+	if err := app.Assets.LoadFile(); err != nil {
+		log.Printf("Asset inventory file not loaded: %v", err)
+	}
+	go watchFile(app.Assets.Path, 30*time.Second, func() {
+		err := app.Assets.LoadFile()
+		if err != nil {
+			log.Printf("Keeping previous asset inventory: %v", err)
+		}
+		app.Audit.RecordSystem("config.reload", app.Assets.Path, err)
+	})
+
+	// Notification routes for finished analyses; secrets come from ${VAR}
+	// references to the environment
+	notifier := NewNotifier(db, envString("NOTIFICATION_ROUTES_FILE", "notifications.yml"))
+	if err := notifier.Load(); err != nil {
+		log.Printf("Notifications disabled: %v", err)
+	}
+	app.Notifier = notifier
+	go watchFile(notifier.Path, 10*time.Second, func() {
+		err := notifier.Load()
+		if err != nil {
+			log.Printf("Keeping previous notification routes: %v", err)
+		}
+		app.Audit.RecordSystem("config.reload", notifier.Path, err)
+	})
+
+	// API keys and JWT signing keys; with neither loaded every API call is
+	// refused unless AUTH_DISABLED=true
+	app.Auth = NewAuthenticator(redisClient, envString("API_KEYS_FILE", "api_keys.yml"), envString("JWKS_FILE", ""))
+	app.Auth.Issuer = envString("JWT_ISSUER", "")
+	app.Auth.Audience = envString("JWT_AUDIENCE", "")
+	app.Auth.ProjectsClaim = envString("JWT_PROJECTS_CLAIM", app.Auth.ProjectsClaim)
+	if envString("AUTH_DISABLED", "false") == "true" {
+		app.Auth.Disabled = true
+		log.Printf("WARNING: authentication is disabled; every caller has admin access to all projects")
+	}
+	if err := app.Auth.LoadKeys(); err != nil {
+		log.Printf("API keys not loaded: %v", err)
+	}
+	go watchFile(app.Auth.KeysPath, 10*time.Second, func() {
+		err := app.Auth.LoadKeys()
+		if err != nil {
+			log.Printf("Keeping previous API keys: %v", err)
+		}
+		app.Audit.RecordSystem("config.reload", app.Auth.KeysPath, err)
+	})
+	if app.Auth.JWKSPath != "" {
+		if err := app.Auth.LoadJWKS(); err != nil {
+			log.Printf("JWT authentication disabled: %v", err)
+		}
+		go watchFile(app.Auth.JWKSPath, 30*time.Second, func() {
+			err := app.Auth.LoadJWKS()
+			if err != nil {
+				log.Printf("Keeping previous token signing keys: %v", err)
+			}
+			app.Audit.RecordSystem("config.reload", app.Auth.JWKSPath, err)
+		})
 	}
 
 	// Setup task handlers
 	taskMux := asynq.NewServeMux()
 	taskMux.HandleFunc("alert:analyze", app.handleAlertAnalysis)
+	taskMux.HandleFunc("notification:deliver", app.handleNotificationDelivery)
 
-	// Start task server
+	// Start task server. Failures of either server end up in the shutdown
+	// below, so queued audit entries are still written.
+	serverErrors := make(chan error, 2)
 	go func() {
 		if err := taskServer.Run(taskMux); err != nil {
-			log.Fatal("Failed to start task server:", err)
+			serverErrors <- fmt.Errorf("failed to start task server: %v", err)
 		}
 	}()
 
@@ -98,31 +342,87 @@ func main() {
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 
-	// Routes
-	router.Post("/alerts", app.handleAlert)
-	router.Get("/analysis/{alert_id}", app.getAnalysisResult)
+	// Routes. Each group needs a scope; handlers limit the data further to
+	// the caller's projects. Every call is audited, including refused ones.
+	auth, audit := app.Auth, app.Audit.Middleware
+	router.Group(func(r chi.Router) {
+		r.Use(audit, auth.Require(scopeIngest))
+		r.Post("/alerts", app.handleAlert)
+		r.Post("/alerts/batch", app.handleAlertBatch)
+		r.Post("/alerts/ingest/{format}", app.handleAlertIngest)
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(audit, auth.Require(scopeRead))
+		r.Get("/alerts", app.listAlerts)
+		r.Get("/analysis/{alert_id}", app.getAnalysisResult)
+		r.Get("/analysis/{alert_id}/evidence", app.getCorrelationEvidence)
+		r.Get("/incidents", app.listIncidents)
+		r.Get("/incidents/{incident_id}", app.getIncident)
+		r.Get("/sigma/rules", app.listSigmaRules)
+		r.Get("/rules", app.listStatefulRules)
+		r.Get("/threat-intel", app.getThreatIntelStatus)
+		r.Get("/suppressions", app.listSuppressions)
+		r.Get("/assets", app.listAssets)
+		r.Get("/assets/{hostname}", app.getAsset)
+		r.Post("/events/ticket", app.issueStreamTicket)
+		r.Get("/graph", app.getEntityGraph)
+	})
+	router.With(audit, auth.RequireStream(scopeRead)).Get("/events", app.streamEvents)
+	router.Group(func(r chi.Router) {
+		r.Use(audit, auth.Require(scopeAdmin))
+		r.Post("/suppressions", app.createSuppression)
+		r.Delete("/suppressions/{suppression_id}", app.deleteSuppression)
+		r.Post("/assets", app.pushAssets)
+		r.Get("/audit", app.listAuditLog)
+		r.Group(func(r chi.Router) {
+			r.Use(requireAllProjects)
+			r.Get("/audit/verify", app.verifyAuditLog)
+			r.Get("/notifications/deliveries", app.listNotificationDeliveries)
+			r.Get("/notifications/dead-letters", app.listDeadLetters)
+			r.Post("/notifications/dead-letters/{dead_letter_id}/requeue", app.requeueDeadLetter)
+		})
+	})
+	router.Get("/openapi.yaml", app.getOpenAPISpec)
 	router.Get("/health", app.healthCheck)
 
+	// Relay worker events to this replica's live feed clients
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	defer stopEvents()
+	go app.Events.Run(eventsCtx)
+
 	// Start mock data generator
 	go app.startMockDataGenerator()
 
+	if len(pipeline.Projects) > 0 && len(pipeline.Detectors) > 0 {
+		go app.startDetection(pipeline)
+	}
+
 	// Start HTTP server
 	server := &http.Server{
 		Addr:    ":8080",
 		Handler: router,
 	}
+	// Live feed connections never go idle, so end them as soon as shutdown
+	// starts rather than waiting out the timeout
+	server.RegisterOnShutdown(app.Events.Close)
 
 	go func() {
 		log.Println("Starting server on :8080")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal("Server failed:", err)
+			serverErrors <- fmt.Errorf("server failed: %v", err)
 		}
 	}()
 
 	// Graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	exitCode := 0
+	select {
+	case <-quit:
+	case err := <-serverErrors:
+		log.Printf("Shutting down after failure: %v", err)
+		exitCode = 1
+	}
 
 	log.Println("Shutting down server...")
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
@@ -130,47 +430,164 @@ func main() {
 
 	taskServer.Shutdown()
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal("Server forced to shutdown:", err)
+		log.Printf("Server forced to shutdown: %v", err)
+		exitCode = 1
+	}
+	// Write the audit entries still queued, whatever happened above
+	app.Audit.Close()
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
 }
 
 func (app *App) handleAlert(w http.ResponseWriter, r *http.Request) {
-	var alert Alert
-	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	request, ok := decodeAlertRequest(w, r)
+	if !ok {
 		return
 	}
+	auditProjects(r.Context(), request.ProjectID)
+	if !principalFrom(r.Context()).CanAccess(request.ProjectID) {
+		writeValidationError(w, http.StatusForbidden, "forbidden", "Not allowed to submit alerts for this project", nil)
+		return
+	}
+	alert := request.Alert(time.Now())
 
-	alert.ID = generateID()
-	alert.Timestamp = time.Now()
-
-	// Queue analysis task
-	task := asynq.NewTask("alert:analyze", mustMarshal(alert))
-	if _, err := app.TaskClient.Enqueue(task); err != nil {
+	result, err := app.acceptAlert(r.Context(), alert)
+	if err != nil {
+		log.Printf("Failed to accept alert: %v", err)
 		http.Error(w, "Failed to queue analysis", http.StatusInternalServerError)
 		return
 	}
+	auditTarget(r.Context(), result.AlertID)
+	auditDetail(r.Context(), "status", result.Status)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"alert_id": alert.ID,
-		"status":   "queued_for_analysis",
-	})
+	json.NewEncoder(w).Encode(result)
 }
 
+// getAnalysisResult returns 202 with the current stage while the alert is
+// being analysed, 200 with the status and error once it has failed, and 200
+// with the result when it completed (fully or partially). Alerts of projects
+// the caller can't read are reported as not found.
 func (app *App) getAnalysisResult(w http.ResponseWriter, r *http.Request) {
 	alertID := chi.URLParam(r, "alert_id")
+	principal := principalFrom(r.Context())
+
+	// Alerts analysed before the alerts table existed only have a result
+	status, err := app.getAnalysisStatus(alertID)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Failed to load analysis status", http.StatusInternalServerError)
+		return
+	}
+	if status != nil {
+		auditProjects(r.Context(), status.ProjectID)
+	}
+	if status != nil && !principal.CanAccess(status.ProjectID) {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
+	if status != nil && !isAnalysisFinished(status.Status) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+	if status != nil && status.Status == alertStatusFailed {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+		return
+	}
 
 	result, err := app.getStoredAnalysisResult(alertID)
+	if err == nil {
+		auditProjects(r.Context(), result.ProjectID)
+	}
+	if err == sql.ErrNoRows || (err == nil && !principal.CanAccess(result.ProjectID)) {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Analysis result not found", http.StatusNotFound)
+		http.Error(w, "Failed to load analysis result", http.StatusInternalServerError)
 		return
 	}
+	if result.Status == "" {
+		result.Status = alertStatusCompleted
+	}
+
+	if count, lastSeen, err := app.Dedup.DuplicateStats(r.Context(), alertID); err == nil {
+		result.DuplicateCount = count
+		result.LastDuplicateAt = lastSeen
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
+// getCorrelationEvidence resolves the evidence of the correlations matching the
+// optional user and ip query parameters to the normalized logs behind them.
+func (app *App) getCorrelationEvidence(w http.ResponseWriter, r *http.Request) {
+	alertID := chi.URLParam(r, "alert_id")
+	user := r.URL.Query().Get("user")
+	ip := r.URL.Query().Get("ip")
+
+	result, err := app.getStoredAnalysisResult(alertID)
+	if err == nil {
+		auditProjects(r.Context(), result.ProjectID)
+	}
+	if err != nil || !principalFrom(r.Context()).CanAccess(result.ProjectID) {
+		http.Error(w, "Analysis result not found", http.StatusNotFound)
+		return
+	}
+
+	logsByID := make(map[string]NormalizedLog)
+	for _, log := range result.CorrelatedLogs {
+		logsByID[log.ID] = log
+	}
+
+	type evidenceResponse struct {
+		Correlation UserCorrelation `json:"correlation"`
+		Logs        []NormalizedLog `json:"logs"`
+		MissingLogs []string        `json:"missing_log_ids,omitempty"`
+	}
+
+	responses := []evidenceResponse{}
+	for _, correlation := range result.UserCorrelations {
+		if user != "" && correlation.UserIdentifier != user {
+			continue
+		}
+		if ip != "" && correlation.IPAddress != ip {
+			continue
+		}
+
+		response := evidenceResponse{Correlation: correlation, Logs: []NormalizedLog{}}
+		seen := make(map[string]bool)
+		for _, evidence := range correlation.Evidence {
+			for _, logID := range evidence.LogIDs {
+				if seen[logID] {
+					continue
+				}
+				seen[logID] = true
+				// Historical evidence may point at logs outside this alert's window
+				if log, ok := logsByID[logID]; ok {
+					response.Logs = append(response.Logs, log)
+				} else {
+					response.MissingLogs = append(response.MissingLogs, logID)
+				}
+			}
+		}
+		responses = append(responses, response)
+	}
+
+	if (user != "" || ip != "") && len(responses) == 0 {
+		http.Error(w, "Correlation not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses)
+}
+
 func (app *App) healthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
@@ -204,6 +621,59 @@ func createTables(db *sql.DB) error {
 			result_data JSONB NOT NULL,
 			created_at TIMESTAMP DEFAULT NOW()
 		)`,
+		`ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS risk_score INTEGER`,
+		`CREATE INDEX IF NOT EXISTS idx_analysis_results_risk ON analysis_results(risk_score DESC NULLS LAST, created_at DESC)`,
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id VARCHAR(255) PRIMARY KEY,
+			project_id VARCHAR(255) NOT NULL,
+			source VARCHAR(255) NOT NULL,
+			severity VARCHAR(32) NOT NULL,
+			message TEXT NOT NULL,
+			timestamp TIMESTAMP NOT NULL,
+			raw_data JSONB NOT NULL DEFAULT '{}',
+			status VARCHAR(32) NOT NULL DEFAULT 'queued',
+			risk_score INTEGER,
+			risk_priority VARCHAR(8) NOT NULL DEFAULT '',
+			incident_id VARCHAR(255) NOT NULL DEFAULT '',
+			duplicate_count INTEGER NOT NULL DEFAULT 0,
+			last_duplicate_at TIMESTAMP,
+			received_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			analyzed_at TIMESTAMP
+		)`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS external_id VARCHAR(255) NOT NULL DEFAULT ''`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_external_id ON alerts(project_id, source, external_id) WHERE external_id <> ''`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS status_updated_at TIMESTAMP NOT NULL DEFAULT NOW()`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_status ON alerts(status)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_timestamp ON alerts(timestamp DESC, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_received_at ON alerts(received_at DESC, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_risk ON alerts((COALESCE(risk_score, -1)) DESC, id DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_project_timestamp ON alerts(project_id, timestamp DESC)`,
+		`CREATE TABLE IF NOT EXISTS notification_deliveries (
+			id SERIAL PRIMARY KEY,
+			alert_id VARCHAR(255) NOT NULL,
+			route VARCHAR(255) NOT NULL,
+			destination VARCHAR(255) NOT NULL,
+			destination_type VARCHAR(32) NOT NULL,
+			attempt INTEGER NOT NULL,
+			success BOOLEAN NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_deliveries_alert ON notification_deliveries(alert_id)`,
+		`CREATE TABLE IF NOT EXISTS notification_dead_letters (
+			id VARCHAR(255) PRIMARY KEY,
+			alert_id VARCHAR(255) NOT NULL,
+			route VARCHAR(255) NOT NULL,
+			destination VARCHAR(255) NOT NULL,
+			destination_type VARCHAR(32) NOT NULL,
+			payload JSONB NOT NULL,
+			error TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			created_at TIMESTAMP DEFAULT NOW(),
+			requeued_at TIMESTAMP
+		)`,
 		`CREATE TABLE IF NOT EXISTS user_correlations (
 			id SERIAL PRIMARY KEY,
 			user_identifier VARCHAR(255) NOT NULL,
@@ -211,7 +681,170 @@ func createTables(db *sql.DB) error {
 			first_seen TIMESTAMP NOT NULL,
 			last_seen TIMESTAMP NOT NULL,
 			confidence_score FLOAT NOT NULL,
-			source_systems TEXT[] NOT NULL
+			observation_count INTEGER NOT NULL DEFAULT 1,
+			source_systems TEXT[] NOT NULL,
+			evidence JSONB NOT NULL DEFAULT '[]',
+			project_id VARCHAR(255) NOT NULL DEFAULT ''
+		)`,
+		`ALTER TABLE user_correlations ADD COLUMN IF NOT EXISTS observation_count INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE user_correlations ADD COLUMN IF NOT EXISTS evidence JSONB NOT NULL DEFAULT '[]'`,
+		// Correlations are per project; rows stored before that have project ''
+		// and are no longer read by any analysis
+		`ALTER TABLE user_correlations ADD COLUMN IF NOT EXISTS project_id VARCHAR(255) NOT NULL DEFAULT ''`,
+		`DROP INDEX IF EXISTS idx_user_correlations_pair`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_correlations_project_pair ON user_correlations(project_id, user_identifier, ip_address)`,
+		// unseen_evidence keeps the incoming evidence entries that reference a
+		// log not already in stored, so re-correlating overlapping windows
+		// neither duplicates evidence nor inflates observation_count
+		`CREATE OR REPLACE FUNCTION unseen_evidence(stored JSONB, incoming JSONB) RETURNS JSONB AS $$
+			SELECT COALESCE(jsonb_agg(entry ORDER BY position), '[]'::jsonb)
+			FROM jsonb_array_elements(incoming) WITH ORDINALITY AS e(entry, position)
+			WHERE EXISTS (
+				SELECT 1 FROM jsonb_array_elements_text(entry->'log_ids') AS l(log_id)
+				WHERE NOT stored @> jsonb_build_array(jsonb_build_object('log_ids', jsonb_build_array(log_id)))
+			)
+		$$ LANGUAGE sql IMMUTABLE`,
+		`CREATE TABLE IF NOT EXISTS entities (
+			entity_type VARCHAR(64) NOT NULL,
+			entity_value TEXT NOT NULL,
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			source_systems TEXT[] NOT NULL,
+			project_id VARCHAR(255) NOT NULL DEFAULT ''
+		)`,
+		// Entities are per project like their correlations; the original
+		// key had no project
+		`ALTER TABLE entities ADD COLUMN IF NOT EXISTS project_id VARCHAR(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE entities DROP CONSTRAINT IF EXISTS entities_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_entities_project_entity ON entities(project_id, entity_type, entity_value)`,
+		`CREATE INDEX IF NOT EXISTS idx_entities_value ON entities(entity_value)`,
+		`CREATE TABLE IF NOT EXISTS entity_correlations (
+			id SERIAL PRIMARY KEY,
+			entity_a_type VARCHAR(64) NOT NULL,
+			entity_a_value TEXT NOT NULL,
+			entity_b_type VARCHAR(64) NOT NULL,
+			entity_b_value TEXT NOT NULL,
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			confidence_score FLOAT NOT NULL,
+			observation_count INTEGER NOT NULL DEFAULT 1,
+			source_systems TEXT[] NOT NULL,
+			evidence JSONB NOT NULL DEFAULT '[]',
+			project_id VARCHAR(255) NOT NULL DEFAULT ''
+		)`,
+		`ALTER TABLE entity_correlations ADD COLUMN IF NOT EXISTS project_id VARCHAR(255) NOT NULL DEFAULT ''`,
+		// Replace the original project-less pair constraint, whatever name
+		// Postgres generated for it
+		`DO $$
+		DECLARE constraint_name TEXT;
+		BEGIN
+			SELECT conname INTO constraint_name FROM pg_constraint
+			WHERE conrelid = 'entity_correlations'::regclass AND contype = 'u' AND array_length(conkey, 1) = 4;
+			IF constraint_name IS NOT NULL THEN
+				EXECUTE format('ALTER TABLE entity_correlations DROP CONSTRAINT %I', constraint_name);
+			END IF;
+		END $$`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_entity_correlations_project_pair ON entity_correlations(project_id, entity_a_type, entity_a_value, entity_b_type, entity_b_value)`,
+		`CREATE INDEX IF NOT EXISTS idx_entity_correlations_a ON entity_correlations(entity_a_type, entity_a_value)`,
+		`CREATE INDEX IF NOT EXISTS idx_entity_correlations_b ON entity_correlations(entity_b_type, entity_b_value)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			seq BIGSERIAL PRIMARY KEY,
+			time TIMESTAMPTZ NOT NULL,
+			principal VARCHAR(255) NOT NULL,
+			auth_method VARCHAR(16) NOT NULL DEFAULT '',
+			request_id VARCHAR(255) NOT NULL DEFAULT '',
+			action VARCHAR(255) NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			project_ids TEXT[],
+			outcome VARCHAR(16) NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+			detail JSON,
+			prev_hash VARCHAR(64) NOT NULL,
+			hash VARCHAR(64) NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log(time DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_principal ON audit_log(principal, seq DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_request_id ON audit_log(request_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_projects ON audit_log USING GIN (project_ids)`,
+		// The trail is append-only; detail is JSON rather than JSONB so the
+		// hashed text is kept byte for byte
+		`CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+		BEGIN
+			RAISE EXCEPTION 'audit_log is append-only';
+		END;
+		$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE TRIGGER audit_log_no_update BEFORE UPDATE OR DELETE ON audit_log
+			FOR EACH ROW EXECUTE FUNCTION audit_log_append_only()`,
+		`CREATE OR REPLACE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON audit_log
+			FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only()`,
+		`CREATE TABLE IF NOT EXISTS suppression_rules (
+			id VARCHAR(255) PRIMARY KEY,
+			project_id VARCHAR(255) NOT NULL DEFAULT '',
+			match JSONB NOT NULL,
+			reason TEXT NOT NULL,
+			created_by VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMP NOT NULL,
+			hit_count INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_suppression_rules_expires ON suppression_rules(expires_at)`,
+		`CREATE TABLE IF NOT EXISTS assets (
+			hostname VARCHAR(255) PRIMARY KEY,
+			owner VARCHAR(255) NOT NULL DEFAULT '',
+			environment VARCHAR(64) NOT NULL DEFAULT '',
+			criticality VARCHAR(16) NOT NULL DEFAULT 'medium',
+			ips TEXT[] NOT NULL DEFAULT '{}',
+			tags TEXT[] NOT NULL DEFAULT '{}',
+			source VARCHAR(16) NOT NULL DEFAULT 'api',
+			updated_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_assets_ips ON assets USING GIN (ips)`,
+		`CREATE TABLE IF NOT EXISTS incidents (
+			id VARCHAR(255) PRIMARY KEY,
+			project_id VARCHAR(255) NOT NULL,
+			title TEXT NOT NULL,
+			status VARCHAR(32) NOT NULL DEFAULT 'open',
+			severity VARCHAR(32) NOT NULL,
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			alert_count INTEGER NOT NULL DEFAULT 0,
+			entities TEXT[] NOT NULL DEFAULT '{}',
+			signatures TEXT[] NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP DEFAULT NOW(),
+			updated_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incidents_project_last_seen ON incidents(project_id, last_seen DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_incidents_entities ON incidents USING GIN (entities)`,
+		`CREATE TABLE IF NOT EXISTS incident_alerts (
+			incident_id VARCHAR(255) NOT NULL REFERENCES incidents(id),
+			alert_id VARCHAR(255) UNIQUE NOT NULL,
+			alert_timestamp TIMESTAMP NOT NULL,
+			match_reason VARCHAR(64) NOT NULL,
+			added_at TIMESTAMP DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_alerts_incident ON incident_alerts(incident_id)`,
+		`CREATE TABLE IF NOT EXISTS user_baselines (
+			user_identifier VARCHAR(255) NOT NULL,
+			profile JSONB NOT NULL,
+			event_count INTEGER NOT NULL,
+			updated_at TIMESTAMP DEFAULT NOW(),
+			project_id VARCHAR(255) NOT NULL DEFAULT ''
+		)`,
+		// Baselines are per project; ones learned before that have project ''
+		// and are no longer read
+		`ALTER TABLE user_baselines ADD COLUMN IF NOT EXISTS project_id VARCHAR(255) NOT NULL DEFAULT ''`,
+		`ALTER TABLE user_baselines DROP CONSTRAINT IF EXISTS user_baselines_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_user_baselines_project_user ON user_baselines(project_id, user_identifier)`,
+		// Where each user was seen from, by client IP only, for impossible
+		// travel checks
+		`CREATE TABLE IF NOT EXISTS user_locations (
+			project_id VARCHAR(255) NOT NULL,
+			user_identifier VARCHAR(255) NOT NULL,
+			ip_address INET NOT NULL,
+			first_seen TIMESTAMP NOT NULL,
+			last_seen TIMESTAMP NOT NULL,
+			PRIMARY KEY (project_id, user_identifier, ip_address)
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_user_correlations_user ON user_correlations(user_identifier)`,
 		`CREATE INDEX IF NOT EXISTS idx_user_correlations_ip ON user_correlations(ip_address)`,
@@ -226,8 +859,43 @@ func createTables(db *sql.DB) error {
 	return nil
 }
 
+func envString(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// envList reads a comma-separated list from the environment.
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// envDuration reads a time.Duration from the environment, falling back to def
+// when the variable is unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using %s: %v", key, value, def, err)
+		return def
+	}
+	return d
+}
+
+// generateID returns a UUIDv7: unique across replicas, and sorting IDs
+// sorts by creation time.
 func generateID() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
+	return uuid.Must(uuid.NewV7()).String()
 }
 
 func mustMarshal(v interface{}) []byte {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"net"
 	"regexp"
@@ -14,6 +16,7 @@ type LogNormalizer struct {
 }
 
 type NormalizedLog struct {
+	ID          string                 `json:"id"`
 	OriginalLog string                 `json:"original_log"`
 	Source      string                 `json:"source"`
 	Timestamp   time.Time              `json:"timestamp"`
@@ -29,6 +32,9 @@ type NormalizedLog struct {
 	StatusCode  string                 `json:"status_code"`
 	Country     string                 `json:"country"`
 	RawData     map[string]interface{} `json:"raw_data"`
+	Entities    []Entity               `json:"entities"`
+	// AnomalyScore is set by the offline-trained model during analysis
+	AnomalyScore *float64 `json:"anomaly_score,omitempty"`
 }
 
 func NewLogNormalizer() *LogNormalizer {
@@ -40,6 +46,7 @@ func NewLogNormalizer() *LogNormalizer {
 
 func (ln *LogNormalizer) NormalizeLog(lokiLog LokiLog) (*NormalizedLog, error) {
 	normalized := &NormalizedLog{
+		ID:          logID(lokiLog),
 		OriginalLog: lokiLog.Line,
 		Timestamp:   lokiLog.Timestamp,
 		RawData:     make(map[string]interface{}),
@@ -62,9 +69,21 @@ func (ln *LogNormalizer) NormalizeLog(lokiLog LokiLog) (*NormalizedLog, error) {
 	// Determine source based on log content
 	normalized.Source = ln.determineSource(lokiLog.Line, logData)
 
+	// Collect every correlatable identifier once the source is known
+	normalized.Entities = ln.extractEntities(normalized)
+
 	return normalized, nil
 }
 
+// logID derives a stable identifier from the Loki timestamp and line so that
+// correlation evidence can point back at the exact log it came from.
+func logID(lokiLog LokiLog) string {
+	h := sha1.New()
+	h.Write([]byte(lokiLog.Timestamp.UTC().Format(time.RFC3339Nano)))
+	h.Write([]byte(lokiLog.Line))
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
 func (ln *LogNormalizer) extractFromJSON(normalized *NormalizedLog, data map[string]interface{}) {
 	// Common field mappings across different log sources
 	fieldMappings := map[string][]string{
@@ -105,6 +124,15 @@ func (ln *LogNormalizer) extractFromJSON(normalized *NormalizedLog, data map[str
 		}
 	}
 
+	// Extract user names
+	for _, field := range entityFieldMappings[EntityUserName] {
+		if value, exists := data[field]; exists {
+			if name := toString(value); name != "" {
+				normalized.UserNames = append(normalized.UserNames, name)
+			}
+		}
+	}
+
 	// Extract specific IP fields
 	ipFields := []string{"clientIP", "cliIP", "client_ip", "clientIp"}
 	for _, field := range ipFields {
@@ -203,15 +231,34 @@ func (ln *LogNormalizer) extractEmails(text string) []string {
 	seen := make(map[string]bool)
 
 	for _, match := range matches {
-		if !seen[match] {
-			validEmails = append(validEmails, strings.ToLower(match))
-			seen[match] = true
+		email := normalizeEmail(match)
+		if !seen[email] {
+			validEmails = append(validEmails, email)
+			seen[email] = true
 		}
 	}
 
 	return validEmails
 }
 
+// normalizeEmail is the one canonical form of a user email; correlations,
+// baselines and travel history are all keyed by it.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ClientIP returns the address of the client that made the request, read
+// from the log's client IP field. IPAddresses holds every address in the
+// line, including edge and destination addresses, so it is not used here.
+func (l NormalizedLog) ClientIP() string {
+	for _, key := range alertClientIPKeys {
+		if ip := toString(l.RawData[key]); net.ParseIP(ip) != nil {
+			return ip
+		}
+	}
+	return ""
+}
+
 func (ln *LogNormalizer) isValidIP(ip string) bool {
 	parsed := net.ParseIP(ip)
 	return parsed != nil && !parsed.IsLoopback() && !parsed.IsUnspecified()
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/hibiken/asynq"
+	"gopkg.in/yaml.v3"
+)
+
+// Notification destination types.
+const (
+	DestinationWebhook   = "webhook"
+	DestinationSlack     = "slack"
+	DestinationEmail     = "email"
+	DestinationPagerDuty = "pagerduty"
+)
+
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// notifyMaxRetry is how often a failed delivery is retried, with asynq's
+// exponential backoff, before it is dead-lettered.
+const notifyMaxRetry = 5
+
+// NotificationMatch selects analyses for a route. Empty lists match
+// anything; MinRisk 0 also matches analyses without a risk score.
+type NotificationMatch struct {
+	Projects   []string `yaml:"projects"`
+	Sources    []string `yaml:"sources"`
+	Severities []string `yaml:"severities"`
+	MinRisk    int      `yaml:"min_risk"`
+}
+
+type NotificationDestination struct {
+	Name       string   `yaml:"name"` // defaults to the type; unique within a route
+	Type       string   `yaml:"type"`
+	URL        string   `yaml:"url"`         // webhook, slack, pagerduty
+	Secret     string   `yaml:"secret"`      // webhook HMAC key
+	RoutingKey string   `yaml:"routing_key"` // pagerduty integration key
+	To         []string `yaml:"to"`          // email recipients
+}
+
+type NotificationRoute struct {
+	Name         string                    `yaml:"name"`
+	Match        NotificationMatch         `yaml:"match"`
+	Destinations []NotificationDestination `yaml:"destinations"`
+}
+
+type SMTPConfig struct {
+	Addr     string `yaml:"addr"` // host:port
+	From     string `yaml:"from"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type notificationsFile struct {
+	SMTP   SMTPConfig          `yaml:"smtp"`
+	Routes []NotificationRoute `yaml:"routes"`
+}
+
+func (m NotificationMatch) matches(n Notification) bool {
+	if len(m.Projects) > 0 && !containsFold(m.Projects, n.ProjectID) {
+		return false
+	}
+	if len(m.Sources) > 0 && !containsFold(m.Sources, n.Source) {
+		return false
+	}
+	if len(m.Severities) > 0 && !containsFold(m.Severities, n.Severity) {
+		return false
+	}
+	if m.MinRisk > 0 && (n.RiskScore == nil || *n.RiskScore < m.MinRisk) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification is what destinations are told about a finished analysis.
+type Notification struct {
+	AlertID      string    `json:"alert_id"`
+	ProjectID    string    `json:"project_id"`
+	Source       string    `json:"source"`
+	Severity     string    `json:"severity"`
+	Message      string    `json:"message"`
+	Timestamp    time.Time `json:"timestamp"`
+	Status       string    `json:"status"`
+	RiskScore    *int      `json:"risk_score,omitempty"`
+	RiskPriority string    `json:"risk_priority,omitempty"`
+	IncidentID   string    `json:"incident_id,omitempty"`
+	Warnings     []string  `json:"warnings,omitempty"`
+	AnalyzedAt   time.Time `json:"analyzed_at"`
+}
+
+func newNotification(alert Alert, result AnalysisResult) Notification {
+	n := Notification{
+		AlertID:    alert.ID,
+		ProjectID:  alert.ProjectID,
+		Source:     alert.Source,
+		Severity:   alert.Severity,
+		Message:    alert.Message,
+		Timestamp:  alert.Timestamp,
+		Status:     result.Status,
+		IncidentID: result.IncidentID,
+		Warnings:   result.Warnings,
+		AnalyzedAt: result.AnalysisTimestamp,
+	}
+	if result.Risk != nil {
+		n.RiskScore = &result.Risk.Score
+		n.RiskPriority = result.Risk.Priority
+	}
+	return n
+}
+
+// Summary is the one-line text used by chat and email destinations.
+func (n Notification) Summary() string {
+	label := strings.ToUpper(n.Severity)
+	if n.RiskPriority != "" {
+		label = n.RiskPriority + " " + label
+	}
+	summary := fmt.Sprintf("[%s] %s: %s", label, n.Source, n.Message)
+	if n.RiskScore != nil {
+		summary += fmt.Sprintf(" (risk %d/100)", *n.RiskScore)
+	}
+	return summary
+}
+
+// Notifier routes finished analyses to the destinations configured in Path.
+// ${VAR} references in the file are expanded from the environment so secrets
+// can stay out of it.
+type Notifier struct {
+	mu     sync.RWMutex
+	routes []NotificationRoute
+	smtp   SMTPConfig
+
+	db     *sql.DB
+	client *http.Client
+
+	Path string
+}
+
+func NewNotifier(db *sql.DB, path string) *Notifier {
+	return &Notifier{db: db, client: &http.Client{Timeout: 10 * time.Second}, Path: path}
+}
+
+// Load replaces the routes with the contents of Path, keeping the previous
+// routes on any error.
+func (nt *Notifier) Load() error {
+	data, err := os.ReadFile(nt.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read notification routes %s: %v", nt.Path, err)
+	}
+
+	var file notificationsFile
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &file); err != nil {
+		return fmt.Errorf("failed to parse notification routes %s: %v", nt.Path, err)
+	}
+
+	routeNames := make(map[string]bool)
+	for i := range file.Routes {
+		route := &file.Routes[i]
+		if route.Name == "" || routeNames[route.Name] {
+			return fmt.Errorf("route %d needs a unique name", i+1)
+		}
+		routeNames[route.Name] = true
+
+		destinationNames := make(map[string]bool)
+		for j := range route.Destinations {
+			destination := &route.Destinations[j]
+			if destination.Name == "" {
+				destination.Name = destination.Type
+			}
+			if destinationNames[destination.Name] {
+				return fmt.Errorf("route %s: destination name %q is used twice", route.Name, destination.Name)
+			}
+			destinationNames[destination.Name] = true
+			if err := destination.validate(file.SMTP); err != nil {
+				return fmt.Errorf("route %s destination %s: %v", route.Name, destination.Name, err)
+			}
+		}
+	}
+
+	nt.mu.Lock()
+	nt.routes, nt.smtp = file.Routes, file.SMTP
+	nt.mu.Unlock()
+
+	log.Printf("Loaded %d notification routes from %s", len(file.Routes), nt.Path)
+	return nil
+}
+
+func (d *NotificationDestination) validate(smtpConfig SMTPConfig) error {
+	switch d.Type {
+	case DestinationWebhook, DestinationSlack:
+		if d.URL == "" {
+			return fmt.Errorf("url is required")
+		}
+	case DestinationPagerDuty:
+		if d.RoutingKey == "" {
+			return fmt.Errorf("routing_key is required")
+		}
+		if d.URL == "" {
+			d.URL = defaultPagerDutyURL
+		}
+	case DestinationEmail:
+		if len(d.To) == 0 {
+			return fmt.Errorf("to is required")
+		}
+		if smtpConfig.Addr == "" || smtpConfig.From == "" {
+			return fmt.Errorf("email needs smtp.addr and smtp.from")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", d.Type)
+	}
+	return nil
+}
+
+// Routes returns the routes whose match selects n.
+func (nt *Notifier) Routes(n Notification) []NotificationRoute {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+	var matched []NotificationRoute
+	for _, route := range nt.routes {
+		if route.Match.matches(n) {
+			matched = append(matched, route)
+		}
+	}
+	return matched
+}
+
+// Destination looks up a destination by route and name in the current
+// configuration.
+func (nt *Notifier) Destination(routeName, name string) (NotificationDestination, SMTPConfig, bool) {
+	nt.mu.RLock()
+	defer nt.mu.RUnlock()
+	for _, route := range nt.routes {
+		if route.Name != routeName {
+			continue
+		}
+		for _, destination := range route.Destinations {
+			if destination.Name == name {
+				return destination, nt.smtp, true
+			}
+		}
+	}
+	return NotificationDestination{}, SMTPConfig{}, false
+}
+
+// notificationTask is the payload of a notification:deliver task. It names
+// the destination rather than embedding it so secrets stay out of Redis and
+// the dead-letter table.
+type notificationTask struct {
+	Route        string       `json:"route"`
+	Destination  string       `json:"destination"`
+	Notification Notification `json:"notification"`
+}
+
+// dispatchNotifications queues one delivery per destination of every route
+// that matches the finished analysis.
+func (app *App) dispatchNotifications(alert Alert, result AnalysisResult) {
+	if app.Notifier == nil {
+		return
+	}
+	n := newNotification(alert, result)
+	for _, route := range app.Notifier.Routes(n) {
+		for _, destination := range route.Destinations {
+			app.enqueueNotification(notificationTask{Route: route.Name, Destination: destination.Name, Notification: n})
+		}
+	}
+}
+
+func (app *App) enqueueNotification(task notificationTask) error {
+	_, err := app.TaskClient.Enqueue(asynq.NewTask("notification:deliver", mustMarshal(task)), asynq.MaxRetry(notifyMaxRetry))
+	if err != nil {
+		log.Printf("Failed to queue notification of alert %s to %s/%s: %v", task.Notification.AlertID, task.Route, task.Destination, err)
+		return err
+	}
+	return nil
+}
+
+// handleNotificationDelivery is the notification:deliver task handler. Every
+// attempt is logged; the last failed one is dead-lettered.
+func (app *App) handleNotificationDelivery(ctx context.Context, t *asynq.Task) error {
+	var task notificationTask
+	if err := json.Unmarshal(t.Payload(), &task); err != nil {
+		return fmt.Errorf("failed to unmarshal notification: %v", err)
+	}
+
+	retried, _ := asynq.GetRetryCount(ctx)
+	maxRetry, _ := asynq.GetMaxRetry(ctx)
+	return app.deliverNotification(ctx, task, retried, maxRetry)
+}
+
+// deliverNotification makes one attempt at task after retried earlier ones,
+// dead-lettering it if it fails for good or retried has reached maxRetry.
+func (app *App) deliverNotification(ctx context.Context, task notificationTask, retried, maxRetry int) error {
+	destination, smtpConfig, ok := app.Notifier.Destination(task.Route, task.Destination)
+	if !ok {
+		log.Printf("Dropping notification of alert %s: %s/%s is no longer configured", task.Notification.AlertID, task.Route, task.Destination)
+		return nil
+	}
+
+	statusCode, err := app.Notifier.Deliver(ctx, destination, smtpConfig, task.Notification)
+	app.Notifier.logDelivery(task, destination.Type, retried+1, statusCode, err)
+	if err == nil {
+		return nil
+	}
+
+	if retried >= maxRetry || errors.Is(err, asynq.SkipRetry) {
+		app.Notifier.deadLetter(task, destination.Type, retried+1, err)
+	}
+	return err
+}
+
+// Deliver sends n to one destination and returns the HTTP status code, if
+// any. Errors wrapping asynq.SkipRetry will not succeed on retry.
+func (nt *Notifier) Deliver(ctx context.Context, destination NotificationDestination, smtpConfig SMTPConfig, n Notification) (int, error) {
+	switch destination.Type {
+	case DestinationWebhook:
+		body := mustMarshal(n)
+		headers := map[string]string{}
+		if destination.Secret != "" {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			headers["X-SOC-Timestamp"] = timestamp
+			headers["X-SOC-Signature"] = "sha256=" + signWebhook(destination.Secret, timestamp, body)
+		}
+		return nt.postJSON(ctx, destination.URL, body, headers)
+
+	case DestinationSlack:
+		return nt.postJSON(ctx, destination.URL, mustMarshal(slackPayload(n)), nil)
+
+	case DestinationPagerDuty:
+		return nt.postJSON(ctx, destination.URL, mustMarshal(pagerDutyEvent(destination.RoutingKey, n)), nil)
+
+	case DestinationEmail:
+		return 0, sendEmail(smtpConfig, destination.To, n)
+	}
+	return 0, fmt.Errorf("unknown destination type %q: %w", destination.Type, asynq.SkipRetry)
+}
+
+// signWebhook is the hex HMAC-SHA256 of "<timestamp>.<body>". Receivers
+// should recompute it and reject stale timestamps to stop replays.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (nt *Notifier) postJSON(ctx context.Context, url string, body []byte, headers map[string]string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("failed to build request: %v: %w", err, asynq.SkipRetry)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := nt.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("destination returned %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	// Other client errors mean the request itself is wrong, so retrying
+	// won't help
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		err = fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+	}
+	return resp.StatusCode, err
+}
+
+// slackPayload is an incoming-webhook message; Mattermost and Teams'
+// Slack-compatible webhooks accept the same shape.
+func slackPayload(n Notification) map[string]interface{} {
+	fields := []string{fmt.Sprintf("*Project:* %s", n.ProjectID), fmt.Sprintf("*Alert:* %s", n.AlertID)}
+	if n.IncidentID != "" {
+		fields = append(fields, fmt.Sprintf("*Incident:* %s", n.IncidentID))
+	}
+	if len(n.Warnings) > 0 {
+		fields = append(fields, fmt.Sprintf("*Partial analysis:* %s", strings.Join(n.Warnings, "; ")))
+	}
+	return map[string]interface{}{
+		"text": n.Summary(),
+		"blocks": []map[string]interface{}{
+			{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": n.Summary()}},
+			{"type": "context", "elements": []map[string]string{{"type": "mrkdwn", "text": strings.Join(fields, "  ·  ")}}},
+		},
+	}
+}
+
+// pagerDutySeverities maps risk priority, then alert severity, to an Events
+// API v2 severity.
+var pagerDutySeverities = map[string]string{
+	"P1": "critical", "P2": "error", "P3": "warning", "P4": "info",
+	"critical": "critical", "high": "error", "medium": "warning", "low": "info",
+}
+
+// pagerDutyEvent is an Events API v2 trigger. The alert ID is the dedup key,
+// so a redelivered notification doesn't open a second PagerDuty incident.
+func pagerDutyEvent(routingKey string, n Notification) map[string]interface{} {
+	severity := pagerDutySeverities[n.RiskPriority]
+	if severity == "" {
+		severity = pagerDutySeverities[strings.ToLower(n.Severity)]
+	}
+	if severity == "" {
+		severity = "warning"
+	}
+	return map[string]interface{}{
+		"routing_key":  routingKey,
+		"event_action": "trigger",
+		"dedup_key":    n.AlertID,
+		"payload": map[string]interface{}{
+			"summary":        truncate(n.Summary(), 1024),
+			"source":         n.Source,
+			"severity":       severity,
+			"timestamp":      n.Timestamp.Format(time.RFC3339),
+			"group":          n.ProjectID,
+			"class":          n.Source,
+			"custom_details": n,
+		},
+	}
+}
+
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max]
+}
+
+func sendEmail(config SMTPConfig, to []string, n Notification) error {
+	var body strings.Builder
+	fmt.Fprintf(&body, "From: %s\r\n", config.From)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(truncate(n.Summary(), 200)))
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&body, "%s\r\n\r\n", n.Summary())
+	fmt.Fprintf(&body, "Project:   %s\r\nAlert:     %s\r\nSeverity:  %s\r\nTimestamp: %s\r\n",
+		n.ProjectID, n.AlertID, n.Severity, n.Timestamp.Format(time.RFC3339))
+	if n.IncidentID != "" {
+		fmt.Fprintf(&body, "Incident:  %s\r\n", n.IncidentID)
+	}
+	for _, warning := range n.Warnings {
+		fmt.Fprintf(&body, "Warning:   %s\r\n", warning)
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		host := config.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", config.Username, config.Password, host)
+	}
+	if err := smtp.SendMail(config.Addr, auth, config.From, to, []byte(body.String())); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
+
+func (nt *Notifier) logDelivery(task notificationTask, destinationType string, attempt, statusCode int, deliveryErr error) {
+	errText := ""
+	if deliveryErr != nil {
+		errText = deliveryErr.Error()
+	}
+	_, err := nt.db.Exec(`
+		INSERT INTO notification_deliveries (alert_id, route, destination, destination_type, attempt, success, status_code, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, task.Notification.AlertID, task.Route, task.Destination, destinationType, attempt, deliveryErr == nil, statusCode, errText)
+	if err != nil {
+		log.Printf("Failed to log notification delivery for alert %s: %v", task.Notification.AlertID, err)
+	}
+}
+
+func (nt *Notifier) deadLetter(task notificationTask, destinationType string, attempts int, deliveryErr error) {
+	_, err := nt.db.Exec(`
+		INSERT INTO notification_dead_letters (id, alert_id, route, destination, destination_type, payload, error, attempts)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, generateID(), task.Notification.AlertID, task.Route, task.Destination, destinationType, mustMarshal(task),
+		deliveryErr.Error(), attempts)
+	if err != nil {
+		log.Printf("Failed to dead-letter notification for alert %s: %v", task.Notification.AlertID, err)
+		return
+	}
+	log.Printf("Notification of alert %s to %s/%s dead-lettered after %d attempts: %v",
+		task.Notification.AlertID, task.Route, task.Destination, attempts, deliveryErr)
+}
+
+// NotificationDelivery is one logged delivery attempt.
+type NotificationDelivery struct {
+	ID              int64     `json:"id"`
+	AlertID         string    `json:"alert_id"`
+	Route           string    `json:"route"`
+	Destination     string    `json:"destination"`
+	DestinationType string    `json:"destination_type"`
+	Attempt         int       `json:"attempt"`
+	Success         bool      `json:"success"`
+	StatusCode      int       `json:"status_code,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (app *App) listNotificationDeliveries(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+	rows, err := app.DB.Query(`
+		SELECT id, alert_id, route, destination, destination_type, attempt, success, status_code, error, created_at
+		FROM notification_deliveries
+		WHERE ($1 = '' OR alert_id = $1)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $2
+	`, r.URL.Query().Get("alert_id"), limit)
+	if err != nil {
+		http.Error(w, "Failed to list notification deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	deliveries := []NotificationDelivery{}
+	for rows.Next() {
+		var d NotificationDelivery
+		if err := rows.Scan(&d.ID, &d.AlertID, &d.Route, &d.Destination, &d.DestinationType, &d.Attempt,
+			&d.Success, &d.StatusCode, &d.Error, &d.CreatedAt); err != nil {
+			http.Error(w, "Failed to list notification deliveries", http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// DeadLetter is a notification that exhausted its retries.
+type DeadLetter struct {
+	ID              string       `json:"id"`
+	AlertID         string       `json:"alert_id"`
+	Route           string       `json:"route"`
+	Destination     string       `json:"destination"`
+	DestinationType string       `json:"destination_type"`
+	Notification    Notification `json:"notification"`
+	Error           string       `json:"error"`
+	Attempts        int          `json:"attempts"`
+	CreatedAt       time.Time    `json:"created_at"`
+	RequeuedAt      *time.Time   `json:"requeued_at,omitempty"`
+}
+
+func (app *App) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	rows, err := app.DB.Query(`
+		SELECT id, alert_id, route, destination, destination_type, payload, error, attempts, created_at, requeued_at
+		FROM notification_dead_letters
+		WHERE ($1 OR requeued_at IS NULL)
+		ORDER BY created_at DESC
+		LIMIT 500
+	`, r.URL.Query().Get("include_requeued") == "true")
+	if err != nil {
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+		var payload []byte
+		var requeuedAt sql.NullTime
+		if err := rows.Scan(&letter.ID, &letter.AlertID, &letter.Route, &letter.Destination, &letter.DestinationType,
+			&payload, &letter.Error, &letter.Attempts, &letter.CreatedAt, &requeuedAt); err != nil {
+			http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+			return
+		}
+		var task notificationTask
+		json.Unmarshal(payload, &task)
+		letter.Notification = task.Notification
+		if requeuedAt.Valid {
+			letter.RequeuedAt = &requeuedAt.Time
+		}
+		letters = append(letters, letter)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+// requeueDeadLetter queues a dead-lettered notification again with a fresh
+// set of retries, e.g. after fixing the destination's configuration.
+func (app *App) requeueDeadLetter(w http.ResponseWriter, r *http.Request) {
+	var payload []byte
+	err := app.DB.QueryRow(`
+		UPDATE notification_dead_letters SET requeued_at = NOW()
+		WHERE id = $1 AND requeued_at IS NULL
+		RETURNING payload
+	`, chi.URLParam(r, "dead_letter_id")).Scan(&payload)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Dead letter not found or already requeued", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to requeue dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	var task notificationTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		http.Error(w, "Dead letter payload is corrupt", http.StatusInternalServerError)
+		return
+	}
+	if err := app.enqueueNotification(task); err != nil {
+		app.DB.Exec(`UPDATE notification_dead_letters SET requeued_at = NULL WHERE id = $1`, chi.URLParam(r, "dead_letter_id"))
+		http.Error(w, "Failed to queue notification", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
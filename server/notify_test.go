@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hibiken/asynq"
+)
+
+// recordingDB is a database/sql connector whose connections accept any
+// statement and remember it, so code that only writes can be tested without
+// Postgres.
+type recordingDB struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+func (r *recordingDB) Connect(context.Context) (driver.Conn, error) { return recordingConn{r}, nil }
+func (r *recordingDB) Driver() driver.Driver                        { return nil }
+
+// count returns how many recorded statements contain fragment.
+func (r *recordingDB) count(fragment string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, statement := range r.statements {
+		if strings.Contains(statement, fragment) {
+			n++
+		}
+	}
+	return n
+}
+
+type recordingConn struct{ db *recordingDB }
+
+func (c recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return recordingStmt{db: c.db, query: query}, nil
+}
+func (c recordingConn) Close() error { return nil }
+func (c recordingConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type recordingStmt struct {
+	db    *recordingDB
+	query string
+}
+
+func (s recordingStmt) Close() error  { return nil }
+func (s recordingStmt) NumInput() int { return -1 }
+func (s recordingStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	s.db.statements = append(s.db.statements, s.query)
+	s.db.mu.Unlock()
+	return driver.RowsAffected(1), nil
+}
+func (s recordingStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries not supported")
+}
+
+// captured is one request received by a test destination.
+type captured struct {
+	header http.Header
+	body   []byte
+}
+
+// newDestinationServer answers every request with status and passes what it
+// received to the returned channel.
+func newDestinationServer(t *testing.T, status int) (*httptest.Server, chan captured) {
+	t.Helper()
+	requests := make(chan captured, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- captured{header: r.Header.Clone(), body: body}
+		w.WriteHeader(status)
+		fmt.Fprint(w, http.StatusText(status))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func testNotification() Notification {
+	score := 87
+	return Notification{
+		AlertID:      "alert-1",
+		ProjectID:    "company-a",
+		Source:       "aws_waf",
+		Severity:     "high",
+		Message:      "SQL injection attempt",
+		Timestamp:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Status:       "completed",
+		RiskScore:    &score,
+		RiskPriority: "P1",
+		IncidentID:   "incident-1",
+	}
+}
+
+func TestDeliverWebhookSignsBody(t *testing.T) {
+	server, requests := newDestinationServer(t, http.StatusOK)
+	nt := NewNotifier(nil, "")
+	destination := NotificationDestination{Type: DestinationWebhook, URL: server.URL, Secret: "s3cret"}
+
+	status, err := nt.Deliver(context.Background(), destination, SMTPConfig{}, testNotification())
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("Deliver = %d, %v; want 200, nil", status, err)
+	}
+	request := <-requests
+
+	timestamp := request.header.Get("X-SOC-Timestamp")
+	if timestamp == "" {
+		t.Fatal("X-SOC-Timestamp is missing")
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(request.body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := request.header.Get("X-SOC-Signature"); got != want {
+		t.Errorf("X-SOC-Signature = %q, want %q", got, want)
+	}
+
+	var received Notification
+	if err := json.Unmarshal(request.body, &received); err != nil {
+		t.Fatalf("body is not a notification: %v", err)
+	}
+	if received.AlertID != "alert-1" || received.ProjectID != "company-a" {
+		t.Errorf("body = %+v, want the notification", received)
+	}
+}
+
+func TestDeliverWebhookWithoutSecretIsUnsigned(t *testing.T) {
+	server, requests := newDestinationServer(t, http.StatusNoContent)
+	nt := NewNotifier(nil, "")
+	destination := NotificationDestination{Type: DestinationWebhook, URL: server.URL}
+
+	if _, err := nt.Deliver(context.Background(), destination, SMTPConfig{}, testNotification()); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	request := <-requests
+	if request.header.Get("X-SOC-Signature") != "" || request.header.Get("X-SOC-Timestamp") != "" {
+		t.Errorf("unsigned webhook carries signature headers: %v", request.header)
+	}
+}
+
+func TestDeliverSlackPayload(t *testing.T) {
+	server, requests := newDestinationServer(t, http.StatusOK)
+	nt := NewNotifier(nil, "")
+	n := testNotification()
+	n.Warnings = []string{"loki unavailable"}
+
+	if _, err := nt.Deliver(context.Background(), NotificationDestination{Type: DestinationSlack, URL: server.URL}, SMTPConfig{}, n); err != nil {
+		t.Fatalf("Deliver: %v", err)
+	}
+	request := <-requests
+
+	var payload struct {
+		Text   string `json:"text"`
+		Blocks []struct {
+			Type string `json:"type"`
+			Text struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"text"`
+			Elements []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"elements"`
+		} `json:"blocks"`
+	}
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatalf("invalid Slack payload: %v", err)
+	}
+
+	summary := "[P1 HIGH] aws_waf: SQL injection attempt (risk 87/100)"
+	if payload.Text != summary {
+		t.Errorf("text = %q, want %q", payload.Text, summary)
+	}
+	if len(payload.Blocks) != 2 {
+		t.Fatalf("got %d blocks, want 2", len(payload.Blocks))
+	}
+	if section := payload.Blocks[0]; section.Type != "section" || section.Text.Type != "mrkdwn" || section.Text.Text != summary {
+		t.Errorf("section block = %+v", section)
+	}
+	contextBlock := payload.Blocks[1]
+	if contextBlock.Type != "context" || len(contextBlock.Elements) != 1 {
+		t.Fatalf("context block = %+v", contextBlock)
+	}
+	for _, field := range []string{"*Project:* company-a", "*Alert:* alert-1", "*Incident:* incident-1", "*Partial analysis:* loki unavailable"} {
+		if !strings.Contains(contextBlock.Elements[0].Text, field) {
+			t.Errorf("context %q lacks %q", contextBlock.Elements[0].Text, field)
+		}
+	}
+}
+
+func TestDeliverPagerDutyEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority string
+		severity string
+		want     string
+	}{
+		{"risk priority wins", "P1", "low", "critical"},
+		{"falls back to severity", "", "high", "error"},
+		{"unknown severity", "", "urgent", "warning"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newDestinationServer(t, http.StatusAccepted)
+			nt := NewNotifier(nil, "")
+			n := testNotification()
+			n.RiskPriority, n.Severity = tt.priority, tt.severity
+			destination := NotificationDestination{Type: DestinationPagerDuty, URL: server.URL, RoutingKey: "routing-key"}
+
+			if _, err := nt.Deliver(context.Background(), destination, SMTPConfig{}, n); err != nil {
+				t.Fatalf("Deliver: %v", err)
+			}
+			request := <-requests
+
+			var event struct {
+				RoutingKey  string `json:"routing_key"`
+				EventAction string `json:"event_action"`
+				DedupKey    string `json:"dedup_key"`
+				Payload     struct {
+					Summary       string       `json:"summary"`
+					Source        string       `json:"source"`
+					Severity      string       `json:"severity"`
+					Timestamp     string       `json:"timestamp"`
+					Group         string       `json:"group"`
+					CustomDetails Notification `json:"custom_details"`
+				} `json:"payload"`
+			}
+			if err := json.Unmarshal(request.body, &event); err != nil {
+				t.Fatalf("invalid PagerDuty event: %v", err)
+			}
+			if event.RoutingKey != "routing-key" || event.EventAction != "trigger" || event.DedupKey != "alert-1" {
+				t.Errorf("event = %+v", event)
+			}
+			if event.Payload.Severity != tt.want {
+				t.Errorf("severity = %q, want %q", event.Payload.Severity, tt.want)
+			}
+			if event.Payload.Source != "aws_waf" || event.Payload.Group != "company-a" || event.Payload.Timestamp != "2024-05-01T12:00:00Z" {
+				t.Errorf("payload = %+v", event.Payload)
+			}
+			if event.Payload.Summary != n.Summary() || event.Payload.CustomDetails.AlertID != "alert-1" {
+				t.Errorf("payload summary or details = %+v", event.Payload)
+			}
+		})
+	}
+}
+
+func TestDeliverRetriesOnlyRecoverableStatuses(t *testing.T) {
+	tests := []struct {
+		status    int
+		skipRetry bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusUnauthorized, true},
+		{http.StatusNotFound, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server, _ := newDestinationServer(t, tt.status)
+			nt := NewNotifier(nil, "")
+			destination := NotificationDestination{Type: DestinationWebhook, URL: server.URL}
+
+			status, err := nt.Deliver(context.Background(), destination, SMTPConfig{}, testNotification())
+			if status != tt.status {
+				t.Errorf("status = %d, want %d", status, tt.status)
+			}
+			if err == nil {
+				t.Fatal("Deliver succeeded, want an error")
+			}
+			if got := errors.Is(err, asynq.SkipRetry); got != tt.skipRetry {
+				t.Errorf("SkipRetry = %v, want %v (err %v)", got, tt.skipRetry, err)
+			}
+		})
+	}
+}
+
+func TestDeliverNotificationDeadLettersLastAttempt(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retried    int
+		deadLetter bool
+	}{
+		{"retryable failure with retries left", http.StatusInternalServerError, 2, false},
+		{"retryable failure on the last attempt", http.StatusInternalServerError, notifyMaxRetry, true},
+		{"permanent failure on the first attempt", http.StatusBadRequest, 0, true},
+		{"success on the last attempt", http.StatusOK, notifyMaxRetry, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newDestinationServer(t, tt.status)
+			recorder := &recordingDB{}
+			db := sql.OpenDB(recorder)
+			defer db.Close()
+
+			nt := NewNotifier(db, "")
+			nt.routes = []NotificationRoute{{
+				Name:         "soc",
+				Destinations: []NotificationDestination{{Name: "hook", Type: DestinationWebhook, URL: server.URL}},
+			}}
+			app := &App{Notifier: nt}
+			task := notificationTask{Route: "soc", Destination: "hook", Notification: testNotification()}
+
+			err := app.deliverNotification(context.Background(), task, tt.retried, notifyMaxRetry)
+			if (err == nil) != (tt.status < 300) {
+				t.Errorf("deliverNotification error = %v for status %d", err, tt.status)
+			}
+			if got := recorder.count("INSERT INTO notification_deliveries"); got != 1 {
+				t.Errorf("logged %d delivery attempts, want 1", got)
+			}
+			deadLettered := recorder.count("INSERT INTO notification_dead_letters") == 1
+			if deadLettered != tt.deadLetter {
+				t.Errorf("dead-lettered = %v, want %v", deadLettered, tt.deadLetter)
+			}
+		})
+	}
+}
+
+func TestDeliverNotificationDropsRemovedDestination(t *testing.T) {
+	recorder := &recordingDB{}
+	db := sql.OpenDB(recorder)
+	defer db.Close()
+
+	app := &App{Notifier: NewNotifier(db, "")}
+	task := notificationTask{Route: "gone", Destination: "hook", Notification: testNotification()}
+	if err := app.deliverNotification(context.Background(), task, notifyMaxRetry, notifyMaxRetry); err != nil {
+		t.Errorf("deliverNotification = %v, want nil", err)
+	}
+	if got := recorder.count("INSERT"); got != 0 {
+		t.Errorf("wrote %d rows for a destination that no longer exists", got)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// RiskFactor is one line of a risk score breakdown.
+type RiskFactor struct {
+	Name   string  `json:"name"`
+	Points float64 `json:"points"`
+	Max    float64 `json:"max"`
+	Detail string  `json:"detail,omitempty"`
+}
+
+// RiskScore is the 0-100 triage priority of an analyzed alert.
+type RiskScore struct {
+	Score     int          `json:"score"`
+	Priority  string       `json:"priority"`
+	Breakdown []RiskFactor `json:"breakdown"`
+}
+
+// RiskInputs gathers the signals the scorer weighs. Anomaly scores are
+// normalized to 0-1.
+type RiskInputs struct {
+	Alert               Alert
+	Correlation         *CorrelationResult
+	UserAnomaly         float64
+	LogAnomaly          float64
+	ThreatIntelHits     int
+	ImpossibleTravel    bool
+	AssetCriticality    string
+	HighConfidenceUsers int
+}
+
+// Maximum points per factor; they add up to 100.
+const (
+	riskSeverityMax    = 35.0
+	riskUsersMax       = 15.0
+	riskAssetsMax      = 15.0
+	riskAnomalyMax     = 15.0
+	riskThreatIntelMax = 20.0
+)
+
+var riskSeverityPoints = map[string]float64{
+	"critical": 35,
+	"high":     26,
+	"medium":   16,
+	"low":      7,
+}
+
+var riskCriticalityPoints = map[string]float64{
+	"critical": 15,
+	"high":     11,
+	"medium":   6,
+	"low":      2,
+}
+
+// defaultSourceReliability is how much we trust each alert source's severity,
+// from 0 to 1. Unlisted sources get defaultReliability.
+var defaultSourceReliability = map[string]float64{
+	"aws_guardduty": 0.95,
+	"deep_security": 0.9,
+	"sigma":         0.9,
+	"rule_engine":   0.85,
+	"aws_waf":       0.8,
+	"azure_waf":     0.8,
+	"akamai_waf":    0.75,
+}
+
+const defaultReliability = 0.7
+
+// RiskScorer turns analysis signals into a triage priority.
+type RiskScorer struct {
+	SourceReliability map[string]float64
+}
+
+func NewRiskScorer() *RiskScorer {
+	return &RiskScorer{SourceReliability: defaultSourceReliability}
+}
+
+func riskPriority(score int) string {
+	switch {
+	case score >= 80:
+		return "P1"
+	case score >= 60:
+		return "P2"
+	case score >= 35:
+		return "P3"
+	default:
+		return "P4"
+	}
+}
+
+// Score computes the risk score. The source's reliability discounts its
+// reported severity, so an unreliable "critical" ranks below a trusted one.
+func (rs *RiskScorer) Score(in RiskInputs) *RiskScore {
+	var breakdown []RiskFactor
+
+	severity := strings.ToLower(in.Alert.Severity)
+	severityPoints := riskSeverityPoints[severity]
+	breakdown = append(breakdown, RiskFactor{Name: "severity", Points: severityPoints, Max: riskSeverityMax, Detail: severity})
+
+	reliability, ok := rs.SourceReliability[in.Alert.Source]
+	if !ok {
+		reliability = defaultReliability
+	}
+	breakdown = append(breakdown, RiskFactor{
+		Name:   "source_reliability",
+		Points: -severityPoints * (1 - reliability),
+		Max:    0,
+		Detail: in.Alert.Source,
+	})
+
+	users := 0
+	if in.Correlation != nil {
+		uniqueUsers := make(map[string]bool)
+		for _, log := range in.Correlation.RelatedLogs {
+			for _, email := range log.UserEmails {
+				uniqueUsers[strings.ToLower(email)] = true
+			}
+		}
+		users = len(uniqueUsers)
+	}
+	// Users we can tie to the activity with confidence matter more than
+	// addresses merely seen in the window
+	otherUsers := math.Max(0, float64(users-in.HighConfidenceUsers))
+	userPoints := math.Min(riskUsersMax, 5*float64(in.HighConfidenceUsers)+2*otherUsers)
+	breakdown = append(breakdown, RiskFactor{Name: "users", Points: userPoints, Max: riskUsersMax})
+
+	assetPoints := 0.0
+	assetDetail := strings.ToLower(in.AssetCriticality)
+	if points, ok := riskCriticalityPoints[assetDetail]; ok {
+		assetPoints = points
+	} else if in.Correlation != nil {
+		// Without inventory context, count the distinct hosts touched
+		hosts := make(map[string]bool)
+		for _, log := range in.Correlation.RelatedLogs {
+			if log.Host != "" {
+				hosts[strings.ToLower(log.Host)] = true
+			}
+		}
+		assetPoints = math.Min(6, 2*float64(len(hosts)))
+		assetDetail = "unknown"
+	}
+	breakdown = append(breakdown, RiskFactor{Name: "assets", Points: assetPoints, Max: riskAssetsMax, Detail: assetDetail})
+
+	// Impossible travel is as strong an anomaly as we can observe
+	anomaly := math.Max(in.UserAnomaly, in.LogAnomaly)
+	anomalyDetail := ""
+	if in.ImpossibleTravel {
+		anomaly, anomalyDetail = 1, "impossible travel"
+	}
+	breakdown = append(breakdown, RiskFactor{Name: "anomaly", Points: riskAnomalyMax * math.Min(1, anomaly), Max: riskAnomalyMax, Detail: anomalyDetail})
+
+	intelPoints := 0.0
+	if in.ThreatIntelHits > 0 {
+		intelPoints = math.Min(riskThreatIntelMax, 10+5*float64(in.ThreatIntelHits-1))
+	}
+	breakdown = append(breakdown, RiskFactor{Name: "threat_intel", Points: intelPoints, Max: riskThreatIntelMax})
+
+	total := 0.0
+	for i := range breakdown {
+		breakdown[i].Points = math.Round(breakdown[i].Points*10) / 10
+		total += breakdown[i].Points
+	}
+	score := int(math.Round(math.Max(0, math.Min(100, total))))
+
+	return &RiskScore{Score: score, Priority: riskPriority(score), Breakdown: breakdown}
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func riskFactor(t *testing.T, score *RiskScore, name string) RiskFactor {
+	t.Helper()
+	for _, factor := range score.Breakdown {
+		if factor.Name == name {
+			return factor
+		}
+	}
+	t.Fatalf("no %s factor in %+v", name, score.Breakdown)
+	return RiskFactor{}
+}
+
+func TestRiskScoreBounds(t *testing.T) {
+	rs := &RiskScorer{SourceReliability: map[string]float64{"aws_guardduty": 1}}
+
+	top := rs.Score(RiskInputs{
+		Alert:               Alert{Source: "aws_guardduty", Severity: "CRITICAL"},
+		HighConfidenceUsers: 3,
+		AssetCriticality:    "critical",
+		ImpossibleTravel:    true,
+		ThreatIntelHits:     5,
+	})
+	if top.Score != 100 || top.Priority != "P1" {
+		t.Errorf("every factor at its maximum = %d %s, want 100 P1", top.Score, top.Priority)
+	}
+
+	// 7 severity points, less 30% for an unlisted source
+	bottom := NewRiskScorer().Score(RiskInputs{Alert: Alert{Source: "custom", Severity: "low"}})
+	if bottom.Score != 5 || bottom.Priority != "P4" {
+		t.Errorf("low alert from an unknown source = %d %s, want 5 P4", bottom.Score, bottom.Priority)
+	}
+}
+
+func TestRiskScoreSourceReliability(t *testing.T) {
+	rs := NewRiskScorer()
+	trusted := rs.Score(RiskInputs{Alert: Alert{Source: "aws_guardduty", Severity: "critical"}})
+	untrusted := rs.Score(RiskInputs{Alert: Alert{Source: "akamai_waf", Severity: "critical"}})
+	if trusted.Score <= untrusted.Score {
+		t.Errorf("trusted critical scored %d, untrusted %d", trusted.Score, untrusted.Score)
+	}
+	if discount := riskFactor(t, untrusted, "source_reliability"); discount.Points != -8.8 {
+		t.Errorf("akamai_waf discount = %v, want -8.8", discount.Points)
+	}
+}
+
+func TestRiskScoreFactors(t *testing.T) {
+	rs := NewRiskScorer()
+	correlation := &CorrelationResult{RelatedLogs: []NormalizedLog{
+		{UserEmails: []string{"alice@example.com", "bob@example.com"}, Host: "web-1"},
+		{UserEmails: []string{"Alice@example.com", "carol@example.com"}, Host: "WEB-1"},
+		{Host: "db-1"},
+	}}
+	tests := []struct {
+		name   string
+		in     RiskInputs
+		factor string
+		points float64
+		detail string
+	}{
+		{"confident and seen users", RiskInputs{Correlation: correlation, HighConfidenceUsers: 2}, "users", 12, ""},
+		{"users capped", RiskInputs{Correlation: correlation, HighConfidenceUsers: 4}, "users", 15, ""},
+		{"inventory criticality", RiskInputs{Correlation: correlation, AssetCriticality: "High"}, "assets", 11, "high"},
+		{"distinct hosts without inventory", RiskInputs{Correlation: correlation}, "assets", 4, "unknown"},
+		{"stronger anomaly wins", RiskInputs{UserAnomaly: 0.2, LogAnomaly: 0.6}, "anomaly", 9, ""},
+		{"impossible travel", RiskInputs{UserAnomaly: 0.2, ImpossibleTravel: true}, "anomaly", 15, "impossible travel"},
+		{"one intel hit", RiskInputs{ThreatIntelHits: 1}, "threat_intel", 10, ""},
+		{"intel capped", RiskInputs{ThreatIntelHits: 4}, "threat_intel", 20, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.in.Alert = Alert{Source: "aws_waf", Severity: "medium"}
+			factor := riskFactor(t, rs.Score(tt.in), tt.factor)
+			if factor.Points != tt.points || factor.Detail != tt.detail {
+				t.Errorf("%s = %v (%q), want %v (%q)", tt.factor, factor.Points, factor.Detail, tt.points, tt.detail)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RuleStateStore keeps the sliding windows and seen-value sets used by the
+// stateful rule engine. Windows are keyed by rule and group and ordered by
+// event time rather than wall-clock time, so replays behave like live data.
+type RuleStateStore interface {
+	// AddEvent records ref in the window at key and returns every event still
+	// inside [ref.Timestamp-window, ref.Timestamp], oldest first.
+	AddEvent(key string, ref LogRef, window time.Duration) ([]LogRef, error)
+	// Events returns the events in the window ending at now without adding one.
+	Events(key string, now time.Time, window time.Duration) ([]LogRef, error)
+	// Reset clears the window at key after a rule fired.
+	Reset(keys ...string) error
+	// SeenValue records value in the set at key and reports whether it was
+	// already present and whether the set held any values before.
+	SeenValue(key, value string, ttl time.Duration) (seen bool, hadHistory bool, err error)
+}
+
+type memoryRuleState struct {
+	mu     sync.Mutex
+	events map[string][]LogRef
+	values map[string]map[string]time.Time
+}
+
+func NewMemoryRuleState() RuleStateStore {
+	return &memoryRuleState{
+		events: make(map[string][]LogRef),
+		values: make(map[string]map[string]time.Time),
+	}
+}
+
+func (m *memoryRuleState) prune(key string, now time.Time, window time.Duration) []LogRef {
+	cutoff := now.Add(-window)
+	events := m.events[key]
+	kept := events[:0]
+	var inWindow []LogRef
+	for _, event := range events {
+		if event.Timestamp.Before(cutoff) {
+			continue
+		}
+		kept = append(kept, event)
+		if !event.Timestamp.After(now) {
+			inWindow = append(inWindow, event)
+		}
+	}
+	if len(kept) == 0 {
+		delete(m.events, key)
+		return nil
+	}
+	m.events[key] = kept
+	return inWindow
+}
+
+func (m *memoryRuleState) AddEvent(key string, ref LogRef, window time.Duration) ([]LogRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.events[key] = append(m.events[key], ref)
+	sort.SliceStable(m.events[key], func(i, j int) bool {
+		return m.events[key][i].Timestamp.Before(m.events[key][j].Timestamp)
+	})
+	return m.prune(key, ref.Timestamp, window), nil
+}
+
+func (m *memoryRuleState) Events(key string, now time.Time, window time.Duration) ([]LogRef, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.prune(key, now, window), nil
+}
+
+func (m *memoryRuleState) Reset(keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range keys {
+		delete(m.events, key)
+	}
+	return nil
+}
+
+func (m *memoryRuleState) SeenValue(key, value string, ttl time.Duration) (bool, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	values := m.values[key]
+	if values == nil {
+		values = make(map[string]time.Time)
+		m.values[key] = values
+	}
+	for v, expires := range values {
+		if now.After(expires) {
+			delete(values, v)
+		}
+	}
+
+	hadHistory := len(values) > 0
+	_, seen := values[value]
+	values[value] = now.Add(ttl)
+	return seen, hadHistory, nil
+}
+
+// redisRuleState shares windows across API replicas and workers. Each window
+// is a sorted set scored by event time in milliseconds.
+type redisRuleState struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisRuleState(client *redis.Client) RuleStateStore {
+	return &redisRuleState{client: client, prefix: "rules:"}
+}
+
+func (r *redisRuleState) AddEvent(key string, ref LogRef, window time.Duration) ([]LogRef, error) {
+	ctx := context.Background()
+	member, err := json.Marshal(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	redisKey := r.prefix + key
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(ctx, redisKey, redis.Z{Score: float64(ref.Timestamp.UnixMilli()), Member: member})
+		pipe.Expire(ctx, redisKey, 2*window)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record rule event: %v", err)
+	}
+
+	return r.Events(key, ref.Timestamp, window)
+}
+
+func (r *redisRuleState) Events(key string, now time.Time, window time.Duration) ([]LogRef, error) {
+	ctx := context.Background()
+	redisKey := r.prefix + key
+
+	cutoff := now.Add(-window).UnixMilli()
+	if err := r.client.ZRemRangeByScore(ctx, redisKey, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return nil, fmt.Errorf("failed to prune rule window: %v", err)
+	}
+
+	members, err := r.client.ZRangeByScore(ctx, redisKey, &redis.ZRangeBy{
+		Min: strconv.FormatInt(cutoff, 10),
+		Max: strconv.FormatInt(now.UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule window: %v", err)
+	}
+
+	events := make([]LogRef, 0, len(members))
+	for _, member := range members {
+		var ref LogRef
+		if err := json.Unmarshal([]byte(member), &ref); err != nil {
+			continue
+		}
+		events = append(events, ref)
+	}
+	return events, nil
+}
+
+func (r *redisRuleState) Reset(keys ...string) error {
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = r.prefix + key
+	}
+	return r.client.Del(context.Background(), redisKeys...).Err()
+}
+
+func (r *redisRuleState) SeenValue(key, value string, ttl time.Duration) (bool, bool, error) {
+	ctx := context.Background()
+	redisKey := r.prefix + "values:" + key
+
+	// Score each value by its expiry so stale ones can be trimmed cheaply
+	now := time.Now()
+	var countCmd *redis.IntCmd
+	var scoreCmd *redis.FloatCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, redisKey, "-inf", "("+strconv.FormatInt(now.UnixMilli(), 10))
+		countCmd = pipe.ZCard(ctx, redisKey)
+		scoreCmd = pipe.ZScore(ctx, redisKey, value)
+		pipe.ZAdd(ctx, redisKey, redis.Z{Score: float64(now.Add(ttl).UnixMilli()), Member: value})
+		pipe.Expire(ctx, redisKey, ttl)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, false, fmt.Errorf("failed to record rule value: %v", err)
+	}
+
+	seen := scoreCmd.Err() == nil
+	return seen, countCmd.Val() > 0, nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Stateful rule types supported by the RuleEngine.
+const (
+	RuleTypeThreshold = "threshold"
+	RuleTypeSequence  = "sequence"
+	RuleTypeNewValue  = "new_value"
+)
+
+// StatefulRule is one entry of the rules config file. Filters use the same
+// field syntax as Sigma selections, e.g. {"action|contains": "BLOCK"}.
+type StatefulRule struct {
+	ID      string                 `yaml:"id" json:"id"`
+	Title   string                 `yaml:"title" json:"title"`
+	Type    string                 `yaml:"type" json:"type"`
+	Level   string                 `yaml:"level" json:"level"`
+	Tags    []string               `yaml:"tags" json:"tags,omitempty"`
+	Filter  map[string]interface{} `yaml:"filter" json:"filter,omitempty"`
+	GroupBy string                 `yaml:"group_by" json:"group_by"`
+	Window  string                 `yaml:"window" json:"window,omitempty"`
+
+	// threshold
+	Threshold int `yaml:"threshold" json:"threshold,omitempty"`
+
+	// sequence
+	Steps []struct {
+		Filter map[string]interface{} `yaml:"filter" json:"filter"`
+		Count  int                    `yaml:"count" json:"count"`
+	} `yaml:"steps" json:"steps,omitempty"`
+
+	// new_value
+	Field    string `yaml:"field" json:"field,omitempty"`
+	Lookback string `yaml:"lookback" json:"lookback,omitempty"`
+
+	window   time.Duration
+	lookback time.Duration
+	filter   sigmaMatcher
+	steps    []compiledStep
+}
+
+type compiledStep struct {
+	filter sigmaMatcher
+	count  int
+}
+
+type rulesFile struct {
+	Rules []StatefulRule `yaml:"rules"`
+}
+
+func matchAll(NormalizedLog) bool { return true }
+
+func compileOptionalFilter(filter map[string]interface{}) (sigmaMatcher, error) {
+	if len(filter) == 0 {
+		return matchAll, nil
+	}
+	return compileFieldMap(filter)
+}
+
+func (rule *StatefulRule) compile() error {
+	if rule.ID == "" {
+		return fmt.Errorf("rule without id")
+	}
+	if rule.GroupBy == "" {
+		return fmt.Errorf("rule %s: group_by is required", rule.ID)
+	}
+
+	var err error
+	if rule.filter, err = compileOptionalFilter(rule.Filter); err != nil {
+		return fmt.Errorf("rule %s filter: %v", rule.ID, err)
+	}
+
+	if rule.Window != "" {
+		if rule.window, err = time.ParseDuration(rule.Window); err != nil {
+			return fmt.Errorf("rule %s window: %v", rule.ID, err)
+		}
+	}
+
+	switch rule.Type {
+	case RuleTypeThreshold:
+		if rule.Threshold <= 0 || rule.window <= 0 {
+			return fmt.Errorf("rule %s: threshold rules need threshold and window", rule.ID)
+		}
+	case RuleTypeSequence:
+		if len(rule.Steps) < 2 || rule.window <= 0 {
+			return fmt.Errorf("rule %s: sequence rules need at least two steps and a window", rule.ID)
+		}
+		rule.steps = nil
+		for i, step := range rule.Steps {
+			filter, err := compileOptionalFilter(step.Filter)
+			if err != nil {
+				return fmt.Errorf("rule %s step %d: %v", rule.ID, i, err)
+			}
+			count := step.Count
+			if count <= 0 {
+				count = 1
+			}
+			rule.steps = append(rule.steps, compiledStep{filter: filter, count: count})
+		}
+	case RuleTypeNewValue:
+		if rule.Field == "" {
+			return fmt.Errorf("rule %s: new_value rules need a field", rule.ID)
+		}
+		rule.lookback = 30 * 24 * time.Hour
+		if rule.Lookback != "" {
+			if rule.lookback, err = time.ParseDuration(rule.Lookback); err != nil {
+				return fmt.Errorf("rule %s lookback: %v", rule.ID, err)
+			}
+		}
+	default:
+		return fmt.Errorf("rule %s: unknown type %q", rule.ID, rule.Type)
+	}
+
+	if rule.Title == "" {
+		rule.Title = rule.ID
+	}
+	return nil
+}
+
+// RuleEngine evaluates threshold, sequence and new-value rules over the
+// normalized log stream, keeping its sliding windows in a RuleStateStore.
+type RuleEngine struct {
+	mu    sync.RWMutex
+	rules []*StatefulRule
+
+	Path  string
+	State RuleStateStore
+}
+
+func NewRuleEngine(path string, state RuleStateStore) *RuleEngine {
+	return &RuleEngine{Path: path, State: state}
+}
+
+// LoadRules replaces the active rule set with the contents of Path. On any
+// error the previous rules stay active, so a bad edit doesn't disable
+// detection.
+func (re *RuleEngine) LoadRules() error {
+	data, err := os.ReadFile(re.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read rules file %s: %v", re.Path, err)
+	}
+
+	var file rulesFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse rules file %s: %v", re.Path, err)
+	}
+
+	rules := make([]*StatefulRule, 0, len(file.Rules))
+	for i := range file.Rules {
+		rule := file.Rules[i]
+		if err := rule.compile(); err != nil {
+			return err
+		}
+		rules = append(rules, &rule)
+	}
+
+	re.mu.Lock()
+	re.rules = rules
+	re.mu.Unlock()
+
+	log.Printf("Loaded %d stateful rules from %s", len(rules), re.Path)
+	return nil
+}
+
+func (re *RuleEngine) Rules() []*StatefulRule {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+	return re.rules
+}
+
+// Detect implements Detector.
+func (re *RuleEngine) Detect(projectID string, normalized NormalizedLog) []Detection {
+	var detections []Detection
+	for _, rule := range re.Rules() {
+		groups := sigmaFieldValues(normalized, rule.GroupBy)
+		for _, group := range groups {
+			if group == "" {
+				continue
+			}
+			detection, err := re.evaluate(rule, projectID, group, normalized)
+			if err != nil {
+				log.Printf("Rule %s evaluation failed: %v", rule.ID, err)
+				continue
+			}
+			if detection != nil {
+				detections = append(detections, *detection)
+			}
+		}
+	}
+	return detections
+}
+
+func (re *RuleEngine) evaluate(rule *StatefulRule, projectID, group string, log NormalizedLog) (*Detection, error) {
+	key := strings.Join([]string{projectID, rule.ID, strings.ToLower(group)}, ":")
+	ref := newLogRef(log)
+
+	detection := &Detection{
+		Engine:    rule.Type,
+		RuleID:    rule.ID,
+		RuleTitle: rule.Title,
+		Level:     rule.Level,
+		Tags:      rule.Tags,
+		GroupKey:  rule.GroupBy + "=" + group,
+		Log:       log,
+	}
+
+	switch rule.Type {
+	case RuleTypeThreshold:
+		if !rule.filter(log) {
+			return nil, nil
+		}
+		events, err := re.State.AddEvent(key, ref, rule.window)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) < rule.Threshold {
+			return nil, nil
+		}
+		// Start a fresh window so the rule fires once per burst of N events
+		if err := re.State.Reset(key); err != nil {
+			return nil, err
+		}
+		detection.Contributing = events
+		return detection, nil
+
+	case RuleTypeSequence:
+		return re.evaluateSequence(rule, key, ref, detection)
+
+	case RuleTypeNewValue:
+		if !rule.filter(log) {
+			return nil, nil
+		}
+		for _, value := range sigmaFieldValues(log, rule.Field) {
+			seen, hadHistory, err := re.State.SeenValue(key, strings.ToLower(value), rule.lookback)
+			if err != nil {
+				return nil, err
+			}
+			// The first value ever recorded for a group is its baseline, not an anomaly
+			if !seen && hadHistory {
+				detection.RuleTitle = fmt.Sprintf("%s (%s=%s)", rule.Title, rule.Field, value)
+				detection.Contributing = []LogRef{ref}
+				return detection, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// evaluateSequence counts an event towards a step only once every earlier
+// step has reached its count inside the window, which enforces ordering.
+// Completing the last step fires the rule and clears the group's state.
+func (re *RuleEngine) evaluateSequence(rule *StatefulRule, key string, ref LogRef, detection *Detection) (*Detection, error) {
+	stepKeys := make([]string, len(rule.steps))
+	for i := range rule.steps {
+		stepKeys[i] = fmt.Sprintf("%s:step%d", key, i)
+	}
+
+	var contributing []LogRef
+	for i, step := range rule.steps {
+		if step.filter(detection.Log) {
+			events, err := re.State.AddEvent(stepKeys[i], ref, rule.window)
+			if err != nil {
+				return nil, err
+			}
+			if i == len(rule.steps)-1 && len(events) >= step.count {
+				contributing = append(contributing, events...)
+				if err := re.State.Reset(stepKeys...); err != nil {
+					return nil, err
+				}
+				detection.Contributing = contributing
+				return detection, nil
+			}
+		}
+
+		events, err := re.State.Events(stepKeys[i], ref.Timestamp, rule.window)
+		if err != nil {
+			return nil, err
+		}
+		if len(events) < step.count {
+			return nil, nil
+		}
+		contributing = append(contributing, events...)
+	}
+
+	return nil, nil
+}
+
+func (app *App) listStatefulRules(w http.ResponseWriter, r *http.Request) {
+	rules := []*StatefulRule{}
+	if app.Rules != nil {
+		rules = append(rules, app.Rules.Rules()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
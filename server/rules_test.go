@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func loadShippedRules(t *testing.T) *RuleEngine {
+	t.Helper()
+	engine := NewRuleEngine("rules/detections.yml", NewMemoryRuleState())
+	if err := engine.LoadRules(); err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	return engine
+}
+
+func TestWAFBlockBurstGroupsByClient(t *testing.T) {
+	engine := loadShippedRules(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// Two clients behind the same edge node, each blocked 20 times, send
+	// 40 blocks through the shared edge and destination addresses
+	var detections []Detection
+	for i := 0; i < 20; i++ {
+		for _, client := range []string{"203.0.113.7", "203.0.113.8"} {
+			detections = append(detections, engine.Detect("company-a", NormalizedLog{
+				ID:          fmt.Sprintf("%s-%d", client, i),
+				Source:      "aws_waf",
+				Timestamp:   start.Add(time.Duration(i) * time.Second),
+				Action:      "BLOCK",
+				IPAddresses: []string{client, "198.51.100.80", "10.0.0.5"},
+				RawData:     map[string]interface{}{"clientIP": client},
+			})...)
+		}
+	}
+
+	bursts := make(map[string]int)
+	for _, detection := range detections {
+		if detection.RuleID == "waf-block-burst" {
+			bursts[detection.GroupKey]++
+			if len(detection.Contributing) != 20 {
+				t.Errorf("%s burst has %d contributing logs, want 20", detection.GroupKey, len(detection.Contributing))
+			}
+		}
+	}
+	want := map[string]int{"c-ip=203.0.113.7": 1, "c-ip=203.0.113.8": 1}
+	if len(bursts) != len(want) {
+		t.Fatalf("bursts = %v, want %v", bursts, want)
+	}
+	for group, count := range want {
+		if bursts[group] != count {
+			t.Errorf("bursts = %v, want %v", bursts, want)
+		}
+	}
+}
+
+func TestWAFBlockBurstBelowThreshold(t *testing.T) {
+	engine := loadShippedRules(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// 19 blocks, then one outside the five-minute window
+	for i := 0; i < 20; i++ {
+		at := start.Add(time.Duration(i) * time.Second)
+		if i == 19 {
+			at = start.Add(10 * time.Minute)
+		}
+		for _, detection := range engine.Detect("company-a", NormalizedLog{
+			ID:        fmt.Sprintf("log-%d", i),
+			Timestamp: at,
+			Action:    "BLOCK",
+			RawData:   map[string]interface{}{"clientIP": "203.0.113.7"},
+		}) {
+			if detection.RuleID == "waf-block-burst" {
+				t.Fatalf("burst fired on log %d: %+v", i, detection.GroupKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SigmaRule is a compiled Sigma detection rule. Only the parts of the Sigma
+// specification needed to evaluate single events are supported: selections,
+// field modifiers (contains, startswith, endswith, re, cidr, all, gt/gte/lt/lte),
+// keyword lists and conditions with and/or/not, parentheses and "1 of"/"all of".
+type SigmaRule struct {
+	ID          string   `yaml:"id" json:"id"`
+	Title       string   `yaml:"title" json:"title"`
+	Status      string   `yaml:"status" json:"status"`
+	Level       string   `yaml:"level" json:"level"`
+	Description string   `yaml:"description" json:"description"`
+	Tags        []string `yaml:"tags" json:"tags"`
+	LogSource   struct {
+		Product  string `yaml:"product" json:"product"`
+		Service  string `yaml:"service" json:"service"`
+		Category string `yaml:"category" json:"category"`
+	} `yaml:"logsource" json:"logsource"`
+	Detection map[string]interface{} `yaml:"detection" json:"-"`
+
+	Path       string                             `yaml:"-" json:"path"`
+	sources    []string                           // NormalizedLog.Source values the rule applies to, nil for all
+	selections map[string]sigmaMatcher            // compiled named selections
+	condition  func(results map[string]bool) bool // compiled condition
+}
+
+type sigmaMatcher func(log NormalizedLog) bool
+
+// sigmaLogSources maps Sigma logsource product/service/category values to the
+// sources assigned by LogNormalizer.determineSource.
+var sigmaLogSources = map[string][]string{
+	"aws/waf":         {"aws_waf"},
+	"aws/guardduty":   {"aws_guardduty"},
+	"azure/waf":       {"azure_waf"},
+	"azure/frontdoor": {"azure_waf"},
+	"akamai":          {"akamai_waf"},
+	"deepsecurity":    {"deep_security"},
+	"trendmicro":      {"deep_security"},
+	"waf":             {"aws_waf", "azure_waf", "akamai_waf"},
+	"webserver":       {"aws_waf", "azure_waf", "akamai_waf"},
+}
+
+func stringValues(values ...string) []string {
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// sigmaFieldMappings maps Sigma taxonomy field names (lowercased) onto
+// NormalizedLog fields. Unmapped fields are looked up in RawData. The client
+// address fields read ClientIP, not every address in the line.
+var sigmaFieldMappings = map[string]func(log NormalizedLog) []string{
+	"c-ip":            func(l NormalizedLog) []string { return stringValues(l.ClientIP()) },
+	"src_ip":          func(l NormalizedLog) []string { return stringValues(l.ClientIP()) },
+	"sourceip":        func(l NormalizedLog) []string { return stringValues(l.ClientIP()) },
+	"clientip":        func(l NormalizedLog) []string { return stringValues(l.ClientIP()) },
+	"ipaddress":       func(l NormalizedLog) []string { return stringValues(l.ClientIP()) },
+	"cs-uri":          func(l NormalizedLog) []string { return stringValues(l.URI) },
+	"cs-uri-stem":     func(l NormalizedLog) []string { return stringValues(l.URI) },
+	"cs-uri-query":    func(l NormalizedLog) []string { return stringValues(l.URI) },
+	"uri":             func(l NormalizedLog) []string { return stringValues(l.URI) },
+	"url":             func(l NormalizedLog) []string { return stringValues(l.URI) },
+	"cs-method":       func(l NormalizedLog) []string { return stringValues(l.Method) },
+	"method":          func(l NormalizedLog) []string { return stringValues(l.Method) },
+	"sc-status":       func(l NormalizedLog) []string { return stringValues(l.StatusCode) },
+	"status":          func(l NormalizedLog) []string { return stringValues(l.StatusCode) },
+	"cs-host":         func(l NormalizedLog) []string { return stringValues(l.Host) },
+	"host":            func(l NormalizedLog) []string { return stringValues(l.Host) },
+	"hostname":        func(l NormalizedLog) []string { return stringValues(l.Host) },
+	"computername":    func(l NormalizedLog) []string { return stringValues(l.Host) },
+	"user":            func(l NormalizedLog) []string { return append(append([]string{}, l.UserEmails...), l.UserNames...) },
+	"username":        func(l NormalizedLog) []string { return append(append([]string{}, l.UserEmails...), l.UserNames...) },
+	"action":          func(l NormalizedLog) []string { return stringValues(l.Action) },
+	"severity":        func(l NormalizedLog) []string { return stringValues(l.Severity) },
+	"country":         func(l NormalizedLog) []string { return stringValues(l.Country) },
+	"source":          func(l NormalizedLog) []string { return stringValues(l.Source) },
+	"company_code":    func(l NormalizedLog) []string { return stringValues(l.CompanyCode) },
+	"cs-user-agent":   func(l NormalizedLog) []string { return entityValues(l, EntityUserAgent) },
+	"useragent":       func(l NormalizedLog) []string { return entityValues(l, EntityUserAgent) },
+	"accesskeyid":     func(l NormalizedLog) []string { return entityValues(l, EntityAWSAccessKey) },
+	"ja3":             func(l NormalizedLog) []string { return entityValues(l, EntityJA3) },
+	"sessionid":       func(l NormalizedLog) []string { return entityValues(l, EntitySessionID) },
+	"original_log":    func(l NormalizedLog) []string { return stringValues(l.OriginalLog) },
+	"deviceid":        func(l NormalizedLog) []string { return entityValues(l, EntityDeviceID) },
+	"cs-referrer":     func(l NormalizedLog) []string { return rawValues(l.RawData, "referer") },
+	"sc-bytes":        func(l NormalizedLog) []string { return rawValues(l.RawData, "bytes") },
+	"dst_ip":          func(l NormalizedLog) []string { return rawValues(l.RawData, "destinationIp") },
+	"destinationip":   func(l NormalizedLog) []string { return rawValues(l.RawData, "destinationIp") },
+	"eventname":       func(l NormalizedLog) []string { return rawValues(l.RawData, "eventName") },
+	"eventsource":     func(l NormalizedLog) []string { return rawValues(l.RawData, "eventSource") },
+	"terminatingrule": func(l NormalizedLog) []string { return rawValues(l.RawData, "terminatingRuleId") },
+}
+
+func entityValues(log NormalizedLog, entityType string) []string {
+	var values []string
+	for _, entity := range log.Entities {
+		if entity.Type == entityType {
+			values = append(values, entity.Value)
+		}
+	}
+	return values
+}
+
+// rawValues resolves a field in the raw log data, following dotted paths into
+// nested objects and flattening arrays.
+func rawValues(data map[string]interface{}, field string) []string {
+	if value, exists := data[field]; exists {
+		return flattenValue(value)
+	}
+
+	var current interface{} = data
+	for _, part := range strings.Split(field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if current, ok = object[part]; !ok {
+			return nil
+		}
+	}
+	return flattenValue(current)
+}
+
+func flattenValue(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, flattenValue(item)...)
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func sigmaFieldValues(log NormalizedLog, field string) []string {
+	if mapping, exists := sigmaFieldMappings[strings.ToLower(field)]; exists {
+		if values := mapping(log); len(values) > 0 {
+			return values
+		}
+	}
+	return rawValues(log.RawData, field)
+}
+
+// LoadSigmaRule parses and compiles a single Sigma YAML file.
+func LoadSigmaRule(path string) (*SigmaRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rule SigmaRule
+	if err := yaml.Unmarshal(data, &rule); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	rule.Path = path
+
+	if err := rule.compile(); err != nil {
+		return nil, fmt.Errorf("failed to compile %s: %v", path, err)
+	}
+	return &rule, nil
+}
+
+func (rule *SigmaRule) compile() error {
+	if len(rule.Detection) == 0 {
+		return fmt.Errorf("rule has no detection section")
+	}
+
+	rule.sources = rule.matchingSources()
+
+	conditionValue, exists := rule.Detection["condition"]
+	if !exists {
+		return fmt.Errorf("detection has no condition")
+	}
+
+	rule.selections = make(map[string]sigmaMatcher)
+	for name, definition := range rule.Detection {
+		if name == "condition" || name == "timeframe" {
+			continue
+		}
+		matcher, err := compileSelection(definition)
+		if err != nil {
+			return fmt.Errorf("selection %s: %v", name, err)
+		}
+		rule.selections[name] = matcher
+	}
+
+	// Multiple conditions in a list are ORed together
+	var conditions []string
+	switch c := conditionValue.(type) {
+	case string:
+		conditions = []string{c}
+	case []interface{}:
+		for _, item := range c {
+			conditions = append(conditions, fmt.Sprint(item))
+		}
+	default:
+		return fmt.Errorf("unsupported condition type %T", conditionValue)
+	}
+
+	var compiled []func(map[string]bool) bool
+	for _, condition := range conditions {
+		if strings.Contains(condition, "|") {
+			return fmt.Errorf("aggregation conditions are not supported: %q", condition)
+		}
+		parser := &sigmaConditionParser{tokens: tokenizeCondition(condition), selections: rule.selections}
+		fn, err := parser.parseExpression()
+		if err != nil {
+			return fmt.Errorf("condition %q: %v", condition, err)
+		}
+		if parser.pos != len(parser.tokens) {
+			return fmt.Errorf("condition %q: unexpected %q", condition, parser.tokens[parser.pos])
+		}
+		compiled = append(compiled, fn)
+	}
+
+	rule.condition = func(results map[string]bool) bool {
+		for _, fn := range compiled {
+			if fn(results) {
+				return true
+			}
+		}
+		return false
+	}
+	return nil
+}
+
+func (rule *SigmaRule) matchingSources() []string {
+	product := strings.ToLower(rule.LogSource.Product)
+	service := strings.ToLower(rule.LogSource.Service)
+	category := strings.ToLower(rule.LogSource.Category)
+
+	for _, key := range []string{product + "/" + service, product, category} {
+		if sources, exists := sigmaLogSources[key]; exists {
+			return sources
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule fires on the given log.
+func (rule *SigmaRule) Match(log NormalizedLog) bool {
+	if rule.sources != nil {
+		applies := false
+		for _, source := range rule.sources {
+			if source == log.Source {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return false
+		}
+	}
+
+	results := make(map[string]bool, len(rule.selections))
+	for name, matcher := range rule.selections {
+		results[name] = matcher(log)
+	}
+	return rule.condition(results)
+}
+
+func compileSelection(definition interface{}) (sigmaMatcher, error) {
+	switch d := definition.(type) {
+	case map[string]interface{}:
+		return compileFieldMap(d)
+	case []interface{}:
+		if len(d) == 0 {
+			return nil, fmt.Errorf("empty selection")
+		}
+		// A list of maps is an OR of field maps; a list of scalars is a keyword search
+		if _, isMap := d[0].(map[string]interface{}); isMap {
+			var matchers []sigmaMatcher
+			for _, item := range d {
+				fieldMap, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("mixed selection list")
+				}
+				matcher, err := compileFieldMap(fieldMap)
+				if err != nil {
+					return nil, err
+				}
+				matchers = append(matchers, matcher)
+			}
+			return func(log NormalizedLog) bool {
+				for _, matcher := range matchers {
+					if matcher(log) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		return compileKeywords(d)
+	default:
+		return nil, fmt.Errorf("unsupported selection type %T", definition)
+	}
+}
+
+func compileKeywords(keywords []interface{}) (sigmaMatcher, error) {
+	var patterns []*regexp.Regexp
+	for _, keyword := range keywords {
+		pattern, err := sigmaGlob("*" + fmt.Sprint(keyword) + "*")
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return func(log NormalizedLog) bool {
+		for _, pattern := range patterns {
+			if pattern.MatchString(log.OriginalLog) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileFieldMap(fields map[string]interface{}) (sigmaMatcher, error) {
+	var matchers []sigmaMatcher
+	for key, value := range fields {
+		matcher, err := compileFieldCondition(key, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	return func(log NormalizedLog) bool {
+		for _, matcher := range matchers {
+			if !matcher(log) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func compileFieldCondition(key string, value interface{}) (sigmaMatcher, error) {
+	parts := strings.Split(key, "|")
+	field := parts[0]
+	modifiers := parts[1:]
+
+	var expected []interface{}
+	if list, ok := value.([]interface{}); ok {
+		expected = list
+	} else {
+		expected = []interface{}{value}
+	}
+
+	matchAll := false
+	var transform string
+	for _, modifier := range modifiers {
+		switch modifier {
+		case "all":
+			matchAll = true
+		case "contains", "startswith", "endswith", "re", "cidr", "gt", "gte", "lt", "lte":
+			transform = modifier
+		default:
+			return nil, fmt.Errorf("unsupported modifier %q", modifier)
+		}
+	}
+
+	var valueMatchers []func(string) bool
+	fieldMustBeEmpty := false
+	for _, item := range expected {
+		if item == nil {
+			fieldMustBeEmpty = true
+			continue
+		}
+		matcher, err := compileValueMatcher(transform, fmt.Sprint(item))
+		if err != nil {
+			return nil, err
+		}
+		valueMatchers = append(valueMatchers, matcher)
+	}
+
+	return func(log NormalizedLog) bool {
+		actual := sigmaFieldValues(log, field)
+		if len(actual) == 0 {
+			return fieldMustBeEmpty
+		}
+
+		matchesAny := func(matcher func(string) bool) bool {
+			for _, value := range actual {
+				if matcher(value) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if matchAll {
+			for _, matcher := range valueMatchers {
+				if !matchesAny(matcher) {
+					return false
+				}
+			}
+			return len(valueMatchers) > 0
+		}
+		for _, matcher := range valueMatchers {
+			if matchesAny(matcher) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func compileValueMatcher(transform, expected string) (func(string) bool, error) {
+	switch transform {
+	case "re":
+		pattern, err := regexp.Compile(expected)
+		if err != nil {
+			return nil, err
+		}
+		return pattern.MatchString, nil
+	case "cidr":
+		_, network, err := net.ParseCIDR(expected)
+		if err != nil {
+			return nil, err
+		}
+		return func(value string) bool {
+			ip := net.ParseIP(value)
+			return ip != nil && network.Contains(ip)
+		}, nil
+	case "gt", "gte", "lt", "lte":
+		threshold, err := strconv.ParseFloat(expected, 64)
+		if err != nil {
+			return nil, err
+		}
+		return func(value string) bool {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return false
+			}
+			switch transform {
+			case "gt":
+				return number > threshold
+			case "gte":
+				return number >= threshold
+			case "lt":
+				return number < threshold
+			default:
+				return number <= threshold
+			}
+		}, nil
+	case "contains":
+		expected = "*" + expected + "*"
+	case "startswith":
+		expected = expected + "*"
+	case "endswith":
+		expected = "*" + expected
+	}
+
+	pattern, err := sigmaGlob(expected)
+	if err != nil {
+		return nil, err
+	}
+	return pattern.MatchString, nil
+}
+
+// sigmaGlob compiles a Sigma value with * and ? wildcards into a
+// case-insensitive regular expression.
+func sigmaGlob(value string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("(?is)^")
+	for _, r := range value {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+func tokenizeCondition(condition string) []string {
+	condition = strings.ReplaceAll(condition, "(", " ( ")
+	condition = strings.ReplaceAll(condition, ")", " ) ")
+	return strings.Fields(condition)
+}
+
+type sigmaConditionParser struct {
+	tokens     []string
+	pos        int
+	selections map[string]sigmaMatcher
+}
+
+func (p *sigmaConditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return strings.ToLower(p.tokens[p.pos])
+	}
+	return ""
+}
+
+func (p *sigmaConditionParser) parseExpression() (func(map[string]bool) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(results map[string]bool) bool { return l(results) || right(results) }
+	}
+	return left, nil
+}
+
+func (p *sigmaConditionParser) parseAnd() (func(map[string]bool) bool, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(results map[string]bool) bool { return l(results) && right(results) }
+	}
+	return left, nil
+}
+
+func (p *sigmaConditionParser) parseUnary() (func(map[string]bool) bool, error) {
+	if p.peek() == "not" {
+		p.pos++
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(results map[string]bool) bool { return !inner(results) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *sigmaConditionParser) parsePrimary() (func(map[string]bool) bool, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case token == "(":
+		p.pos++
+		inner, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	case token == "1" || token == "all" || token == "any":
+		p.pos++
+		if p.peek() != "of" {
+			return nil, fmt.Errorf("expected 'of' after %q", token)
+		}
+		p.pos++
+		if p.pos >= len(p.tokens) {
+			return nil, fmt.Errorf("expected selection after 'of'")
+		}
+		target := p.tokens[p.pos]
+		p.pos++
+		names := p.matchSelections(target)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no selections match %q", target)
+		}
+		requireAll := token == "all"
+		return func(results map[string]bool) bool {
+			for _, name := range names {
+				if results[name] && !requireAll {
+					return true
+				}
+				if !results[name] && requireAll {
+					return false
+				}
+			}
+			return requireAll
+		}, nil
+	default:
+		name := p.tokens[p.pos]
+		if _, exists := p.selections[name]; !exists {
+			return nil, fmt.Errorf("unknown selection %q", name)
+		}
+		p.pos++
+		return func(results map[string]bool) bool { return results[name] }, nil
+	}
+}
+
+func (p *sigmaConditionParser) matchSelections(target string) []string {
+	var names []string
+	for name := range p.selections {
+		if target == "them" {
+			// "them" excludes selections starting with an underscore by convention
+			if !strings.HasPrefix(name, "_") {
+				names = append(names, name)
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(target, name); matched {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// SigmaEngine evaluates the loaded Sigma rules against normalized logs.
+type SigmaEngine struct {
+	mu    sync.RWMutex
+	rules []*SigmaRule
+
+	RulesDir string
+}
+
+func NewSigmaEngine(rulesDir string) *SigmaEngine {
+	return &SigmaEngine{RulesDir: rulesDir}
+}
+
+// LoadRules (re)loads every .yml/.yaml file in RulesDir. Rules that fail to
+// parse are logged and skipped so one bad rule does not disable the rest.
+func (se *SigmaEngine) LoadRules() error {
+	var rules []*SigmaRule
+	err := filepath.WalkDir(se.RulesDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if d.IsDir() || (ext != ".yml" && ext != ".yaml") {
+			return nil
+		}
+		rule, err := LoadSigmaRule(path)
+		if err != nil {
+			log.Printf("Skipping Sigma rule: %v", err)
+			return nil
+		}
+		rules = append(rules, rule)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load Sigma rules from %s: %v", se.RulesDir, err)
+	}
+
+	se.mu.Lock()
+	se.rules = rules
+	se.mu.Unlock()
+
+	log.Printf("Loaded %d Sigma rules from %s", len(rules), se.RulesDir)
+	return nil
+}
+
+func (se *SigmaEngine) Rules() []*SigmaRule {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	return se.rules
+}
+
+// Detect implements Detector: every matching rule yields one detection for
+// the log.
+func (se *SigmaEngine) Detect(projectID string, log NormalizedLog) []Detection {
+	var detections []Detection
+	for _, rule := range se.Rules() {
+		if !rule.Match(log) {
+			continue
+		}
+		detections = append(detections, Detection{
+			Engine:       "sigma",
+			RuleID:       rule.ID,
+			RuleTitle:    rule.Title,
+			Level:        rule.Level,
+			Tags:         rule.Tags,
+			Log:          log,
+			Contributing: []LogRef{newLogRef(log)},
+		})
+	}
+	return detections
+}
+
+func (app *App) listSigmaRules(w http.ResponseWriter, r *http.Request) {
+	rules := []*SigmaRule{}
+	if app.Sigma != nil {
+		rules = append(rules, app.Sigma.Rules()...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// compileTestRule compiles a rule from YAML the way LoadSigmaRule does.
+func compileTestRule(t *testing.T, source string) *SigmaRule {
+	t.Helper()
+	var rule SigmaRule
+	if err := yaml.Unmarshal([]byte(source), &rule); err != nil {
+		t.Fatalf("invalid rule YAML: %v", err)
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	return &rule
+}
+
+func TestBundledSigmaRulesCompile(t *testing.T) {
+	files, err := filepath.Glob("rules/sigma/*.yml")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no bundled rules found: %v", err)
+	}
+	for _, file := range files {
+		if _, err := LoadSigmaRule(file); err != nil {
+			t.Errorf("%v", err)
+		}
+	}
+
+	engine := NewSigmaEngine("rules/sigma")
+	if err := engine.LoadRules(); err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	if got := len(engine.Rules()); got != len(files) {
+		t.Errorf("loaded %d rules, want %d", got, len(files))
+	}
+}
+
+func TestSigmaSQLInjectionRule(t *testing.T) {
+	rule, err := LoadSigmaRule("rules/sigma/waf_sql_injection.yml")
+	if err != nil {
+		t.Fatalf("LoadSigmaRule: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		log  NormalizedLog
+		want bool
+	}{
+		{"allowed injection", NormalizedLog{Source: "aws_waf", URI: "/items?id=1' OR 1=1--", Action: "ALLOW"}, true},
+		{"encoded injection", NormalizedLog{Source: "azure_waf", URI: "/q?id=1%27%20OR%201=1", Action: "Allow"}, true},
+		{"blocked injection", NormalizedLog{Source: "aws_waf", URI: "/items?id=1 UNION SELECT password", Action: "BLOCK"}, false},
+		{"benign request", NormalizedLog{Source: "aws_waf", URI: "/items?id=1", Action: "ALLOW"}, false},
+		{"other log source", NormalizedLog{Source: "deep_security", URI: "/items?id=1' or 1=1", Action: "ALLOW"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rule.Match(tt.log); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	detections := (&SigmaEngine{rules: []*SigmaRule{rule}}).Detect("company-a", tests[0].log)
+	if len(detections) != 1 || detections[0].Engine != "sigma" || detections[0].RuleID != rule.ID || detections[0].Level != "high" {
+		t.Errorf("Detect = %+v, want one high sigma detection of %s", detections, rule.ID)
+	}
+}
+
+func TestSigmaFieldModifiers(t *testing.T) {
+	log := NormalizedLog{
+		Source:      "aws_waf",
+		OriginalLog: `{"uri":"/admin/login.php","note":"Suspicious Scanner"}`,
+		IPAddresses: []string{"203.0.113.7", "10.0.0.1"},
+		URI:         "/admin/login.php",
+		Method:      "POST",
+		StatusCode:  "403",
+		UserEmails:  []string{"alice@example.com"},
+		RawData: map[string]interface{}{
+			"clientIP":    "203.0.113.7",
+			"bytes":       float64(5120),
+			"httpRequest": map[string]interface{}{"headers": []interface{}{"curl/8.0", "gzip"}},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		selection string
+		want      bool
+	}{
+		{"exact is case-insensitive", `method: post`, true},
+		{"wildcard", `uri: "/admin/*.php"`, true},
+		{"contains", `uri|contains: LOGIN`, true},
+		{"startswith", `uri|startswith: /admin`, true},
+		{"startswith mismatch", `uri|startswith: /login`, false},
+		{"endswith", `uri|endswith: .php`, true},
+		{"regex", `uri|re: '^/admin/[a-z]+\.php$'`, true},
+		{"cidr client address", `src_ip|cidr: 203.0.113.0/24`, true},
+		{"cidr no address", `src_ip|cidr: 198.51.100.0/24`, false},
+		{"cidr ignores other addresses", `c-ip|cidr: 10.0.0.0/8`, false},
+		{"numeric gt", `sc-bytes|gt: 4096`, true},
+		{"numeric lte", `sc-bytes|lte: 4096`, false},
+		{"list is or", `sc-status: ["401", "403"]`, true},
+		{"all requires every value", `uri|contains|all: [admin, login]`, true},
+		{"all fails on one value", `uri|contains|all: [admin, logout]`, false},
+		{"fields in a map are and", "method: POST\nsc-status: \"200\"", false},
+		{"list of maps is or", "- method: GET\n- sc-status: \"403\"", true},
+		{"dotted raw field", `httpRequest.headers|startswith: curl/`, true},
+		{"mapped user field", `user: alice@example.com`, true},
+		{"null matches a missing field", `referer: null`, true},
+		{"null fails on a present field", `method: null`, false},
+		{"keywords search the original log", "- scanner\n- nikto", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selection := "    " + strings.ReplaceAll(tt.selection, "\n", "\n    ")
+			rule := compileTestRule(t, "detection:\n  selection:\n"+selection+"\n  condition: selection")
+			if got := rule.Match(log); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigmaConditions(t *testing.T) {
+	const detection = `
+detection:
+  selection_get:
+    method: GET
+  selection_admin:
+    uri|startswith: /admin
+  selection_denied:
+    sc-status: "403"
+  _internal:
+    source: aws_waf
+  condition: %s
+`
+	log := NormalizedLog{Source: "aws_waf", Method: "GET", URI: "/admin", StatusCode: "200"}
+
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{"selection_get and selection_admin", true},
+		{"selection_get and selection_denied", false},
+		{"selection_denied or selection_admin", true},
+		{"selection_get and not selection_denied", true},
+		{"not (selection_get or selection_denied)", false},
+		{"selection_denied or selection_get and selection_admin", true},
+		{"(selection_denied or selection_get) and not selection_admin", false},
+		{"1 of selection_*", true},
+		{"all of selection_*", false},
+		{"all of selection_g* and all of selection_a*", true},
+		// "them" leaves out _internal, which matches too
+		{"all of them", false},
+		{"1 of them", true},
+		{"_internal and selection_get", true},
+		{"[selection_denied, selection_admin]", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			rule := compileTestRule(t, strings.Replace(detection, "%s", tt.condition, 1))
+			if got := rule.Match(log); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigmaCompileErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		detection string
+		wantErr   string
+	}{
+		{"no condition", "selection:\n    method: GET", "no condition"},
+		{"unknown selection", "selection:\n    method: GET\n  condition: other", "unknown selection"},
+		{"aggregation", "selection:\n    method: GET\n  condition: selection | count() > 5", "aggregation"},
+		{"unsupported modifier", "selection:\n    uri|base64: x\n  condition: selection", "unsupported modifier"},
+		{"unclosed parenthesis", "selection:\n    method: GET\n  condition: (selection", "closing parenthesis"},
+		{"trailing token", "selection:\n    method: GET\n  condition: selection selection", "unexpected"},
+		{"bad regex", "selection:\n    uri|re: '('\n  condition: selection", "selection"},
+		{"bad cidr", "selection:\n    src_ip|cidr: 10.0.0.0/33\n  condition: selection", "selection"},
+		{"of without match", "selection:\n    method: GET\n  condition: 1 of filter_*", "no selections match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rule SigmaRule
+			if err := yaml.Unmarshal([]byte("detection:\n  "+tt.detection), &rule); err != nil {
+				t.Fatalf("invalid rule YAML: %v", err)
+			}
+			err := rule.compile()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("compile error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSigmaEngineSkipsBrokenRules(t *testing.T) {
+	dir := t.TempDir()
+	good := "title: Good\nid: good\ndetection:\n  selection:\n    method: GET\n  condition: selection\n"
+	files := map[string]string{
+		"good.yml":   good,
+		"broken.yml": "title: Broken\ndetection:\n  selection:\n    method: GET\n",
+		"notes.txt":  good,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine := NewSigmaEngine(dir)
+	if err := engine.LoadRules(); err != nil {
+		t.Fatalf("LoadRules: %v", err)
+	}
+	rules := engine.Rules()
+	if len(rules) != 1 || rules[0].ID != "good" {
+		t.Errorf("loaded %+v, want only the good rule", rules)
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Indicator types held by the threat-intel store.
+const (
+	IOCTypeIP     = "ip"
+	IOCTypeCIDR   = "cidr"
+	IOCTypeDomain = "domain"
+	IOCTypeURL    = "url"
+	IOCTypeHash   = "hash"
+)
+
+// Indicator is a single IOC from a feed file.
+type Indicator struct {
+	Type        string     `json:"type"`
+	Value       string     `json:"value"`
+	Feed        string     `json:"feed"`
+	Confidence  int        `json:"confidence,omitempty"` // 0-100 when the feed provides it
+	Description string     `json:"description,omitempty"`
+	Labels      []string   `json:"labels,omitempty"`
+	ValidUntil  *time.Time `json:"valid_until,omitempty"`
+}
+
+func (i Indicator) expired(now time.Time) bool {
+	return i.ValidUntil != nil && now.After(*i.ValidUntil)
+}
+
+// ThreatIntelHit is an indicator matched by something seen in the logs or in
+// the alert itself.
+type ThreatIntelHit struct {
+	Indicator    Indicator `json:"indicator"`
+	MatchedType  string    `json:"matched_type"` // entity type or "url"
+	MatchedValue string    `json:"matched_value"`
+	LogIDs       []string  `json:"log_ids"`
+	InAlert      bool      `json:"in_alert,omitempty"`
+}
+
+type cidrIndicator struct {
+	network   *net.IPNet
+	indicator Indicator
+}
+
+// ThreatIntelStore holds IOCs loaded from STIX 2.1 bundles, MISP JSON exports
+// and CSV files in Dir.
+type ThreatIntelStore struct {
+	mu      sync.RWMutex
+	exact   map[string]map[string]Indicator // type -> normalized value -> indicator
+	cidrs   []cidrIndicator
+	count   int
+	loaded  time.Time
+	byFeeds map[string]int
+
+	Dir string
+}
+
+func NewThreatIntelStore(dir string) *ThreatIntelStore {
+	return &ThreatIntelStore{Dir: dir}
+}
+
+func normalizeIOCValue(iocType, value string) string {
+	value = strings.TrimSpace(value)
+	switch iocType {
+	case IOCTypeDomain, IOCTypeHash:
+		return strings.TrimSuffix(strings.ToLower(value), ".")
+	case IOCTypeURL:
+		return normalizeURL(value)
+	case IOCTypeIP:
+		// IPv6 has many textual forms
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String()
+		}
+	}
+	return value
+}
+
+// normalizeURL strips the scheme, lower-cases the host and drops a trailing
+// slash so feed URLs and log host+path combinations compare equal.
+func normalizeURL(raw string) string {
+	u := strings.TrimSpace(raw)
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+	host, path, _ := strings.Cut(u, "/")
+	u = strings.ToLower(host)
+	if path != "" {
+		u += "/" + path
+	}
+	return strings.TrimSuffix(u, "/")
+}
+
+// newIndicator classifies a raw value of a feed-declared type, returning false
+// for types we don't match on.
+func newIndicator(iocType, value, feed string) (Indicator, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return Indicator{}, false
+	}
+
+	switch strings.ToLower(iocType) {
+	case "ip", "ipv4", "ipv6", "ipv4-addr", "ipv6-addr", "ip-src", "ip-dst", "ip-src|port", "ip-dst|port":
+		value, _, _ = strings.Cut(value, "|")
+		if strings.Contains(value, "/") {
+			if _, network, err := net.ParseCIDR(value); err == nil {
+				return Indicator{Type: IOCTypeCIDR, Value: network.String(), Feed: feed}, true
+			}
+			return Indicator{}, false
+		}
+		if ip := net.ParseIP(value); ip != nil {
+			return Indicator{Type: IOCTypeIP, Value: ip.String(), Feed: feed}, true
+		}
+	case "cidr":
+		if _, network, err := net.ParseCIDR(value); err == nil {
+			return Indicator{Type: IOCTypeCIDR, Value: network.String(), Feed: feed}, true
+		}
+	case "domain", "domain-name", "hostname", "fqdn":
+		return Indicator{Type: IOCTypeDomain, Value: normalizeIOCValue(IOCTypeDomain, value), Feed: feed}, true
+	case "url", "uri", "link":
+		return Indicator{Type: IOCTypeURL, Value: normalizeIOCValue(IOCTypeURL, value), Feed: feed}, true
+	case "hash", "md5", "sha1", "sha256", "sha-1", "sha-256", "sha512", "sha-512", "file-hash":
+		return Indicator{Type: IOCTypeHash, Value: normalizeIOCValue(IOCTypeHash, value), Feed: feed}, true
+	}
+	return Indicator{}, false
+}
+
+// Load replaces the store's contents with every feed file in Dir. A feed
+// that fails to parse is skipped and logged rather than dropping the rest.
+func (s *ThreatIntelStore) Load() error {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read threat intel dir %s: %v", s.Dir, err)
+	}
+
+	exact := make(map[string]map[string]Indicator)
+	var cidrs []cidrIndicator
+	byFeeds := make(map[string]int)
+	count := 0
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.Dir, entry.Name())
+
+		var indicators []Indicator
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json":
+			indicators, err = parseJSONFeed(path)
+		case ".csv":
+			indicators, err = parseCSVFeed(path)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Skipping threat intel feed %s: %v", path, err)
+			continue
+		}
+
+		for _, indicator := range indicators {
+			if indicator.Type == IOCTypeCIDR {
+				_, network, err := net.ParseCIDR(indicator.Value)
+				if err != nil {
+					continue
+				}
+				cidrs = append(cidrs, cidrIndicator{network: network, indicator: indicator})
+			} else {
+				if exact[indicator.Type] == nil {
+					exact[indicator.Type] = make(map[string]Indicator)
+				}
+				exact[indicator.Type][indicator.Value] = indicator
+			}
+			byFeeds[indicator.Feed]++
+			count++
+		}
+	}
+
+	s.mu.Lock()
+	s.exact, s.cidrs, s.count, s.byFeeds, s.loaded = exact, cidrs, count, byFeeds, time.Now()
+	s.mu.Unlock()
+
+	log.Printf("Loaded %d threat intel indicators from %d feeds in %s", count, len(byFeeds), s.Dir)
+	return nil
+}
+
+// parseJSONFeed detects whether a JSON file is a STIX 2.1 bundle or a MISP
+// export.
+func parseJSONFeed(path string) ([]Indicator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	feed := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err == nil {
+		var objectType string
+		json.Unmarshal(probe["type"], &objectType)
+		if objectType == "bundle" {
+			return parseSTIXBundle(data, feed)
+		}
+	}
+	return parseMISP(data, feed)
+}
+
+type stixObject struct {
+	Type           string            `json:"type"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description"`
+	Pattern        string            `json:"pattern"`
+	PatternType    string            `json:"pattern_type"`
+	Value          string            `json:"value"`
+	Hashes         map[string]string `json:"hashes"`
+	Confidence     int               `json:"confidence"`
+	Labels         []string          `json:"labels"`
+	IndicatorTypes []string          `json:"indicator_types"`
+	ValidUntil     *time.Time        `json:"valid_until"`
+	Revoked        bool              `json:"revoked"`
+}
+
+// stixComparison matches the comparison expressions of a STIX pattern, e.g.
+// [ipv4-addr:value = '198.51.100.1'] or [file:hashes.'SHA-256' = '...'].
+var stixComparison = regexp.MustCompile(`([a-z0-9-]+):([A-Za-z0-9_.'-]+)\s*=\s*'((?:[^'\\]|\\.)*)'`)
+
+var stixObjectTypes = map[string]string{
+	"ipv4-addr":   "ip",
+	"ipv6-addr":   "ip",
+	"domain-name": "domain",
+	"url":         "url",
+}
+
+func parseSTIXBundle(data []byte, feed string) ([]Indicator, error) {
+	var bundle struct {
+		Objects []stixObject `json:"objects"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("invalid STIX bundle: %v", err)
+	}
+
+	var indicators []Indicator
+	for _, object := range bundle.Objects {
+		if object.Revoked {
+			continue
+		}
+
+		var found []Indicator
+		switch object.Type {
+		case "indicator":
+			if object.PatternType != "" && object.PatternType != "stix" {
+				continue
+			}
+			for _, match := range stixComparison.FindAllStringSubmatch(object.Pattern, -1) {
+				objectType, property, value := match[1], match[2], strings.ReplaceAll(match[3], `\'`, `'`)
+				iocType := stixObjectTypes[objectType]
+				if objectType == "file" && strings.HasPrefix(property, "hashes.") {
+					iocType = IOCTypeHash
+				} else if property != "value" {
+					continue
+				}
+				if indicator, ok := newIndicator(iocType, value, feed); ok {
+					found = append(found, indicator)
+				}
+			}
+		case "file":
+			for _, hash := range object.Hashes {
+				if indicator, ok := newIndicator(IOCTypeHash, hash, feed); ok {
+					found = append(found, indicator)
+				}
+			}
+		default:
+			if iocType, ok := stixObjectTypes[object.Type]; ok {
+				if indicator, ok := newIndicator(iocType, object.Value, feed); ok {
+					found = append(found, indicator)
+				}
+			}
+		}
+
+		for _, indicator := range found {
+			indicator.Confidence = object.Confidence
+			indicator.Description = object.Name
+			if indicator.Description == "" {
+				indicator.Description = object.Description
+			}
+			indicator.Labels = append(append([]string(nil), object.IndicatorTypes...), object.Labels...)
+			indicator.ValidUntil = object.ValidUntil
+			indicators = append(indicators, indicator)
+		}
+	}
+	return indicators, nil
+}
+
+type mispAttribute struct {
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Comment string `json:"comment"`
+	ToIDS   bool   `json:"to_ids"`
+}
+
+type mispEvent struct {
+	Info      string          `json:"info"`
+	Attribute []mispAttribute `json:"Attribute"`
+	Object    []struct {
+		Attribute []mispAttribute `json:"Attribute"`
+	} `json:"Object"`
+	Tag []struct {
+		Name string `json:"name"`
+	} `json:"Tag"`
+}
+
+// parseMISP accepts a single {"Event": ...} export, a {"response": [...]}
+// search result or a bare list of events.
+func parseMISP(data []byte, feed string) ([]Indicator, error) {
+	type wrapped struct {
+		Event mispEvent `json:"Event"`
+	}
+
+	var events []mispEvent
+	var single wrapped
+	var response struct {
+		Response []wrapped `json:"response"`
+	}
+	var list []wrapped
+
+	switch {
+	case json.Unmarshal(data, &response) == nil && len(response.Response) > 0:
+		for _, w := range response.Response {
+			events = append(events, w.Event)
+		}
+	case json.Unmarshal(data, &list) == nil && len(list) > 0:
+		for _, w := range list {
+			events = append(events, w.Event)
+		}
+	case json.Unmarshal(data, &single) == nil && (len(single.Event.Attribute) > 0 || len(single.Event.Object) > 0):
+		events = append(events, single.Event)
+	default:
+		return nil, fmt.Errorf("neither a STIX bundle nor a MISP export")
+	}
+
+	var indicators []Indicator
+	for _, event := range events {
+		var tags []string
+		for _, tag := range event.Tag {
+			tags = append(tags, tag.Name)
+		}
+
+		attributes := event.Attribute
+		for _, object := range event.Object {
+			attributes = append(attributes, object.Attribute...)
+		}
+
+		for _, attribute := range attributes {
+			// Attributes not flagged for detection are context, not IOCs
+			if !attribute.ToIDS {
+				continue
+			}
+			iocType, value := attribute.Type, attribute.Value
+			// Composite types such as domain|ip or filename|sha256
+			if left, right, ok := strings.Cut(iocType, "|"); ok && left != "ip-src" && left != "ip-dst" {
+				_, v, _ := strings.Cut(value, "|")
+				iocType, value = right, v
+				if left == "domain" && right == "ip" {
+					iocType = "ip"
+				}
+			}
+			indicator, ok := newIndicator(iocType, value, feed)
+			if !ok {
+				continue
+			}
+			indicator.Description = event.Info
+			if attribute.Comment != "" {
+				indicator.Description += ": " + attribute.Comment
+			}
+			indicator.Labels = tags
+			indicators = append(indicators, indicator)
+		}
+	}
+	return indicators, nil
+}
+
+// parseCSVFeed reads a CSV with a header row containing at least "type" and
+// "value"; "confidence", "description" and "valid_until" are optional.
+func parseCSVFeed(path string) ([]Indicator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	feed := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["type"]; !ok {
+		return nil, fmt.Errorf("CSV header needs type and value columns")
+	}
+	if _, ok := columns["value"]; !ok {
+		return nil, fmt.Errorf("CSV header needs type and value columns")
+	}
+
+	column := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var indicators []Indicator
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %v", err)
+		}
+
+		indicator, ok := newIndicator(column(record, "type"), column(record, "value"), feed)
+		if !ok {
+			continue
+		}
+		indicator.Description = column(record, "description")
+		if confidence, err := strconv.Atoi(column(record, "confidence")); err == nil {
+			indicator.Confidence = confidence
+		}
+		if validUntil, err := time.Parse(time.RFC3339, column(record, "valid_until")); err == nil {
+			indicator.ValidUntil = &validUntil
+		}
+		indicators = append(indicators, indicator)
+	}
+	return indicators, nil
+}
+
+func (s *ThreatIntelStore) lookup(iocType, value string, now time.Time) (Indicator, bool) {
+	indicator, ok := s.exact[iocType][normalizeIOCValue(iocType, value)]
+	if !ok || indicator.expired(now) {
+		return Indicator{}, false
+	}
+	return indicator, true
+}
+
+// matchValue checks one observed value of the given entity type against the
+// store and returns every indicator it hits.
+func (s *ThreatIntelStore) matchValue(entityType, value string, now time.Time) []Indicator {
+	var hits []Indicator
+	switch entityType {
+	case EntityIP:
+		if indicator, ok := s.lookup(IOCTypeIP, value, now); ok {
+			hits = append(hits, indicator)
+		}
+		if ip := net.ParseIP(value); ip != nil {
+			for _, cidr := range s.cidrs {
+				if cidr.network.Contains(ip) && !cidr.indicator.expired(now) {
+					hits = append(hits, cidr.indicator)
+				}
+			}
+		}
+	case EntityHostname, IOCTypeDomain:
+		// A listed domain also covers its subdomains
+		domain := normalizeIOCValue(IOCTypeDomain, value)
+		for domain != "" {
+			if indicator, ok := s.lookup(IOCTypeDomain, domain, now); ok {
+				hits = append(hits, indicator)
+				break
+			}
+			_, parent, found := strings.Cut(domain, ".")
+			if !found || !strings.Contains(parent, ".") {
+				break
+			}
+			domain = parent
+		}
+	case EntityUserEmail:
+		if _, domain, ok := strings.Cut(value, "@"); ok {
+			hits = append(hits, s.matchValue(IOCTypeDomain, domain, now)...)
+		}
+	case EntityFileHash:
+		if indicator, ok := s.lookup(IOCTypeHash, value, now); ok {
+			hits = append(hits, indicator)
+		}
+	case IOCTypeURL:
+		if indicator, ok := s.lookup(IOCTypeURL, value, now); ok {
+			hits = append(hits, indicator)
+		} else if path, _, hasQuery := strings.Cut(normalizeURL(value), "?"); hasQuery {
+			if indicator, ok := s.lookup(IOCTypeURL, path, now); ok {
+				hits = append(hits, indicator)
+			}
+		}
+	}
+	return hits
+}
+
+// Match checks the alert's entities, every entity extracted from the logs and
+// each log's host+URI as a URL against the store. Hits are grouped per
+// indicator and matched value.
+func (s *ThreatIntelStore) Match(alertEntities []Entity, logs []NormalizedLog) []ThreatIntelHit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.count == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	hitsByKey := make(map[string]*ThreatIntelHit)
+	var order []string
+	// logID is empty for the alert's own entities
+	record := func(indicator Indicator, matchedType, matchedValue, logID string) {
+		key := indicator.Type + ":" + indicator.Value + "|" + matchedValue
+		hit, exists := hitsByKey[key]
+		if !exists {
+			hit = &ThreatIntelHit{Indicator: indicator, MatchedType: matchedType, MatchedValue: matchedValue, LogIDs: []string{}}
+			hitsByKey[key] = hit
+			order = append(order, key)
+		}
+		switch {
+		case logID == "":
+			hit.InAlert = true
+		case len(hit.LogIDs) < maxEvidencePerCorrelation && !containsString(hit.LogIDs, logID):
+			hit.LogIDs = append(hit.LogIDs, logID)
+		}
+	}
+
+	for _, entity := range alertEntities {
+		for _, indicator := range s.matchValue(entity.Type, entity.Value, now) {
+			record(indicator, entity.Type, entity.Value, "")
+		}
+	}
+	for _, log := range logs {
+		for _, entity := range log.Entities {
+			for _, indicator := range s.matchValue(entity.Type, entity.Value, now) {
+				record(indicator, entity.Type, entity.Value, log.ID)
+			}
+		}
+		if log.Host != "" && log.URI != "" {
+			url := log.Host + "/" + strings.TrimPrefix(log.URI, "/")
+			for _, indicator := range s.matchValue(IOCTypeURL, url, now) {
+				record(indicator, IOCTypeURL, url, log.ID)
+			}
+		}
+	}
+
+	hits := make([]ThreatIntelHit, 0, len(order))
+	for _, key := range order {
+		hits = append(hits, *hitsByKey[key])
+	}
+	return hits
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// distinctIndicators counts the indicators behind a set of hits, so one IOC
+// seen in many logs isn't counted many times.
+func distinctIndicators(hits []ThreatIntelHit) int {
+	seen := make(map[string]bool)
+	for _, hit := range hits {
+		seen[hit.Indicator.Type+":"+hit.Indicator.Value] = true
+	}
+	return len(seen)
+}
+
+func (app *App) getThreatIntelStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{"enabled": false}
+	if s := app.ThreatIntel; s != nil {
+		s.mu.RLock()
+		counts := make(map[string]int, len(s.byFeeds))
+		for feed, count := range s.byFeeds {
+			counts[feed] = count
+		}
+		status = map[string]interface{}{
+			"enabled":    !s.loaded.IsZero(),
+			"dir":        s.Dir,
+			"indicators": s.count,
+			"feeds":      counts,
+			"loaded_at":  s.loaded,
+		}
+		s.mu.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestThreatIntel(t *testing.T, csv string) *ThreatIntelStore {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "feed.csv"), []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewThreatIntelStore(dir)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return store
+}
+
+func TestThreatIntelMatchCanonicalisesIPs(t *testing.T) {
+	store := newTestThreatIntel(t, "type,value\nipv6-addr,2001:DB8:0:0::0:1\nip,203.0.113.7\ncidr,198.51.100.0/24\n")
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"2001:db8::1", 1},
+		{"2001:0db8:0000:0000:0000:0000:0000:0001", 1},
+		{"2001:db8::2", 0},
+		{"203.0.113.7", 1},
+		{"::ffff:203.0.113.7", 1},
+		{"198.51.100.42", 1},
+		{"192.0.2.1", 0},
+	}
+	for _, tt := range tests {
+		hits := store.Match([]Entity{{Type: EntityIP, Value: tt.value}}, nil)
+		if len(hits) != tt.want {
+			t.Errorf("%s: %d hits %+v, want %d", tt.value, len(hits), hits, tt.want)
+		}
+	}
+}
+
+func TestThreatIntelMatchAlertEntities(t *testing.T) {
+	store := newTestThreatIntel(t, "type,value\nip,203.0.113.7\ndomain,evil.example\n")
+	logs := []NormalizedLog{
+		{ID: "log-1", Entities: []Entity{{Type: EntityIP, Value: "203.0.113.7"}}},
+		{ID: "log-2", Entities: []Entity{{Type: EntityHostname, Value: "cdn.evil.example"}}},
+	}
+	alertEntities := []Entity{{Type: EntityIP, Value: "203.0.113.7"}}
+
+	// Without logs the alert's own client IP still matches
+	hits := store.Match(alertEntities, nil)
+	if len(hits) != 1 || !hits[0].InAlert || len(hits[0].LogIDs) != 0 {
+		t.Fatalf("alert-only hits = %+v", hits)
+	}
+
+	hits = store.Match(alertEntities, logs)
+	if len(hits) != 2 {
+		t.Fatalf("got %d hits %+v, want 2", len(hits), hits)
+	}
+	if ip := hits[0]; ip.MatchedValue != "203.0.113.7" || !ip.InAlert || len(ip.LogIDs) != 1 || ip.LogIDs[0] != "log-1" {
+		t.Errorf("IP hit = %+v, want one in the alert and log-1", ip)
+	}
+	if domain := hits[1]; domain.Indicator.Value != "evil.example" || domain.InAlert || domain.LogIDs[0] != "log-2" {
+		t.Errorf("domain hit = %+v, want a subdomain match in log-2 only", domain)
+	}
+}
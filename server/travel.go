@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// defaultMaxTravelSpeedKmh is roughly airliner cruising speed; anything faster
+// between two logins is not physically possible.
+const defaultMaxTravelSpeedKmh = 900.0
+
+// TravelFinding is a pair of consecutive events for one user whose implied
+// speed exceeds the detector's limit.
+type TravelFinding struct {
+	User        string    `json:"user"`
+	FromIP      string    `json:"from_ip"`
+	FromCountry string    `json:"from_country,omitempty"`
+	FromCity    string    `json:"from_city,omitempty"`
+	FromTime    time.Time `json:"from_time"`
+	FromOrigin  string    `json:"from_origin"` // "window" or "history"
+	ToIP        string    `json:"to_ip"`
+	ToCountry   string    `json:"to_country,omitempty"`
+	ToCity      string    `json:"to_city,omitempty"`
+	ToTime      time.Time `json:"to_time"`
+	ToOrigin    string    `json:"to_origin"`
+	DistanceKm  float64   `json:"distance_km"`
+	SpeedKmh    float64   `json:"speed_kmh"`
+}
+
+type travelEvent struct {
+	ip     string
+	at     time.Time
+	info   GeoInfo
+	origin string
+	logID  string // empty for history events
+}
+
+// ImpossibleTravelDetector orders each user's geolocated events, from the
+// current window and from the client IPs recorded by earlier analyses, and flags
+// consecutive pairs that would need faster-than-flight travel. Events from
+// VPN or corporate egress ranges are ignored because their location says
+// nothing about where the user is.
+type ImpossibleTravelDetector struct {
+	db  *sql.DB
+	geo *GeoIPResolver
+
+	EmitAlerts      bool
+	MaxSpeedKmh     float64
+	Lookback        time.Duration
+	AllowedNetworks []*net.IPNet
+	AllowedASNs     map[uint]bool
+}
+
+func NewImpossibleTravelDetector(db *sql.DB, geo *GeoIPResolver) *ImpossibleTravelDetector {
+	return &ImpossibleTravelDetector{
+		db:          db,
+		geo:         geo,
+		EmitAlerts:  true,
+		MaxSpeedKmh: defaultMaxTravelSpeedKmh,
+		Lookback:    24 * time.Hour,
+		AllowedASNs: make(map[uint]bool),
+	}
+}
+
+// AllowNetworks parses CIDRs (or single IPs) of VPN and egress ranges.
+func (d *ImpossibleTravelDetector) AllowNetworks(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid allowed network %q: %v", cidr, err)
+		}
+		d.AllowedNetworks = append(d.AllowedNetworks, network)
+	}
+	return nil
+}
+
+// AllowASNs marks whole networks, e.g. a VPN provider's, as egress points.
+func (d *ImpossibleTravelDetector) AllowASNs(asns []string) error {
+	for _, asn := range asns {
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid allowed ASN %q: %v", asn, err)
+		}
+		d.AllowedASNs[uint(number)] = true
+	}
+	return nil
+}
+
+func (d *ImpossibleTravelDetector) allowed(ip string, info GeoInfo) bool {
+	if info.ASN != 0 && d.AllowedASNs[info.ASN] {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, network := range d.AllowedNetworks {
+		if parsed != nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// historicalEvents loads the users' client IPs recorded by earlier analyses
+// within the project. Both the first and last sighting at an IP are events.
+func (d *ImpossibleTravelDetector) historicalEvents(projectID string, users []string, since time.Time) (map[string][]travelEvent, error) {
+	events := make(map[string][]travelEvent)
+	if d.db == nil || len(users) == 0 {
+		return events, nil
+	}
+
+	rows, err := d.db.Query(`
+		SELECT user_identifier, host(ip_address), first_seen, last_seen
+		FROM user_locations
+		WHERE project_id = $1 AND user_identifier = ANY($2) AND last_seen >= $3
+	`, projectID, pq.Array(users), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user, ip string
+		var firstSeen, lastSeen time.Time
+		if err := rows.Scan(&user, &ip, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		info := d.geo.Lookup(ip)
+		if info == nil {
+			continue
+		}
+		events[user] = append(events[user], travelEvent{ip: ip, at: lastSeen, info: *info, origin: "history"})
+		if !firstSeen.Before(since) && !firstSeen.Equal(lastSeen) {
+			events[user] = append(events[user], travelEvent{ip: ip, at: firstSeen, info: *info, origin: "history"})
+		}
+	}
+	return events, rows.Err()
+}
+
+// travelSighting is when a user was first and last seen at one client IP.
+type travelSighting struct {
+	user, ip            string
+	firstSeen, lastSeen time.Time
+}
+
+// travelSightings folds window events into one sighting per user and IP,
+// since a statement cannot update the same row twice.
+func travelSightings(eventsByUser map[string][]travelEvent) []travelSighting {
+	var sightings []travelSighting
+	index := make(map[string]int)
+	for user, events := range eventsByUser {
+		for _, event := range events {
+			key := user + "|" + event.ip
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(sightings)
+				sightings = append(sightings, travelSighting{user: user, ip: event.ip, firstSeen: event.at, lastSeen: event.at})
+				continue
+			}
+			sightings[i].firstSeen = minTime(sightings[i].firstSeen, event.at)
+			sightings[i].lastSeen = maxTime(sightings[i].lastSeen, event.at)
+		}
+	}
+	return sightings
+}
+
+// recordLocations stores the window's client IPs as location history for
+// later analyses of the same users.
+func (d *ImpossibleTravelDetector) recordLocations(projectID string, eventsByUser map[string][]travelEvent) error {
+	if d.db == nil {
+		return nil
+	}
+	sightings := travelSightings(eventsByUser)
+
+	const columns = 5
+	for start := 0; start < len(sightings); start += entityUpsertBatch {
+		batch := sightings[start:min(start+entityUpsertBatch, len(sightings))]
+		args := make([]interface{}, 0, len(batch)*columns)
+		for _, s := range batch {
+			args = append(args, projectID, s.user, s.ip, s.firstSeen, s.lastSeen)
+		}
+
+		_, err := d.db.Exec(`
+			INSERT INTO user_locations (project_id, user_identifier, ip_address, first_seen, last_seen)
+			VALUES `+valuesPlaceholders(len(batch), columns)+`
+			ON CONFLICT (project_id, user_identifier, ip_address)
+			DO UPDATE SET
+				first_seen = LEAST(user_locations.first_seen, EXCLUDED.first_seen),
+				last_seen = GREATEST(user_locations.last_seen, EXCLUDED.last_seen)
+		`, args...)
+		if err != nil {
+			return fmt.Errorf("failed to record user locations: %v", err)
+		}
+	}
+	return nil
+}
+
+// Detect returns the impossible-travel pairs that involve at least one event
+// from logs; pairs entirely from history were reported when they happened.
+// The window's client IPs are recorded as history for later analyses.
+func (d *ImpossibleTravelDetector) Detect(projectID string, logs []NormalizedLog, geo map[string]GeoInfo) ([]TravelFinding, error) {
+	eventsByUser := make(map[string][]travelEvent)
+	var earliest time.Time
+	for _, log := range logs {
+		// One location per log: the client's. Other addresses in the line
+		// are edge nodes or destinations, not where the user is.
+		ip := log.ClientIP()
+		info, ok := geo[ip]
+		if ip == "" || !ok || !info.HasLocation() {
+			continue
+		}
+		for _, user := range log.UserEmails {
+			eventsByUser[user] = append(eventsByUser[user], travelEvent{ip: ip, at: log.Timestamp, info: info, origin: "window", logID: log.ID})
+		}
+		if earliest.IsZero() || log.Timestamp.Before(earliest) {
+			earliest = log.Timestamp
+		}
+	}
+	if len(eventsByUser) == 0 {
+		return nil, nil
+	}
+
+	users := make([]string, 0, len(eventsByUser))
+	for user := range eventsByUser {
+		users = append(users, user)
+	}
+	history, err := d.historicalEvents(projectID, users, earliest.Add(-d.Lookback))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load location history: %v", err)
+	}
+	// Recorded before filterEvents reorders the window events in place
+	recordErr := d.recordLocations(projectID, eventsByUser)
+
+	var findings []TravelFinding
+	for _, user := range users {
+		events := d.filterEvents(append(eventsByUser[user], history[user]...))
+		for i := 1; i < len(events); i++ {
+			from, to := events[i-1], events[i]
+			if from.ip == to.ip || (from.origin == "history" && to.origin == "history") {
+				continue
+			}
+			// Two sightings at once say nothing about travel speed
+			if !to.at.After(from.at) || (from.logID != "" && from.logID == to.logID) {
+				continue
+			}
+			if finding, ok := d.checkPair(user, from, to); ok {
+				findings = append(findings, finding)
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].ToTime.Before(findings[j].ToTime) })
+	return findings, recordErr
+}
+
+// filterEvents drops allowed egress points and duplicate sightings, and
+// orders the rest by time. A window event wins over the same history event.
+func (d *ImpossibleTravelDetector) filterEvents(events []travelEvent) []travelEvent {
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].at.Equal(events[j].at) {
+			return events[i].origin == "window" && events[j].origin != "window"
+		}
+		return events[i].at.Before(events[j].at)
+	})
+
+	seen := make(map[string]bool)
+	filtered := events[:0]
+	for _, event := range events {
+		key := event.ip + "|" + event.at.UTC().Format(time.RFC3339)
+		if seen[key] || d.allowed(event.ip, event.info) {
+			continue
+		}
+		seen[key] = true
+		filtered = append(filtered, event)
+	}
+	return filtered
+}
+
+func (d *ImpossibleTravelDetector) checkPair(user string, from, to travelEvent) (TravelFinding, bool) {
+	// Discount the uncertainty of both lookups so coarse city-level locations
+	// don't produce false positives
+	distance := haversineKm(from.info.Latitude, from.info.Longitude, to.info.Latitude, to.info.Longitude) -
+		float64(from.info.AccuracyRadius) - float64(to.info.AccuracyRadius)
+	if distance <= 0 {
+		return TravelFinding{}, false
+	}
+
+	hours := to.at.Sub(from.at).Hours()
+	if hours <= 0 {
+		return TravelFinding{}, false
+	}
+	speed := distance / hours
+	if speed <= d.MaxSpeedKmh {
+		return TravelFinding{}, false
+	}
+
+	return TravelFinding{
+		User:        user,
+		FromIP:      from.ip,
+		FromCountry: from.info.Country,
+		FromCity:    from.info.City,
+		FromTime:    from.at,
+		FromOrigin:  from.origin,
+		ToIP:        to.ip,
+		ToCountry:   to.info.Country,
+		ToCity:      to.info.City,
+		ToTime:      to.at,
+		ToOrigin:    to.origin,
+		DistanceKm:  math.Round(distance),
+		SpeedKmh:    math.Round(speed),
+	}, true
+}
+
+func travelPlace(city, country, ip string) string {
+	switch {
+	case city != "" && country != "":
+		return city + ", " + country
+	case country != "":
+		return country
+	}
+	return ip
+}
+
+// travelAlert turns a finding into an alert of its own, so impossible travel
+// is triaged even when the alert that surfaced it is not.
+func travelAlert(finding TravelFinding, projectID string) Alert {
+	return Alert{
+		ID:        generateID(),
+		Timestamp: finding.ToTime,
+		Source:    "impossible_travel",
+		Severity:  "high",
+		Message: fmt.Sprintf("Impossible travel for %s: %s to %s at %.0f km/h",
+			finding.User,
+			travelPlace(finding.FromCity, finding.FromCountry, finding.FromIP),
+			travelPlace(finding.ToCity, finding.ToCountry, finding.ToIP),
+			finding.SpeedKmh),
+		ProjectID: projectID,
+		RawData: map[string]interface{}{
+			"ruleId":     "impossible-travel",
+			"user_email": finding.User,
+			"clientIP":   finding.ToIP,
+			"finding":    finding,
+		},
+	}
+}
+
+// emitTravelAlerts queues one alert per new finding. The Redis key makes a
+// pair alert once per lookback even though every later analysis of the same
+// user sees it again.
+func (app *App) emitTravelAlerts(findings []TravelFinding, source Alert) {
+	// Analyzing a travel alert rediscovers its own finding
+	if source.Source == "impossible_travel" {
+		return
+	}
+
+	ctx := context.Background()
+	for _, finding := range findings {
+		key := fmt.Sprintf("travel:%s:%s:%s:%s", source.ProjectID, finding.User, finding.FromIP, finding.ToIP)
+		if app.Redis != nil {
+			fresh, err := app.Redis.SetNX(ctx, key, source.ID, app.Travel.Lookback).Result()
+			if err != nil {
+				log.Printf("Failed to deduplicate travel alert for %s: %v", finding.User, err)
+				continue
+			}
+			if !fresh {
+				continue
+			}
+		}
+
+		result, err := app.acceptAlert(ctx, travelAlert(finding, source.ProjectID))
+		if err != nil {
+			log.Printf("Failed to queue impossible travel alert for %s: %v", finding.User, err)
+			continue
+		}
+		log.Printf("Impossible travel for %s (%s -> %s): alert %s (%s)", finding.User, finding.FromIP, finding.ToIP, result.AlertID, result.Status)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var (
+	travelStart = time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	london      = GeoInfo{Country: "GB", City: "London", Latitude: 51.51, Longitude: -0.13, AccuracyRadius: 20}
+	sydney      = GeoInfo{Country: "AU", City: "Sydney", Latitude: -33.87, Longitude: 151.21, AccuracyRadius: 20}
+	paris       = GeoInfo{Country: "FR", City: "Paris", Latitude: 48.86, Longitude: 2.35, AccuracyRadius: 20}
+	edge        = GeoInfo{Country: "US", City: "Ashburn", Latitude: 39.04, Longitude: -77.49, AccuracyRadius: 50, ASN: 13335}
+)
+
+func travelLog(id, user, clientIP string, at time.Duration, otherIPs ...string) NormalizedLog {
+	return NormalizedLog{
+		ID:          id,
+		Timestamp:   travelStart.Add(at),
+		UserEmails:  []string{user},
+		IPAddresses: append([]string{clientIP}, otherIPs...),
+		RawData:     map[string]interface{}{"clientIP": clientIP},
+	}
+}
+
+func TestCheckPair(t *testing.T) {
+	d := NewImpossibleTravelDetector(nil, nil)
+	tests := []struct {
+		name     string
+		from, to GeoInfo
+		elapsed  time.Duration
+		want     bool
+	}{
+		{"London to Sydney in two hours", london, sydney, 2 * time.Hour, true},
+		{"London to Sydney in a day", london, sydney, 24 * time.Hour, false},
+		{"London to Paris in an hour", london, paris, time.Hour, false},
+		{"London to Paris in ten minutes", london, paris, 10 * time.Minute, true},
+		{"within the accuracy radius", london, GeoInfo{Latitude: 51.6, Longitude: -0.1, AccuracyRadius: 20}, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from := travelEvent{ip: "192.0.2.1", at: travelStart, info: tt.from, origin: "history"}
+			to := travelEvent{ip: "198.51.100.1", at: travelStart.Add(tt.elapsed), info: tt.to, origin: "window"}
+			finding, ok := d.checkPair("alice@example.com", from, to)
+			if ok != tt.want {
+				t.Fatalf("checkPair = %+v, %v; want %v", finding, ok, tt.want)
+			}
+			if ok && (finding.SpeedKmh <= d.MaxSpeedKmh || finding.FromOrigin != "history" || finding.ToOrigin != "window") {
+				t.Errorf("finding = %+v", finding)
+			}
+		})
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	d := NewImpossibleTravelDetector(nil, nil)
+	if err := d.AllowNetworks([]string{"10.8.0.0/16", "203.0.113.9"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AllowASNs([]string{"AS13335"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events := d.filterEvents([]travelEvent{
+		{ip: "198.51.100.1", at: travelStart.Add(time.Hour), info: sydney, origin: "history"},
+		{ip: "198.51.100.1", at: travelStart.Add(time.Hour), info: sydney, origin: "window", logID: "log-2"},
+		{ip: "10.8.3.4", at: travelStart.Add(30 * time.Minute), info: paris, origin: "window"},
+		{ip: "203.0.113.9", at: travelStart.Add(40 * time.Minute), info: paris, origin: "window"},
+		{ip: "192.0.2.50", at: travelStart.Add(50 * time.Minute), info: edge, origin: "window"},
+		{ip: "192.0.2.1", at: travelStart, info: london, origin: "window", logID: "log-1"},
+	})
+
+	if len(events) != 2 {
+		t.Fatalf("kept %d events %+v, want 2", len(events), events)
+	}
+	if events[0].ip != "192.0.2.1" || events[1].ip != "198.51.100.1" {
+		t.Errorf("events out of order: %+v", events)
+	}
+	if events[1].origin != "window" {
+		t.Errorf("history event kept over the same window event: %+v", events[1])
+	}
+}
+
+func TestAllowNetworksRejectsInvalidCIDRs(t *testing.T) {
+	d := NewImpossibleTravelDetector(nil, nil)
+	if err := d.AllowNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("AllowNetworks accepted a /33")
+	}
+	if err := d.AllowASNs([]string{"ASxyz"}); err == nil {
+		t.Error("AllowASNs accepted a non-numeric ASN")
+	}
+}
+
+func TestDetectUsesClientIPOnly(t *testing.T) {
+	d := NewImpossibleTravelDetector(nil, nil)
+	geo := map[string]GeoInfo{"192.0.2.1": london, "198.51.100.1": sydney, "203.0.113.80": edge}
+
+	// The edge address shares every line but is never where the user is
+	findings, err := d.Detect("company-a", []NormalizedLog{
+		travelLog("log-1", "alice@example.com", "192.0.2.1", 0, "203.0.113.80"),
+		travelLog("log-2", "alice@example.com", "198.51.100.1", 2*time.Hour, "203.0.113.80"),
+		travelLog("log-3", "bob@example.com", "192.0.2.1", 0, "203.0.113.80"),
+		travelLog("log-4", "bob@example.com", "192.0.2.1", time.Hour, "203.0.113.80"),
+	}, geo)
+	if err != nil {
+		t.Fatalf("Detect: %v", err)
+	}
+	if len(findings) != 1 {
+		t.Fatalf("got %d findings %+v, want 1", len(findings), findings)
+	}
+	if f := findings[0]; f.User != "alice@example.com" || f.FromIP != "192.0.2.1" || f.ToIP != "198.51.100.1" {
+		t.Errorf("finding = %+v", f)
+	}
+}
+
+func TestTravelSightings(t *testing.T) {
+	sightings := travelSightings(map[string][]travelEvent{
+		"alice@example.com": {
+			{ip: "192.0.2.1", at: travelStart.Add(time.Hour)},
+			{ip: "192.0.2.1", at: travelStart},
+			{ip: "192.0.2.1", at: travelStart.Add(30 * time.Minute)},
+			{ip: "198.51.100.1", at: travelStart.Add(2 * time.Hour)},
+		},
+		"bob@example.com": {{ip: "192.0.2.1", at: travelStart}},
+	})
+
+	got := make(map[string]travelSighting)
+	for _, s := range sightings {
+		got[s.user+"|"+s.ip] = s
+	}
+	if len(sightings) != 3 || len(got) != 3 {
+		t.Fatalf("sightings = %+v, want one per user and IP", sightings)
+	}
+	if s := got["alice@example.com|192.0.2.1"]; !s.firstSeen.Equal(travelStart) || !s.lastSeen.Equal(travelStart.Add(time.Hour)) {
+		t.Errorf("alice at 192.0.2.1 = %v to %v", s.firstSeen, s.lastSeen)
+	}
+}
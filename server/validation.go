@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Limits on submitted alerts. openapi.yaml documents the same values.
+const (
+	maxAlertBody       = 256 << 10
+	maxSourceLength    = 64
+	maxProjectIDLength = 128
+	maxMessageLength   = 4096
+	maxExternalIDLen   = 255
+)
+
+// An alert's event time must fall within this window around its receipt.
+// Older alerts predate the logs Loki still holds, and ones from the future
+// mean the sender's clock is wrong; either way the Loki search would miss.
+// ALERT_MAX_AGE and ALERT_MAX_CLOCK_SKEW override them at startup.
+var (
+	alertMaxAge       = 7 * 24 * time.Hour
+	alertMaxClockSkew = 5 * time.Minute
+)
+
+var alertSeverities = []string{"low", "medium", "high", "critical"}
+
+// identifierRegex restricts sources and project IDs to characters that are
+// safe to place in Loki selectors and Redis keys.
+var identifierRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// AlertRequest is the body of POST /alerts. Fields the server assigns, such
+// as id, are rejected. external_id doubles as the idempotency key, and the
+// Idempotency-Key header fills it in when the body leaves it out.
+type AlertRequest struct {
+	Source     string                 `json:"source"`
+	Severity   string                 `json:"severity"`
+	Message    string                 `json:"message"`
+	ProjectID  string                 `json:"project_id"`
+	Timestamp  *time.Time             `json:"timestamp,omitempty"`   // when the event happened; defaults to receipt time
+	ExternalID string                 `json:"external_id,omitempty"` // the sender's own ID for the alert
+	RawData    map[string]interface{} `json:"raw_data,omitempty"`
+}
+
+// FieldError is one problem with one field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is the body of every 4xx response from the alert intake
+// endpoints, and of every authentication failure.
+type ValidationError struct {
+	Error   string       `json:"error"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+func writeValidationError(w http.ResponseWriter, status int, code, message string, fields []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ValidationError{Error: code, Message: message, Fields: fields})
+}
+
+// decodeAlertRequest reads and strictly decodes a POST /alerts body. On
+// failure it has already written the error response.
+func decodeAlertRequest(w http.ResponseWriter, r *http.Request) (*AlertRequest, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAlertBody+1))
+	if err != nil {
+		writeValidationError(w, http.StatusBadRequest, "invalid_body", "Failed to read request body", nil)
+		return nil, false
+	}
+	if len(body) > maxAlertBody {
+		writeValidationError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+			fmt.Sprintf("Request body exceeds %d bytes", maxAlertBody), nil)
+		return nil, false
+	}
+
+	request, fields, err := parseAlertRequest(body, r.Header.Get("Idempotency-Key"), time.Now())
+	if err != nil {
+		writeValidationError(w, http.StatusBadRequest, "invalid_json", err.Error(), nil)
+		return nil, false
+	}
+	if len(fields) > 0 {
+		writeValidationError(w, http.StatusUnprocessableEntity, "validation_failed", "Alert failed validation", fields)
+		return nil, false
+	}
+	return request, true
+}
+
+// parseAlertRequest strictly decodes and validates one alert. err is set when
+// data isn't a single JSON object; otherwise fields lists every problem with
+// it. idempotencyKey fills in external_id when data has none.
+func parseAlertRequest(data []byte, idempotencyKey string, receivedAt time.Time) (*AlertRequest, []FieldError, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, nil, errors.New("Body must be a single JSON object")
+	}
+
+	var request AlertRequest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		if field := decodeErrorField(err); field != nil {
+			return nil, []FieldError{*field}, nil
+		}
+		return nil, nil, fmt.Errorf("Invalid JSON: %v", err)
+	}
+	if decoder.More() {
+		return nil, nil, errors.New("Body must be a single JSON object")
+	}
+
+	var fields []FieldError
+	if key := strings.TrimSpace(idempotencyKey); key != "" {
+		if request.ExternalID == "" {
+			request.ExternalID = key
+		} else if request.ExternalID != key {
+			fields = append(fields, FieldError{Field: "external_id", Message: "does not match the Idempotency-Key header"})
+		}
+	}
+	if fields = append(fields, request.validate(receivedAt)...); len(fields) > 0 {
+		return nil, fields, nil
+	}
+	return &request, nil, nil
+}
+
+// decodeErrorField attributes a decoding error to a field where possible.
+func decodeErrorField(err error) *FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		if typeErr.Field == "timestamp" {
+			return &FieldError{Field: "timestamp", Message: "must be an RFC 3339 timestamp"}
+		}
+		return &FieldError{Field: typeErr.Field, Message: "must be a " + jsonTypeName(typeErr.Type.Kind().String())}
+	}
+	var parseErr *time.ParseError
+	if errors.As(err, &parseErr) {
+		return &FieldError{Field: "timestamp", Message: "must be an RFC 3339 timestamp"}
+	}
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return &FieldError{Field: strings.Trim(field, `"`), Message: "is not a recognised field"}
+	}
+	return nil
+}
+
+func jsonTypeName(kind string) string {
+	switch kind {
+	case "map", "struct":
+		return "JSON object"
+	case "slice":
+		return "JSON array"
+	}
+	return "string"
+}
+
+func (request *AlertRequest) validate(receivedAt time.Time) []FieldError {
+	var fields []FieldError
+	add := func(field, message string) {
+		fields = append(fields, FieldError{Field: field, Message: message})
+	}
+
+	request.Source = strings.TrimSpace(request.Source)
+	request.ProjectID = strings.TrimSpace(request.ProjectID)
+	request.Severity = strings.ToLower(strings.TrimSpace(request.Severity))
+
+	if field := validateIdentifier("source", request.Source, maxSourceLength); field != nil {
+		fields = append(fields, *field)
+	}
+	if field := validateIdentifier("project_id", request.ProjectID, maxProjectIDLength); field != nil {
+		fields = append(fields, *field)
+	}
+
+	if request.Severity == "" {
+		add("severity", "is required")
+	} else if !containsFold(alertSeverities, request.Severity) {
+		add("severity", "must be one of "+strings.Join(alertSeverities, ", "))
+	}
+
+	if strings.TrimSpace(request.Message) == "" {
+		add("message", "is required")
+	} else if len(request.Message) > maxMessageLength {
+		add("message", fmt.Sprintf("must be at most %d bytes", maxMessageLength))
+	}
+
+	if request.Timestamp != nil && !request.Timestamp.IsZero() {
+		if message := alertTimeError(*request.Timestamp, receivedAt); message != "" {
+			add("timestamp", message)
+		}
+	}
+
+	if len(request.ExternalID) > maxExternalIDLen {
+		add("external_id", fmt.Sprintf("must be at most %d bytes", maxExternalIDLen))
+	}
+	return fields
+}
+
+// alertTimeError explains why an event time is outside the accepted window,
+// or returns "" if it is inside it.
+func alertTimeError(timestamp, receivedAt time.Time) string {
+	switch {
+	case timestamp.After(receivedAt.Add(alertMaxClockSkew)):
+		return fmt.Sprintf("must not be more than %s in the future", alertMaxClockSkew)
+	case timestamp.Before(receivedAt.Add(-alertMaxAge)):
+		return fmt.Sprintf("must not be more than %s in the past", alertMaxAge)
+	}
+	return ""
+}
+
+func validateIdentifier(field, value string, maxLength int) *FieldError {
+	switch {
+	case value == "":
+		return &FieldError{Field: field, Message: "is required"}
+	case len(value) > maxLength:
+		return &FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxLength)}
+	case !identifierRegex.MatchString(value):
+		return &FieldError{Field: field, Message: "may only contain letters, digits, '_', '.' and '-'"}
+	}
+	return nil
+}
+
+// Alert converts a validated request into an alert received at receivedAt.
+// Times are converted to UTC, since the alert tables store them without an
+// offset.
+func (request *AlertRequest) Alert(receivedAt time.Time) Alert {
+	alert := Alert{
+		Timestamp:  receivedAt.UTC(),
+		Source:     request.Source,
+		Severity:   request.Severity,
+		Message:    request.Message,
+		ProjectID:  request.ProjectID,
+		ExternalID: request.ExternalID,
+		RawData:    request.RawData,
+	}
+	if request.Timestamp != nil && !request.Timestamp.IsZero() {
+		alert.Timestamp = request.Timestamp.UTC()
+	}
+	return alert
+}
+
+//go:embed openapi.yaml
+var apiSpec embed.FS
+
+func (app *App) getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	spec, err := apiSpec.ReadFile("openapi.yaml")
+	if err != nil {
+		http.Error(w, "Spec not available", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(spec)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testReceivedAt = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestParseAlertRequestValid(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp string
+	}{
+		{"UTC", "2024-05-01T11:30:00Z"},
+		{"ahead of UTC", "2024-05-01T20:30:00+09:00"},
+		{"behind UTC", "2024-05-01T07:30:00-04:00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"source":" aws_waf ","severity":"HIGH","message":"SQL injection","project_id":"company-a",
+				"timestamp":"` + tt.timestamp + `","raw_data":{"ruleId":"sqli"}}`
+
+			request, fields, err := parseAlertRequest([]byte(body), "", testReceivedAt)
+			if err != nil || len(fields) > 0 {
+				t.Fatalf("parseAlertRequest = %v, %v; want a valid request", fields, err)
+			}
+			if request.Source != "aws_waf" || request.Severity != "high" || request.ProjectID != "company-a" {
+				t.Errorf("request not normalised: %+v", request)
+			}
+
+			// Stored without an offset, so the alert must carry UTC
+			alert := request.Alert(testReceivedAt)
+			want := time.Date(2024, 5, 1, 11, 30, 0, 0, time.UTC)
+			if alert.Timestamp != want {
+				t.Errorf("alert timestamp = %v, want %v", alert.Timestamp, want)
+			}
+			if alert.RawData["ruleId"] != "sqli" {
+				t.Errorf("alert raw data = %v", alert.RawData)
+			}
+		})
+	}
+}
+
+func TestParseAlertRequestDefaultsTimestampToReceipt(t *testing.T) {
+	body := `{"source":"aws_waf","severity":"low","message":"m","project_id":"p"}`
+	request, fields, err := parseAlertRequest([]byte(body), "", testReceivedAt)
+	if err != nil || len(fields) > 0 {
+		t.Fatalf("parseAlertRequest = %v, %v", fields, err)
+	}
+	receivedAt := testReceivedAt.In(time.FixedZone("JST", 9*60*60))
+	if got := request.Alert(receivedAt).Timestamp; got != testReceivedAt {
+		t.Errorf("alert timestamp = %v, want %v", got, testReceivedAt)
+	}
+}
+
+func TestParseAlertRequestIdempotencyKey(t *testing.T) {
+	const base = `"source":"aws_waf","severity":"low","message":"m","project_id":"p"`
+	tests := []struct {
+		name       string
+		body       string
+		key        string
+		externalID string
+		wantField  bool
+	}{
+		{"header fills external_id", `{` + base + `}`, " key-1 ", "key-1", false},
+		{"matching header", `{` + base + `,"external_id":"key-1"}`, "key-1", "key-1", false},
+		{"conflicting header", `{` + base + `,"external_id":"key-1"}`, "key-2", "", true},
+		{"no header", `{` + base + `,"external_id":"key-1"}`, "", "key-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, fields, err := parseAlertRequest([]byte(tt.body), tt.key, testReceivedAt)
+			if err != nil {
+				t.Fatalf("parseAlertRequest: %v", err)
+			}
+			if tt.wantField {
+				if len(fields) != 1 || fields[0].Field != "external_id" {
+					t.Errorf("fields = %+v, want an external_id error", fields)
+				}
+				return
+			}
+			if len(fields) > 0 || request.ExternalID != tt.externalID {
+				t.Errorf("parseAlertRequest = %+v, %+v; want external_id %q", request, fields, tt.externalID)
+			}
+		})
+	}
+}
+
+func TestParseAlertRequestMalformedBody(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`   `,
+		`[{"source":"aws_waf"}]`,
+		`"alert"`,
+		`{"source":`,
+		`{"source":"a","severity":"low","message":"m","project_id":"p"} {"source":"b"}`,
+	} {
+		t.Run(body, func(t *testing.T) {
+			request, fields, err := parseAlertRequest([]byte(body), "", testReceivedAt)
+			if err == nil {
+				t.Errorf("parseAlertRequest = %+v, %+v; want an error", request, fields)
+			}
+		})
+	}
+}
+
+func TestParseAlertRequestFieldErrors(t *testing.T) {
+	valid := map[string]interface{}{
+		"source": "aws_waf", "severity": "low", "message": "m", "project_id": "company-a",
+	}
+	with := func(changes map[string]interface{}) string {
+		body := make(map[string]interface{})
+		for key, value := range valid {
+			body[key] = value
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(body, key)
+			} else {
+				body[key] = value
+			}
+		}
+		return string(mustMarshal(body))
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		fields []FieldError
+	}{
+		{"missing required fields", `{}`, []FieldError{
+			{"source", "is required"},
+			{"project_id", "is required"},
+			{"severity", "is required"},
+			{"message", "is required"},
+		}},
+		{"blank message", with(map[string]interface{}{"message": "  "}), []FieldError{{"message", "is required"}}},
+		{"unknown severity", with(map[string]interface{}{"severity": "urgent"}), []FieldError{
+			{"severity", "must be one of low, medium, high, critical"},
+		}},
+		{"unsafe source", with(map[string]interface{}{"source": "aws waf"}), []FieldError{
+			{"source", "may only contain letters, digits, '_', '.' and '-'"},
+		}},
+		{"project starting with a dot", with(map[string]interface{}{"project_id": ".hidden"}), []FieldError{
+			{"project_id", "may only contain letters, digits, '_', '.' and '-'"},
+		}},
+		{"long source", with(map[string]interface{}{"source": strings.Repeat("a", maxSourceLength+1)}), []FieldError{
+			{"source", "must be at most 64 characters"},
+		}},
+		{"long message", with(map[string]interface{}{"message": strings.Repeat("m", maxMessageLength+1)}), []FieldError{
+			{"message", "must be at most 4096 bytes"},
+		}},
+		{"long external_id", with(map[string]interface{}{"external_id": strings.Repeat("x", maxExternalIDLen+1)}), []FieldError{
+			{"external_id", "must be at most 255 bytes"},
+		}},
+		{"future timestamp", with(map[string]interface{}{"timestamp": "2024-05-01T12:06:00Z"}), []FieldError{
+			{"timestamp", "must not be more than 5m0s in the future"},
+		}},
+		{"old timestamp", with(map[string]interface{}{"timestamp": "2024-04-24T11:59:00Z"}), []FieldError{
+			{"timestamp", "must not be more than 168h0m0s in the past"},
+		}},
+		{"unparseable timestamp", with(map[string]interface{}{"timestamp": "yesterday"}), []FieldError{
+			{"timestamp", "must be an RFC 3339 timestamp"},
+		}},
+		{"numeric timestamp", with(map[string]interface{}{"timestamp": 1714564800}), []FieldError{
+			{"timestamp", "must be an RFC 3339 timestamp"},
+		}},
+		{"numeric severity", with(map[string]interface{}{"severity": 3}), []FieldError{{"severity", "must be a string"}}},
+		{"raw_data not an object", with(map[string]interface{}{"raw_data": "text"}), []FieldError{
+			{"raw_data", "must be a JSON object"},
+		}},
+		{"server-assigned field", with(map[string]interface{}{"id": "alert-1"}), []FieldError{
+			{"id", "is not a recognised field"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, fields, err := parseAlertRequest([]byte(tt.body), "", testReceivedAt)
+			if err != nil {
+				t.Fatalf("parseAlertRequest: %v", err)
+			}
+			if request != nil {
+				t.Errorf("got request %+v, want none", request)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("fields = %+v, want %+v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestParseAlertRequestTimestampBounds(t *testing.T) {
+	for _, timestamp := range []time.Time{
+		testReceivedAt.Add(alertMaxClockSkew),
+		testReceivedAt.Add(-alertMaxAge),
+	} {
+		body := `{"source":"aws_waf","severity":"low","message":"m","project_id":"p","timestamp":"` + timestamp.Format(time.RFC3339) + `"}`
+		if _, fields, err := parseAlertRequest([]byte(body), "", testReceivedAt); err != nil || len(fields) > 0 {
+			t.Errorf("timestamp %v rejected: %v, %v", timestamp, fields, err)
+		}
+	}
+}
+
+func TestDecodeAlertRequestResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"valid", `{"source":"aws_waf","severity":"low","message":"m","project_id":"p"}`, http.StatusOK, ""},
+		{"not an object", `[]`, http.StatusBadRequest, "invalid_json"},
+		{"invalid alert", `{"source":"aws_waf"}`, http.StatusUnprocessableEntity, "validation_failed"},
+		{"too large", `{"message":"` + strings.Repeat("m", maxAlertBody) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodPost, "/alerts", strings.NewReader(tt.body))
+
+			_, ok := decodeAlertRequest(recorder, request)
+			if ok != (tt.status == http.StatusOK) {
+				t.Fatalf("decodeAlertRequest ok = %v, want status %d", ok, tt.status)
+			}
+			if ok {
+				return
+			}
+			if recorder.Code != tt.status {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			var response ValidationError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error != tt.code {
+				t.Errorf("response = %s, want error %q", recorder.Body.String(), tt.code)
+			}
+		})
+	}
+}